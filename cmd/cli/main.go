@@ -2,12 +2,24 @@ package main
 
 import (
 	"context"
+	"errors"
 	"os"
+	"os/signal"
+	"syscall"
 
 	"github.com/nixpig/syringe.sh/internal/cli"
+	"github.com/nixpig/syringe.sh/pkg/protocol"
+	"github.com/nixpig/syringe.sh/pkg/ssh"
 	"github.com/spf13/viper"
 )
 
+// connectionErrorStatus is the exit status when the server can't be reached,
+// so scripts can tell it apart from the server rejecting a request.
+const connectionErrorStatus = 7
+
+// interruptedStatus is the exit status when interrupted, as for shells.
+const interruptedStatus = 130
+
 func main() {
 	v := viper.New()
 	// TODO: sort out server config properly
@@ -15,9 +27,20 @@ func main() {
 	// 	log.Fatal(err)
 	// }
 
-	ctx := context.Background()
+	// the first interrupt cancels any request in flight, and a second exits
+	// immediately
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	context.AfterFunc(ctx, stop)
 
 	if err := cli.New(v).ExecuteContext(ctx); err != nil {
-		os.Exit(1)
+		if errors.Is(err, context.Canceled) {
+			os.Exit(interruptedStatus)
+		}
+
+		if ssh.IsConnectionError(err) {
+			os.Exit(connectionErrorStatus)
+		}
+
+		os.Exit(protocol.ExitStatus(protocol.ErrorCode(err)))
 	}
 }
@@ -7,7 +7,7 @@ import (
 	"os"
 	"os/signal"
 	"path/filepath"
-	"slices"
+	"strconv"
 	"syscall"
 	"time"
 
@@ -18,7 +18,11 @@ import (
 	"github.com/joho/godotenv"
 	"github.com/nixpig/syringe.sh/database"
 	"github.com/nixpig/syringe.sh/internal/middleware"
+	"github.com/nixpig/syringe.sh/internal/reaper"
 	"github.com/nixpig/syringe.sh/internal/stores"
+	"github.com/nixpig/syringe.sh/pkg/protocol"
+	syringessh "github.com/nixpig/syringe.sh/pkg/ssh"
+	gossh "golang.org/x/crypto/ssh"
 )
 
 const (
@@ -28,13 +32,37 @@ const (
 	keyEnv      = "SYRINGE_KEY"
 	systemDBEnv = "SYRINGE_DB_SYSTEM_DIR"
 	tenantDBEnv = "SYRINGE_DB_TENANT_DIR"
+
+	minClientVersionEnv = "SYRINGE_MIN_CLIENT_VERSION"
+	userCAKeysEnv       = "SYRINGE_USER_CA_KEYS"
+	historyRetentionEnv = "SYRINGE_HISTORY_RETENTION"
+	reapIntervalEnv     = "SYRINGE_REAP_INTERVAL"
 )
 
-var maxTimeout = 10 * time.Second
+// defaultMinClientVersion accepts all syringe clients, including those that
+// predate versioned identifiers.
+const defaultMinClientVersion = "0.0.0"
+
+// defaultHistoryRetention is the number of versions of each value kept when
+// no retention is configured.
+const defaultHistoryRetention = 10
+
+// defaultReapInterval is how often expired items are removed when no interval
+// is configured.
+const defaultReapInterval = time.Minute
+
+// maxTimeout limits how long a connection is kept open, including subsystem
+// sessions carrying many requests
+var maxTimeout = 5 * time.Minute
+
+var idleTimeout = 10 * time.Second
 
 var allowedKeyTypes = []string{
 	"ssh-rsa",
 	"ssh-ed25519",
+	"ecdsa-sha2-nistp256",
+	"ecdsa-sha2-nistp384",
+	"ecdsa-sha2-nistp521",
 }
 
 func main() {
@@ -103,23 +131,73 @@ func main() {
 		)
 	}
 
+	minClientVersion := os.Getenv(minClientVersionEnv)
+	if minClientVersion == "" {
+		minClientVersion = defaultMinClientVersion
+	}
+
+	if err := protocol.ValidateVersion(minClientVersion); err != nil {
+		log.Fatal("invalid minimum client version", "err", err)
+	}
+
+	historyRetention := defaultHistoryRetention
+	if r := os.Getenv(historyRetentionEnv); r != "" {
+		historyRetention, err = strconv.Atoi(r)
+		if err != nil || historyRetention < 0 {
+			log.Fatal("invalid history retention", "retention", r)
+		}
+	}
+
+	reapInterval := defaultReapInterval
+	if i := os.Getenv(reapIntervalEnv); i != "" {
+		reapInterval, err = time.ParseDuration(i)
+		if err != nil || reapInterval <= 0 {
+			log.Fatal("invalid reap interval", "interval", i)
+		}
+	}
+
+	var userCAKeys []gossh.PublicKey
+
+	if userCAKeysPath := os.Getenv(userCAKeysEnv); userCAKeysPath != "" {
+		b, err := os.ReadFile(userCAKeysPath)
+		if err != nil {
+			log.Fatal("failed to read user CA keys", "path", userCAKeysPath, "err", err)
+		}
+
+		userCAKeys, err = syringessh.ParseAuthorizedKeys(b)
+		if err != nil {
+			log.Fatal("failed to parse user CA keys", "path", userCAKeysPath, "err", err)
+		}
+
+		log.Info("trusting user certificates", "path", userCAKeysPath, "authorities", len(userCAKeys))
+	}
+
 	systemStore := stores.NewSystemStore(db)
 
+	publicKeyHandler := middleware.NewPublicKeyHandler(allowedKeyTypes, userCAKeys)
+
 	middleware := []wish.Middleware{
-		middleware.NewCmdMiddleware(systemStore),
+		middleware.NewCmdMiddleware(systemStore, historyRetention),
 		middleware.NewIdentityMiddleware(systemStore),
-		middleware.ClientMiddleware,
+		middleware.NewClientMiddleware(minClientVersion),
 		middleware.LoggingMiddleware,
 	}
 
+	// subsystem sessions skip the middleware of exec sessions, so are given
+	// the same chain
+	subsystemHandler := func(ssh.Session) {}
+	for _, m := range middleware {
+		subsystemHandler = m(subsystemHandler)
+	}
+
 	s, err := wish.NewServer(
 		wish.WithAddress(net.JoinHostPort(host, port)),
 		wish.WithHostKeyPath(key),
 		wish.WithMaxTimeout(maxTimeout),
-		wish.WithPublicKeyAuth(func(ctx ssh.Context, key ssh.PublicKey) bool {
-			return slices.Contains(allowedKeyTypes, key.Type())
-		}),
+		wish.WithIdleTimeout(idleTimeout),
+		wish.WithPublicKeyAuth(publicKeyHandler),
 		wish.WithMiddleware(middleware...),
+		wish.WithSubsystem(protocol.Subsystem, subsystemHandler),
 	)
 	if err != nil {
 		log.Fatal("failed to create server", "err", err)
@@ -140,8 +218,15 @@ func main() {
 
 	log.Info("server started", "host", host, "port", port)
 
+	reapCtx, stopReaping := context.WithCancel(context.Background())
+	defer stopReaping()
+
+	go reaper.New(tenantDBDir, reapInterval).Run(reapCtx)
+
 	<-done
 
+	stopReaping()
+
 	ctx, cancel := context.WithTimeout(context.Background(), time.Second*30)
 	defer cancel()
 
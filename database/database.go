@@ -2,13 +2,26 @@ package database
 
 import (
 	"database/sql"
+	"errors"
 	"fmt"
+	"path/filepath"
+	"sync"
+	"time"
 
+	"github.com/golang-migrate/migrate/v4"
 	_ "github.com/mattn/go-sqlite3"
 )
 
+// busyTimeout is how long a connection waits for a lock held by another,
+// e.g. the reaper's or another session's, before failing.
+const busyTimeout = 5 * time.Second
+
 func NewConnection(filename string) (*sql.DB, error) {
-	connectionString := fmt.Sprintf("file:%s", filename)
+	connectionString := fmt.Sprintf(
+		"file:%s?_busy_timeout=%d",
+		filename,
+		busyTimeout.Milliseconds(),
+	)
 
 	db, err := sql.Open("sqlite3", connectionString)
 	if err != nil {
@@ -24,3 +37,42 @@ func NewConnection(filename string) (*sql.DB, error) {
 
 	return db, nil
 }
+
+// migrateLocks serialise migrating each tenant database, by its path. The
+// migrator's own lock only applies to its connection, so sessions and the
+// reaper migrating the same database at once would each apply the
+// migrations, failing all but the first and leaving the database dirty.
+var migrateLocks sync.Map
+
+// NewTenantConnection connects to the tenant database at filename, creating
+// it and migrating it to the latest schema as needed. It's safe to call for
+// the same database at once, e.g. by the reaper and sessions.
+func NewTenantConnection(filename string) (*sql.DB, error) {
+	db, err := NewConnection(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	path, err := filepath.Abs(filename)
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("resolve tenant database path: %w", err)
+	}
+
+	mu, _ := migrateLocks.LoadOrStore(path, &sync.Mutex{})
+	mu.(*sync.Mutex).Lock()
+	defer mu.(*sync.Mutex).Unlock()
+
+	migrator, err := NewMigration(db, TenantMigrations)
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	if err := migrator.Up(); err != nil && !errors.Is(err, migrate.ErrNoChange) {
+		db.Close()
+		return nil, fmt.Errorf("migrate tenant database: %w", err)
+	}
+
+	return db, nil
+}
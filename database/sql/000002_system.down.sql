@@ -0,0 +1 @@
+alter table public_keys_ drop column public_key_;
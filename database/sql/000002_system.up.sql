@@ -0,0 +1 @@
+alter table public_keys_ add column public_key_ text;
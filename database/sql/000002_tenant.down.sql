@@ -0,0 +1 @@
+alter table store_ drop column name_;
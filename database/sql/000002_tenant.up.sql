@@ -0,0 +1 @@
+alter table store_ add column name_ text;
@@ -0,0 +1,18 @@
+drop index if exists audit_user_id_timestamp_;
+
+drop table if exists audit_;
+
+create table if not exists audit_ (
+  id_ integer primary key autoincrement,
+  session_ char(64),
+  timestamp_ datetime default current_timestamp,
+  action_ varchar(8), -- get/set/list/delete
+  status_ varchar(8), -- success/error
+  address_ varchar(16), -- ip address
+  client_ varchar(64), -- syringe/ssh
+
+  public_key_id_ integer not null,
+  user_id_ integer not null,
+  foreign key (public_key_id_) references public_keys_(id_),
+  foreign key (user_id_) references users_(id_)
+);
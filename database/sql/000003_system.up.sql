@@ -0,0 +1,21 @@
+-- nothing was ever written to audit_, so it's recreated to record attempts by
+-- users that aren't registered, and the key used
+drop table if exists audit_;
+
+create table if not exists audit_ (
+  id_ integer primary key autoincrement,
+  session_ char(64) not null,
+  timestamp_ datetime not null,
+  action_ varchar(32) not null, -- the command, e.g. get/set/list/remove
+  status_ varchar(32) not null, -- success, or the code of the error
+  address_ varchar(64) not null, -- ip address
+  client_ varchar(64) not null, -- ssh client version
+  username_ varchar(32) not null, -- as given by the client
+  public_key_ varchar(64) not null, -- sha256 fingerprint
+  key_id_ varchar(256) not null default '', -- certificate key id, if any
+
+  user_id_ integer, -- null when the username isn't registered
+  foreign key (user_id_) references users_(id_)
+);
+
+create index if not exists audit_user_id_timestamp_ on audit_ (user_id_, timestamp_);
@@ -0,0 +1,20 @@
+create table store_old_ (
+  id_ integer primary key autoincrement,
+  key_ varchar(255) not null unique,
+  value_ varchar(2048) not null,
+  name_ text
+);
+
+insert into store_old_ (id_, key_, value_, name_)
+  select s.id_, s.key_, s.value_, s.name_ from store_ s
+  inner join environment_ e on e.id_ = s.environment_id_
+  inner join project_ p on p.id_ = e.project_id_
+  where p.name_ = 'default' and e.name_ = 'default';
+
+drop table store_;
+
+alter table store_old_ rename to store_;
+
+drop table if exists environment_;
+
+drop table if exists project_;
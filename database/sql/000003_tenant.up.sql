@@ -0,0 +1,32 @@
+create table if not exists project_ (
+  id_ integer primary key autoincrement,
+  name_ varchar(255) not null unique
+);
+
+create table if not exists environment_ (
+  id_ integer primary key autoincrement,
+  project_id_ integer not null references project_(id_),
+  name_ varchar(255) not null,
+  unique (project_id_, name_)
+);
+
+insert into project_ (name_) values ('default');
+
+insert into environment_ (project_id_, name_)
+  select id_, 'default' from project_ where name_ = 'default';
+
+create table store_new_ (
+  id_ integer primary key autoincrement,
+  environment_id_ integer not null references environment_(id_),
+  key_ varchar(255) not null,
+  value_ varchar(2048) not null,
+  name_ text,
+  unique (environment_id_, key_)
+);
+
+insert into store_new_ (id_, environment_id_, key_, value_, name_)
+  select s.id_, e.id_, s.key_, s.value_, s.name_ from store_ s, environment_ e;
+
+drop table store_;
+
+alter table store_new_ rename to store_;
@@ -0,0 +1,3 @@
+drop table if exists history_;
+
+alter table store_ drop column version_;
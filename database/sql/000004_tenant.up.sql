@@ -0,0 +1,14 @@
+alter table store_ add column version_ integer not null default 1;
+
+create table if not exists history_ (
+  id_ integer primary key autoincrement,
+  store_id_ integer not null references store_(id_),
+  version_ integer not null,
+  value_ varchar(2048) not null,
+  name_ text,
+  created_at_ timestamp not null default current_timestamp,
+  unique (store_id_, version_)
+);
+
+insert into history_ (store_id_, version_, value_, name_)
+  select id_, version_, value_, name_ from store_;
@@ -0,0 +1,3 @@
+drop index if exists store_expires_at_;
+
+alter table store_ drop column expires_at_;
@@ -0,0 +1,3 @@
+alter table store_ add column expires_at_ timestamp;
+
+create index if not exists store_expires_at_ on store_ (expires_at_);
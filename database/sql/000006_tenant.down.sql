@@ -0,0 +1,5 @@
+drop table if exists tag_;
+
+alter table store_ drop column updated_at_;
+alter table store_ drop column created_at_;
+alter table store_ drop column description_;
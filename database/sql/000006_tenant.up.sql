@@ -0,0 +1,22 @@
+alter table store_ add column description_ text;
+alter table store_ add column created_at_ timestamp;
+alter table store_ add column updated_at_ timestamp;
+
+update store_ set
+  created_at_ = coalesce(
+    (select min(h.created_at_) from history_ h where h.store_id_ = store_.id_),
+    current_timestamp
+  ),
+  updated_at_ = coalesce(
+    (select max(h.created_at_) from history_ h where h.store_id_ = store_.id_),
+    current_timestamp
+  );
+
+create table if not exists tag_ (
+  id_ integer primary key autoincrement,
+  store_id_ integer not null references store_(id_),
+  name_ varchar(64) not null,
+  unique (store_id_, name_)
+);
+
+create index if not exists tag_name_ on tag_ (name_);
@@ -1,20 +1,26 @@
 package cli
 
 import (
-	"bytes"
+	"context"
 	"fmt"
-	"io"
 	"net/mail"
 	"os"
 	"os/user"
 	"path/filepath"
+	"slices"
+	"strconv"
 	"strings"
+	"text/tabwriter"
+	"time"
 
-	"github.com/nixpig/syringe.sh/internal/api"
+	"github.com/nixpig/syringe.sh/internal/version"
+	"github.com/nixpig/syringe.sh/pkg/client"
+	"github.com/nixpig/syringe.sh/pkg/protocol"
 	"github.com/nixpig/syringe.sh/pkg/ssh"
 	"github.com/spf13/cobra"
 	"github.com/spf13/pflag"
 	"github.com/spf13/viper"
+	gossh "golang.org/x/crypto/ssh"
 	"golang.org/x/term"
 )
 
@@ -26,17 +32,48 @@ const (
 	portFlag     = "port"
 	configFlag   = "config"
 
-	defaultHost = "ssh.syringe.sh"
-	defaultPort = 2323
+	sshConfigFlag = "ssh-config"
+	timeoutFlag   = "timeout"
+	keepaliveFlag = "keepalive"
+	retriesFlag   = "retries"
+
+	hostKeyCheckingFlag    = "host-key-checking"
+	hostKeyFingerprintFlag = "host-key-fingerprint"
+
+	recipientFlag = "recipient"
+	hideKeysFlag  = "hide-keys"
+	vaultFlag     = "vault"
+
+	allowLegacyFlag = "allow-legacy"
+
+	projectFlag     = "project"
+	environmentFlag = "env"
+
+	versionFlag = "version"
+
+	ttlFlag       = "ttl"
+	expiresAtFlag = "expires-at"
+
+	descriptionFlag = "description"
+	tagFlag         = "tag"
+
+	sinceFlag  = "since"
+	actionFlag = "action"
 )
 
+// session is the client for the server, which is connected before each
+// command runs.
+type session struct {
+	*client.Client
+}
+
 func New(v *viper.Viper) *cobra.Command {
-	a := api.New()
+	s := &session{}
 
 	rootCmd := &cobra.Command{
 		Use:          "syringe",
 		Short:        "Encrypted key-value store",
-		Version:      "",
+		Version:      version.Version,
 		SilenceUsage: true,
 		PersistentPreRunE: func(c *cobra.Command, args []string) error {
 			applyFlags(c, v)
@@ -46,16 +83,48 @@ func New(v *viper.Viper) *cobra.Command {
 			v.SetConfigFile(configPath)
 			v.ReadInConfig()
 
+			host := v.GetString(hostFlag)
+			if host == "" {
+				c.Help()
+				return fmt.Errorf("no host")
+			}
+
+			// the host may be an alias in the ssh config, whose settings apply
+			// unless they're given as flags or in the config file
+			hostConfig, err := ssh.LoadHostConfig(v.GetString(sshConfigFlag), host)
+			if err != nil {
+				return fmt.Errorf("failed to resolve host from ssh config: %w", err)
+			}
+
+			if !v.IsSet(portFlag) && hostConfig.Port != 0 {
+				v.Set(portFlag, hostConfig.Port)
+			}
+
+			if !v.IsSet(usernameFlag) && hostConfig.User != "" {
+				v.Set(usernameFlag, hostConfig.User)
+			}
+
+			if !v.IsSet(identityFlag) {
+				if i := slices.IndexFunc(hostConfig.IdentityFiles, func(identityFile string) bool {
+					_, err := os.Stat(identityFile + ".pub")
+					return err == nil
+				}); i != -1 {
+					v.Set(identityFlag, hostConfig.IdentityFiles[i])
+				}
+			}
+
 			identity := v.GetString(identityFlag)
 			if identity == "" {
 				c.Help()
 				return fmt.Errorf("no identity")
 			}
 
-			host := v.GetString(hostFlag)
-			if host == "" {
-				c.Help()
-				return fmt.Errorf("no host")
+			// a certificate is for the usernames that are its principals
+			if !v.IsSet(usernameFlag) {
+				cert, err := ssh.GetCertificate(identity)
+				if err == nil && cert != nil && len(cert.ValidPrincipals) > 0 {
+					v.Set(usernameFlag, cert.ValidPrincipals[0])
+				}
 			}
 
 			port := v.GetInt(portFlag)
@@ -85,29 +154,93 @@ func New(v *viper.Viper) *cobra.Command {
 				return fmt.Errorf("invalid email")
 			}
 
+			hostKeyChecking, err := ssh.ParseHostKeyChecking(
+				v.GetString(hostKeyCheckingFlag),
+			)
+			if err != nil {
+				return err
+			}
+
 			authMethod, err := ssh.AuthMethod(identity, c.OutOrStdout())
 			if err != nil {
 				return fmt.Errorf("failed to create auth method: %w", err)
 			}
 
-			client, err := ssh.NewSSHClient(
-				host,
+			knownHosts := filepath.Join(os.Getenv("HOME"), ".ssh", "known_hosts")
+
+			// the pinned fingerprint is the server's, so jump hosts are only
+			// checked against known hosts
+			for i := range hostConfig.ProxyJumps {
+				hostConfig.ProxyJumps[i].HostKeyCallback = ssh.HostKeyCallback(
+					knownHosts,
+					hostKeyChecking,
+					"",
+					confirmHostKey(c.ErrOrStderr()),
+				)
+			}
+
+			conn, err := ssh.NewSSHClient(
+				c.Context(),
+				hostConfig.HostName,
 				port,
 				username,
 				authMethod,
-				filepath.Join(os.Getenv("HOME"), ".ssh", "known_hosts"),
+				ssh.HostKeyCallback(
+					knownHosts,
+					hostKeyChecking,
+					v.GetString(hostKeyFingerprintFlag),
+					confirmHostKey(c.ErrOrStderr()),
+				),
+				ssh.DialOptions{
+					Timeout:           v.GetDuration(timeoutFlag),
+					KeepaliveInterval: v.GetDuration(keepaliveFlag),
+					Retries:           v.GetInt(retriesFlag),
+					RetryBackoff:      ssh.DefaultDialOptions.RetryBackoff,
+				},
+				hostConfig.ProxyJumps...,
 			)
 			if err != nil {
 				return fmt.Errorf("failed to create ssh client: %w", err)
 			}
 
-			a.SetClient(client)
-			a.SetOut(c.OutOrStdout())
+			id, err := client.NewIdentity(identity, c.OutOrStderr(), term.ReadPassword)
+			if err != nil {
+				conn.Close()
+				return err
+			}
+
+			opts := []client.Option{
+				client.WithNamespace(
+					v.GetString(projectFlag),
+					v.GetString(environmentFlag),
+				),
+				client.WithPassphrase(func(confirm bool) ([]byte, error) {
+					return readPassphrase(c.OutOrStderr(), confirm)
+				}),
+			}
+
+			if v.GetBool(hideKeysFlag) {
+				opts = append(opts, client.WithHiddenKeys())
+			}
+
+			if v.GetBool(vaultFlag) {
+				opts = append(opts, client.WithVault())
+			}
+
+			if v.GetBool(allowLegacyFlag) {
+				opts = append(opts, client.WithLegacyValues())
+			}
+
+			s.Client, err = client.New(conn, id, opts...)
+			if err != nil {
+				conn.Close()
+				return err
+			}
 
 			return nil
 		},
 		PersistentPostRun: func(c *cobra.Command, args []string) {
-			a.Close()
+			s.Close()
 		},
 	}
 
@@ -127,128 +260,455 @@ func New(v *viper.Viper) *cobra.Command {
 	rootCmd.PersistentFlags().StringP(identityFlag, "i", "", "Path to SSH key")
 	rootCmd.PersistentFlags().StringP(usernameFlag, "u", defaultUsername, "Username")
 	rootCmd.PersistentFlags().StringP(emailFlag, "e", "", "Email")
-	rootCmd.PersistentFlags().StringP(hostFlag, "d", defaultHost, "Host")
-	rootCmd.PersistentFlags().IntP(portFlag, "p", defaultPort, "Port")
+	rootCmd.PersistentFlags().StringP(hostFlag, "d", client.DefaultHost, "Host")
+	rootCmd.PersistentFlags().IntP(portFlag, "p", client.DefaultPort, "Port")
 	rootCmd.PersistentFlags().StringP(configFlag, "c", defaultConfigPath, "Config file location")
+	rootCmd.PersistentFlags().String(sshConfigFlag, filepath.Join(os.Getenv("HOME"), ".ssh", "config"), "SSH config file to resolve the host through")
+	rootCmd.PersistentFlags().Duration(timeoutFlag, ssh.DefaultDialOptions.Timeout, "Timeout for connecting to the server (0 for none)")
+	rootCmd.PersistentFlags().Duration(keepaliveFlag, ssh.DefaultDialOptions.KeepaliveInterval, "Interval between keepalives (0 to disable)")
+	rootCmd.PersistentFlags().Int(retriesFlag, ssh.DefaultDialOptions.Retries, "Times to retry connecting, and reads, after connection errors")
+	rootCmd.PersistentFlags().String(hostKeyCheckingFlag, string(ssh.HostKeyCheckingAsk), "How to treat unknown host keys (strict, ask or accept-new)")
+	rootCmd.PersistentFlags().String(hostKeyFingerprintFlag, "", "Only trust a host key with this SHA256 fingerprint")
+	rootCmd.PersistentFlags().Bool(hideKeysFlag, false, "Hide key names from the server")
+	rootCmd.PersistentFlags().Bool(vaultFlag, false, "Encrypt values with a passphrase instead of the SSH key")
+	rootCmd.PersistentFlags().Bool(allowLegacyFlag, false, "Allow values encrypted before values were authenticated with their key")
+	rootCmd.PersistentFlags().String(projectFlag, protocol.DefaultNamespace.Project, "Project the values are in")
+	rootCmd.PersistentFlags().String(environmentFlag, protocol.DefaultNamespace.Environment, "Environment of the project the values are in")
 
 	bindFlags(rootCmd, v)
 
 	rootCmd.AddCommand(
-		registerCmd(v, a),
-		setCmd(v, a),
-		getCmd(v, a),
-		listCmd(v, a),
-		removeCmd(v, a),
+		registerCmd(v, s),
+		setCmd(v, s),
+		getCmd(v, s),
+		listCmd(v, s),
+		removeCmd(v, s),
+		rekeyCmd(v, s),
+		namespacesCmd(v, s),
+		historyCmd(v, s),
+		describeCmd(v, s),
+		rollbackCmd(v, s),
+		auditCmd(v, s),
 	)
 
 	return rootCmd
 }
 
-func registerCmd(v *viper.Viper, a *api.HostAPI) *cobra.Command {
+func registerCmd(v *viper.Viper, s *session) *cobra.Command {
 	return &cobra.Command{
 		Use:   "register [flags]",
 		Short: "Register a user and key",
 		Args:  cobra.ExactArgs(0),
 		RunE: func(c *cobra.Command, args []string) error {
-			return a.Register()
+			return s.Register(c.Context())
 		},
 	}
 }
 
-func setCmd(v *viper.Viper, a *api.HostAPI) *cobra.Command {
-	return &cobra.Command{
-		Use:     "set [flags] KEY VALUE",
-		Short:   "Set a key-value",
-		Args:    cobra.ExactArgs(2),
-		Example: "  syringe set username nixpig",
+func setCmd(v *viper.Viper, s *session) *cobra.Command {
+	setCmd := &cobra.Command{
+		Use:   "set [flags] KEY VALUE",
+		Short: "Set a key-value",
+		Args:  cobra.ExactArgs(2),
+		Example: `  syringe set username nixpig
+  syringe set --recipient ~/.ssh/teammate.pub --recipient janedoe password p4ssw0rd
+  syringe set --ttl 24h contractor_token t0k3n
+  syringe set --description "Password for the API" --tag api --tag prod password p4ssw0rd`,
 		RunE: func(c *cobra.Command, args []string) error {
-			identity := v.GetString(identityFlag)
-			publicKey, err := ssh.GetPublicKey(identity + ".pub")
+			ctx := c.Context()
+
+			recipients, err := c.Flags().GetStringArray(recipientFlag)
 			if err != nil {
-				return fmt.Errorf("get public key: %w", err)
+				return err
 			}
 
-			encrypt := ssh.NewEncryptor(publicKey)
+			var publicKeys []gossh.PublicKey
+
+			for _, recipient := range recipients {
+				recipientKeys, err := recipientPublicKeys(ctx, s, recipient)
+				if err != nil {
+					return fmt.Errorf("get public keys for '%s': %w", recipient, err)
+				}
+
+				for _, k := range recipientKeys {
+					fmt.Fprintf(
+						c.ErrOrStderr(),
+						"encrypting for %s (%s)\n",
+						recipient,
+						gossh.FingerprintSHA256(k),
+					)
+				}
+
+				publicKeys = append(publicKeys, recipientKeys...)
+			}
+
+			expiresAt, err := expiry(c)
+			if err != nil {
+				return err
+			}
 
-			encryptedValue, err := encrypt(args[1])
+			description, err := c.Flags().GetString(descriptionFlag)
 			if err != nil {
-				return fmt.Errorf("encrypt: %w", err)
+				return err
 			}
 
-			if err := a.Set(args[0], encryptedValue); err != nil {
-				return fmt.Errorf("set '%s' in store: %w", args[0], err)
+			opts := client.SetOptions{
+				ExpiresAt:   expiresAt,
+				Description: description,
+			}
+
+			if c.Flags().Changed(tagFlag) {
+				opts.Tags, err = c.Flags().GetStringArray(tagFlag)
+				if err != nil {
+					return err
+				}
+			}
+
+			return s.SetWithOptions(ctx, args[0], []byte(args[1]), opts, publicKeys...)
+		},
+	}
+
+	setCmd.Flags().StringArrayP(
+		recipientFlag,
+		"r",
+		[]string{},
+		"Public key file or username of an additional recipient (repeatable)",
+	)
+	setCmd.Flags().Duration(ttlFlag, 0, "How long until the value expires, e.g. 24h")
+	setCmd.Flags().String(expiresAtFlag, "", "When the value expires, in RFC 3339 format")
+	setCmd.MarkFlagsMutuallyExclusive(ttlFlag, expiresAtFlag)
+	setCmd.Flags().String(descriptionFlag, "", "What the value is for")
+	setCmd.Flags().StringArray(tagFlag, []string{}, "Tag of the value (repeatable)")
+
+	return setCmd
+}
+
+// expiry returns when the value being set expires, from the ttl or
+// expires-at flag, or nil if it doesn't.
+func expiry(c *cobra.Command) (*time.Time, error) {
+	if c.Flags().Changed(ttlFlag) {
+		ttl, err := c.Flags().GetDuration(ttlFlag)
+		if err != nil {
+			return nil, err
+		}
+
+		if ttl <= 0 {
+			return nil, fmt.Errorf("invalid ttl '%s'", ttl)
+		}
+
+		expiresAt := time.Now().Add(ttl)
+
+		return &expiresAt, nil
+	}
+
+	if c.Flags().Changed(expiresAtFlag) {
+		v, err := c.Flags().GetString(expiresAtFlag)
+		if err != nil {
+			return nil, err
+		}
+
+		expiresAt, err := time.Parse(time.RFC3339, v)
+		if err != nil {
+			return nil, fmt.Errorf("invalid expiry '%s': %w", v, err)
+		}
+
+		return &expiresAt, nil
+	}
+
+	return nil, nil
+}
+
+// recipientPublicKeys returns the public keys for a recipient, read from file
+// if it's a path to a public key, otherwise fetched for the username from the
+// server.
+func recipientPublicKeys(
+	ctx context.Context,
+	s *session,
+	recipient string,
+) ([]gossh.PublicKey, error) {
+	if _, err := os.Stat(recipient); err == nil {
+		publicKey, err := ssh.GetPublicKey(recipient)
+		if err != nil {
+			return nil, err
+		}
+
+		return []gossh.PublicKey{publicKey}, nil
+	}
+
+	return s.PublicKeys(ctx, recipient)
+}
+
+func getCmd(v *viper.Viper, s *session) *cobra.Command {
+	getCmd := &cobra.Command{
+		Use:   "get [flags] KEY",
+		Short: "Get a value from the store",
+		Args:  cobra.ExactArgs(1),
+		Example: `  syringe get username
+  syringe get --version 2 username`,
+		RunE: func(c *cobra.Command, args []string) error {
+			version, err := c.Flags().GetInt(versionFlag)
+			if err != nil {
+				return err
 			}
 
+			var value []byte
+
+			if c.Flags().Changed(versionFlag) {
+				value, err = s.GetVersion(c.Context(), args[0], version)
+			} else {
+				value, err = s.Get(c.Context(), args[0])
+			}
+			if err != nil {
+				return err
+			}
+
+			c.OutOrStdout().Write(value)
+
 			return nil
 		},
 	}
+
+	getCmd.Flags().Int(versionFlag, 0, "Version of the value to get, as listed by history")
+
+	return getCmd
 }
 
-func getCmd(v *viper.Viper, a *api.HostAPI) *cobra.Command {
+func removeCmd(v *viper.Viper, s *session) *cobra.Command {
 	return &cobra.Command{
-		Use:     "get [flags] KEY",
-		Short:   "Get a value from the store",
+		Use:     "remove [flags] KEY",
+		Short:   "Remove a record from the store",
 		Args:    cobra.ExactArgs(1),
-		Example: "  syringe get username",
+		Example: "  syringe remove username",
 		RunE: func(c *cobra.Command, args []string) error {
-			identity := v.GetString(identityFlag)
+			return s.Remove(c.Context(), args[0])
+		},
+	}
+}
 
-			privateKey, err := ssh.GetPrivateKey(
-				identity, c.OutOrStderr(), term.ReadPassword,
-			)
+func listCmd(v *viper.Viper, s *session) *cobra.Command {
+	listCmd := &cobra.Command{
+		Use:   "list [flags]",
+		Short: "List all records in store",
+		Args:  cobra.ExactArgs(0),
+		Example: `  syringe list
+  syringe list --tag prod`,
+		RunE: func(c *cobra.Command, args []string) error {
+			tag, err := c.Flags().GetString(tagFlag)
 			if err != nil {
-				return fmt.Errorf("failed to get private key from identity: %w", err)
+				return err
 			}
 
-			decrypt := ssh.NewDecryptor(privateKey)
+			var entries []client.Entry
 
-			var b bytes.Buffer
-			a.SetOut(io.Writer(&b))
-
-			err = a.Get(args[0])
+			if tag != "" {
+				entries, err = s.ListTagged(c.Context(), tag)
+			} else {
+				entries, err = s.List(c.Context())
+			}
 			if err != nil {
 				return err
 			}
 
-			d, err := io.ReadAll(&b)
+			keys := make([]string, len(entries))
+			for i, e := range entries {
+				keys[i] = e.Key
+			}
+
+			c.OutOrStdout().Write([]byte(strings.Join(keys, "\n")))
+
+			return nil
+		},
+	}
+
+	listCmd.Flags().String(tagFlag, "", "Only list records with the tag")
+
+	return listCmd
+}
+
+func describeCmd(v *viper.Viper, s *session) *cobra.Command {
+	return &cobra.Command{
+		Use:     "describe [flags] KEY",
+		Short:   "Show what's known about a record, besides its value",
+		Args:    cobra.ExactArgs(1),
+		Example: "  syringe describe password",
+		RunE: func(c *cobra.Command, args []string) error {
+			d, err := s.Describe(c.Context(), args[0])
 			if err != nil {
 				return err
 			}
 
-			decryptedValue, err := decrypt(string(d))
+			w := tabwriter.NewWriter(c.OutOrStdout(), 0, 0, 2, ' ', 0)
+
+			fmt.Fprintf(w, "Key:\t%s\n", d.Key)
+			fmt.Fprintf(w, "Version:\t%d\n", d.Version)
+
+			if d.Description != "" {
+				fmt.Fprintf(w, "Description:\t%s\n", d.Description)
+			}
+
+			if len(d.Tags) > 0 {
+				fmt.Fprintf(w, "Tags:\t%s\n", strings.Join(d.Tags, ", "))
+			}
+
+			fmt.Fprintf(w, "Created:\t%s\n", d.CreatedAt.Local().Format(time.RFC3339))
+			fmt.Fprintf(w, "Updated:\t%s\n", d.UpdatedAt.Local().Format(time.RFC3339))
+
+			if d.ExpiresAt != nil {
+				fmt.Fprintf(w, "Expires:\t%s\n", d.ExpiresAt.Local().Format(time.RFC3339))
+			}
+
+			return w.Flush()
+		},
+	}
+}
+
+func namespacesCmd(v *viper.Viper, s *session) *cobra.Command {
+	return &cobra.Command{
+		Use:     "namespaces [flags]",
+		Short:   "List the projects and environments in the store",
+		Args:    cobra.ExactArgs(0),
+		Example: "  syringe namespaces",
+		RunE: func(c *cobra.Command, args []string) error {
+			namespaces, err := s.Namespaces(c.Context())
 			if err != nil {
 				return err
 			}
 
-			c.OutOrStdout().Write([]byte(decryptedValue))
+			lines := make([]string, len(namespaces))
+			for i, ns := range namespaces {
+				lines[i] = ns.Project + " " + ns.Environment
+			}
+
+			c.OutOrStdout().Write([]byte(strings.Join(lines, "\n")))
 
 			return nil
 		},
 	}
 }
 
-func removeCmd(v *viper.Viper, a *api.HostAPI) *cobra.Command {
+func historyCmd(v *viper.Viper, s *session) *cobra.Command {
 	return &cobra.Command{
-		Use:     "remove [flags] KEY",
-		Short:   "Remove a record from the store",
+		Use:     "history [flags] KEY",
+		Short:   "List the versions kept of a value",
 		Args:    cobra.ExactArgs(1),
-		Example: "  syringe remove username",
+		Example: "  syringe history password",
 		RunE: func(c *cobra.Command, args []string) error {
-			return a.Remove(args[0])
+			revisions, err := s.History(c.Context(), args[0])
+			if err != nil {
+				return err
+			}
+
+			lines := make([]string, len(revisions))
+			for i, r := range revisions {
+				lines[i] = fmt.Sprintf(
+					"%d %s",
+					r.Version,
+					r.CreatedAt.Local().Format(time.RFC3339),
+				)
+			}
+
+			c.OutOrStdout().Write([]byte(strings.Join(lines, "\n")))
+
+			return nil
 		},
 	}
 }
 
-func listCmd(v *viper.Viper, a *api.HostAPI) *cobra.Command {
+func rollbackCmd(v *viper.Viper, s *session) *cobra.Command {
 	return &cobra.Command{
-		Use:     "list [flags]",
-		Short:   "List all records in store",
-		Args:    cobra.ExactArgs(0),
-		Example: "  syringe list",
+		Use:     "rollback [flags] KEY VERSION",
+		Short:   "Set a value back to a previous version",
+		Args:    cobra.ExactArgs(2),
+		Example: "  syringe rollback password 2",
 		RunE: func(c *cobra.Command, args []string) error {
-			return a.List()
+			version, err := strconv.Atoi(args[1])
+			if err != nil {
+				return fmt.Errorf("invalid version '%s'", args[1])
+			}
+
+			return s.Rollback(c.Context(), args[0], version)
+		},
+	}
+}
+
+func auditCmd(v *viper.Viper, s *session) *cobra.Command {
+	auditCmd := &cobra.Command{
+		Use:   "audit [flags]",
+		Short: "List the commands run on the account, and attempts to run them",
+		Args:  cobra.ExactArgs(0),
+		Example: `  syringe audit
+  syringe audit --since 24h --action get`,
+		RunE: func(c *cobra.Command, args []string) error {
+			since, err := auditSince(c)
+			if err != nil {
+				return err
+			}
+
+			action, err := c.Flags().GetString(actionFlag)
+			if err != nil {
+				return err
+			}
+
+			events, err := s.Audit(c.Context(), since, action)
+			if err != nil {
+				return err
+			}
+
+			w := tabwriter.NewWriter(c.OutOrStdout(), 0, 0, 2, ' ', 0)
+
+			for _, e := range events {
+				// only certificates have a key ID
+				keyID := e.KeyID
+				if keyID == "" {
+					keyID = "-"
+				}
+
+				fmt.Fprintf(
+					w,
+					"%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\n",
+					e.Timestamp.Local().Format(time.RFC3339),
+					e.Action,
+					e.Status,
+					e.Address,
+					e.Username,
+					e.PublicKey,
+					keyID,
+					e.Client,
+				)
+			}
+
+			return w.Flush()
 		},
 	}
+
+	auditCmd.Flags().String(sinceFlag, "", "Only list events since a duration ago (e.g. 24h) or a time (RFC 3339)")
+	auditCmd.Flags().String(actionFlag, "", "Only list events of the command (e.g. get)")
+
+	return auditCmd
+}
+
+// auditSince returns the earliest time of the events to list, from the since
+// flag, or the zero time for all of them.
+func auditSince(c *cobra.Command) (time.Time, error) {
+	v, err := c.Flags().GetString(sinceFlag)
+	if err != nil || v == "" {
+		return time.Time{}, err
+	}
+
+	if d, err := time.ParseDuration(v); err == nil {
+		if d <= 0 {
+			return time.Time{}, fmt.Errorf("invalid duration '%s'", v)
+		}
+
+		return time.Now().Add(-d), nil
+	}
+
+	since, err := time.Parse(time.RFC3339, v)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid time '%s': expected a duration or RFC 3339 time", v)
+	}
+
+	return since, nil
 }
 
 func bindFlags(c *cobra.Command, v *viper.Viper) {
@@ -0,0 +1,41 @@
+package cli
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/nixpig/syringe.sh/pkg/ssh"
+	gossh "golang.org/x/crypto/ssh"
+	"golang.org/x/term"
+)
+
+// confirmHostKey returns a HostKeyConfirm that shows the fingerprint of an
+// unknown host key and asks whether to trust it, as ssh does.
+func confirmHostKey(out io.Writer) ssh.HostKeyConfirm {
+	return func(hostname string, key gossh.PublicKey) (bool, error) {
+		if !term.IsTerminal(int(os.Stdin.Fd())) {
+			return false, fmt.Errorf(
+				"can't confirm unknown host key for %s without a terminal; pin its fingerprint with --%s or use --%s=%s",
+				hostname,
+				hostKeyFingerprintFlag,
+				hostKeyCheckingFlag,
+				ssh.HostKeyCheckingAcceptNew,
+			)
+		}
+
+		fmt.Fprintf(out, "The authenticity of host '%s' can't be established.\n", hostname)
+		fmt.Fprintf(out, "%s key fingerprint is %s.\n", key.Type(), gossh.FingerprintSHA256(key))
+		fmt.Fprint(out, "Are you sure you want to continue connecting (yes/no)? ")
+
+		answer, err := bufio.NewReader(os.Stdin).ReadString('\n')
+		if err != nil && !errors.Is(err, io.EOF) {
+			return false, fmt.Errorf("failed to read answer: %w", err)
+		}
+
+		return strings.TrimSpace(strings.ToLower(answer)) == "yes", nil
+	}
+}
@@ -0,0 +1,206 @@
+package cli
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/nixpig/syringe.sh/pkg/client"
+	"github.com/nixpig/syringe.sh/pkg/ssh"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+	gossh "golang.org/x/crypto/ssh"
+	"golang.org/x/term"
+)
+
+const (
+	rekeyFromFlag = "from"
+	rekeyToFlag   = "to"
+)
+
+func rekeyCmd(v *viper.Viper, s *session) *cobra.Command {
+	rekeyCmd := &cobra.Command{
+		Use:   "rekey [flags]",
+		Short: "Re-encrypt all records for a new key",
+		Long: `Re-encrypt all records for a new key.
+
+The new public key is registered, then each record is decrypted locally with
+the old key and re-encrypted for the new key. Records shared with other
+recipients are re-encrypted for them too, given with --recipient as for set.
+Progress is recorded, so an interrupted rekey can be resumed by running the
+same command again.`,
+		Args: cobra.ExactArgs(0),
+		Example: `  syringe rekey --from ~/.ssh/id_rsa --to ~/.ssh/id_ed25519
+  syringe rekey --to ~/.ssh/id_ed25519 --recipient ~/.ssh/teammate.pub --recipient janedoe`,
+		RunE: func(c *cobra.Command, args []string) error {
+			ctx := c.Context()
+
+			from, err := c.Flags().GetString(rekeyFromFlag)
+			if err != nil {
+				return err
+			}
+
+			if from == "" {
+				from = v.GetString(identityFlag)
+			}
+
+			to, err := c.Flags().GetString(rekeyToFlag)
+			if err != nil {
+				return err
+			}
+
+			oldID, err := client.NewIdentity(from, c.OutOrStderr(), term.ReadPassword)
+			if err != nil {
+				return fmt.Errorf("get old key: %w", err)
+			}
+
+			newID, err := client.NewIdentity(to, c.OutOrStderr(), term.ReadPassword)
+			if err != nil {
+				return fmt.Errorf("get new key: %w", err)
+			}
+
+			recipients, err := c.Flags().GetStringArray(recipientFlag)
+			if err != nil {
+				return err
+			}
+
+			var publicKeys []gossh.PublicKey
+
+			for _, recipient := range recipients {
+				recipientKeys, err := recipientPublicKeys(ctx, s, recipient)
+				if err != nil {
+					return fmt.Errorf("get public keys for '%s': %w", recipient, err)
+				}
+
+				publicKeys = append(publicKeys, recipientKeys...)
+			}
+
+			progress, err := openRekeyProgress(oldID.PublicKey(), newID.PublicKey())
+			if err != nil {
+				return err
+			}
+			defer progress.close()
+
+			rekeyed, total, err := s.Rekey(ctx, oldID, newID, progress, publicKeys...)
+			if errors.Is(err, ssh.ErrUnknownRecipient) {
+				return fmt.Errorf("%w; give its public key or username with --%s", err, recipientFlag)
+			}
+			if err != nil {
+				return err
+			}
+
+			if err := progress.remove(); err != nil {
+				return err
+			}
+
+			fmt.Fprintf(
+				c.ErrOrStderr(),
+				"rekeyed %d of %d records for %s; use --identity %s from now on\n",
+				rekeyed,
+				total,
+				gossh.FingerprintSHA256(newID.PublicKey()),
+				to,
+			)
+
+			return nil
+		},
+	}
+
+	rekeyCmd.Flags().String(rekeyFromFlag, "", "Path to old SSH key (defaults to identity)")
+	rekeyCmd.Flags().String(rekeyToFlag, "", "Path to new SSH key")
+	rekeyCmd.Flags().StringArray(
+		recipientFlag,
+		nil,
+		"Public key file or username of a recipient records are shared with (repeatable)",
+	)
+	rekeyCmd.MarkFlagRequired(rekeyToFlag)
+
+	return rekeyCmd
+}
+
+// rekeyProgress records the keys that have been rekeyed, so an interrupted
+// rekey can be resumed.
+type rekeyProgress struct {
+	path string
+	done map[string]bool
+	f    *os.File
+}
+
+func openRekeyProgress(oldPublicKey, newPublicKey gossh.PublicKey) (*rekeyProgress, error) {
+	configDir, err := os.UserConfigDir()
+	if err != nil {
+		return nil, fmt.Errorf("get user config dir: %w", err)
+	}
+
+	dir := filepath.Join(configDir, "syringe", "rekey")
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, fmt.Errorf("create rekey progress dir: %w", err)
+	}
+
+	h := sha256.Sum256(append(oldPublicKey.Marshal(), newPublicKey.Marshal()...))
+	path := filepath.Join(dir, hex.EncodeToString(h[:8])+".log")
+
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("open rekey progress: %w", err)
+	}
+
+	p := &rekeyProgress{
+		path: path,
+		done: map[string]bool{},
+		f:    f,
+	}
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		p.done[scanner.Text()] = true
+	}
+
+	if err := scanner.Err(); err != nil {
+		f.Close()
+		return nil, fmt.Errorf("read rekey progress: %w", err)
+	}
+
+	return p, nil
+}
+
+func (p *rekeyProgress) IsDone(key string) bool {
+	return p.done[key]
+}
+
+func (p *rekeyProgress) MarkDone(key string) error {
+	if _, err := p.f.WriteString(key + "\n"); err != nil {
+		return fmt.Errorf("write rekey progress: %w", err)
+	}
+
+	if err := p.f.Sync(); err != nil {
+		return fmt.Errorf("sync rekey progress: %w", err)
+	}
+
+	p.done[key] = true
+
+	return nil
+}
+
+func (p *rekeyProgress) close() error {
+	if err := p.f.Close(); err != nil && !errors.Is(err, os.ErrClosed) {
+		return err
+	}
+
+	return nil
+}
+
+// remove deletes the progress once the rekey is complete.
+func (p *rekeyProgress) remove() error {
+	p.close()
+
+	if err := os.Remove(p.path); err != nil {
+		return fmt.Errorf("remove rekey progress: %w", err)
+	}
+
+	return nil
+}
@@ -0,0 +1,55 @@
+package cli
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+
+	"golang.org/x/term"
+)
+
+// passphraseEnv is the environment variable the vault passphrase is read from
+// before prompting for it.
+const passphraseEnv = "SYRINGE_PASSPHRASE"
+
+// readPassphrase returns the vault passphrase, prompting for it twice when
+// confirm is set, so a mistyped passphrase doesn't lock away a value.
+func readPassphrase(out io.Writer, confirm bool) ([]byte, error) {
+	if passphrase := os.Getenv(passphraseEnv); passphrase != "" {
+		return []byte(passphrase), nil
+	}
+
+	out.Write([]byte("Enter vault passphrase: "))
+
+	passphrase, err := term.ReadPassword(int(os.Stdin.Fd()))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read passphrase: %w", err)
+	}
+
+	out.Write([]byte("\n"))
+
+	if len(passphrase) == 0 {
+		return nil, errors.New("passphrase is empty")
+	}
+
+	if !confirm {
+		return passphrase, nil
+	}
+
+	out.Write([]byte("Confirm vault passphrase: "))
+
+	confirmation, err := term.ReadPassword(int(os.Stdin.Fd()))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read passphrase: %w", err)
+	}
+
+	out.Write([]byte("\n"))
+
+	if !bytes.Equal(passphrase, confirmation) {
+		return nil, errors.New("passphrases don't match")
+	}
+
+	return passphrase, nil
+}
@@ -0,0 +1,93 @@
+package middleware
+
+import (
+	"net"
+	"time"
+
+	"github.com/charmbracelet/log"
+	"github.com/charmbracelet/ssh"
+	"github.com/nixpig/syringe.sh/internal/stores"
+	"github.com/nixpig/syringe.sh/pkg/protocol"
+	"github.com/spf13/cobra"
+	gossh "golang.org/x/crypto/ssh"
+)
+
+// auditStatusSuccess is the status of commands that succeeded. Commands that
+// failed have the code of their error.
+const auditStatusSuccess = "success"
+
+// auditActionConnect is the audited action of sessions rejected before
+// running a command.
+const auditActionConnect = "connect"
+
+// auditAction is the audited name of the executed command, which is the root
+// command when it was unknown or missing.
+func auditAction(root, executed *cobra.Command) string {
+	if executed == nil || executed == root {
+		return "unknown"
+	}
+
+	return executed.Name()
+}
+
+// audit records that the connection authenticated with the key ran the
+// action, or attempted to. Connections that aren't authenticated as a user
+// are only logged, as they could claim to be anyone. Failing to record it
+// doesn't fail the command, as its effects can't be undone.
+func audit(
+	ctx ssh.Context,
+	key ssh.PublicKey,
+	s *stores.SystemStore,
+	action string,
+	err error,
+) {
+	status := auditStatusSuccess
+	if err != nil {
+		status = string(protocol.ErrorCode(err))
+	}
+
+	address := ctx.RemoteAddr().String()
+	if host, _, err := net.SplitHostPort(address); err == nil {
+		address = host
+	}
+
+	// a certificate is recorded as the user's key it's for, and its key ID
+	var fingerprint, keyID string
+	if key != nil {
+		if cert, ok := key.(*gossh.Certificate); ok {
+			key = cert.Key
+			keyID = cert.KeyId
+		}
+
+		fingerprint = gossh.FingerprintSHA256(key)
+	}
+
+	userID, ok := ctx.Value(contextKeyUserID).(int)
+	if !ok {
+		log.Warn(
+			"unauthenticated",
+			"session", ctx.SessionID(),
+			"action", action,
+			"status", status,
+			"address", address,
+			"user", ctx.User(),
+			"key", fingerprint,
+		)
+		return
+	}
+
+	if err := s.AddAuditEvent(&stores.AuditEvent{
+		Session:   ctx.SessionID(),
+		Timestamp: time.Now(),
+		Action:    action,
+		Status:    status,
+		Address:   address,
+		Client:    ctx.ClientVersion(),
+		Username:  ctx.User(),
+		PublicKey: fingerprint,
+		KeyID:     keyID,
+		UserID:    userID,
+	}); err != nil {
+		log.Error("audit", "session", ctx.SessionID(), "action", action, "err", err)
+	}
+}
@@ -0,0 +1,78 @@
+package middleware
+
+import (
+	"bytes"
+	"slices"
+
+	"github.com/charmbracelet/log"
+	"github.com/charmbracelet/ssh"
+	gossh "golang.org/x/crypto/ssh"
+)
+
+// NewPublicKeyHandler returns a handler that accepts keys of the allowed types
+// and certificates signed by one of the user certificate authorities, for the
+// user as one of their principals. Rejected keys are only logged, as they
+// don't authenticate anyone to audit them for.
+func NewPublicKeyHandler(
+	allowedKeyTypes []string,
+	userCAKeys []gossh.PublicKey,
+) ssh.PublicKeyHandler {
+	checker := &gossh.CertChecker{
+		IsUserAuthority: func(auth gossh.PublicKey) bool {
+			return slices.ContainsFunc(userCAKeys, func(k gossh.PublicKey) bool {
+				return bytes.Equal(auth.Marshal(), k.Marshal())
+			})
+		},
+	}
+
+	return func(ctx ssh.Context, key ssh.PublicKey) bool {
+		cert, ok := key.(*gossh.Certificate)
+		if !ok {
+			if !slices.Contains(allowedKeyTypes, key.Type()) {
+				log.Warn(
+					"unsupported key type",
+					"user", ctx.User(),
+					"address", ctx.RemoteAddr(),
+					"type", key.Type(),
+				)
+				return false
+			}
+
+			return true
+		}
+
+		if !slices.Contains(allowedKeyTypes, cert.Key.Type()) {
+			log.Warn(
+				"unsupported key type",
+				"user", ctx.User(),
+				"address", ctx.RemoteAddr(),
+				"type", cert.Key.Type(),
+				"keyId", cert.KeyId,
+			)
+			return false
+		}
+
+		if !checker.IsUserAuthority(cert.SignatureKey) {
+			log.Warn(
+				"certificate from untrusted authority",
+				"user", ctx.User(),
+				"address", ctx.RemoteAddr(),
+				"keyId", cert.KeyId,
+			)
+			return false
+		}
+
+		if err := checker.CheckCert(ctx.User(), cert); err != nil {
+			log.Warn(
+				"invalid certificate",
+				"user", ctx.User(),
+				"address", ctx.RemoteAddr(),
+				"keyId", cert.KeyId,
+				"err", err,
+			)
+			return false
+		}
+
+		return true
+	}
+}
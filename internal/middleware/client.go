@@ -1,30 +1,54 @@
 package middleware
 
 import (
-	"slices"
+	"fmt"
 
 	"github.com/charmbracelet/log"
 	"github.com/charmbracelet/ssh"
+	"github.com/charmbracelet/wish"
+	"github.com/nixpig/syringe.sh/pkg/protocol"
 )
 
-var allowedClients = []string{
-	"SSH-2.0-Syringe",
-}
+// NewClientMiddleware rejects sessions from clients other than syringe, or
+// with a version lower than minVersion, logging them.
+func NewClientMiddleware(minVersion string) wish.Middleware {
+	return func(next ssh.Handler) ssh.Handler {
+		return func(sess ssh.Session) {
+			clientVersion := sess.Context().ClientVersion()
 
-func ClientMiddleware(next ssh.Handler) ssh.Handler {
-	return func(sess ssh.Session) {
-		clientVersion := sess.Context().ClientVersion()
-		if !slices.Contains(allowedClients, clientVersion) {
-			log.Error(
-				"disallowed client",
-				"session", sess.Context().SessionID(),
-				"version", clientVersion,
-			)
-			sess.Stderr().Write([]byte("unsupported client"))
-			sess.Exit(1)
-			return
-		}
+			version, err := protocol.ParseClientIdentifier(clientVersion)
+			if err != nil {
+				log.Error(
+					"disallowed client",
+					"session", sess.Context().SessionID(),
+					"user", sess.User(),
+					"address", sess.RemoteAddr(),
+					"version", clientVersion,
+				)
+				sess.Stderr().Write([]byte("unsupported client"))
+				sess.Exit(1)
+				return
+			}
 
-		next(sess)
+			if c, err := protocol.CompareVersions(version, minVersion); err != nil || c < 0 {
+				log.Error(
+					"outdated client",
+					"session", sess.Context().SessionID(),
+					"user", sess.User(),
+					"address", sess.RemoteAddr(),
+					"version", version,
+					"minVersion", minVersion,
+				)
+				sess.Stderr().Write([]byte(fmt.Sprintf(
+					"syringe %s is no longer supported by this server; upgrade to %s or later",
+					version,
+					minVersion,
+				)))
+				sess.Exit(1)
+				return
+			}
+
+			next(sess)
+		}
 	}
 }
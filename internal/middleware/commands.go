@@ -1,68 +1,136 @@
 package middleware
 
 import (
+	"bytes"
+	"context"
+	"crypto/sha1"
 	"database/sql"
+	"encoding/hex"
+	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
+	"maps"
 	"net/mail"
 	"os"
 	"path/filepath"
+	"regexp"
+	"slices"
+	"strconv"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/charmbracelet/log"
 	"github.com/charmbracelet/ssh"
 	"github.com/charmbracelet/wish"
-	"github.com/golang-migrate/migrate/v4"
 	"github.com/nixpig/syringe.sh/database"
 	"github.com/nixpig/syringe.sh/internal/stores"
+	"github.com/nixpig/syringe.sh/internal/version"
+	"github.com/nixpig/syringe.sh/pkg/protocol"
+	syringessh "github.com/nixpig/syringe.sh/pkg/ssh"
 	"github.com/spf13/cobra"
+	gossh "golang.org/x/crypto/ssh"
 )
 
 // TODO: better strategy for logging, writing errors and exiting
 
-func NewCmdMiddleware(systemStore *stores.SystemStore) wish.Middleware {
+// NewCmdMiddleware runs the commands of sessions. Tenant stores keep the last
+// historyRetention versions of each value, or every version when it's 0.
+func NewCmdMiddleware(systemStore *stores.SystemStore, historyRetention int) wish.Middleware {
 	return func(next ssh.Handler) ssh.Handler {
 		return func(sess ssh.Session) {
 			log.Debug(sess.RawCommand())
-			cmd := rootCmd()
-			cmd.SetArgs(sess.Command())
-			cmd.SetIn(sess)
-			cmd.SetOut(sess)
-			cmd.SetErr(sess.Stderr())
 
 			sessionID := sess.Context().SessionID()
 
 			sess.Context().SetValue(contextKeyUsername, sess.Context().User())
 
-			publicKeyHash, ok := sess.Context().Value(contextKeyHash).(string)
+			tenant, ok := sess.Context().Value(contextKeyTenant).(string)
 			if !ok {
+				audit(sess.Context(), sess.PublicKey(), systemStore, auditActionConnect, protocol.Errorf(
+					protocol.CodeInternal,
+					"no tenant for session",
+				))
 				sess.Stderr().Write([]byte("failed to get public key"))
 				sess.Exit(1)
+				return
 			}
 
-			db, err := tenantDB(publicKeyHash)
+			db, err := tenantDB(tenant)
 			if err != nil {
 				log.Error("connect to tenant database", "session", sessionID, "err", err)
+				audit(sess.Context(), sess.PublicKey(), systemStore, auditActionConnect, protocol.Errorf(
+					protocol.CodeInternal,
+					"connect to tenant database: %s",
+					err,
+				))
 				sess.Stderr().Write([]byte("database connection error"))
 				sess.Exit(1)
 				return
 			}
 
-			tenantStore := stores.NewTenantStore(db)
-			cmd.AddCommand(
-				setCmd(tenantStore),
-				getCmd(tenantStore),
-				listCmd(tenantStore),
-				removeCmd(tenantStore),
-				registerCmd(systemStore),
-			)
-			cmd.AddCommand()
+			tenantStore := stores.NewTenantStore(db, historyRetention)
+
+			ctx, cancel := context.WithCancel(sess.Context())
+			defer cancel()
+
+			run := func(ctx context.Context, args []string, in io.Reader, out io.Writer) error {
+				cmd := rootCmd()
+				cmd.SetArgs(args)
+				cmd.SetIn(in)
+				cmd.SetOut(out)
+				cmd.SetErr(sess.Stderr())
+
+				cmd.AddCommand(
+					setCmd(tenantStore),
+					getCmd(tenantStore),
+					listCmd(tenantStore),
+					removeCmd(tenantStore),
+					namespacesCmd(tenantStore),
+					historyCmd(tenantStore),
+					describeCmd(tenantStore),
+					rollbackCmd(tenantStore),
+					replaceCmd(tenantStore),
+					registerCmd(systemStore),
+					publicKeyCmd(systemStore),
+					addKeyCmd(systemStore),
+					auditCmd(systemStore),
+					capabilitiesCmd(),
+				)
+
+				executed, err := cmd.ExecuteContextC(ctx)
+
+				// clients ask for capabilities before their first request,
+				// which isn't worth auditing
+				if executed == nil || executed.Name() != protocol.CapabilitiesCommand {
+					audit(sess.Context(), sess.PublicKey(), systemStore, auditAction(cmd, executed), err)
+				}
+
+				return err
+			}
+
+			// clients that predate cancel frames, or send commands as text,
+			// signal the session when a request in it is cancelled, before
+			// closing it
+			signals := make(chan ssh.Signal, 1)
+			sess.Signals(signals)
 
 			doneCh := make(chan bool, 1)
 			errCh := make(chan error, 1)
 
 			go func() {
-				if err := cmd.ExecuteContext(sess.Context()); err != nil {
+				var err error
+
+				// clients that predate the protocol send commands as text
+				if sess.Subsystem() == protocol.Subsystem ||
+					slices.Equal(sess.Command(), []string{protocol.Command}) {
+					err = serveProtocol(ctx, sess, run)
+				} else {
+					err = run(ctx, sess.Command(), sess, sess)
+				}
+
+				if err != nil {
 					errCh <- err
 					return
 				}
@@ -71,6 +139,12 @@ func NewCmdMiddleware(systemStore *stores.SystemStore) wish.Middleware {
 			}()
 
 			select {
+			case sig := <-signals:
+				cancel()
+				log.Info("cancelled", "session", sessionID, "signal", sig)
+				sess.Exit(1)
+				return
+
 			case <-sess.Context().Done():
 				log.Error("timeout", "session", sessionID)
 				sess.Stderr().Write([]byte("timed out"))
@@ -80,7 +154,7 @@ func NewCmdMiddleware(systemStore *stores.SystemStore) wish.Middleware {
 			case err := <-errCh:
 				log.Error("cmd", "session", sessionID, "err", err)
 				sess.Stderr().Write([]byte(err.Error()))
-				sess.Exit(1)
+				sess.Exit(protocol.ExitStatus(protocol.ErrorCode(err)))
 				return
 
 			case <-doneCh:
@@ -91,61 +165,349 @@ func NewCmdMiddleware(systemStore *stores.SystemStore) wish.Middleware {
 	}
 }
 
+// serveProtocol runs each request read from the session in turn, responding
+// with its output, until the client closes its end of the session. Frames are
+// read while requests run, so a request can be cancelled by a cancel frame
+// with its ID.
+func serveProtocol(
+	ctx context.Context,
+	sess ssh.Session,
+	run func(ctx context.Context, args []string, in io.Reader, out io.Writer) error,
+) error {
+	type queued struct {
+		req    protocol.Request
+		ctx    context.Context
+		cancel context.CancelFunc
+	}
+
+	var mu sync.Mutex
+	cancels := map[uint64]context.CancelFunc{}
+
+	queue := make(chan *queued, maxQueuedRequests)
+	errCh := make(chan error, 1)
+
+	go func() {
+		var writeErr error
+
+		for q := range queue {
+			res := protocol.Response{
+				ID:      q.req.ID,
+				Version: protocol.Version,
+			}
+
+			switch {
+			case q.req.Version != protocol.Version:
+				res.Error = fmt.Sprintf("unsupported protocol version: %d", q.req.Version)
+				res.Code = protocol.CodeUnsupported
+
+			case q.ctx.Err() != nil:
+				res.Error = "request cancelled"
+				res.Code = protocol.CodeInternal
+
+			default:
+				var out bytes.Buffer
+
+				if err := run(q.ctx, requestArgs(&q.req), bytes.NewReader(nil), &out); err != nil {
+					log.Error("cmd", "session", sess.Context().SessionID(), "err", err)
+					res.Error = err.Error()
+					res.Code = protocol.ErrorCode(err)
+				}
+
+				res.Output = out.Bytes()
+			}
+
+			mu.Lock()
+			delete(cancels, q.req.ID)
+			mu.Unlock()
+			q.cancel()
+
+			// the rest of the queue is drained once the session can't be
+			// written to
+			if writeErr == nil {
+				writeErr = protocol.WriteFrame(sess, &res)
+			}
+		}
+
+		errCh <- writeErr
+	}()
+
+	var readErr error
+
+	for {
+		var req protocol.Request
+		if err := protocol.ReadFrame(sess, &req); err != nil {
+			if !errors.Is(err, io.EOF) {
+				readErr = err
+			}
+
+			break
+		}
+
+		if req.Command == protocol.CancelCommand {
+			mu.Lock()
+			if cancel, ok := cancels[req.ID]; ok {
+				cancel()
+			}
+			mu.Unlock()
+
+			continue
+		}
+
+		reqCtx, cancel := context.WithCancel(ctx)
+
+		mu.Lock()
+		cancels[req.ID] = cancel
+		mu.Unlock()
+
+		queue <- &queued{req: req, ctx: reqCtx, cancel: cancel}
+	}
+
+	close(queue)
+
+	if err := <-errCh; err != nil {
+		return err
+	}
+
+	return readErr
+}
+
+// maxQueuedRequests is how many of a session's requests can wait to run
+// before reading the session waits for them, delaying cancel frames.
+const maxQueuedRequests = 64
+
+// requestArgs returns the command line for the request. Args follow "--", so
+// they're never parsed as flags.
+func requestArgs(req *protocol.Request) []string {
+	args := []string{req.Command}
+
+	for _, name := range slices.Sorted(maps.Keys(req.Flags)) {
+		args = append(args, fmt.Sprintf("--%s=%s", name, req.Flags[name]))
+	}
+
+	args = append(args, "--")
+
+	for _, arg := range req.Args {
+		args = append(args, string(arg))
+	}
+
+	return args
+}
+
 func rootCmd() *cobra.Command {
 	cmd := &cobra.Command{
 		Use:           "syringe",
 		SilenceUsage:  true,
 		SilenceErrors: true,
+		Args: func(c *cobra.Command, args []string) error {
+			if len(args) > 0 {
+				return protocol.Errorf(
+					protocol.CodeUnknownCommand,
+					"unknown command '%s'",
+					args[0],
+				)
+			}
+
+			return nil
+		},
 		RunE: func(c *cobra.Command, args []string) error {
-			return fmt.Errorf("no command specified")
+			return protocol.Errorf(protocol.CodeInvalidArgument, "no command specified")
 		},
 	}
 
 	cmd.CompletionOptions.HiddenDefaultCmd = true
+	cmd.PersistentFlags().String(
+		protocol.ProjectFlag,
+		protocol.DefaultNamespace.Project,
+		"Project of the values",
+	)
+	cmd.PersistentFlags().String(
+		protocol.EnvironmentFlag,
+		protocol.DefaultNamespace.Environment,
+		"Environment of the values in the project",
+	)
+	cmd.SetFlagErrorFunc(func(c *cobra.Command, err error) error {
+		return protocol.Errorf(protocol.CodeInvalidArgument, "%s", err)
+	})
 
 	return cmd
 }
 
+// namespaceName is what project and environment names can be.
+var namespaceName = regexp.MustCompile(`^[a-zA-Z0-9][a-zA-Z0-9_.-]{0,63}$`)
+
+// namespace returns the namespace named by the command's project and
+// environment flags.
+func namespace(c *cobra.Command) (stores.Namespace, error) {
+	project, err := c.Flags().GetString(protocol.ProjectFlag)
+	if err != nil {
+		return stores.Namespace{}, err
+	}
+
+	environment, err := c.Flags().GetString(protocol.EnvironmentFlag)
+	if err != nil {
+		return stores.Namespace{}, err
+	}
+
+	for _, name := range []string{project, environment} {
+		if !namespaceName.MatchString(name) {
+			return stores.Namespace{}, protocol.Errorf(
+				protocol.CodeInvalidArgument,
+				"invalid project or environment name '%s'",
+				name,
+			)
+		}
+	}
+
+	return stores.Namespace{Project: project, Environment: environment}, nil
+}
+
+// tagName is what tags can be.
+var tagName = regexp.MustCompile(`^[a-zA-Z0-9][a-zA-Z0-9_.-]{0,63}$`)
+
+// maxDescriptionLength is the longest a description can be, in bytes.
+const maxDescriptionLength = 1024
+
+// validArgs returns the positional args validator, failing with
+// CodeInvalidArgument.
+func validArgs(fn cobra.PositionalArgs) cobra.PositionalArgs {
+	return func(c *cobra.Command, args []string) error {
+		if err := fn(c, args); err != nil {
+			return protocol.Errorf(protocol.CodeInvalidArgument, "%s", err)
+		}
+
+		return nil
+	}
+}
+
 func setCmd(s *stores.TenantStore) *cobra.Command {
-	return &cobra.Command{
+	setCmd := &cobra.Command{
 		Use:  "set",
-		Args: cobra.ExactArgs(2),
+		Args: validArgs(cobra.RangeArgs(2, 3)),
 		PreRunE: func(c *cobra.Command, args []string) error {
 			authenticated, ok := c.Context().Value(contextKeyAuthenticated).(bool)
 			if !ok || !authenticated {
-				return fmt.Errorf("not authenticated")
+				return protocol.Errorf(protocol.CodeNotAuthenticated, "not authenticated")
 			}
 			return nil
 		},
 		RunE: func(c *cobra.Command, args []string) error {
-			if err := s.SetItem(
-				c.Context(),
-				&stores.Item{
-					Key:   args[0],
-					Value: args[1],
-				},
-			); err != nil {
+			ns, err := namespace(c)
+			if err != nil {
+				return err
+			}
+
+			item := &stores.Item{
+				Key:   args[0],
+				Value: args[1],
+			}
+
+			// the encrypted key name is sent when the key is hidden
+			if len(args) == 3 {
+				item.Name = args[2]
+			}
+
+			expiresAt, err := c.Flags().GetString(protocol.ExpiresAtFlag)
+			if err != nil {
+				return err
+			}
+
+			if expiresAt != "" {
+				t, err := time.Parse(time.RFC3339, expiresAt)
+				if err != nil {
+					return protocol.Errorf(protocol.CodeInvalidArgument, "invalid expiry '%s'", expiresAt)
+				}
+
+				if !t.After(time.Now()) {
+					return protocol.Errorf(protocol.CodeInvalidArgument, "expiry is in the past")
+				}
+
+				item.ExpiresAt = &t
+			}
+
+			item.Description, err = c.Flags().GetString(protocol.DescriptionFlag)
+			if err != nil {
+				return err
+			}
+
+			if len(item.Description) > maxDescriptionLength {
+				return protocol.Errorf(
+					protocol.CodeInvalidArgument,
+					"description is longer than %d characters",
+					maxDescriptionLength,
+				)
+			}
+
+			// tags are only replaced when they're given, so the flag can be
+			// empty to remove them
+			if c.Flags().Changed(protocol.TagsFlag) {
+				tags, err := c.Flags().GetString(protocol.TagsFlag)
+				if err != nil {
+					return err
+				}
+
+				item.Tags = []string{}
+
+				if tags != "" {
+					item.Tags = strings.Split(tags, ",")
+				}
+
+				for _, tag := range item.Tags {
+					if !tagName.MatchString(tag) {
+						return protocol.Errorf(protocol.CodeInvalidArgument, "invalid tag '%s'", tag)
+					}
+				}
+			}
+
+			if err := s.SetItem(c.Context(), ns, item); err != nil {
 				return err
 			}
 
 			return nil
 		},
 	}
+
+	setCmd.Flags().String(protocol.ExpiresAtFlag, "", "When the value expires, in RFC 3339 format")
+	setCmd.Flags().String(protocol.DescriptionFlag, "", "What the value is for")
+	setCmd.Flags().String(protocol.TagsFlag, "", "Tags of the value, separated by commas")
+
+	return setCmd
 }
 
 func getCmd(s *stores.TenantStore) *cobra.Command {
-	return &cobra.Command{
+	getCmd := &cobra.Command{
 		Use:  "get",
-		Args: cobra.ExactArgs(1),
+		Args: validArgs(cobra.ExactArgs(1)),
 		PreRunE: func(c *cobra.Command, args []string) error {
 			authenticated, ok := c.Context().Value(contextKeyAuthenticated).(bool)
 			if !ok || !authenticated {
-				return fmt.Errorf("not authenticated")
+				return protocol.Errorf(protocol.CodeNotAuthenticated, "not authenticated")
 			}
 			return nil
 		},
 		RunE: func(c *cobra.Command, args []string) error {
-			item, err := s.GetItemByKey(c.Context(), args[0])
+			ns, err := namespace(c)
+			if err != nil {
+				return err
+			}
+
+			version, err := c.Flags().GetInt(protocol.VersionFlag)
+			if err != nil {
+				return err
+			}
+
+			var item *stores.Item
+
+			if version == 0 {
+				item, err = s.GetItemByKey(c.Context(), ns, args[0])
+				if errors.Is(err, sql.ErrNoRows) {
+					return protocol.Errorf(protocol.CodeNotFound, "key not found")
+				}
+			} else {
+				item, err = s.GetItemVersion(c.Context(), ns, args[0], version)
+				if errors.Is(err, sql.ErrNoRows) {
+					return protocol.Errorf(protocol.CodeNotFound, "version not found")
+				}
+			}
 			if err != nil {
 				return err
 			}
@@ -154,49 +516,103 @@ func getCmd(s *stores.TenantStore) *cobra.Command {
 			return nil
 		},
 	}
+
+	getCmd.Flags().Int(protocol.VersionFlag, 0, "Version of the value to get, instead of the current value")
+
+	return getCmd
 }
 
 func listCmd(s *stores.TenantStore) *cobra.Command {
-	return &cobra.Command{
+	listCmd := &cobra.Command{
 		Use:  "list",
-		Args: cobra.ExactArgs(0),
+		Args: validArgs(cobra.ExactArgs(0)),
 		PreRunE: func(c *cobra.Command, args []string) error {
 			authenticated, ok := c.Context().Value(contextKeyAuthenticated).(bool)
 			if !ok || !authenticated {
-				return fmt.Errorf("not authenticated")
+				return protocol.Errorf(protocol.CodeNotAuthenticated, "not authenticated")
 			}
 			return nil
 		},
 		RunE: func(c *cobra.Command, args []string) error {
-			items, err := s.ListItems(c.Context())
+			ns, err := namespace(c)
 			if err != nil {
 				return err
 			}
 
+			tag, err := c.Flags().GetString(protocol.TagFlag)
+			if err != nil {
+				return err
+			}
+
+			items, err := s.ListItems(c.Context(), ns, tag)
+			if err != nil {
+				return err
+			}
+
+			asJSON, err := c.Flags().GetBool("json")
+			if err != nil {
+				return err
+			}
+
+			if asJSON {
+				entries := make([]protocol.Entry, len(items))
+				for i, item := range items {
+					entries[i] = protocol.Entry{
+						Key:         []byte(item.Key),
+						Name:        item.Name,
+						ExpiresAt:   item.ExpiresAt,
+						Description: item.Description,
+						Tags:        item.Tags,
+					}
+				}
+
+				b, err := json.Marshal(entries)
+				if err != nil {
+					return fmt.Errorf("marshal entries: %w", err)
+				}
+
+				c.OutOrStdout().Write(b)
+				return nil
+			}
+
 			keys := make([]string, len(items))
 			for i, item := range items {
 				keys[i] = item.Key
+
+				if item.Name != "" {
+					keys[i] += " " + item.Name
+				}
 			}
 
 			c.OutOrStdout().Write([]byte(strings.Join(keys, "\n")))
 			return nil
 		},
 	}
+
+	listCmd.Flags().Bool("json", false, "List entries as JSON")
+	listCmd.Flags().String(protocol.TagFlag, "", "Only list entries with the tag")
+
+	return listCmd
 }
 
 func removeCmd(s *stores.TenantStore) *cobra.Command {
 	return &cobra.Command{
 		Use:  "remove",
-		Args: cobra.ExactArgs(1),
+		Args: validArgs(cobra.ExactArgs(1)),
 		PreRunE: func(c *cobra.Command, args []string) error {
 			authenticated, ok := c.Context().Value(contextKeyAuthenticated).(bool)
 			if !ok || !authenticated {
-				return fmt.Errorf("not authenticated")
+				return protocol.Errorf(protocol.CodeNotAuthenticated, "not authenticated")
 			}
 			return nil
 		},
 		RunE: func(c *cobra.Command, args []string) error {
-			if err := s.RemoveItemByKey(c.Context(), args[0]); err != nil {
+			ns, err := namespace(c)
+			if err != nil {
+				return err
+			}
+
+			if err := s.RemoveItemByKey(c.Context(), ns, args[0]); err != nil {
 				return err
 			}
 
@@ -205,14 +621,215 @@ func removeCmd(s *stores.TenantStore) *cobra.Command {
 	}
 }
 
+func namespacesCmd(s *stores.TenantStore) *cobra.Command {
+	return &cobra.Command{
+		Use:  protocol.NamespacesCommand,
+		Args: validArgs(cobra.ExactArgs(0)),
+		PreRunE: func(c *cobra.Command, args []string) error {
+			authenticated, ok := c.Context().Value(contextKeyAuthenticated).(bool)
+			if !ok || !authenticated {
+				return protocol.Errorf(protocol.CodeNotAuthenticated, "not authenticated")
+			}
+			return nil
+		},
+		RunE: func(c *cobra.Command, args []string) error {
+			namespaces, err := s.ListNamespaces(c.Context())
+			if err != nil {
+				return err
+			}
+
+			entries := make([]protocol.Namespace, len(namespaces))
+			for i, ns := range namespaces {
+				entries[i] = protocol.Namespace{
+					Project:     ns.Project,
+					Environment: ns.Environment,
+				}
+			}
+
+			b, err := json.Marshal(entries)
+			if err != nil {
+				return fmt.Errorf("marshal namespaces: %w", err)
+			}
+
+			c.OutOrStdout().Write(b)
+			return nil
+		},
+	}
+}
+
+func describeCmd(s *stores.TenantStore) *cobra.Command {
+	return &cobra.Command{
+		Use:  protocol.DescribeCommand,
+		Args: validArgs(cobra.ExactArgs(1)),
+		PreRunE: func(c *cobra.Command, args []string) error {
+			authenticated, ok := c.Context().Value(contextKeyAuthenticated).(bool)
+			if !ok || !authenticated {
+				return protocol.Errorf(protocol.CodeNotAuthenticated, "not authenticated")
+			}
+			return nil
+		},
+		RunE: func(c *cobra.Command, args []string) error {
+			ns, err := namespace(c)
+			if err != nil {
+				return err
+			}
+
+			item, err := s.GetItemByKey(c.Context(), ns, args[0])
+			if errors.Is(err, sql.ErrNoRows) {
+				return protocol.Errorf(protocol.CodeNotFound, "key not found")
+			}
+			if err != nil {
+				return err
+			}
+
+			b, err := json.Marshal(&protocol.Description{
+				Key:         []byte(item.Key),
+				Name:        item.Name,
+				Version:     item.Version,
+				Description: item.Description,
+				Tags:        item.Tags,
+				CreatedAt:   item.CreatedAt,
+				UpdatedAt:   item.UpdatedAt,
+				ExpiresAt:   item.ExpiresAt,
+			})
+			if err != nil {
+				return fmt.Errorf("marshal description: %w", err)
+			}
+
+			c.OutOrStdout().Write(b)
+			return nil
+		},
+	}
+}
+
+func historyCmd(s *stores.TenantStore) *cobra.Command {
+	return &cobra.Command{
+		Use:  protocol.HistoryCommand,
+		Args: validArgs(cobra.ExactArgs(1)),
+		PreRunE: func(c *cobra.Command, args []string) error {
+			authenticated, ok := c.Context().Value(contextKeyAuthenticated).(bool)
+			if !ok || !authenticated {
+				return protocol.Errorf(protocol.CodeNotAuthenticated, "not authenticated")
+			}
+			return nil
+		},
+		RunE: func(c *cobra.Command, args []string) error {
+			ns, err := namespace(c)
+			if err != nil {
+				return err
+			}
+
+			versions, err := s.ListVersions(c.Context(), ns, args[0])
+			if err != nil {
+				return err
+			}
+
+			if len(versions) == 0 {
+				return protocol.Errorf(protocol.CodeNotFound, "key not found")
+			}
+
+			revisions := make([]protocol.Revision, len(versions))
+			for i, v := range versions {
+				revisions[i] = protocol.Revision{
+					Version:   v.Version,
+					CreatedAt: v.CreatedAt,
+				}
+			}
+
+			b, err := json.Marshal(revisions)
+			if err != nil {
+				return fmt.Errorf("marshal revisions: %w", err)
+			}
+
+			c.OutOrStdout().Write(b)
+			return nil
+		},
+	}
+}
+
+func rollbackCmd(s *stores.TenantStore) *cobra.Command {
+	return &cobra.Command{
+		Use:  protocol.RollbackCommand,
+		Args: validArgs(cobra.ExactArgs(2)),
+		PreRunE: func(c *cobra.Command, args []string) error {
+			authenticated, ok := c.Context().Value(contextKeyAuthenticated).(bool)
+			if !ok || !authenticated {
+				return protocol.Errorf(protocol.CodeNotAuthenticated, "not authenticated")
+			}
+			return nil
+		},
+		RunE: func(c *cobra.Command, args []string) error {
+			ns, err := namespace(c)
+			if err != nil {
+				return err
+			}
+
+			version, err := strconv.Atoi(args[1])
+			if err != nil || version < 1 {
+				return protocol.Errorf(protocol.CodeInvalidArgument, "invalid version '%s'", args[1])
+			}
+
+			err = s.RollbackItem(c.Context(), ns, args[0], version)
+			if errors.Is(err, sql.ErrNoRows) {
+				return protocol.Errorf(protocol.CodeNotFound, "version not found")
+			}
+
+			return err
+		},
+	}
+}
+
+func replaceCmd(s *stores.TenantStore) *cobra.Command {
+	return &cobra.Command{
+		Use:  protocol.ReplaceCommand,
+		Args: validArgs(cobra.ExactArgs(2)),
+		PreRunE: func(c *cobra.Command, args []string) error {
+			authenticated, ok := c.Context().Value(contextKeyAuthenticated).(bool)
+			if !ok || !authenticated {
+				return protocol.Errorf(protocol.CodeNotAuthenticated, "not authenticated")
+			}
+			return nil
+		},
+		RunE: func(c *cobra.Command, args []string) error {
+			ns, err := namespace(c)
+			if err != nil {
+				return err
+			}
+
+			var replacement protocol.Replacement
+			if err := json.Unmarshal([]byte(args[1]), &replacement); err != nil {
+				return protocol.Errorf(protocol.CodeInvalidArgument, "invalid replacement: %s", err)
+			}
+
+			if replacement.Key == "" || len(replacement.Values) == 0 {
+				return protocol.Errorf(protocol.CodeInvalidArgument, "invalid replacement")
+			}
+
+			err = s.ReplaceItem(c.Context(), ns, args[0], &stores.Replacement{
+				Key:    replacement.Key,
+				Name:   replacement.Name,
+				Values: replacement.Values,
+			})
+			if errors.Is(err, sql.ErrNoRows) {
+				return protocol.Errorf(protocol.CodeNotFound, "key not found")
+			}
+			if errors.Is(err, stores.ErrStaleReplacement) {
+				return protocol.Errorf(protocol.CodeInvalidArgument, "%s", err)
+			}
+
+			return err
+		},
+	}
+}
+
 func registerCmd(s *stores.SystemStore) *cobra.Command {
 	return &cobra.Command{
 		Use:  "register",
-		Args: cobra.ExactArgs(0),
+		Args: validArgs(cobra.ExactArgs(0)),
 		PreRunE: func(c *cobra.Command, args []string) error {
 			authenticated, ok := c.Context().Value(contextKeyAuthenticated).(bool)
 			if ok && authenticated {
-				return fmt.Errorf("already registered")
+				return protocol.Errorf(protocol.CodeAlreadyExists, "already registered")
 			}
 			return nil
 		},
@@ -230,44 +847,244 @@ func registerCmd(s *stores.SystemStore) *cobra.Command {
 			// TODO: this needs to be passed from client/maybe username should just be email??
 			email := "nixpig@example.org"
 			if _, err := mail.ParseAddress(email); err != nil {
-				return fmt.Errorf("invalid email address")
+				return protocol.Errorf(protocol.CodeInvalidArgument, "invalid email address")
 			}
 
-			if _, err := s.CreateUser(&stores.User{
+			publicKey, ok := c.Context().Value(contextKeyPublicKey).(string)
+			if !ok {
+				return fmt.Errorf("failed to get public key")
+			}
+
+			userID, err := s.CreateUser(&stores.User{
 				Username:      username,
 				Email:         email,
 				PublicKeySHA1: publicKeyHash,
+				PublicKey:     publicKey,
 				Verified:      false,
-			}); err != nil {
+			})
+			if err != nil {
 				return err
 			}
 
+			// the session wasn't authenticated as the user it created, but
+			// registering them is audited for them
+			if sess, ok := c.Context().Value(ssh.ContextKeySession).(ssh.Session); ok {
+				sess.Context().SetValue(contextKeyUserID, userID)
+			}
+
 			return nil
 		},
 	}
 }
 
-// TODO: move this somewhere sensible!
-func tenantDB(publicKeyHash string) (*sql.DB, error) {
-	tenantDBDir := os.Getenv("SYRINGE_DB_TENANT_DIR")
-	tenantDBName := fmt.Sprintf("%x.db", publicKeyHash)
-	tenantDBPath := filepath.Join(tenantDBDir, tenantDBName)
+func publicKeyCmd(s *stores.SystemStore) *cobra.Command {
+	return &cobra.Command{
+		Use:  "publickey",
+		Args: validArgs(cobra.ExactArgs(1)),
+		PreRunE: func(c *cobra.Command, args []string) error {
+			authenticated, ok := c.Context().Value(contextKeyAuthenticated).(bool)
+			if !ok || !authenticated {
+				return protocol.Errorf(protocol.CodeNotAuthenticated, "not authenticated")
+			}
+			return nil
+		},
+		RunE: func(c *cobra.Command, args []string) error {
+			publicKeys, err := s.GetPublicKeys(args[0])
+			if err != nil {
+				return err
+			}
 
-	tenantDB, err := database.NewConnection(tenantDBPath)
-	if err != nil {
-		return nil, err
+			if len(publicKeys) == 0 {
+				return protocol.Errorf(
+					protocol.CodeNotFound,
+					"no public keys for user '%s'",
+					args[0],
+				)
+			}
+
+			c.OutOrStdout().Write([]byte(strings.Join(publicKeys, "\n")))
+			return nil
+		},
 	}
+}
 
-	migrator, err := database.NewMigration(tenantDB, database.TenantMigrations)
-	if err != nil {
-		return nil, err
+func addKeyCmd(s *stores.SystemStore) *cobra.Command {
+	addKeyCmd := &cobra.Command{
+		Use: protocol.AddKeyCommand,
+		// the key is a single arg over the protocol, or split into its type
+		// and base64 by clients that send commands as text
+		Args: validArgs(cobra.RangeArgs(1, 2)),
+		PreRunE: func(c *cobra.Command, args []string) error {
+			authenticated, ok := c.Context().Value(contextKeyAuthenticated).(bool)
+			if !ok || !authenticated {
+				return protocol.Errorf(protocol.CodeNotAuthenticated, "not authenticated")
+			}
+			return nil
+		},
+		RunE: func(c *cobra.Command, args []string) error {
+			username, ok := c.Context().Value(contextKeyUsername).(string)
+			if !ok {
+				return fmt.Errorf("failed to get username")
+			}
+
+			publicKey, _, _, _, err := gossh.ParseAuthorizedKey(
+				[]byte(strings.Join(args, " ")),
+			)
+			if err != nil {
+				return protocol.Errorf(protocol.CodeInvalidArgument, "invalid public key: %s", err)
+			}
+
+			sessionID, ok := c.Context().Value(ssh.ContextKeySessionID).(string)
+			if !ok {
+				return fmt.Errorf("failed to get session ID")
+			}
+
+			sessionIDBytes, err := hex.DecodeString(sessionID)
+			if err != nil {
+				return fmt.Errorf("decode session ID: %w", err)
+			}
+
+			// a key can only be added by a client that holds it, so a
+			// session can't add a key it was given
+			proof, _ := c.Flags().GetString(protocol.ProofFlag)
+
+			if err := syringessh.VerifyKeyProof(publicKey, sessionIDBytes, proof); err != nil {
+				return protocol.Errorf(protocol.CodeInvalidArgument, "%s", err)
+			}
+
+			publicKeyHash := fmt.Sprintf("%x", sha1.Sum(publicKey.Marshal()))
+
+			hasKey, err := s.HasPublicKey(username, publicKeyHash)
+			if err != nil {
+				return err
+			}
+
+			if hasKey {
+				return nil
+			}
+
+			return s.AddPublicKey(
+				username,
+				publicKeyHash,
+				strings.TrimSpace(string(gossh.MarshalAuthorizedKey(publicKey))),
+			)
+		},
 	}
 
-	if err := migrator.Up(); err != nil {
-		if !errors.Is(err, migrate.ErrNoChange) {
-			return nil, err
-		}
+	addKeyCmd.Flags().String(protocol.ProofFlag, "", "Signature of the session ID by the key")
+
+	return addKeyCmd
+}
+
+// maxAuditEvents is the most events the audit command returns.
+const maxAuditEvents = 1000
+
+func auditCmd(s *stores.SystemStore) *cobra.Command {
+	auditCmd := &cobra.Command{
+		Use:  protocol.AuditCommand,
+		Args: validArgs(cobra.ExactArgs(0)),
+		PreRunE: func(c *cobra.Command, args []string) error {
+			authenticated, ok := c.Context().Value(contextKeyAuthenticated).(bool)
+			if !ok || !authenticated {
+				return protocol.Errorf(protocol.CodeNotAuthenticated, "not authenticated")
+			}
+			return nil
+		},
+		RunE: func(c *cobra.Command, args []string) error {
+			userID, ok := c.Context().Value(contextKeyUserID).(int)
+			if !ok {
+				return fmt.Errorf("failed to get user")
+			}
+
+			sinceFlag, err := c.Flags().GetString(protocol.SinceFlag)
+			if err != nil {
+				return err
+			}
+
+			var since time.Time
+			if sinceFlag != "" {
+				since, err = time.Parse(time.RFC3339, sinceFlag)
+				if err != nil {
+					return protocol.Errorf(protocol.CodeInvalidArgument, "invalid time '%s'", sinceFlag)
+				}
+			}
+
+			action, err := c.Flags().GetString(protocol.ActionFlag)
+			if err != nil {
+				return err
+			}
+
+			events, err := s.ListAuditEvents(userID, since, action, maxAuditEvents)
+			if err != nil {
+				return err
+			}
+
+			auditEvents := make([]protocol.AuditEvent, len(events))
+			for i, e := range events {
+				auditEvents[i] = protocol.AuditEvent{
+					Timestamp: e.Timestamp,
+					Action:    e.Action,
+					Status:    e.Status,
+					Address:   e.Address,
+					Client:    e.Client,
+					Username:  e.Username,
+					PublicKey: e.PublicKey,
+					KeyID:     e.KeyID,
+				}
+			}
+
+			b, err := json.Marshal(auditEvents)
+			if err != nil {
+				return fmt.Errorf("marshal audit events: %w", err)
+			}
+
+			c.OutOrStdout().Write(b)
+			return nil
+		},
 	}
 
-	return tenantDB, nil
+	auditCmd.Flags().String(protocol.SinceFlag, "", "Earliest time of events, in RFC 3339 format")
+	auditCmd.Flags().String(protocol.ActionFlag, "", "Only list events of the command")
+
+	return auditCmd
+}
+
+func capabilitiesCmd() *cobra.Command {
+	return &cobra.Command{
+		Use:  protocol.CapabilitiesCommand,
+		Args: validArgs(cobra.ExactArgs(0)),
+		RunE: func(c *cobra.Command, args []string) error {
+			b, err := json.Marshal(&protocol.Capabilities{
+				Version:   version.Version,
+				Protocols: []int{protocol.Version},
+				Features: []string{
+					protocol.FeatureSubsystem,
+					protocol.FeatureHiddenKeys,
+					protocol.FeaturePublicKeys,
+					protocol.FeatureNamespaces,
+					protocol.FeatureHistory,
+					protocol.FeatureExpiry,
+					protocol.FeatureMetadata,
+					protocol.FeatureAudit,
+					protocol.FeatureReplace,
+					protocol.FeatureKeyProof,
+				},
+			})
+			if err != nil {
+				return fmt.Errorf("marshal capabilities: %w", err)
+			}
+
+			c.OutOrStdout().Write(b)
+			return nil
+		},
+	}
+}
+
+// TODO: move this somewhere sensible!
+func tenantDB(publicKeyHash string) (*sql.DB, error) {
+	tenantDBDir := os.Getenv("SYRINGE_DB_TENANT_DIR")
+	tenantDBName := fmt.Sprintf("%x.db", publicKeyHash)
+	tenantDBPath := filepath.Join(tenantDBDir, tenantDBName)
+
+	return database.NewTenantConnection(tenantDBPath)
 }
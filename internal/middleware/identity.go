@@ -3,30 +3,64 @@ package middleware
 import (
 	"crypto/sha1"
 	"fmt"
+	"strings"
 
 	"github.com/charmbracelet/log"
 	"github.com/charmbracelet/ssh"
 	"github.com/charmbracelet/wish"
 	"github.com/nixpig/syringe.sh/internal/stores"
+	gossh "golang.org/x/crypto/ssh"
 )
 
 var contextKeyHash = struct{ string }{"publicKeyHash"}
 var contextKeyEmail = struct{ string }{"email"}
 var contextKeyAuthenticated = struct{ string }{"authenticated"}
 var contextKeyUsername = struct{ string }{"username"}
+var contextKeyPublicKey = struct{ string }{"publicKey"}
+var contextKeyTenant = struct{ string }{"tenant"}
+var contextKeyUserID = struct{ string }{"userID"}
 
 func NewIdentityMiddleware(s *stores.SystemStore) wish.Middleware {
 	return func(next ssh.Handler) ssh.Handler {
 		return func(sess ssh.Session) {
-			publicKeyHash := fmt.Sprintf("%x", sha1.Sum(sess.PublicKey().Marshal()))
+			// a certificate's key is the user's key, which values are
+			// encrypted for, and the certificate itself is short-lived
+			publicKey := sess.PublicKey()
+			cert, isCert := publicKey.(*gossh.Certificate)
+			if isCert {
+				publicKey = cert.Key
+			}
+
+			publicKeyHash := fmt.Sprintf("%x", sha1.Sum(publicKey.Marshal()))
 			sess.Context().SetValue(contextKeyHash, publicKeyHash)
+			sess.Context().SetValue(
+				contextKeyPublicKey,
+				strings.TrimSpace(string(gossh.MarshalAuthorizedKey(publicKey))),
+			)
 
+			// a user's store is tied to the first key they registered, so any
+			// key added since accesses the same store. A certificate was
+			// checked for the username as a principal when authenticating, so
+			// vouches for the user whichever key it's for.
 			authenticated := false
+			tenant := publicKeyHash
 			user, err := s.GetUser(sess.Context().User())
-			if err == nil && user != nil && user.PublicKeySHA1 == publicKeyHash {
-				authenticated = true
+			if err == nil && user != nil {
+				hasKey := isCert
+				if !hasKey {
+					hasKey, err = s.HasPublicKey(user.Username, publicKeyHash)
+				}
+
+				// only authenticated sessions are audited for the user, so
+				// anyone can't fill their audit log by claiming to be them
+				if err == nil && hasKey {
+					authenticated = true
+					tenant = user.PublicKeySHA1
+					sess.Context().SetValue(contextKeyUserID, user.ID)
+				}
 			}
 			sess.Context().SetValue(contextKeyAuthenticated, authenticated)
+			sess.Context().SetValue(contextKeyTenant, tenant)
 
 			log.Debug("authenticate", "authenticated", authenticated)
 
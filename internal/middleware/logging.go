@@ -5,6 +5,7 @@ import (
 
 	"github.com/charmbracelet/log"
 	"github.com/charmbracelet/ssh"
+	gossh "golang.org/x/crypto/ssh"
 )
 
 func LoggingMiddleware(next ssh.Handler) ssh.Handler {
@@ -14,8 +15,7 @@ func LoggingMiddleware(next ssh.Handler) ssh.Handler {
 			command = sess.Command()[0]
 		}
 
-		log.Info(
-			"connect",
+		keyvals := []any{
 			"session", sess.Context().SessionID(),
 			"command", command,
 			"user", sess.Context().User(),
@@ -23,7 +23,13 @@ func LoggingMiddleware(next ssh.Handler) ssh.Handler {
 			"public", sess.PublicKey() != nil,
 			"client", sess.Context().ClientVersion(),
 			"publicKeyType", sess.PublicKey().Type(),
-		)
+		}
+
+		if cert, ok := sess.PublicKey().(*gossh.Certificate); ok {
+			keyvals = append(keyvals, "keyId", cert.KeyId, "serial", cert.Serial)
+		}
+
+		log.Info("connect", keyvals...)
 
 		now := time.Now()
 
@@ -0,0 +1,103 @@
+// Package reaper removes expired items from the tenant databases, so values
+// given a TTL are deleted even if they're never read again.
+package reaper
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"time"
+
+	"github.com/charmbracelet/log"
+	"github.com/nixpig/syringe.sh/database"
+	"github.com/nixpig/syringe.sh/internal/stores"
+)
+
+// Reaper removes expired items from each tenant database in a directory.
+type Reaper struct {
+	dir      string
+	interval time.Duration
+
+	// migrated is the databases migrated by the reaper, so each is only
+	// migrated the first time it's reaped
+	migrated map[string]bool
+}
+
+// New returns a reaper of the tenant databases in dir, that reaps every
+// interval when run.
+func New(dir string, interval time.Duration) *Reaper {
+	return &Reaper{
+		dir:      dir,
+		interval: interval,
+		migrated: map[string]bool{},
+	}
+}
+
+// Run reaps every interval until ctx is done.
+func (r *Reaper) Run(ctx context.Context) {
+	ticker := time.NewTicker(r.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+
+		case <-ticker.C:
+			removed, err := r.Reap(ctx)
+			if err != nil {
+				log.Error("reap expired items", "err", err)
+			}
+
+			if removed > 0 {
+				log.Info("reaped expired items", "removed", removed)
+			}
+		}
+	}
+}
+
+// Reap removes the items that have expired from each tenant database,
+// returning how many were removed. A database that can't be reaped doesn't
+// stop the others being reaped. It isn't safe for concurrent use.
+func (r *Reaper) Reap(ctx context.Context) (int64, error) {
+	paths, err := filepath.Glob(filepath.Join(r.dir, "*.db"))
+	if err != nil {
+		return 0, fmt.Errorf("find tenant databases: %w", err)
+	}
+
+	var removed int64
+	var errs []error
+
+	for _, path := range paths {
+		n, err := r.reap(ctx, path)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("reap '%s': %w", filepath.Base(path), err))
+		}
+
+		removed += n
+	}
+
+	return removed, errors.Join(errs...)
+}
+
+// reap removes the items that have expired from the tenant database, which
+// is migrated first if the reaper hasn't already, in case it was created by
+// an older server.
+func (r *Reaper) reap(ctx context.Context, path string) (int64, error) {
+	connect := database.NewConnection
+	if !r.migrated[path] {
+		connect = database.NewTenantConnection
+	}
+
+	db, err := connect(path)
+	if err != nil {
+		return 0, err
+	}
+	defer db.Close()
+
+	r.migrated[path] = true
+
+	// retention doesn't matter, since nothing is set
+	return stores.NewTenantStore(db, 0).RemoveExpiredItems(ctx, time.Now())
+}
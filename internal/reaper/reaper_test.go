@@ -0,0 +1,160 @@
+package reaper_test
+
+import (
+	"context"
+	"database/sql"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/nixpig/syringe.sh/database"
+	"github.com/nixpig/syringe.sh/internal/reaper"
+	"github.com/nixpig/syringe.sh/internal/stores"
+	"github.com/stretchr/testify/require"
+)
+
+func TestReaper(t *testing.T) {
+	dir := t.TempDir()
+
+	past := time.Now().Add(-time.Minute)
+	future := time.Now().Add(time.Hour)
+
+	alice := newTenantStore(t, filepath.Join(dir, "alice.db"))
+	bob := newTenantStore(t, filepath.Join(dir, "bob.db"))
+
+	ctx := context.Background()
+	ns := stores.DefaultNamespace
+
+	for _, item := range []*stores.Item{
+		{Key: "expired", Value: "a", ExpiresAt: &past},
+		{Key: "expiring", Value: "b", ExpiresAt: &future},
+		{Key: "forever", Value: "c"},
+	} {
+		require.NoError(t, alice.SetItem(ctx, ns, item))
+	}
+
+	require.NoError(t, bob.SetItem(ctx, ns, &stores.Item{
+		Key:       "expired",
+		Value:     "d",
+		ExpiresAt: &past,
+	}))
+
+	// expired items can't be read before they're reaped
+	_, err := alice.GetItemByKey(ctx, ns, "expired")
+	require.ErrorIs(t, err, sql.ErrNoRows)
+
+	// other files in the directory are left alone
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "notes.txt"), nil, 0644))
+
+	removed, err := reaper.New(dir, time.Minute).Reap(ctx)
+	require.NoError(t, err)
+	require.Equal(t, int64(2), removed)
+
+	items, err := alice.ListItems(ctx, ns, "")
+	require.NoError(t, err)
+	require.Len(t, items, 2)
+	require.Equal(t, "expiring", items[0].Key)
+	require.WithinDuration(t, future, *items[0].ExpiresAt, time.Second)
+	require.Equal(t, "forever", items[1].Key)
+	require.Nil(t, items[1].ExpiresAt)
+
+	removed, err = reaper.New(dir, time.Minute).Reap(ctx)
+	require.NoError(t, err)
+	require.Zero(t, removed)
+}
+
+func TestReaperLocked(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "alice.db")
+
+	past := time.Now().Add(-time.Minute)
+
+	ctx := context.Background()
+
+	require.NoError(t, newTenantStore(t, path).SetItem(ctx, stores.DefaultNamespace, &stores.Item{
+		Key:       "expired",
+		Value:     "a",
+		ExpiresAt: &past,
+	}))
+
+	r := reaper.New(dir, time.Minute)
+
+	_, err := r.Reap(ctx)
+	require.NoError(t, err)
+
+	db, err := database.NewConnection(path)
+	require.NoError(t, err)
+	t.Cleanup(func() { db.Close() })
+
+	// a session holds the write lock for a moment, which the reaper waits for
+	tx, err := db.BeginTx(ctx, nil)
+	require.NoError(t, err)
+
+	_, err = tx.Exec("delete from store_ where key_ = 'missing'")
+	require.NoError(t, err)
+
+	time.AfterFunc(200*time.Millisecond, func() { tx.Commit() })
+
+	_, err = r.Reap(ctx)
+	require.NoError(t, err)
+}
+
+func TestReaperMigratesWithSessions(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "alice.db")
+
+	// the database is created by a session, which the reaper finds while
+	// sessions are still migrating it
+	require.NoError(t, os.WriteFile(path, nil, 0644))
+
+	ctx := context.Background()
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 8)
+
+	for range 4 {
+		wg.Add(1)
+
+		go func() {
+			defer wg.Done()
+
+			db, err := database.NewTenantConnection(path)
+			if err == nil {
+				db.Close()
+			}
+
+			errs <- err
+		}()
+	}
+
+	wg.Add(1)
+
+	go func() {
+		defer wg.Done()
+
+		_, err := reaper.New(dir, time.Minute).Reap(ctx)
+		errs <- err
+	}()
+
+	wg.Wait()
+	close(errs)
+
+	for err := range errs {
+		require.NoError(t, err)
+	}
+
+	require.NoError(t, newTenantStore(t, path).SetItem(ctx, stores.DefaultNamespace, &stores.Item{
+		Key:   "foo",
+		Value: "bar",
+	}))
+}
+
+func newTenantStore(t *testing.T, path string) *stores.TenantStore {
+	db, err := database.NewTenantConnection(path)
+	require.NoError(t, err)
+	t.Cleanup(func() { db.Close() })
+
+	return stores.NewTenantStore(db, 0)
+}
@@ -1,15 +1,82 @@
 package stores
 
+import "time"
+
 type Item struct {
 	ID    int
 	Key   string
 	Value string
+	// Name is the encrypted key name, when the key is a hash hiding the name.
+	Name string
+	// Version counts the values the key has had, starting from 1.
+	Version int
+	// ExpiresAt is when the item expires, or nil if it doesn't.
+	ExpiresAt *time.Time
+	// Description says what the item is for.
+	Description string
+	// Tags label the item, so items can be listed by tag.
+	Tags []string
+	// CreatedAt is when the key was first set, and UpdatedAt when it was
+	// last set.
+	CreatedAt time.Time
+	UpdatedAt time.Time
+}
+
+// ItemVersion is a value a key has had, which is kept so it can be read or
+// rolled back to.
+type ItemVersion struct {
+	Version   int
+	CreatedAt time.Time
+}
+
+// Replacement is a key's values re-encrypted, by version, and the key and
+// encrypted name it's moved to, which are the same unless the key is hidden.
+type Replacement struct {
+	Key    string
+	Name   string
+	Values map[int]string
 }
 
+// Namespace is a project and one of its environments, so the same key can
+// have a value in each.
+type Namespace struct {
+	Project     string
+	Environment string
+}
+
+// DefaultNamespace is the namespace when none is given, which items stored
+// before namespaces were added are in.
+var DefaultNamespace = Namespace{Project: "default", Environment: "default"}
+
 type User struct {
 	ID            int
 	Username      string
 	Email         string
 	Verified      bool
 	PublicKeySHA1 string
+	PublicKey     string
+}
+
+// AuditEvent is a command run in a session, or an attempt to run one.
+type AuditEvent struct {
+	ID        int
+	Session   string
+	Timestamp time.Time
+	Action    string
+	// Status is "success", or the code of the error the command failed with.
+	Status  string
+	Address string
+	Client  string
+	// Username is the username the session was for, which may not be
+	// registered.
+	Username string
+	// PublicKey is the SHA256 fingerprint of the key the session was
+	// authenticated with.
+	PublicKey string
+	// KeyID is the key ID of the certificate the session was authenticated
+	// with, or empty if it wasn't a certificate.
+	KeyID string
+	// UserID is the ID of the user registered with the username, or 0 if
+	// there isn't one.
+	UserID int
 }
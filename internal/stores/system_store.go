@@ -3,7 +3,9 @@ package stores
 import (
 	"database/sql"
 	"fmt"
+	"slices"
 	"sync"
+	"time"
 )
 
 type SystemStore struct {
@@ -20,7 +22,8 @@ func NewSystemStore(db *sql.DB) *SystemStore {
 
 func (s *SystemStore) GetUser(username string) (*User, error) {
 	query := `select u.id_, u.username_, u.email_, u.verified_, k.public_key_sha1_
-		from users_ u inner join public_keys_ k on u.id_ = k.user_id_ where u.username_ = $username`
+		from users_ u inner join public_keys_ k on u.id_ = k.user_id_ where u.username_ = $username
+		order by k.id_ limit 1`
 
 	row := s.db.QueryRow(
 		query,
@@ -66,11 +69,12 @@ func (s *SystemStore) CreateUser(user *User) (int, error) {
 		return 0, fmt.Errorf("scan user id: %w", err)
 	}
 
-	keyQuery := `insert into public_keys_ (public_key_sha1_, user_id_)
-		values ($publicKeySHA1, $userID)`
+	keyQuery := `insert into public_keys_ (public_key_sha1_, public_key_, user_id_)
+		values ($publicKeySHA1, $publicKey, $userID)`
 	if _, err := tx.Exec(
 		keyQuery,
 		sql.Named("publicKeySHA1", user.PublicKeySHA1),
+		sql.Named("publicKey", user.PublicKey),
 		sql.Named("userID", userID),
 	); err != nil {
 		return 0, fmt.Errorf("create public key: %w", err)
@@ -82,3 +86,146 @@ func (s *SystemStore) CreateUser(user *User) (int, error) {
 
 	return userID, nil
 }
+
+func (s *SystemStore) HasPublicKey(username, publicKeySHA1 string) (bool, error) {
+	query := `select count(*) from public_keys_ k
+		inner join users_ u on u.id_ = k.user_id_
+		where u.username_ = $username and k.public_key_sha1_ = $publicKeySHA1`
+
+	row := s.db.QueryRow(
+		query,
+		sql.Named("username", username),
+		sql.Named("publicKeySHA1", publicKeySHA1),
+	)
+
+	var count int
+
+	if err := row.Scan(&count); err != nil {
+		return false, fmt.Errorf("scan public key count: %w", err)
+	}
+
+	return count > 0, nil
+}
+
+func (s *SystemStore) AddPublicKey(username, publicKeySHA1, publicKey string) error {
+	query := `insert into public_keys_ (public_key_sha1_, public_key_, user_id_)
+		select $publicKeySHA1, $publicKey, id_ from users_ where username_ = $username`
+
+	result, err := s.db.Exec(
+		query,
+		sql.Named("publicKeySHA1", publicKeySHA1),
+		sql.Named("publicKey", publicKey),
+		sql.Named("username", username),
+	)
+	if err != nil {
+		return fmt.Errorf("add public key: %w", err)
+	}
+
+	if n, err := result.RowsAffected(); err != nil || n == 0 {
+		return fmt.Errorf("add public key: no user '%s'", username)
+	}
+
+	return nil
+}
+
+func (s *SystemStore) GetPublicKeys(username string) ([]string, error) {
+	query := `select k.public_key_ from public_keys_ k
+		inner join users_ u on u.id_ = k.user_id_
+		where u.username_ = $username and k.public_key_ is not null`
+
+	rows, err := s.db.Query(query, sql.Named("username", username))
+	if err != nil {
+		return nil, fmt.Errorf("get public keys from database: %w", err)
+	}
+	defer rows.Close()
+
+	var publicKeys []string
+
+	for rows.Next() {
+		var publicKey string
+
+		if err := rows.Scan(&publicKey); err != nil {
+			return nil, fmt.Errorf("scan public key: %w", err)
+		}
+
+		publicKeys = append(publicKeys, publicKey)
+	}
+
+	return publicKeys, nil
+}
+
+func (s *SystemStore) AddAuditEvent(event *AuditEvent) error {
+	query := `insert into audit_ (session_, timestamp_, action_, status_, address_, client_, username_, public_key_, key_id_, user_id_)
+		values ($session, $timestamp, $action, $status, $address, $client, $username, $publicKey, $keyID, nullif($userID, 0))`
+
+	if _, err := s.db.Exec(
+		query,
+		sql.Named("session", event.Session),
+		sql.Named("timestamp", event.Timestamp.UTC()),
+		sql.Named("action", event.Action),
+		sql.Named("status", event.Status),
+		sql.Named("address", event.Address),
+		sql.Named("client", event.Client),
+		sql.Named("username", event.Username),
+		sql.Named("publicKey", event.PublicKey),
+		sql.Named("keyID", event.KeyID),
+		sql.Named("userID", event.UserID),
+	); err != nil {
+		return fmt.Errorf("add audit event: %w", err)
+	}
+
+	return nil
+}
+
+// ListAuditEvents returns the latest events of the user since the time, up to
+// the limit, oldest first. Only events of the action are returned, unless it's
+// empty.
+func (s *SystemStore) ListAuditEvents(
+	userID int,
+	since time.Time,
+	action string,
+	limit int,
+) ([]AuditEvent, error) {
+	query := `select id_, session_, timestamp_, action_, status_, address_, client_, username_, public_key_, key_id_
+		from audit_ where user_id_ = $userID and timestamp_ >= $since and ($action = '' or action_ = $action)
+		order by id_ desc limit $limit`
+
+	rows, err := s.db.Query(
+		query,
+		sql.Named("userID", userID),
+		sql.Named("since", since.UTC()),
+		sql.Named("action", action),
+		sql.Named("limit", limit),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("get audit events from database: %w", err)
+	}
+	defer rows.Close()
+
+	var events []AuditEvent
+
+	for rows.Next() {
+		event := AuditEvent{UserID: userID}
+
+		if err := rows.Scan(
+			&event.ID,
+			&event.Session,
+			&event.Timestamp,
+			&event.Action,
+			&event.Status,
+			&event.Address,
+			&event.Client,
+			&event.Username,
+			&event.PublicKey,
+			&event.KeyID,
+		); err != nil {
+			return nil, fmt.Errorf("scan audit event: %w", err)
+		}
+
+		events = append(events, event)
+	}
+
+	slices.Reverse(events)
+
+	return events, nil
+}
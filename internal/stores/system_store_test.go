@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"regexp"
 	"testing"
+	"time"
 
 	"github.com/DATA-DOG/go-sqlmock"
 	"github.com/nixpig/syringe.sh/internal/stores"
@@ -13,26 +14,57 @@ import (
 
 const (
 	getUserQuery = `select u.id_, u.username_, u.email_, u.verified_, k.public_key_sha1_
-		from users_ u inner join public_keys_ k on u.id_ = k.user_id_ where u.username_ = $username`
+		from users_ u inner join public_keys_ k on u.id_ = k.user_id_ where u.username_ = $username
+		order by k.id_ limit 1`
 	createUserQuery = `insert into users_ (username_, email_, verified_)
 		values ($username, $email, $verified) returning id_`
-	createKeyQuery = `insert into public_keys_ (public_key_sha1_, user_id_)
-		values ($publicKeySHA1, $userID)`
+	createKeyQuery = `insert into public_keys_ (public_key_sha1_, public_key_, user_id_)
+		values ($publicKeySHA1, $publicKey, $userID)`
+	hasPublicKeyQuery = `select count(*) from public_keys_ k
+		inner join users_ u on u.id_ = k.user_id_
+		where u.username_ = $username and k.public_key_sha1_ = $publicKeySHA1`
+	addPublicKeyQuery = `insert into public_keys_ (public_key_sha1_, public_key_, user_id_)
+		select $publicKeySHA1, $publicKey, id_ from users_ where username_ = $username`
+	getPublicKeysQuery = `select k.public_key_ from public_keys_ k
+		inner join users_ u on u.id_ = k.user_id_
+		where u.username_ = $username and k.public_key_ is not null`
+	addAuditEventQuery = `insert into audit_ (session_, timestamp_, action_, status_, address_, client_, username_, public_key_, key_id_, user_id_)
+		values ($session, $timestamp, $action, $status, $address, $client, $username, $publicKey, $keyID, nullif($userID, 0))`
+	listAuditEventsQuery = `select id_, session_, timestamp_, action_, status_, address_, client_, username_, public_key_, key_id_
+		from audit_ where user_id_ = $userID and timestamp_ >= $since and ($action = '' or action_ = $action)
+		order by id_ desc limit $limit`
 )
 
+var auditColumns = []string{
+	"id_", "session_", "timestamp_", "action_", "status_", "address_", "client_", "username_", "public_key_", "key_id_",
+}
+
 func TestSystemStore(t *testing.T) {
 	scenarios := map[string]func(
 		t *testing.T,
 		store *stores.SystemStore,
 		mock sqlmock.Sqlmock,
 	){
-		"get user from system store (success)":          testGetUserFromSystemStoreSuccess,
-		"get user from system store (no user)":          testGetUserFromSystemStoreNoUser,
-		"create user in system store (success)":         testCreateUserInSystemStoreSuccess,
-		"create user in system store (user error)":      testCreateUserInSystemStoreUserErr,
-		"create user in system store (key error)":       testCreateUserInSystemStoreKeyErr,
-		"create user in system store (tx begin error)":  testCreateUserInSystemStoreTXBeginErr,
-		"create user in system store (tx commit error)": testCreateUserInSystemStoreTXCommitErr,
+		"get user from system store (success)":           testGetUserFromSystemStoreSuccess,
+		"get user from system store (no user)":           testGetUserFromSystemStoreNoUser,
+		"create user in system store (success)":          testCreateUserInSystemStoreSuccess,
+		"create user in system store (user error)":       testCreateUserInSystemStoreUserErr,
+		"create user in system store (key error)":        testCreateUserInSystemStoreKeyErr,
+		"create user in system store (tx begin error)":   testCreateUserInSystemStoreTXBeginErr,
+		"create user in system store (tx commit error)":  testCreateUserInSystemStoreTXCommitErr,
+		"has public key in system store (registered)":    testHasPublicKeyInSystemStoreRegistered,
+		"has public key in system store (unregistered)":  testHasPublicKeyInSystemStoreUnregistered,
+		"add public key to system store (success)":       testAddPublicKeyToSystemStoreSuccess,
+		"add public key to system store (no user)":       testAddPublicKeyToSystemStoreNoUser,
+		"get public keys from system store (success)":    testGetPublicKeysFromSystemStoreSuccess,
+		"get public keys from system store (no keys)":    testGetPublicKeysFromSystemStoreNoKeys,
+		"get public keys from system store (db error)":   testGetPublicKeysFromSystemStoreDBErr,
+		"add audit event to system store (success)":      testAddAuditEventToSystemStoreSuccess,
+		"add audit event to system store (no user)":      testAddAuditEventToSystemStoreNoUser,
+		"add audit event to system store (db error)":     testAddAuditEventToSystemStoreDBErr,
+		"list audit events from system store (success)":  testListAuditEventsFromSystemStoreSuccess,
+		"list audit events from system store (action)":   testListAuditEventsFromSystemStoreAction,
+		"list audit events from system store (db error)": testListAuditEventsFromSystemStoreDBErr,
 	}
 
 	for scenario, fn := range scenarios {
@@ -273,3 +305,327 @@ func testCreateUserInSystemStoreTXCommitErr(
 	require.Equal(t, 0, userID)
 	require.NoError(t, mock.ExpectationsWereMet())
 }
+
+func testGetPublicKeysFromSystemStoreSuccess(
+	t *testing.T,
+	store *stores.SystemStore,
+	mock sqlmock.Sqlmock,
+) {
+	mock.ExpectQuery(
+		regexp.QuoteMeta(getPublicKeysQuery),
+	).WithArgs(
+		sql.Named("username", "janedoe"),
+	).WillReturnRows(
+		sqlmock.
+			NewRows([]string{"public_key_"}).
+			AddRow("ssh-ed25519 AAAA").
+			AddRow("ssh-rsa BBBB"),
+	)
+
+	publicKeys, err := store.GetPublicKeys("janedoe")
+
+	require.NoError(t, err)
+	require.NoError(t, mock.ExpectationsWereMet())
+	require.Equal(t, []string{"ssh-ed25519 AAAA", "ssh-rsa BBBB"}, publicKeys)
+}
+
+func testGetPublicKeysFromSystemStoreNoKeys(
+	t *testing.T,
+	store *stores.SystemStore,
+	mock sqlmock.Sqlmock,
+) {
+	mock.ExpectQuery(
+		regexp.QuoteMeta(getPublicKeysQuery),
+	).WithArgs(
+		sql.Named("username", "janedoe"),
+	).WillReturnRows(sqlmock.NewRows([]string{"public_key_"}))
+
+	publicKeys, err := store.GetPublicKeys("janedoe")
+
+	require.NoError(t, err)
+	require.NoError(t, mock.ExpectationsWereMet())
+	require.Empty(t, publicKeys)
+}
+
+func testGetPublicKeysFromSystemStoreDBErr(
+	t *testing.T,
+	store *stores.SystemStore,
+	mock sqlmock.Sqlmock,
+) {
+	mock.ExpectQuery(
+		regexp.QuoteMeta(getPublicKeysQuery),
+	).WithArgs(
+		sql.Named("username", "janedoe"),
+	).WillReturnError(fmt.Errorf("db_err"))
+
+	publicKeys, err := store.GetPublicKeys("janedoe")
+
+	require.Error(t, err)
+	require.NoError(t, mock.ExpectationsWereMet())
+	require.Nil(t, publicKeys)
+}
+
+func testHasPublicKeyInSystemStoreRegistered(
+	t *testing.T,
+	store *stores.SystemStore,
+	mock sqlmock.Sqlmock,
+) {
+	mock.ExpectQuery(
+		regexp.QuoteMeta(hasPublicKeyQuery),
+	).WithArgs(
+		sql.Named("username", "janedoe"),
+		sql.Named("publicKeySHA1", "some_public_key"),
+	).WillReturnRows(sqlmock.NewRows([]string{"count(*)"}).AddRow(1))
+
+	hasKey, err := store.HasPublicKey("janedoe", "some_public_key")
+
+	require.NoError(t, err)
+	require.NoError(t, mock.ExpectationsWereMet())
+	require.True(t, hasKey)
+}
+
+func testHasPublicKeyInSystemStoreUnregistered(
+	t *testing.T,
+	store *stores.SystemStore,
+	mock sqlmock.Sqlmock,
+) {
+	mock.ExpectQuery(
+		regexp.QuoteMeta(hasPublicKeyQuery),
+	).WithArgs(
+		sql.Named("username", "janedoe"),
+		sql.Named("publicKeySHA1", "some_public_key"),
+	).WillReturnRows(sqlmock.NewRows([]string{"count(*)"}).AddRow(0))
+
+	hasKey, err := store.HasPublicKey("janedoe", "some_public_key")
+
+	require.NoError(t, err)
+	require.NoError(t, mock.ExpectationsWereMet())
+	require.False(t, hasKey)
+}
+
+func testAddPublicKeyToSystemStoreSuccess(
+	t *testing.T,
+	store *stores.SystemStore,
+	mock sqlmock.Sqlmock,
+) {
+	mock.ExpectExec(
+		regexp.QuoteMeta(addPublicKeyQuery),
+	).WithArgs(
+		sql.Named("publicKeySHA1", "some_public_key"),
+		sql.Named("publicKey", "ssh-ed25519 AAAA"),
+		sql.Named("username", "janedoe"),
+	).WillReturnResult(sqlmock.NewResult(2, 1))
+
+	err := store.AddPublicKey("janedoe", "some_public_key", "ssh-ed25519 AAAA")
+
+	require.NoError(t, err)
+	require.NoError(t, mock.ExpectationsWereMet())
+}
+
+func testAddPublicKeyToSystemStoreNoUser(
+	t *testing.T,
+	store *stores.SystemStore,
+	mock sqlmock.Sqlmock,
+) {
+	mock.ExpectExec(
+		regexp.QuoteMeta(addPublicKeyQuery),
+	).WithArgs(
+		sql.Named("publicKeySHA1", "some_public_key"),
+		sql.Named("publicKey", "ssh-ed25519 AAAA"),
+		sql.Named("username", "janedoe"),
+	).WillReturnResult(sqlmock.NewResult(0, 0))
+
+	err := store.AddPublicKey("janedoe", "some_public_key", "ssh-ed25519 AAAA")
+
+	require.Error(t, err)
+	require.NoError(t, mock.ExpectationsWereMet())
+}
+
+func testAddAuditEventToSystemStoreSuccess(
+	t *testing.T,
+	store *stores.SystemStore,
+	mock sqlmock.Sqlmock,
+) {
+	timestamp := time.Date(2024, 5, 1, 12, 0, 0, 0, time.FixedZone("BST", 3600))
+
+	mock.ExpectExec(
+		regexp.QuoteMeta(addAuditEventQuery),
+	).WithArgs(
+		sql.Named("session", "some_session"),
+		sql.Named("timestamp", timestamp.UTC()),
+		sql.Named("action", "get"),
+		sql.Named("status", "success"),
+		sql.Named("address", "192.0.2.1"),
+		sql.Named("client", "SSH-2.0-syringe_1.0.0"),
+		sql.Named("username", "janedoe"),
+		sql.Named("publicKey", "SHA256:some_fingerprint"),
+		sql.Named("keyID", "janedoe@example.org"),
+		sql.Named("userID", 23),
+	).WillReturnResult(sqlmock.NewResult(1, 1))
+
+	err := store.AddAuditEvent(&stores.AuditEvent{
+		Session:   "some_session",
+		Timestamp: timestamp,
+		Action:    "get",
+		Status:    "success",
+		Address:   "192.0.2.1",
+		Client:    "SSH-2.0-syringe_1.0.0",
+		Username:  "janedoe",
+		PublicKey: "SHA256:some_fingerprint",
+		KeyID:     "janedoe@example.org",
+		UserID:    23,
+	})
+
+	require.NoError(t, err)
+	require.NoError(t, mock.ExpectationsWereMet())
+}
+
+func testAddAuditEventToSystemStoreNoUser(
+	t *testing.T,
+	store *stores.SystemStore,
+	mock sqlmock.Sqlmock,
+) {
+	timestamp := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+
+	// the user isn't registered, so the event has no user ID
+	mock.ExpectExec(
+		regexp.QuoteMeta(addAuditEventQuery),
+	).WithArgs(
+		sql.Named("session", "some_session"),
+		sql.Named("timestamp", timestamp),
+		sql.Named("action", "set"),
+		sql.Named("status", "not_authenticated"),
+		sql.Named("address", "192.0.2.1"),
+		sql.Named("client", "SSH-2.0-syringe_1.0.0"),
+		sql.Named("username", "nobody"),
+		sql.Named("publicKey", "SHA256:some_fingerprint"),
+		sql.Named("keyID", ""),
+		sql.Named("userID", 0),
+	).WillReturnResult(sqlmock.NewResult(1, 1))
+
+	err := store.AddAuditEvent(&stores.AuditEvent{
+		Session:   "some_session",
+		Timestamp: timestamp,
+		Action:    "set",
+		Status:    "not_authenticated",
+		Address:   "192.0.2.1",
+		Client:    "SSH-2.0-syringe_1.0.0",
+		Username:  "nobody",
+		PublicKey: "SHA256:some_fingerprint",
+	})
+
+	require.NoError(t, err)
+	require.NoError(t, mock.ExpectationsWereMet())
+}
+
+func testAddAuditEventToSystemStoreDBErr(
+	t *testing.T,
+	store *stores.SystemStore,
+	mock sqlmock.Sqlmock,
+) {
+	mock.ExpectExec(
+		regexp.QuoteMeta(addAuditEventQuery),
+	).WillReturnError(fmt.Errorf("db_err"))
+
+	err := store.AddAuditEvent(&stores.AuditEvent{
+		Session: "some_session",
+		Action:  "get",
+		Status:  "success",
+	})
+
+	require.Error(t, err)
+	require.NoError(t, mock.ExpectationsWereMet())
+}
+
+func testListAuditEventsFromSystemStoreSuccess(
+	t *testing.T,
+	store *stores.SystemStore,
+	mock sqlmock.Sqlmock,
+) {
+	since := time.Date(2024, 5, 1, 0, 0, 0, 0, time.UTC)
+	earlier := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	later := time.Date(2024, 5, 2, 12, 0, 0, 0, time.UTC)
+
+	// latest first, so the limit keeps the latest
+	mock.ExpectQuery(
+		regexp.QuoteMeta(listAuditEventsQuery),
+	).WithArgs(
+		sql.Named("userID", 23),
+		sql.Named("since", since),
+		sql.Named("action", ""),
+		sql.Named("limit", 100),
+	).WillReturnRows(
+		sqlmock.NewRows(auditColumns).
+			AddRow(2, "session_2", later, "set", "not_authenticated", "198.51.100.7", "SSH-2.0-syringe_1.0.0", "janedoe", "SHA256:other_fingerprint", "janedoe@example.org").
+			AddRow(1, "session_1", earlier, "get", "success", "192.0.2.1", "SSH-2.0-syringe_1.0.0", "janedoe", "SHA256:some_fingerprint", ""),
+	)
+
+	events, err := store.ListAuditEvents(23, since, "", 100)
+
+	require.NoError(t, err)
+	require.NoError(t, mock.ExpectationsWereMet())
+	require.Equal(t, []stores.AuditEvent{
+		{
+			ID:        1,
+			Session:   "session_1",
+			Timestamp: earlier,
+			Action:    "get",
+			Status:    "success",
+			Address:   "192.0.2.1",
+			Client:    "SSH-2.0-syringe_1.0.0",
+			Username:  "janedoe",
+			PublicKey: "SHA256:some_fingerprint",
+			UserID:    23,
+		},
+		{
+			ID:        2,
+			Session:   "session_2",
+			Timestamp: later,
+			Action:    "set",
+			Status:    "not_authenticated",
+			Address:   "198.51.100.7",
+			Client:    "SSH-2.0-syringe_1.0.0",
+			Username:  "janedoe",
+			PublicKey: "SHA256:other_fingerprint",
+			KeyID:     "janedoe@example.org",
+			UserID:    23,
+		},
+	}, events)
+}
+
+func testListAuditEventsFromSystemStoreAction(
+	t *testing.T,
+	store *stores.SystemStore,
+	mock sqlmock.Sqlmock,
+) {
+	mock.ExpectQuery(
+		regexp.QuoteMeta(listAuditEventsQuery),
+	).WithArgs(
+		sql.Named("userID", 23),
+		sql.Named("since", time.Time{}),
+		sql.Named("action", "remove"),
+		sql.Named("limit", 100),
+	).WillReturnRows(sqlmock.NewRows(auditColumns))
+
+	events, err := store.ListAuditEvents(23, time.Time{}, "remove", 100)
+
+	require.NoError(t, err)
+	require.NoError(t, mock.ExpectationsWereMet())
+	require.Empty(t, events)
+}
+
+func testListAuditEventsFromSystemStoreDBErr(
+	t *testing.T,
+	store *stores.SystemStore,
+	mock sqlmock.Sqlmock,
+) {
+	mock.ExpectQuery(
+		regexp.QuoteMeta(listAuditEventsQuery),
+	).WillReturnError(fmt.Errorf("db_err"))
+
+	events, err := store.ListAuditEvents(23, time.Time{}, "", 100)
+
+	require.Error(t, err)
+	require.NoError(t, mock.ExpectationsWereMet())
+	require.Nil(t, events)
+}
@@ -3,54 +3,408 @@ package stores
 import (
 	"context"
 	"database/sql"
+	"errors"
 	"fmt"
+	"maps"
+	"slices"
+	"strings"
+	"time"
 )
 
+// ErrStaleReplacement is the error replacing a key that has been set since
+// its values were read.
+var ErrStaleReplacement = errors.New("key has been set since it was read")
+
 type TenantStore struct {
-	db *sql.DB
+	db        *sql.DB
+	retention int
 }
 
-func NewTenantStore(db *sql.DB) *TenantStore {
+// NewTenantStore returns a store that keeps the last retention versions of
+// each key, or every version when retention is 0.
+func NewTenantStore(db *sql.DB, retention int) *TenantStore {
 	return &TenantStore{
-		db: db,
+		db:        db,
+		retention: retention,
 	}
 }
 
-func (s *TenantStore) SetItem(ctx context.Context, item *Item) error {
-	query := `insert into store_ (key_, value_) values ($key, $value) 
-on conflict(key_) do update set value_ = $value`
+// SetItem stores the item in the namespace as the key's next version,
+// creating the namespace's project and environment if they don't exist yet.
+// The item's expiry replaces any the key had. The key keeps its description
+// when the item has none, and its tags when the item's are nil.
+func (s *TenantStore) SetItem(ctx context.Context, ns Namespace, item *Item) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	if err := s.setItem(ctx, tx, ns, item); err != nil {
+		return err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("commit set item transaction: %w", err)
+	}
 
-	if _, err := s.db.ExecContext(
+	return nil
+}
+
+func (s *TenantStore) setItem(ctx context.Context, tx *sql.Tx, ns Namespace, item *Item) error {
+	projectQuery := `insert into project_ (name_) values ($project)
+on conflict(name_) do nothing`
+
+	if _, err := tx.ExecContext(
 		ctx,
-		query,
+		projectQuery,
+		sql.Named("project", ns.Project),
+	); err != nil {
+		return fmt.Errorf("insert project in database: %w", err)
+	}
+
+	environmentQuery := `insert into environment_ (project_id_, name_)
+select id_, $environment from project_ where name_ = $project
+on conflict(project_id_, name_) do nothing`
+
+	if _, err := tx.ExecContext(
+		ctx,
+		environmentQuery,
+		sql.Named("environment", ns.Environment),
+		sql.Named("project", ns.Project),
+	); err != nil {
+		return fmt.Errorf("insert environment in database: %w", err)
+	}
+
+	// a key that expired and hasn't been reaped yet starts afresh, so its
+	// versions can't be got back
+	if err := removeExpiredItem(ctx, tx, ns, item.Key); err != nil {
+		return err
+	}
+
+	itemQuery := `insert into store_ (environment_id_, key_, value_, name_, expires_at_, description_, created_at_, updated_at_)
+select e.id_, $key, $value, nullif($name, ''), $expiresAt, nullif($description, ''), current_timestamp, current_timestamp from environment_ e
+inner join project_ p on p.id_ = e.project_id_
+where p.name_ = $project and e.name_ = $environment
+on conflict(environment_id_, key_) do update set value_ = $value, name_ = nullif($name, ''), expires_at_ = $expiresAt,
+description_ = coalesce(nullif($description, ''), description_), updated_at_ = current_timestamp, version_ = version_ + 1
+returning id_, version_`
+
+	row := tx.QueryRowContext(
+		ctx,
+		itemQuery,
 		sql.Named("key", item.Key),
 		sql.Named("value", item.Value),
-	); err != nil {
+		sql.Named("name", item.Name),
+		sql.Named("expiresAt", utc(item.ExpiresAt)),
+		sql.Named("description", item.Description),
+		sql.Named("project", ns.Project),
+		sql.Named("environment", ns.Environment),
+	)
+
+	var storeID, version int
+
+	if err := row.Scan(&storeID, &version); err != nil {
 		return fmt.Errorf("insert key-value in database: %w", err)
 	}
 
+	historyQuery := `insert into history_ (store_id_, version_, value_, name_)
+values ($storeID, $version, $value, nullif($name, ''))`
+
+	if _, err := tx.ExecContext(
+		ctx,
+		historyQuery,
+		sql.Named("storeID", storeID),
+		sql.Named("version", version),
+		sql.Named("value", item.Value),
+		sql.Named("name", item.Name),
+	); err != nil {
+		return fmt.Errorf("insert version in database: %w", err)
+	}
+
+	if item.Tags != nil {
+		if err := setTags(ctx, tx, storeID, item.Tags); err != nil {
+			return err
+		}
+	}
+
+	if s.retention == 0 {
+		return nil
+	}
+
+	pruneQuery := `delete from history_
+where store_id_ = $storeID and version_ <= $version - $retention`
+
+	if _, err := tx.ExecContext(
+		ctx,
+		pruneQuery,
+		sql.Named("storeID", storeID),
+		sql.Named("version", version),
+		sql.Named("retention", s.retention),
+	); err != nil {
+		return fmt.Errorf("delete old versions: %w", err)
+	}
+
 	return nil
 }
 
-func (s *TenantStore) GetItemByKey(ctx context.Context, key string) (*Item, error) {
-	query := `select id_, key_, value_ from store_
-where key_ = $key`
+// GetItemByKey returns the item, unless it has expired.
+func (s *TenantStore) GetItemByKey(ctx context.Context, ns Namespace, key string) (*Item, error) {
+	query := `select ` + itemColumns + ` from store_ s
+inner join environment_ e on e.id_ = s.environment_id_
+inner join project_ p on p.id_ = e.project_id_
+where p.name_ = $project and e.name_ = $environment and s.key_ = $key
+and (s.expires_at_ is null or s.expires_at_ > $now)`
 
-	row := s.db.QueryRowContext(ctx, query, sql.Named("key", key))
+	row := s.db.QueryRowContext(
+		ctx,
+		query,
+		sql.Named("project", ns.Project),
+		sql.Named("environment", ns.Environment),
+		sql.Named("key", key),
+		sql.Named("now", time.Now().UTC()),
+	)
+
+	item, err := scanItem(row)
+	if err != nil {
+		return nil, fmt.Errorf("get key-value from database: %w", err)
+	}
+
+	return item, nil
+}
+
+// GetItemVersion returns the item as it was at the version, unless the key
+// has expired. The item has the key's current expiry.
+func (s *TenantStore) GetItemVersion(
+	ctx context.Context,
+	ns Namespace,
+	key string,
+	version int,
+) (*Item, error) {
+	return getItemVersion(ctx, s.db, ns, key, version)
+}
+
+// queryRower is a database or a transaction.
+type queryRower interface {
+	QueryRowContext(ctx context.Context, query string, args ...any) *sql.Row
+}
+
+func getItemVersion(
+	ctx context.Context,
+	db queryRower,
+	ns Namespace,
+	key string,
+	version int,
+) (*Item, error) {
+	query := `select s.id_, s.key_, h.value_, coalesce(h.name_, ''), h.version_, s.expires_at_ from history_ h
+inner join store_ s on s.id_ = h.store_id_
+inner join environment_ e on e.id_ = s.environment_id_
+inner join project_ p on p.id_ = e.project_id_
+where p.name_ = $project and e.name_ = $environment and s.key_ = $key and h.version_ = $version
+and (s.expires_at_ is null or s.expires_at_ > $now)`
+
+	row := db.QueryRowContext(
+		ctx,
+		query,
+		sql.Named("project", ns.Project),
+		sql.Named("environment", ns.Environment),
+		sql.Named("key", key),
+		sql.Named("version", version),
+		sql.Named("now", time.Now().UTC()),
+	)
 
 	var item Item
 
-	if err := row.Scan(&item.ID, &item.Key, &item.Value); err != nil {
-		return nil, fmt.Errorf("get key-value from database: %w", err)
+	if err := row.Scan(
+		&item.ID,
+		&item.Key,
+		&item.Value,
+		&item.Name,
+		&item.Version,
+		&item.ExpiresAt,
+	); err != nil {
+		return nil, fmt.Errorf("get version from database: %w", err)
 	}
 
 	return &item, nil
 }
 
-func (s *TenantStore) ListItems(ctx context.Context) ([]Item, error) {
-	query := `select id_, key_, value_ from store_`
+// ListVersions returns the versions kept of the key, oldest first, unless the
+// key has expired.
+func (s *TenantStore) ListVersions(ctx context.Context, ns Namespace, key string) ([]ItemVersion, error) {
+	query := `select h.version_, h.created_at_ from history_ h
+inner join store_ s on s.id_ = h.store_id_
+inner join environment_ e on e.id_ = s.environment_id_
+inner join project_ p on p.id_ = e.project_id_
+where p.name_ = $project and e.name_ = $environment and s.key_ = $key
+and (s.expires_at_ is null or s.expires_at_ > $now)
+order by h.version_`
 
-	rows, err := s.db.QueryContext(ctx, query)
+	rows, err := s.db.QueryContext(
+		ctx,
+		query,
+		sql.Named("project", ns.Project),
+		sql.Named("environment", ns.Environment),
+		sql.Named("key", key),
+		sql.Named("now", time.Now().UTC()),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("get versions from database: %w", err)
+	}
+	defer rows.Close()
+
+	var versions []ItemVersion
+
+	for rows.Next() {
+		var version ItemVersion
+
+		if err := rows.Scan(&version.Version, &version.CreatedAt); err != nil {
+			return nil, fmt.Errorf("scan row version: %w", err)
+		}
+
+		versions = append(versions, version)
+	}
+
+	return versions, nil
+}
+
+// RollbackItem sets the key back to the value it had at the version, as its
+// next version, so the rollback can itself be rolled back.
+func (s *TenantStore) RollbackItem(
+	ctx context.Context,
+	ns Namespace,
+	key string,
+	version int,
+) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	item, err := getItemVersion(ctx, tx, ns, key, version)
+	if err != nil {
+		return err
+	}
+
+	if err := s.setItem(ctx, tx, ns, item); err != nil {
+		return err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("commit rollback item transaction: %w", err)
+	}
+
+	return nil
+}
+
+// ReplaceItem replaces the values of the key's versions and moves the key,
+// with its history, tags and timestamps, to the replacement's key, without
+// setting a new version. It fails with ErrStaleReplacement unless the current
+// version is replaced.
+func (s *TenantStore) ReplaceItem(
+	ctx context.Context,
+	ns Namespace,
+	key string,
+	replacement *Replacement,
+) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	query := `select s.id_, s.version_ from store_ s
+inner join environment_ e on e.id_ = s.environment_id_
+inner join project_ p on p.id_ = e.project_id_
+where p.name_ = $project and e.name_ = $environment and s.key_ = $key
+and (s.expires_at_ is null or s.expires_at_ > $now)`
+
+	row := tx.QueryRowContext(
+		ctx,
+		query,
+		sql.Named("project", ns.Project),
+		sql.Named("environment", ns.Environment),
+		sql.Named("key", key),
+		sql.Named("now", time.Now().UTC()),
+	)
+
+	var storeID, version int
+
+	if err := row.Scan(&storeID, &version); err != nil {
+		return fmt.Errorf("get key-value from database: %w", err)
+	}
+
+	value, ok := replacement.Values[version]
+	if !ok {
+		return ErrStaleReplacement
+	}
+
+	itemQuery := `update store_ set key_ = $newKey, value_ = $value, name_ = nullif($name, '')
+where id_ = $storeID`
+
+	if _, err := tx.ExecContext(
+		ctx,
+		itemQuery,
+		sql.Named("newKey", replacement.Key),
+		sql.Named("value", value),
+		sql.Named("name", replacement.Name),
+		sql.Named("storeID", storeID),
+	); err != nil {
+		return fmt.Errorf("update key-value in database: %w", err)
+	}
+
+	historyQuery := `update history_ set value_ = $value
+where store_id_ = $storeID and version_ = $version`
+
+	for _, v := range slices.Sorted(maps.Keys(replacement.Values)) {
+		if _, err := tx.ExecContext(
+			ctx,
+			historyQuery,
+			sql.Named("value", replacement.Values[v]),
+			sql.Named("storeID", storeID),
+			sql.Named("version", v),
+		); err != nil {
+			return fmt.Errorf("update version in database: %w", err)
+		}
+	}
+
+	nameQuery := `update history_ set name_ = nullif($name, '') where store_id_ = $storeID`
+
+	if _, err := tx.ExecContext(
+		ctx,
+		nameQuery,
+		sql.Named("name", replacement.Name),
+		sql.Named("storeID", storeID),
+	); err != nil {
+		return fmt.Errorf("update version names in database: %w", err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("commit replace item transaction: %w", err)
+	}
+
+	return nil
+}
+
+// ListItems returns the items in the namespace that haven't expired, only
+// those with the tag unless it's empty.
+func (s *TenantStore) ListItems(ctx context.Context, ns Namespace, tag string) ([]Item, error) {
+	query := `select ` + itemColumns + ` from store_ s
+inner join environment_ e on e.id_ = s.environment_id_
+inner join project_ p on p.id_ = e.project_id_
+where p.name_ = $project and e.name_ = $environment
+and (s.expires_at_ is null or s.expires_at_ > $now)
+and ($tag = '' or exists (select 1 from tag_ t where t.store_id_ = s.id_ and t.name_ = $tag))`
+
+	rows, err := s.db.QueryContext(
+		ctx,
+		query,
+		sql.Named("project", ns.Project),
+		sql.Named("environment", ns.Environment),
+		sql.Named("now", time.Now().UTC()),
+		sql.Named("tag", tag),
+	)
 	if err != nil {
 		return nil, fmt.Errorf("get all key-values from database: %w", err)
 	}
@@ -59,26 +413,286 @@ func (s *TenantStore) ListItems(ctx context.Context) ([]Item, error) {
 	var allItems []Item
 
 	for rows.Next() {
-		var item Item
-
-		if err := rows.Scan(&item.ID, &item.Key, &item.Value); err != nil {
+		item, err := scanItem(rows)
+		if err != nil {
 			return nil, fmt.Errorf("scan row item: %w", err)
 		}
 
-		allItems = append(allItems, item)
+		allItems = append(allItems, *item)
 	}
 
 	return allItems, nil
 }
 
-func (s *TenantStore) RemoveItemByKey(ctx context.Context, key string) error {
-	query := `delete from store_ where key_ = $key`
+// RemoveItemByKey removes the key, along with the versions kept of it and
+// its tags.
+func (s *TenantStore) RemoveItemByKey(ctx context.Context, ns Namespace, key string) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
 
-	if _, err := s.db.ExecContext(
-		ctx, query, sql.Named("key", key),
+	historyQuery := `delete from history_ where store_id_ in (
+select s.id_ from store_ s
+inner join environment_ e on e.id_ = s.environment_id_
+inner join project_ p on p.id_ = e.project_id_
+where p.name_ = $project and e.name_ = $environment and s.key_ = $key)`
+
+	if _, err := tx.ExecContext(
+		ctx,
+		historyQuery,
+		sql.Named("project", ns.Project),
+		sql.Named("environment", ns.Environment),
+		sql.Named("key", key),
+	); err != nil {
+		return fmt.Errorf("delete versions: %w", err)
+	}
+
+	tagsQuery := `delete from tag_ where store_id_ in (
+select s.id_ from store_ s
+inner join environment_ e on e.id_ = s.environment_id_
+inner join project_ p on p.id_ = e.project_id_
+where p.name_ = $project and e.name_ = $environment and s.key_ = $key)`
+
+	if _, err := tx.ExecContext(
+		ctx,
+		tagsQuery,
+		sql.Named("project", ns.Project),
+		sql.Named("environment", ns.Environment),
+		sql.Named("key", key),
+	); err != nil {
+		return fmt.Errorf("delete tags: %w", err)
+	}
+
+	query := `delete from store_ where key_ = $key and environment_id_ in (
+select e.id_ from environment_ e
+inner join project_ p on p.id_ = e.project_id_
+where p.name_ = $project and e.name_ = $environment)`
+
+	if _, err := tx.ExecContext(
+		ctx,
+		query,
+		sql.Named("key", key),
+		sql.Named("project", ns.Project),
+		sql.Named("environment", ns.Environment),
 	); err != nil {
 		return fmt.Errorf("delete item: %w", err)
 	}
 
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("commit remove item transaction: %w", err)
+	}
+
 	return nil
 }
+
+// ListNamespaces returns the environment of each project.
+func (s *TenantStore) ListNamespaces(ctx context.Context) ([]Namespace, error) {
+	query := `select p.name_, e.name_ from environment_ e
+inner join project_ p on p.id_ = e.project_id_
+order by p.name_, e.name_`
+
+	rows, err := s.db.QueryContext(ctx, query)
+	if err != nil {
+		return nil, fmt.Errorf("get namespaces from database: %w", err)
+	}
+	defer rows.Close()
+
+	var namespaces []Namespace
+
+	for rows.Next() {
+		var ns Namespace
+
+		if err := rows.Scan(&ns.Project, &ns.Environment); err != nil {
+			return nil, fmt.Errorf("scan row namespace: %w", err)
+		}
+
+		namespaces = append(namespaces, ns)
+	}
+
+	return namespaces, nil
+}
+
+// RemoveExpiredItems removes the items that expired by now, along with the
+// versions kept of them and their tags, returning how many were removed.
+func (s *TenantStore) RemoveExpiredItems(ctx context.Context, now time.Time) (int64, error) {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	historyQuery := `delete from history_ where store_id_ in (
+select id_ from store_ where expires_at_ <= $now)`
+
+	if _, err := tx.ExecContext(
+		ctx,
+		historyQuery,
+		sql.Named("now", now.UTC()),
+	); err != nil {
+		return 0, fmt.Errorf("delete expired versions: %w", err)
+	}
+
+	tagsQuery := `delete from tag_ where store_id_ in (
+select id_ from store_ where expires_at_ <= $now)`
+
+	if _, err := tx.ExecContext(
+		ctx,
+		tagsQuery,
+		sql.Named("now", now.UTC()),
+	); err != nil {
+		return 0, fmt.Errorf("delete expired tags: %w", err)
+	}
+
+	query := `delete from store_ where expires_at_ <= $now`
+
+	res, err := tx.ExecContext(ctx, query, sql.Named("now", now.UTC()))
+	if err != nil {
+		return 0, fmt.Errorf("delete expired items: %w", err)
+	}
+
+	removed, err := res.RowsAffected()
+	if err != nil {
+		return 0, fmt.Errorf("count expired items: %w", err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return 0, fmt.Errorf("commit remove expired items transaction: %w", err)
+	}
+
+	return removed, nil
+}
+
+// removeExpiredItem removes the key if it has expired, along with the
+// versions kept of it and its tags.
+func removeExpiredItem(ctx context.Context, tx *sql.Tx, ns Namespace, key string) error {
+	now := time.Now().UTC()
+
+	historyQuery := `delete from history_ where store_id_ in (
+select s.id_ from store_ s
+inner join environment_ e on e.id_ = s.environment_id_
+inner join project_ p on p.id_ = e.project_id_
+where p.name_ = $project and e.name_ = $environment and s.key_ = $key and s.expires_at_ <= $now)`
+
+	if _, err := tx.ExecContext(
+		ctx,
+		historyQuery,
+		sql.Named("project", ns.Project),
+		sql.Named("environment", ns.Environment),
+		sql.Named("key", key),
+		sql.Named("now", now),
+	); err != nil {
+		return fmt.Errorf("delete expired versions: %w", err)
+	}
+
+	tagsQuery := `delete from tag_ where store_id_ in (
+select s.id_ from store_ s
+inner join environment_ e on e.id_ = s.environment_id_
+inner join project_ p on p.id_ = e.project_id_
+where p.name_ = $project and e.name_ = $environment and s.key_ = $key and s.expires_at_ <= $now)`
+
+	if _, err := tx.ExecContext(
+		ctx,
+		tagsQuery,
+		sql.Named("project", ns.Project),
+		sql.Named("environment", ns.Environment),
+		sql.Named("key", key),
+		sql.Named("now", now),
+	); err != nil {
+		return fmt.Errorf("delete expired tags: %w", err)
+	}
+
+	query := `delete from store_ where key_ = $key and expires_at_ <= $now and environment_id_ in (
+select e.id_ from environment_ e
+inner join project_ p on p.id_ = e.project_id_
+where p.name_ = $project and e.name_ = $environment)`
+
+	if _, err := tx.ExecContext(
+		ctx,
+		query,
+		sql.Named("key", key),
+		sql.Named("now", now),
+		sql.Named("project", ns.Project),
+		sql.Named("environment", ns.Environment),
+	); err != nil {
+		return fmt.Errorf("delete expired item: %w", err)
+	}
+
+	return nil
+}
+
+// setTags replaces the tags of the stored item.
+func setTags(ctx context.Context, tx *sql.Tx, storeID int, tags []string) error {
+	if _, err := tx.ExecContext(
+		ctx,
+		`delete from tag_ where store_id_ = $storeID`,
+		sql.Named("storeID", storeID),
+	); err != nil {
+		return fmt.Errorf("delete tags: %w", err)
+	}
+
+	query := `insert into tag_ (store_id_, name_) values ($storeID, $tag)
+on conflict(store_id_, name_) do nothing`
+
+	for _, tag := range tags {
+		if _, err := tx.ExecContext(
+			ctx,
+			query,
+			sql.Named("storeID", storeID),
+			sql.Named("tag", tag),
+		); err != nil {
+			return fmt.Errorf("insert tag in database: %w", err)
+		}
+	}
+
+	return nil
+}
+
+// itemColumns are the columns scanned by scanItem, of the store_ table as s.
+const itemColumns = `s.id_, s.key_, s.value_, coalesce(s.name_, ''), s.version_, s.expires_at_,
+coalesce(s.description_, ''), coalesce((select group_concat(t.name_) from tag_ t where t.store_id_ = s.id_), ''),
+s.created_at_, s.updated_at_`
+
+// scanner is a row or rows.
+type scanner interface {
+	Scan(dest ...any) error
+}
+
+func scanItem(row scanner) (*Item, error) {
+	var item Item
+	var tags string
+
+	if err := row.Scan(
+		&item.ID,
+		&item.Key,
+		&item.Value,
+		&item.Name,
+		&item.Version,
+		&item.ExpiresAt,
+		&item.Description,
+		&tags,
+		&item.CreatedAt,
+		&item.UpdatedAt,
+	); err != nil {
+		return nil, err
+	}
+
+	if tags != "" {
+		item.Tags = strings.Split(tags, ",")
+		slices.Sort(item.Tags)
+	}
+
+	return &item, nil
+}
+
+// utc returns t in UTC, so times compare in the database as they do in Go.
+func utc(t *time.Time) *time.Time {
+	if t == nil {
+		return nil
+	}
+
+	u := t.UTC()
+
+	return &u
+}
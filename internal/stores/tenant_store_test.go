@@ -5,23 +5,131 @@ import (
 	"database/sql"
 	"database/sql/driver"
 	"fmt"
+	"path/filepath"
 	"regexp"
 	"testing"
+	"time"
 
 	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/nixpig/syringe.sh/database"
 	"github.com/nixpig/syringe.sh/internal/stores"
 	"github.com/stretchr/testify/require"
 )
 
 const (
-	setItemQuery = `insert into store_ (key_, value_)
-		values ($key, $value) on conflict(key_) do update set value_ = $value`
-	getItemByKeyQuery = `select id_, key_, value_ from store_
-		where key_ = $key`
-	listItemsQuery       = `select id_, key_, value_ from store_`
-	removeItemByKeyQuery = `delete from store_ where key_ = $key`
+	setProjectQuery = `insert into project_ (name_) values ($project)
+on conflict(name_) do nothing`
+	setEnvironmentQuery = `insert into environment_ (project_id_, name_)
+select id_, $environment from project_ where name_ = $project
+on conflict(project_id_, name_) do nothing`
+	setItemQuery = `insert into store_ (environment_id_, key_, value_, name_, expires_at_, description_, created_at_, updated_at_)
+select e.id_, $key, $value, nullif($name, ''), $expiresAt, nullif($description, ''), current_timestamp, current_timestamp from environment_ e
+inner join project_ p on p.id_ = e.project_id_
+where p.name_ = $project and e.name_ = $environment
+on conflict(environment_id_, key_) do update set value_ = $value, name_ = nullif($name, ''), expires_at_ = $expiresAt,
+description_ = coalesce(nullif($description, ''), description_), updated_at_ = current_timestamp, version_ = version_ + 1
+returning id_, version_`
+	deleteTagsQuery = `delete from tag_ where store_id_ = $storeID`
+	setTagQuery     = `insert into tag_ (store_id_, name_) values ($storeID, $tag)
+on conflict(store_id_, name_) do nothing`
+	setHistoryQuery = `insert into history_ (store_id_, version_, value_, name_)
+values ($storeID, $version, $value, nullif($name, ''))`
+	pruneHistoryQuery = `delete from history_
+where store_id_ = $storeID and version_ <= $version - $retention`
+	setRemoveExpiredHistoryQuery = `delete from history_ where store_id_ in (
+select s.id_ from store_ s
+inner join environment_ e on e.id_ = s.environment_id_
+inner join project_ p on p.id_ = e.project_id_
+where p.name_ = $project and e.name_ = $environment and s.key_ = $key and s.expires_at_ <= $now)`
+	setRemoveExpiredTagsQuery = `delete from tag_ where store_id_ in (
+select s.id_ from store_ s
+inner join environment_ e on e.id_ = s.environment_id_
+inner join project_ p on p.id_ = e.project_id_
+where p.name_ = $project and e.name_ = $environment and s.key_ = $key and s.expires_at_ <= $now)`
+	setRemoveExpiredItemQuery = `delete from store_ where key_ = $key and expires_at_ <= $now and environment_id_ in (
+select e.id_ from environment_ e
+inner join project_ p on p.id_ = e.project_id_
+where p.name_ = $project and e.name_ = $environment)`
+	getItemByKeyQuery = `select s.id_, s.key_, s.value_, coalesce(s.name_, ''), s.version_, s.expires_at_,
+coalesce(s.description_, ''), coalesce((select group_concat(t.name_) from tag_ t where t.store_id_ = s.id_), ''),
+s.created_at_, s.updated_at_ from store_ s
+inner join environment_ e on e.id_ = s.environment_id_
+inner join project_ p on p.id_ = e.project_id_
+where p.name_ = $project and e.name_ = $environment and s.key_ = $key
+and (s.expires_at_ is null or s.expires_at_ > $now)`
+	getItemVersionQuery = `select s.id_, s.key_, h.value_, coalesce(h.name_, ''), h.version_, s.expires_at_ from history_ h
+inner join store_ s on s.id_ = h.store_id_
+inner join environment_ e on e.id_ = s.environment_id_
+inner join project_ p on p.id_ = e.project_id_
+where p.name_ = $project and e.name_ = $environment and s.key_ = $key and h.version_ = $version
+and (s.expires_at_ is null or s.expires_at_ > $now)`
+	listVersionsQuery = `select h.version_, h.created_at_ from history_ h
+inner join store_ s on s.id_ = h.store_id_
+inner join environment_ e on e.id_ = s.environment_id_
+inner join project_ p on p.id_ = e.project_id_
+where p.name_ = $project and e.name_ = $environment and s.key_ = $key
+and (s.expires_at_ is null or s.expires_at_ > $now)
+order by h.version_`
+	listItemsQuery = `select s.id_, s.key_, s.value_, coalesce(s.name_, ''), s.version_, s.expires_at_,
+coalesce(s.description_, ''), coalesce((select group_concat(t.name_) from tag_ t where t.store_id_ = s.id_), ''),
+s.created_at_, s.updated_at_ from store_ s
+inner join environment_ e on e.id_ = s.environment_id_
+inner join project_ p on p.id_ = e.project_id_
+where p.name_ = $project and e.name_ = $environment
+and (s.expires_at_ is null or s.expires_at_ > $now)
+and ($tag = '' or exists (select 1 from tag_ t where t.store_id_ = s.id_ and t.name_ = $tag))`
+	removeExpiredHistoryQuery = `delete from history_ where store_id_ in (
+select id_ from store_ where expires_at_ <= $now)`
+	removeExpiredTagsQuery = `delete from tag_ where store_id_ in (
+select id_ from store_ where expires_at_ <= $now)`
+	removeExpiredItemsQuery = `delete from store_ where expires_at_ <= $now`
+	removeHistoryQuery      = `delete from history_ where store_id_ in (
+select s.id_ from store_ s
+inner join environment_ e on e.id_ = s.environment_id_
+inner join project_ p on p.id_ = e.project_id_
+where p.name_ = $project and e.name_ = $environment and s.key_ = $key)`
+	removeTagsQuery = `delete from tag_ where store_id_ in (
+select s.id_ from store_ s
+inner join environment_ e on e.id_ = s.environment_id_
+inner join project_ p on p.id_ = e.project_id_
+where p.name_ = $project and e.name_ = $environment and s.key_ = $key)`
+	removeItemByKeyQuery = `delete from store_ where key_ = $key and environment_id_ in (
+select e.id_ from environment_ e
+inner join project_ p on p.id_ = e.project_id_
+where p.name_ = $project and e.name_ = $environment)`
+	getReplacedItemQuery = `select s.id_, s.version_ from store_ s
+inner join environment_ e on e.id_ = s.environment_id_
+inner join project_ p on p.id_ = e.project_id_
+where p.name_ = $project and e.name_ = $environment and s.key_ = $key
+and (s.expires_at_ is null or s.expires_at_ > $now)`
+	replaceItemQuery = `update store_ set key_ = $newKey, value_ = $value, name_ = nullif($name, '')
+where id_ = $storeID`
+	replaceHistoryQuery = `update history_ set value_ = $value
+where store_id_ = $storeID and version_ = $version`
+	replaceHistoryNameQuery = `update history_ set name_ = nullif($name, '') where store_id_ = $storeID`
+	listNamespacesQuery     = `select p.name_, e.name_ from environment_ e
+inner join project_ p on p.id_ = e.project_id_
+order by p.name_, e.name_`
 )
 
+var testNamespace = stores.Namespace{Project: "syringe", Environment: "staging"}
+
+// testRetention is the number of versions the store under test keeps.
+const testRetention = 2
+
+var testExpiry = time.Date(2030, 1, 2, 3, 4, 5, 0, time.UTC)
+
+var (
+	testCreated = time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	testUpdated = time.Date(2024, 2, 3, 4, 5, 6, 0, time.UTC)
+)
+
+// itemColumns are the columns of items got from the store.
+var itemColumns = []string{
+	"id_", "key_", "value_", "name_", "version_", "expires_at_",
+	"description_", "tags_", "created_at_", "updated_at_",
+}
+
 func TestTenantStore(t *testing.T) {
 	scenarios := map[string]func(
 		t *testing.T,
@@ -40,6 +148,24 @@ func TestTenantStore(t *testing.T) {
 		"list items in tenant store (scan error)":         testListItemsInTenantStoreMultipleItemsScanErr,
 		"remove item by key from tenant store (success)":  testRemoveItemByKeyFromTenantStoreSuccess,
 		"remove item by key from tenant store (db error)": testRemoveItemByKeyFromTenantStoreDBErr,
+		"set item in tenant store (tx begin error)":       testSetItemInTenantStoreTXBeginErr,
+		"set item in tenant store (tx commit error)":      testSetItemInTenantStoreTXCommitErr,
+		"list namespaces in tenant store (success)":       testListNamespacesInTenantStoreSuccess,
+		"list namespaces in tenant store (db error)":      testListNamespacesInTenantStoreDBErr,
+		"get item version from tenant store (success)":    testGetItemVersionFromTenantStoreSuccess,
+		"get item version from tenant store (no rows)":    testGetItemVersionFromTenantStoreNoRows,
+		"list versions in tenant store (success)":         testListVersionsInTenantStoreSuccess,
+		"list versions in tenant store (db error)":        testListVersionsInTenantStoreDBErr,
+		"rollback item in tenant store (success)":         testRollbackItemInTenantStoreSuccess,
+		"rollback item in tenant store (no version)":      testRollbackItemInTenantStoreNoVersion,
+		"set expiring item in tenant store (success)":     testSetExpiringItemInTenantStoreSuccess,
+		"remove expired items in tenant store (success)":  testRemoveExpiredItemsInTenantStoreSuccess,
+		"remove expired items in tenant store (db error)": testRemoveExpiredItemsInTenantStoreDBErr,
+		"set described item in tenant store (success)":    testSetDescribedItemInTenantStoreSuccess,
+		"list items by tag in tenant store (success)":     testListItemsByTagInTenantStoreSuccess,
+		"replace item in tenant store (success)":          testReplaceItemInTenantStoreSuccess,
+		"replace item in tenant store (stale)":            testReplaceItemInTenantStoreStale,
+		"replace item in tenant store (no rows)":          testReplaceItemInTenantStoreNoRows,
 	}
 
 	for scenario, fn := range scenarios {
@@ -50,7 +176,7 @@ func TestTenantStore(t *testing.T) {
 			}
 			defer db.Close()
 
-			store := stores.NewTenantStore(db)
+			store := stores.NewTenantStore(db, testRetention)
 
 			fn(t, store, mock)
 		})
@@ -62,16 +188,14 @@ func testSetItemInTenantStoreSuccess(
 	store *stores.TenantStore,
 	mock sqlmock.Sqlmock,
 ) {
-	mock.ExpectExec(
-		regexp.QuoteMeta(setItemQuery),
-	).WithArgs(
-		sql.Named("key", "foo"),
-		sql.Named("value", "bar"),
-	).WillReturnResult(sqlmock.NewResult(1, 1))
+	expectSetNamespace(mock, true)
+
+	expectSetItem(mock, "foo", "bar", nil, 3)
+	mock.ExpectCommit()
 
 	ctx := context.Background()
 
-	err := store.SetItem(ctx, &stores.Item{
+	err := store.SetItem(ctx, testNamespace, &stores.Item{
 		Key:   "foo",
 		Value: "bar",
 	})
@@ -85,16 +209,24 @@ func testSetItemInTenantStoreDBErr(
 	store *stores.TenantStore,
 	mock sqlmock.Sqlmock,
 ) {
-	mock.ExpectExec(
+	expectSetNamespace(mock, true)
+
+	mock.ExpectQuery(
 		regexp.QuoteMeta(setItemQuery),
 	).WithArgs(
 		sql.Named("key", "foo"),
 		sql.Named("value", "bar"),
+		sql.Named("name", ""),
+		sql.Named("expiresAt", nil),
+		sql.Named("description", ""),
+		sql.Named("project", "syringe"),
+		sql.Named("environment", "staging"),
 	).WillReturnError(fmt.Errorf("db_err"))
+	mock.ExpectRollback()
 
 	ctx := context.Background()
 
-	err := store.SetItem(ctx, &stores.Item{
+	err := store.SetItem(ctx, testNamespace, &stores.Item{
 		Key:   "foo",
 		Value: "bar",
 	})
@@ -111,22 +243,31 @@ func testGetItemByKeyFromTenantStoreSuccess(
 	mock.ExpectQuery(
 		regexp.QuoteMeta(getItemByKeyQuery),
 	).WithArgs(
+		sql.Named("project", "syringe"),
+		sql.Named("environment", "staging"),
 		sql.Named("key", "foo"),
+		sqlmock.AnyArg(),
 	).WillReturnRows(
 		sqlmock.
-			NewRows([]string{"id_", "key_", "value_"}).
-			AddRow(1, "foo", "bar"),
+			NewRows(itemColumns).
+			AddRow(1, "foo", "bar", "", 3, testExpiry, "Username for the API", "api,prod", testCreated, testUpdated),
 	)
 
 	ctx := context.Background()
 
-	item, err := store.GetItemByKey(ctx, "foo")
+	item, err := store.GetItemByKey(ctx, testNamespace, "foo")
 
 	require.NoError(t, err)
 	require.Equal(t, &stores.Item{
-		ID:    1,
-		Key:   "foo",
-		Value: "bar",
+		ID:          1,
+		Key:         "foo",
+		Value:       "bar",
+		Version:     3,
+		ExpiresAt:   &testExpiry,
+		Description: "Username for the API",
+		Tags:        []string{"api", "prod"},
+		CreatedAt:   testCreated,
+		UpdatedAt:   testUpdated,
 	}, item)
 	require.NoError(t, mock.ExpectationsWereMet())
 }
@@ -139,17 +280,20 @@ func testGetItemByKeyFromTenantStoreNoRows(
 	mock.ExpectQuery(
 		regexp.QuoteMeta(getItemByKeyQuery),
 	).WithArgs(
+		sql.Named("project", "syringe"),
+		sql.Named("environment", "staging"),
 		sql.Named("key", "foo"),
+		sqlmock.AnyArg(),
 	).WillReturnRows(
 		sqlmock.
 			NewRows(
-				[]string{"id_", "key_", "value_"},
+				itemColumns,
 			),
 	)
 
 	ctx := context.Background()
 
-	item, err := store.GetItemByKey(ctx, "foo")
+	item, err := store.GetItemByKey(ctx, testNamespace, "foo")
 
 	require.ErrorIs(t, err, sql.ErrNoRows)
 	require.Nil(t, item)
@@ -164,17 +308,20 @@ func testGetItemByKeyFromTenantStoreRowErr(
 	mock.ExpectQuery(
 		regexp.QuoteMeta(getItemByKeyQuery),
 	).WithArgs(
+		sql.Named("project", "syringe"),
+		sql.Named("environment", "staging"),
 		sql.Named("key", "foo"),
+		sqlmock.AnyArg(),
 	).WillReturnRows(
 		sqlmock.
 			NewRows(
-				[]string{"id_", "key_", "value_"},
+				itemColumns,
 			).RowError(1, fmt.Errorf("row_error")),
 	)
 
 	ctx := context.Background()
 
-	item, err := store.GetItemByKey(ctx, "foo")
+	item, err := store.GetItemByKey(ctx, testNamespace, "foo")
 
 	require.Error(t, err)
 	require.Nil(t, item)
@@ -187,27 +334,32 @@ func testListItemsInTenantStoreMultipleItemsSuccess(
 	mock sqlmock.Sqlmock,
 ) {
 	mock.ExpectQuery(
-		listItemsQuery,
+		regexp.QuoteMeta(listItemsQuery),
+	).WithArgs(
+		sql.Named("project", "syringe"),
+		sql.Named("environment", "staging"),
+		sqlmock.AnyArg(),
+		sql.Named("tag", ""),
 	).WillReturnRows(
 		sqlmock.
 			NewRows(
-				[]string{"id_", "key_", "value_"},
+				itemColumns,
 			).AddRows([][]driver.Value{
-			{1, "foo", "bar"},
-			{2, "baz", "qux"},
-			{3, "ned", "dur"},
+			{1, "foo", "bar", "", 1, nil, "", "", testCreated, testCreated},
+			{2, "baz", "qux", "ZW5jcnlwdGVk", 2, nil, "", "", testCreated, testUpdated},
+			{3, "ned", "dur", "", 1, nil, "", "", testCreated, testCreated},
 		}...),
 	)
 
 	ctx := context.Background()
 
-	items, err := store.ListItems(ctx)
+	items, err := store.ListItems(ctx, testNamespace, "")
 
 	require.NoError(t, err)
 	require.Equal(t, []stores.Item{
-		{ID: 1, Key: "foo", Value: "bar"},
-		{ID: 2, Key: "baz", Value: "qux"},
-		{ID: 3, Key: "ned", Value: "dur"},
+		{ID: 1, Key: "foo", Value: "bar", Version: 1, CreatedAt: testCreated, UpdatedAt: testCreated},
+		{ID: 2, Key: "baz", Value: "qux", Name: "ZW5jcnlwdGVk", Version: 2, CreatedAt: testCreated, UpdatedAt: testUpdated},
+		{ID: 3, Key: "ned", Value: "dur", Version: 1, CreatedAt: testCreated, UpdatedAt: testCreated},
 	}, items)
 	require.NoError(t, mock.ExpectationsWereMet())
 }
@@ -218,21 +370,26 @@ func testListItemsInTenantStoreMultipleItemsScanErr(
 	mock sqlmock.Sqlmock,
 ) {
 	mock.ExpectQuery(
-		listItemsQuery,
+		regexp.QuoteMeta(listItemsQuery),
+	).WithArgs(
+		sql.Named("project", "syringe"),
+		sql.Named("environment", "staging"),
+		sqlmock.AnyArg(),
+		sql.Named("tag", ""),
 	).WillReturnRows(
 
 		sqlmock.
 			NewRows(
-				[]string{"id_", "key_", "value_"},
+				itemColumns,
 			).AddRow(
-			23, "foo", "bar",
+			23, "foo", "bar", "", 1, nil, "", "", testCreated, testCreated,
 		).RowError(
 			0, fmt.Errorf("scan_err"),
 		))
 
 	ctx := context.Background()
 
-	items, err := store.ListItems(ctx)
+	items, err := store.ListItems(ctx, testNamespace, "")
 
 	var emptyItems []stores.Item
 	require.NoError(t, err)
@@ -246,20 +403,25 @@ func testListItemsInTenantStoreSingleItemSuccess(
 	mock sqlmock.Sqlmock,
 ) {
 	mock.ExpectQuery(
-		listItemsQuery,
+		regexp.QuoteMeta(listItemsQuery),
+	).WithArgs(
+		sql.Named("project", "syringe"),
+		sql.Named("environment", "staging"),
+		sqlmock.AnyArg(),
+		sql.Named("tag", ""),
 	).WillReturnRows(
 		sqlmock.
-			NewRows([]string{"id_", "key_", "value_"}).
-			AddRow(1, "foo", "bar"),
+			NewRows(itemColumns).
+			AddRow(1, "foo", "bar", "", 1, nil, "", "", testCreated, testCreated),
 	)
 
 	ctx := context.Background()
 
-	items, err := store.ListItems(ctx)
+	items, err := store.ListItems(ctx, testNamespace, "")
 
 	require.NoError(t, err)
 	require.Equal(t, []stores.Item{
-		{ID: 1, Key: "foo", Value: "bar"},
+		{ID: 1, Key: "foo", Value: "bar", Version: 1, CreatedAt: testCreated, UpdatedAt: testCreated},
 	}, items)
 	require.NoError(t, mock.ExpectationsWereMet())
 }
@@ -270,12 +432,17 @@ func testListItemsInTenantStoreNoItems(
 	mock sqlmock.Sqlmock,
 ) {
 	mock.ExpectQuery(
-		listItemsQuery,
-	).WillReturnRows(sqlmock.NewRows([]string{"id_", "key_", "value_"}))
+		regexp.QuoteMeta(listItemsQuery),
+	).WithArgs(
+		sql.Named("project", "syringe"),
+		sql.Named("environment", "staging"),
+		sqlmock.AnyArg(),
+		sql.Named("tag", ""),
+	).WillReturnRows(sqlmock.NewRows(itemColumns))
 
 	ctx := context.Background()
 
-	items, err := store.ListItems(ctx)
+	items, err := store.ListItems(ctx, testNamespace, "")
 
 	var expect []stores.Item
 
@@ -290,12 +457,17 @@ func testListItemsInTenantStoreDBErr(
 	mock sqlmock.Sqlmock,
 ) {
 	mock.ExpectQuery(
-		listItemsQuery,
+		regexp.QuoteMeta(listItemsQuery),
+	).WithArgs(
+		sql.Named("project", "syringe"),
+		sql.Named("environment", "staging"),
+		sqlmock.AnyArg(),
+		sql.Named("tag", ""),
 	).WillReturnError(fmt.Errorf("db_err"))
 
 	ctx := context.Background()
 
-	items, err := store.ListItems(ctx)
+	items, err := store.ListItems(ctx, testNamespace, "")
 
 	require.Error(t, err)
 	require.Nil(t, items)
@@ -307,15 +479,20 @@ func testRemoveItemByKeyFromTenantStoreSuccess(
 	store *stores.TenantStore,
 	mock sqlmock.Sqlmock,
 ) {
+	expectRemoveHistory(mock)
+
 	mock.ExpectExec(
 		regexp.QuoteMeta(removeItemByKeyQuery),
 	).WithArgs(
 		sql.Named("key", "foo"),
+		sql.Named("project", "syringe"),
+		sql.Named("environment", "staging"),
 	).WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectCommit()
 
 	ctx := context.Background()
 
-	err := store.RemoveItemByKey(ctx, "foo")
+	err := store.RemoveItemByKey(ctx, testNamespace, "foo")
 
 	require.NoError(t, err)
 	require.NoError(t, mock.ExpectationsWereMet())
@@ -326,16 +503,711 @@ func testRemoveItemByKeyFromTenantStoreDBErr(
 	store *stores.TenantStore,
 	mock sqlmock.Sqlmock,
 ) {
+	expectRemoveHistory(mock)
+
 	mock.ExpectExec(
 		regexp.QuoteMeta(removeItemByKeyQuery),
 	).WithArgs(
 		sql.Named("key", "foo"),
+		sql.Named("project", "syringe"),
+		sql.Named("environment", "staging"),
+	).WillReturnError(fmt.Errorf("db_err"))
+	mock.ExpectRollback()
+
+	ctx := context.Background()
+
+	err := store.RemoveItemByKey(ctx, testNamespace, "foo")
+
+	require.Error(t, err)
+	require.NoError(t, mock.ExpectationsWereMet())
+}
+
+func testSetItemInTenantStoreTXBeginErr(
+	t *testing.T,
+	store *stores.TenantStore,
+	mock sqlmock.Sqlmock,
+) {
+	mock.ExpectBegin().WillReturnError(fmt.Errorf("begin_tx_err"))
+
+	ctx := context.Background()
+
+	err := store.SetItem(ctx, testNamespace, &stores.Item{
+		Key:   "foo",
+		Value: "bar",
+	})
+
+	require.Error(t, err)
+	require.NoError(t, mock.ExpectationsWereMet())
+}
+
+func testSetItemInTenantStoreTXCommitErr(
+	t *testing.T,
+	store *stores.TenantStore,
+	mock sqlmock.Sqlmock,
+) {
+	expectSetNamespace(mock, true)
+
+	expectSetItem(mock, "foo", "bar", nil, 3)
+	mock.ExpectCommit().WillReturnError(fmt.Errorf("commit_tx_err"))
+
+	ctx := context.Background()
+
+	err := store.SetItem(ctx, testNamespace, &stores.Item{
+		Key:   "foo",
+		Value: "bar",
+	})
+
+	require.Error(t, err)
+	require.NoError(t, mock.ExpectationsWereMet())
+}
+
+func testListNamespacesInTenantStoreSuccess(
+	t *testing.T,
+	store *stores.TenantStore,
+	mock sqlmock.Sqlmock,
+) {
+	mock.ExpectQuery(
+		regexp.QuoteMeta(listNamespacesQuery),
+	).WillReturnRows(
+		sqlmock.
+			NewRows([]string{"project_", "environment_"}).
+			AddRow("default", "default").
+			AddRow("syringe", "staging"),
+	)
+
+	ctx := context.Background()
+
+	namespaces, err := store.ListNamespaces(ctx)
+
+	require.NoError(t, err)
+	require.Equal(t, []stores.Namespace{
+		stores.DefaultNamespace,
+		testNamespace,
+	}, namespaces)
+	require.NoError(t, mock.ExpectationsWereMet())
+}
+
+func testListNamespacesInTenantStoreDBErr(
+	t *testing.T,
+	store *stores.TenantStore,
+	mock sqlmock.Sqlmock,
+) {
+	mock.ExpectQuery(
+		regexp.QuoteMeta(listNamespacesQuery),
+	).WillReturnError(fmt.Errorf("db_err"))
+
+	ctx := context.Background()
+
+	namespaces, err := store.ListNamespaces(ctx)
+
+	require.Error(t, err)
+	require.Nil(t, namespaces)
+	require.NoError(t, mock.ExpectationsWereMet())
+}
+
+// expectSetNamespace expects the project and environment of testNamespace to
+// be created when an item is set, in a transaction begun for it when begin is
+// set, and the item to be removed if it has expired.
+func expectSetNamespace(mock sqlmock.Sqlmock, begin bool) {
+	if begin {
+		mock.ExpectBegin()
+	}
+
+	mock.ExpectExec(
+		regexp.QuoteMeta(setProjectQuery),
+	).WithArgs(
+		sql.Named("project", "syringe"),
+	).WillReturnResult(sqlmock.NewResult(1, 1))
+
+	mock.ExpectExec(
+		regexp.QuoteMeta(setEnvironmentQuery),
+	).WithArgs(
+		sql.Named("environment", "staging"),
+		sql.Named("project", "syringe"),
+	).WillReturnResult(sqlmock.NewResult(1, 1))
+
+	expectRemoveExpiredItem(mock)
+}
+
+// expectRemoveExpiredItem expects the key to be removed, with its versions and
+// tags, if it has expired.
+func expectRemoveExpiredItem(mock sqlmock.Sqlmock) {
+	for _, query := range []string{
+		setRemoveExpiredHistoryQuery,
+		setRemoveExpiredTagsQuery,
+	} {
+		mock.ExpectExec(
+			regexp.QuoteMeta(query),
+		).WithArgs(
+			sql.Named("project", "syringe"),
+			sql.Named("environment", "staging"),
+			sql.Named("key", "foo"),
+			sqlmock.AnyArg(),
+		).WillReturnResult(sqlmock.NewResult(0, 0))
+	}
+
+	mock.ExpectExec(
+		regexp.QuoteMeta(setRemoveExpiredItemQuery),
+	).WithArgs(
+		sql.Named("key", "foo"),
+		sqlmock.AnyArg(),
+		sql.Named("project", "syringe"),
+		sql.Named("environment", "staging"),
+	).WillReturnResult(sqlmock.NewResult(0, 0))
+}
+
+func testGetItemVersionFromTenantStoreSuccess(
+	t *testing.T,
+	store *stores.TenantStore,
+	mock sqlmock.Sqlmock,
+) {
+	expectGetItemVersion(mock, 2).WillReturnRows(
+		sqlmock.
+			NewRows([]string{"id_", "key_", "value_", "name_", "version_", "expires_at_"}).
+			AddRow(1, "foo", "bar", "", 2, nil),
+	)
+
+	ctx := context.Background()
+
+	item, err := store.GetItemVersion(ctx, testNamespace, "foo", 2)
+
+	require.NoError(t, err)
+	require.Equal(t, &stores.Item{
+		ID:      1,
+		Key:     "foo",
+		Value:   "bar",
+		Version: 2,
+	}, item)
+	require.NoError(t, mock.ExpectationsWereMet())
+}
+
+func testGetItemVersionFromTenantStoreNoRows(
+	t *testing.T,
+	store *stores.TenantStore,
+	mock sqlmock.Sqlmock,
+) {
+	expectGetItemVersion(mock, 2).WillReturnRows(
+		sqlmock.NewRows([]string{"id_", "key_", "value_", "name_", "version_", "expires_at_"}),
+	)
+
+	ctx := context.Background()
+
+	item, err := store.GetItemVersion(ctx, testNamespace, "foo", 2)
+
+	require.ErrorIs(t, err, sql.ErrNoRows)
+	require.Nil(t, item)
+	require.NoError(t, mock.ExpectationsWereMet())
+}
+
+func testListVersionsInTenantStoreSuccess(
+	t *testing.T,
+	store *stores.TenantStore,
+	mock sqlmock.Sqlmock,
+) {
+	first := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	second := first.Add(time.Hour)
+
+	mock.ExpectQuery(
+		regexp.QuoteMeta(listVersionsQuery),
+	).WithArgs(
+		sql.Named("project", "syringe"),
+		sql.Named("environment", "staging"),
+		sql.Named("key", "foo"),
+		sqlmock.AnyArg(),
+	).WillReturnRows(
+		sqlmock.
+			NewRows([]string{"version_", "created_at_"}).
+			AddRow(1, first).
+			AddRow(2, second),
+	)
+
+	ctx := context.Background()
+
+	versions, err := store.ListVersions(ctx, testNamespace, "foo")
+
+	require.NoError(t, err)
+	require.Equal(t, []stores.ItemVersion{
+		{Version: 1, CreatedAt: first},
+		{Version: 2, CreatedAt: second},
+	}, versions)
+	require.NoError(t, mock.ExpectationsWereMet())
+}
+
+func testListVersionsInTenantStoreDBErr(
+	t *testing.T,
+	store *stores.TenantStore,
+	mock sqlmock.Sqlmock,
+) {
+	mock.ExpectQuery(
+		regexp.QuoteMeta(listVersionsQuery),
+	).WithArgs(
+		sql.Named("project", "syringe"),
+		sql.Named("environment", "staging"),
+		sql.Named("key", "foo"),
+		sqlmock.AnyArg(),
+	).WillReturnError(fmt.Errorf("db_err"))
+
+	ctx := context.Background()
+
+	versions, err := store.ListVersions(ctx, testNamespace, "foo")
+
+	require.Error(t, err)
+	require.Nil(t, versions)
+	require.NoError(t, mock.ExpectationsWereMet())
+}
+
+func testRollbackItemInTenantStoreSuccess(
+	t *testing.T,
+	store *stores.TenantStore,
+	mock sqlmock.Sqlmock,
+) {
+	mock.ExpectBegin()
+
+	expectGetItemVersion(mock, 2).WillReturnRows(
+		sqlmock.
+			NewRows([]string{"id_", "key_", "value_", "name_", "version_", "expires_at_"}).
+			AddRow(1, "foo", "old", "", 2, testExpiry),
+	)
+
+	expectSetNamespace(mock, false)
+	// the key keeps its expiry
+	expectSetItem(mock, "foo", "old", &testExpiry, 5)
+	mock.ExpectCommit()
+
+	ctx := context.Background()
+
+	err := store.RollbackItem(ctx, testNamespace, "foo", 2)
+
+	require.NoError(t, err)
+	require.NoError(t, mock.ExpectationsWereMet())
+}
+
+func testRollbackItemInTenantStoreNoVersion(
+	t *testing.T,
+	store *stores.TenantStore,
+	mock sqlmock.Sqlmock,
+) {
+	mock.ExpectBegin()
+
+	expectGetItemVersion(mock, 2).WillReturnRows(
+		sqlmock.NewRows([]string{"id_", "key_", "value_", "name_", "version_", "expires_at_"}),
+	)
+	mock.ExpectRollback()
+
+	ctx := context.Background()
+
+	err := store.RollbackItem(ctx, testNamespace, "foo", 2)
+
+	require.ErrorIs(t, err, sql.ErrNoRows)
+	require.NoError(t, mock.ExpectationsWereMet())
+}
+
+// expectSetItem expects the item to be stored as the version, with the
+// versions older than the retention removed.
+func expectSetItem(
+	mock sqlmock.Sqlmock,
+	key, value string,
+	expiresAt *time.Time,
+	version int,
+) {
+	mock.ExpectQuery(
+		regexp.QuoteMeta(setItemQuery),
+	).WithArgs(
+		sql.Named("key", key),
+		sql.Named("value", value),
+		sql.Named("name", ""),
+		sql.Named("expiresAt", expiresAt),
+		sql.Named("description", ""),
+		sql.Named("project", "syringe"),
+		sql.Named("environment", "staging"),
+	).WillReturnRows(
+		sqlmock.NewRows([]string{"id_", "version_"}).AddRow(1, version),
+	)
+
+	mock.ExpectExec(
+		regexp.QuoteMeta(setHistoryQuery),
+	).WithArgs(
+		sql.Named("storeID", 1),
+		sql.Named("version", version),
+		sql.Named("value", value),
+		sql.Named("name", ""),
+	).WillReturnResult(sqlmock.NewResult(1, 1))
+
+	mock.ExpectExec(
+		regexp.QuoteMeta(pruneHistoryQuery),
+	).WithArgs(
+		sql.Named("storeID", 1),
+		sql.Named("version", version),
+		sql.Named("retention", testRetention),
+	).WillReturnResult(sqlmock.NewResult(0, 1))
+}
+
+func expectGetItemVersion(mock sqlmock.Sqlmock, version int) *sqlmock.ExpectedQuery {
+	return mock.ExpectQuery(
+		regexp.QuoteMeta(getItemVersionQuery),
+	).WithArgs(
+		sql.Named("project", "syringe"),
+		sql.Named("environment", "staging"),
+		sql.Named("key", "foo"),
+		sql.Named("version", version),
+		sqlmock.AnyArg(),
+	)
+}
+
+// expectRemoveHistory expects the versions and tags of the key to be removed
+// with it.
+func expectRemoveHistory(mock sqlmock.Sqlmock) {
+	mock.ExpectBegin()
+
+	mock.ExpectExec(
+		regexp.QuoteMeta(removeHistoryQuery),
+	).WithArgs(
+		sql.Named("project", "syringe"),
+		sql.Named("environment", "staging"),
+		sql.Named("key", "foo"),
+	).WillReturnResult(sqlmock.NewResult(0, 1))
+
+	mock.ExpectExec(
+		regexp.QuoteMeta(removeTagsQuery),
+	).WithArgs(
+		sql.Named("project", "syringe"),
+		sql.Named("environment", "staging"),
+		sql.Named("key", "foo"),
+	).WillReturnResult(sqlmock.NewResult(0, 1))
+}
+
+func testSetExpiringItemInTenantStoreSuccess(
+	t *testing.T,
+	store *stores.TenantStore,
+	mock sqlmock.Sqlmock,
+) {
+	expectSetNamespace(mock, true)
+
+	// expiries are stored in UTC, so they compare as times
+	expectSetItem(mock, "foo", "bar", &testExpiry, 3)
+	mock.ExpectCommit()
+
+	expiresAt := testExpiry.In(time.FixedZone("CEST", 2*60*60))
+
+	ctx := context.Background()
+
+	err := store.SetItem(ctx, testNamespace, &stores.Item{
+		Key:       "foo",
+		Value:     "bar",
+		ExpiresAt: &expiresAt,
+	})
+
+	require.NoError(t, err)
+	require.NoError(t, mock.ExpectationsWereMet())
+}
+
+func testRemoveExpiredItemsInTenantStoreSuccess(
+	t *testing.T,
+	store *stores.TenantStore,
+	mock sqlmock.Sqlmock,
+) {
+	mock.ExpectBegin()
+	mock.ExpectExec(
+		regexp.QuoteMeta(removeExpiredHistoryQuery),
+	).WithArgs(
+		sql.Named("now", testExpiry),
+	).WillReturnResult(sqlmock.NewResult(0, 3))
+	mock.ExpectExec(
+		regexp.QuoteMeta(removeExpiredTagsQuery),
+	).WithArgs(
+		sql.Named("now", testExpiry),
+	).WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec(
+		regexp.QuoteMeta(removeExpiredItemsQuery),
+	).WithArgs(
+		sql.Named("now", testExpiry),
+	).WillReturnResult(sqlmock.NewResult(0, 2))
+	mock.ExpectCommit()
+
+	ctx := context.Background()
+
+	removed, err := store.RemoveExpiredItems(ctx, testExpiry)
+
+	require.NoError(t, err)
+	require.Equal(t, int64(2), removed)
+	require.NoError(t, mock.ExpectationsWereMet())
+}
+
+func testRemoveExpiredItemsInTenantStoreDBErr(
+	t *testing.T,
+	store *stores.TenantStore,
+	mock sqlmock.Sqlmock,
+) {
+	mock.ExpectBegin()
+	mock.ExpectExec(
+		regexp.QuoteMeta(removeExpiredHistoryQuery),
+	).WithArgs(
+		sql.Named("now", testExpiry),
+	).WillReturnResult(sqlmock.NewResult(0, 3))
+	mock.ExpectExec(
+		regexp.QuoteMeta(removeExpiredTagsQuery),
+	).WithArgs(
+		sql.Named("now", testExpiry),
+	).WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec(
+		regexp.QuoteMeta(removeExpiredItemsQuery),
+	).WithArgs(
+		sql.Named("now", testExpiry),
 	).WillReturnError(fmt.Errorf("db_err"))
+	mock.ExpectRollback()
 
 	ctx := context.Background()
 
-	err := store.RemoveItemByKey(ctx, "foo")
+	removed, err := store.RemoveExpiredItems(ctx, testExpiry)
 
 	require.Error(t, err)
+	require.Zero(t, removed)
+	require.NoError(t, mock.ExpectationsWereMet())
+}
+
+func testSetDescribedItemInTenantStoreSuccess(
+	t *testing.T,
+	store *stores.TenantStore,
+	mock sqlmock.Sqlmock,
+) {
+	expectSetNamespace(mock, true)
+
+	mock.ExpectQuery(
+		regexp.QuoteMeta(setItemQuery),
+	).WithArgs(
+		sql.Named("key", "foo"),
+		sql.Named("value", "bar"),
+		sql.Named("name", ""),
+		sql.Named("expiresAt", nil),
+		sql.Named("description", "Username for the API"),
+		sql.Named("project", "syringe"),
+		sql.Named("environment", "staging"),
+	).WillReturnRows(
+		sqlmock.NewRows([]string{"id_", "version_"}).AddRow(1, 1),
+	)
+
+	mock.ExpectExec(
+		regexp.QuoteMeta(setHistoryQuery),
+	).WithArgs(
+		sql.Named("storeID", 1),
+		sql.Named("version", 1),
+		sql.Named("value", "bar"),
+		sql.Named("name", ""),
+	).WillReturnResult(sqlmock.NewResult(1, 1))
+
+	// the tags replace those the key had
+	mock.ExpectExec(
+		regexp.QuoteMeta(deleteTagsQuery),
+	).WithArgs(
+		sql.Named("storeID", 1),
+	).WillReturnResult(sqlmock.NewResult(0, 1))
+
+	for _, tag := range []string{"api", "prod"} {
+		mock.ExpectExec(
+			regexp.QuoteMeta(setTagQuery),
+		).WithArgs(
+			sql.Named("storeID", 1),
+			sql.Named("tag", tag),
+		).WillReturnResult(sqlmock.NewResult(1, 1))
+	}
+
+	mock.ExpectExec(
+		regexp.QuoteMeta(pruneHistoryQuery),
+	).WithArgs(
+		sql.Named("storeID", 1),
+		sql.Named("version", 1),
+		sql.Named("retention", testRetention),
+	).WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectCommit()
+
+	ctx := context.Background()
+
+	err := store.SetItem(ctx, testNamespace, &stores.Item{
+		Key:         "foo",
+		Value:       "bar",
+		Description: "Username for the API",
+		Tags:        []string{"api", "prod"},
+	})
+
+	require.NoError(t, err)
 	require.NoError(t, mock.ExpectationsWereMet())
 }
+
+func testListItemsByTagInTenantStoreSuccess(
+	t *testing.T,
+	store *stores.TenantStore,
+	mock sqlmock.Sqlmock,
+) {
+	mock.ExpectQuery(
+		regexp.QuoteMeta(listItemsQuery),
+	).WithArgs(
+		sql.Named("project", "syringe"),
+		sql.Named("environment", "staging"),
+		sqlmock.AnyArg(),
+		sql.Named("tag", "prod"),
+	).WillReturnRows(
+		sqlmock.
+			NewRows(itemColumns).
+			AddRow(1, "foo", "bar", "", 1, nil, "", "prod,api", testCreated, testCreated),
+	)
+
+	ctx := context.Background()
+
+	items, err := store.ListItems(ctx, testNamespace, "prod")
+
+	require.NoError(t, err)
+	require.Equal(t, []stores.Item{
+		{
+			ID:        1,
+			Key:       "foo",
+			Value:     "bar",
+			Version:   1,
+			Tags:      []string{"api", "prod"},
+			CreatedAt: testCreated,
+			UpdatedAt: testCreated,
+		},
+	}, items)
+	require.NoError(t, mock.ExpectationsWereMet())
+}
+
+func expectGetReplacedItem(mock sqlmock.Sqlmock) *sqlmock.ExpectedQuery {
+	mock.ExpectBegin()
+
+	return mock.ExpectQuery(
+		regexp.QuoteMeta(getReplacedItemQuery),
+	).WithArgs(
+		sql.Named("project", "syringe"),
+		sql.Named("environment", "staging"),
+		sql.Named("key", "foo"),
+		sqlmock.AnyArg(),
+	)
+}
+
+func testReplaceItemInTenantStoreSuccess(
+	t *testing.T,
+	store *stores.TenantStore,
+	mock sqlmock.Sqlmock,
+) {
+	expectGetReplacedItem(mock).WillReturnRows(
+		sqlmock.NewRows([]string{"id_", "version_"}).AddRow(1, 2),
+	)
+
+	mock.ExpectExec(
+		regexp.QuoteMeta(replaceItemQuery),
+	).WithArgs(
+		sql.Named("newKey", "bar"),
+		sql.Named("value", "baz_v2"),
+		sql.Named("name", "encrypted_name"),
+		sql.Named("storeID", 1),
+	).WillReturnResult(sqlmock.NewResult(0, 1))
+
+	// versions are replaced in order, so the queries are predictable
+	for version, value := range []string{"baz_v1", "baz_v2"} {
+		mock.ExpectExec(
+			regexp.QuoteMeta(replaceHistoryQuery),
+		).WithArgs(
+			sql.Named("value", value),
+			sql.Named("storeID", 1),
+			sql.Named("version", version+1),
+		).WillReturnResult(sqlmock.NewResult(0, 1))
+	}
+
+	mock.ExpectExec(
+		regexp.QuoteMeta(replaceHistoryNameQuery),
+	).WithArgs(
+		sql.Named("name", "encrypted_name"),
+		sql.Named("storeID", 1),
+	).WillReturnResult(sqlmock.NewResult(0, 2))
+
+	mock.ExpectCommit()
+
+	err := store.ReplaceItem(context.Background(), testNamespace, "foo", &stores.Replacement{
+		Key:    "bar",
+		Name:   "encrypted_name",
+		Values: map[int]string{2: "baz_v2", 1: "baz_v1"},
+	})
+
+	require.NoError(t, err)
+	require.NoError(t, mock.ExpectationsWereMet())
+}
+
+func testReplaceItemInTenantStoreStale(
+	t *testing.T,
+	store *stores.TenantStore,
+	mock sqlmock.Sqlmock,
+) {
+	// the key was set again since version 2 was read
+	expectGetReplacedItem(mock).WillReturnRows(
+		sqlmock.NewRows([]string{"id_", "version_"}).AddRow(1, 3),
+	)
+
+	mock.ExpectRollback()
+
+	err := store.ReplaceItem(context.Background(), testNamespace, "foo", &stores.Replacement{
+		Key:    "foo",
+		Values: map[int]string{2: "baz_v2"},
+	})
+
+	require.ErrorIs(t, err, stores.ErrStaleReplacement)
+	require.NoError(t, mock.ExpectationsWereMet())
+}
+
+func testReplaceItemInTenantStoreNoRows(
+	t *testing.T,
+	store *stores.TenantStore,
+	mock sqlmock.Sqlmock,
+) {
+	expectGetReplacedItem(mock).WillReturnRows(
+		sqlmock.NewRows([]string{"id_", "version_"}),
+	)
+
+	mock.ExpectRollback()
+
+	err := store.ReplaceItem(context.Background(), testNamespace, "foo", &stores.Replacement{
+		Key:    "foo",
+		Values: map[int]string{1: "baz_v1"},
+	})
+
+	require.ErrorIs(t, err, sql.ErrNoRows)
+	require.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestTenantStoreSetExpiredItem(t *testing.T) {
+	db, err := database.NewTenantConnection(filepath.Join(t.TempDir(), "alice.db"))
+	require.NoError(t, err)
+	defer db.Close()
+
+	store := stores.NewTenantStore(db, 0)
+
+	ctx := context.Background()
+	past := time.Now().Add(-time.Minute)
+
+	require.NoError(t, store.SetItem(ctx, testNamespace, &stores.Item{
+		Key:         "foo",
+		Value:       "bar",
+		ExpiresAt:   &past,
+		Description: "Username for the API",
+		Tags:        []string{"api"},
+	}))
+
+	// the expired key hasn't been reaped, but its value can't be got back
+	// once the key is set again
+	require.NoError(t, store.SetItem(ctx, testNamespace, &stores.Item{
+		Key:   "foo",
+		Value: "baz",
+	}))
+
+	item, err := store.GetItemByKey(ctx, testNamespace, "foo")
+	require.NoError(t, err)
+	require.Equal(t, "baz", item.Value)
+	require.Equal(t, 1, item.Version)
+	require.Empty(t, item.Description)
+	require.Empty(t, item.Tags)
+
+	versions, err := store.ListVersions(ctx, testNamespace, "foo")
+	require.NoError(t, err)
+	require.Len(t, versions, 1)
+
+	_, err = store.GetItemVersion(ctx, testNamespace, "foo", 2)
+	require.ErrorIs(t, err, sql.ErrNoRows)
+}
@@ -0,0 +1,6 @@
+// Package version is the version of syringe, shared by the client and server.
+package version
+
+// Version is the semantic version of syringe, set for releases with
+// -ldflags "-X github.com/nixpig/syringe.sh/internal/version.Version=...".
+var Version = "0.1.0"
@@ -0,0 +1,1087 @@
+// Package client is a Go client for syringe. Values are encrypted and
+// decrypted locally with the user's SSH key, so the server only ever stores
+// ciphertext.
+package client
+
+import (
+	"cmp"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/nixpig/syringe.sh/pkg/protocol"
+	"github.com/nixpig/syringe.sh/pkg/ssh"
+	gossh "golang.org/x/crypto/ssh"
+)
+
+const (
+	// DefaultHost is the host of the hosted syringe server.
+	DefaultHost = "ssh.syringe.sh"
+
+	// DefaultPort is the port syringe servers listen on.
+	DefaultPort = 2323
+)
+
+// Errors returned by the server, to match with errors.Is.
+var (
+	ErrInternal         error = &protocol.Error{Code: protocol.CodeInternal}
+	ErrInvalidArgument  error = &protocol.Error{Code: protocol.CodeInvalidArgument}
+	ErrNotAuthenticated error = &protocol.Error{Code: protocol.CodeNotAuthenticated}
+	ErrNotFound         error = &protocol.Error{Code: protocol.CodeNotFound}
+	ErrAlreadyExists    error = &protocol.Error{Code: protocol.CodeAlreadyExists}
+	ErrUnsupported      error = &protocol.Error{Code: protocol.CodeUnsupported}
+)
+
+// ErrLegacyValue is the error for a value from before values were
+// authenticated with their key, unless legacy values are allowed. The server
+// could have swapped in another key's value, or a version from before the key
+// was set again.
+var ErrLegacyValue = errors.New("value isn't authenticated with its key, so could have been swapped by the server; allow legacy values to use it")
+
+// Entry is a key in the store.
+type Entry struct {
+	// Key is the name of the key, decrypted locally when it's hidden.
+	Key string
+
+	// Hidden is whether the name of the key is hidden from the server.
+	Hidden bool
+
+	// ExpiresAt is when the value expires, or nil if it doesn't.
+	ExpiresAt *time.Time
+}
+
+// PassphraseFunc returns the vault passphrase. confirm is set when a value is
+// about to be encrypted with it, so a mistyped passphrase can be caught.
+type PassphraseFunc func(confirm bool) ([]byte, error)
+
+// Option configures a Client.
+type Option func(*Client)
+
+// WithHiddenKeys hides key names from the server. Values are stored under a
+// keyed hash of the name, with the name encrypted alongside.
+func WithHiddenKeys() Option {
+	return func(c *Client) {
+		c.hideKeys = true
+	}
+}
+
+// WithVault encrypts values with the vault passphrase instead of the SSH key,
+// so they can be decrypted on any machine with the passphrase.
+func WithVault() Option {
+	return func(c *Client) {
+		c.vault = true
+	}
+}
+
+// WithPassphrase sets where the vault passphrase comes from. It's needed in
+// vault mode, and to get values that were set in vault mode.
+func WithPassphrase(passphrase PassphraseFunc) Option {
+	return func(c *Client) {
+		c.passphrase = passphrase
+	}
+}
+
+// WithLegacyValues allows values from before values were authenticated with
+// their key, which are otherwise refused. Setting them again, or rekeying,
+// authenticates them.
+func WithLegacyValues() Option {
+	return func(c *Client) {
+		c.allowLegacy = true
+	}
+}
+
+// WithNamespace sets the project and environment that values are in, instead
+// of the default namespace.
+func WithNamespace(project, environment string) Option {
+	return func(c *Client) {
+		c.namespace = protocol.Namespace{
+			Project:     project,
+			Environment: environment,
+		}
+	}
+}
+
+// Client gets and sets values in the store. It's safe for concurrent use.
+type Client struct {
+	conn        *ssh.SSHClient
+	identity    *Identity
+	namespace   protocol.Namespace
+	hideKeys    bool
+	vault       bool
+	allowLegacy bool
+	passphrase  PassphraseFunc
+
+	mu           sync.Mutex
+	capabilities *protocol.Capabilities
+	keyHasher    ssh.KeyHasher
+}
+
+// New returns a client that sends requests over conn, encrypting and
+// decrypting values with the identity.
+func New(conn *ssh.SSHClient, identity *Identity, opts ...Option) (*Client, error) {
+	c := &Client{
+		conn:      conn,
+		identity:  identity,
+		namespace: protocol.DefaultNamespace,
+	}
+
+	for _, opt := range opts {
+		opt(c)
+	}
+
+	// hidden key names are hashed with a key derived from the ssh key, which
+	// vault values are meant to be usable without
+	if c.vault && c.hideKeys {
+		return nil, errors.New("hidden keys aren't supported in vault mode")
+	}
+
+	// hidden key names are hashed with a key derived from a signature, so
+	// keys whose signatures aren't deterministic are refused before the
+	// private key is read
+	if c.hideKeys {
+		if err := ssh.CheckDeterministicSignatures(identity.publicKey); err != nil {
+			return nil, err
+		}
+	}
+
+	return c, nil
+}
+
+// Config is the configuration for Dial.
+type Config struct {
+	// Host is the host of the server, which defaults to DefaultHost.
+	Host string
+
+	// Port is the port of the server, which defaults to DefaultPort.
+	Port int
+
+	// Username is the user to authenticate as.
+	Username string
+
+	// Identity is the path to the SSH private key, whose public key is
+	// alongside it with a .pub extension. It can't be encrypted unless the
+	// ssh agent holds it, since there's nothing to prompt for its passphrase.
+	Identity string
+
+	// KnownHosts is the known_hosts file the server's host key is checked
+	// against, which defaults to ~/.ssh/known_hosts.
+	KnownHosts string
+
+	// HostKeyChecking is how an unknown host key is treated, which defaults
+	// to strict since there's no one to ask.
+	HostKeyChecking ssh.HostKeyChecking
+
+	// HostKeyFingerprint is the SHA256 fingerprint of the only host key to
+	// trust, instead of checking known hosts.
+	HostKeyFingerprint string
+
+	// DialOptions are the timeouts, keepalives and retries for the
+	// connection, which default to ssh.DefaultDialOptions.
+	DialOptions *ssh.DialOptions
+}
+
+// Dial connects to the server and returns a client for it, without prompting
+// for anything, for programs that read their secrets from syringe.
+func Dial(ctx context.Context, config Config, opts ...Option) (*Client, error) {
+	if config.Username == "" {
+		return nil, errors.New("username is empty")
+	}
+
+	if config.Identity == "" {
+		return nil, errors.New("no identity")
+	}
+
+	identity, err := NewIdentity(config.Identity, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	authMethod, err := ssh.AuthMethod(config.Identity, io.Discard)
+	if err != nil {
+		return nil, fmt.Errorf("create auth method: %w", err)
+	}
+
+	knownHosts := config.KnownHosts
+	if knownHosts == "" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return nil, fmt.Errorf("get home dir: %w", err)
+		}
+
+		knownHosts = filepath.Join(home, ".ssh", "known_hosts")
+	}
+
+	dialOptions := ssh.DefaultDialOptions
+	if config.DialOptions != nil {
+		dialOptions = *config.DialOptions
+	}
+
+	conn, err := ssh.NewSSHClient(
+		ctx,
+		cmp.Or(config.Host, DefaultHost),
+		cmp.Or(config.Port, DefaultPort),
+		config.Username,
+		authMethod,
+		ssh.HostKeyCallback(
+			knownHosts,
+			cmp.Or(config.HostKeyChecking, ssh.HostKeyCheckingStrict),
+			config.HostKeyFingerprint,
+			nil,
+		),
+		dialOptions,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("connect: %w", err)
+	}
+
+	c, err := New(conn, identity, opts...)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	return c, nil
+}
+
+// Register registers the user and their SSH key with the server.
+func (c *Client) Register(ctx context.Context) error {
+	_, err := c.doRequest(ctx, protocol.NewRequest("register"), c.conn.Do)
+	return err
+}
+
+// Set encrypts the value for the identity, and any recipients, and stores it
+// under the key.
+func (c *Client) Set(
+	ctx context.Context,
+	key string,
+	value []byte,
+	recipients ...gossh.PublicKey,
+) error {
+	return c.set(ctx, key, value, SetOptions{}, recipients)
+}
+
+// SetExpiring is Set for a value that expires at expiresAt, after which it
+// can't be got and is removed by the server. Setting the key again replaces
+// its expiry.
+func (c *Client) SetExpiring(
+	ctx context.Context,
+	key string,
+	value []byte,
+	expiresAt time.Time,
+	recipients ...gossh.PublicKey,
+) error {
+	return c.set(ctx, key, value, SetOptions{ExpiresAt: &expiresAt}, recipients)
+}
+
+// SetOptions are what's set along with a value by SetWithOptions.
+type SetOptions struct {
+	// ExpiresAt is when the value expires, or nil if it doesn't.
+	ExpiresAt *time.Time
+
+	// Description says what the value is for. The key keeps its description
+	// when it's empty.
+	Description string
+
+	// Tags label the value. The key keeps its tags when they're nil, and has
+	// none when they're empty.
+	Tags []string
+}
+
+// SetWithOptions is Set with an expiry, description or tags. Descriptions and
+// tags are stored in plaintext, as key names are without hidden keys.
+func (c *Client) SetWithOptions(
+	ctx context.Context,
+	key string,
+	value []byte,
+	opts SetOptions,
+	recipients ...gossh.PublicKey,
+) error {
+	return c.set(ctx, key, value, opts, recipients)
+}
+
+func (c *Client) set(
+	ctx context.Context,
+	key string,
+	value []byte,
+	opts SetOptions,
+	recipients []gossh.PublicKey,
+) error {
+	publicKeys := append([]gossh.PublicKey{c.identity.publicKey}, recipients...)
+
+	encrypt := c.identity.encryptor(publicKeys, associatedData(c.namespace, key))
+
+	if c.vault {
+		if len(recipients) > 0 {
+			return errors.New("recipients aren't supported in vault mode")
+		}
+
+		passphrase, err := c.readPassphrase(true)
+		if err != nil {
+			return err
+		}
+
+		encrypt = ssh.NewPassphraseEncryptor(passphrase, associatedData(c.namespace, key))
+	}
+
+	encryptedValue, err := encrypt(string(value))
+	if err != nil {
+		return fmt.Errorf("encrypt: %w", err)
+	}
+
+	if !c.hideKeys {
+		if err := c.doSet(ctx, c.namespace, opts, key, encryptedValue); err != nil {
+			return fmt.Errorf("set '%s' in store: %w", key, err)
+		}
+
+		return nil
+	}
+
+	storeKey, err := c.storeKey(ctx, key)
+	if err != nil {
+		return err
+	}
+
+	encryptName := c.identity.encryptor(publicKeys, ssh.KeyNameAssociatedData())
+
+	encryptedName, err := encryptName(key)
+	if err != nil {
+		return fmt.Errorf("encrypt key name: %w", err)
+	}
+
+	if err := c.doSet(
+		ctx,
+		c.namespace,
+		opts,
+		storeKey,
+		encryptedValue,
+		encryptedName,
+	); err != nil {
+		return fmt.Errorf("set '%s' in store: %w", key, err)
+	}
+
+	return nil
+}
+
+// Get returns the decrypted value of the key.
+func (c *Client) Get(ctx context.Context, key string) ([]byte, error) {
+	return c.get(ctx, key, 0)
+}
+
+// GetVersion returns the decrypted value of the key at the version, which is
+// one of those listed by History.
+func (c *Client) GetVersion(ctx context.Context, key string, version int) ([]byte, error) {
+	if version < 1 {
+		return nil, fmt.Errorf("invalid version: %d", version)
+	}
+
+	if err := c.requireFeature(ctx, protocol.FeatureHistory); err != nil {
+		return nil, err
+	}
+
+	return c.get(ctx, key, version)
+}
+
+// History returns the versions kept of the key's value, oldest first.
+func (c *Client) History(ctx context.Context, key string) ([]protocol.Revision, error) {
+	if err := c.requireFeature(ctx, protocol.FeatureHistory); err != nil {
+		return nil, err
+	}
+
+	storeKey, err := c.storeKey(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+
+	return c.history(ctx, c.namespace, storeKey)
+}
+
+// Rollback sets the key back to the value it had at the version. The
+// rollback is itself a new version, so it can be undone.
+func (c *Client) Rollback(ctx context.Context, key string, version int) error {
+	if version < 1 {
+		return fmt.Errorf("invalid version: %d", version)
+	}
+
+	if err := c.requireFeature(ctx, protocol.FeatureHistory); err != nil {
+		return err
+	}
+
+	storeKey, err := c.storeKey(ctx, key)
+	if err != nil {
+		return err
+	}
+
+	value, err := c.getStored(ctx, c.namespace, storeKey, version)
+	if err != nil {
+		return err
+	}
+
+	if err := c.checkLegacy(value); err != nil {
+		return fmt.Errorf("can't roll back: %w", err)
+	}
+
+	// a version that can't be decrypted, e.g. as it predates a rekey, isn't
+	// made current. Vault values would need the passphrase, so aren't
+	// checked.
+	if !c.vault && !(ssh.IsPassphraseEncrypted(value) &&
+		!ssh.IsEncryptedFor(value, c.identity.publicKey)) {
+		if _, err := c.identity.decrypt(value, associatedData(c.namespace, key)); err != nil {
+			return fmt.Errorf("can't roll back: %w", versionError(version, err))
+		}
+	}
+
+	_, err = c.do(ctx, c.namespace, protocol.RollbackCommand, storeKey, strconv.Itoa(version))
+	return err
+}
+
+// versionError is the error decrypting a previous version of a value, which
+// says when the version can't be decrypted as it predates a rekey.
+func versionError(version int, err error) error {
+	if version != 0 && errors.Is(err, ssh.ErrNotRecipient) {
+		return fmt.Errorf("version %d predates a rekey to this key: %w", version, err)
+	}
+
+	return err
+}
+
+// get returns the decrypted value of the key at the version, or its current
+// value when version is 0.
+func (c *Client) get(ctx context.Context, key string, version int) ([]byte, error) {
+	storeKey, err := c.storeKey(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+
+	value, err := c.getStored(ctx, c.namespace, storeKey, version)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := c.checkLegacy(value); err != nil {
+		return nil, err
+	}
+
+	decrypt := func(s string) (string, error) {
+		return c.identity.decrypt(s, associatedData(c.namespace, key))
+	}
+
+	// values in the vault are decrypted with the passphrase, even without
+	// vault mode, so they can be read from any machine
+	if c.vault ||
+		(ssh.IsPassphraseEncrypted(value) &&
+			!ssh.IsEncryptedFor(value, c.identity.publicKey)) {
+		passphrase, err := c.readPassphrase(false)
+		if err != nil {
+			return nil, err
+		}
+
+		decrypt = ssh.NewPassphraseDecryptor(passphrase, associatedData(c.namespace, key))
+	}
+
+	decryptedValue, err := decrypt(value)
+	if err != nil {
+		return nil, versionError(version, err)
+	}
+
+	return []byte(decryptedValue), nil
+}
+
+// List returns the keys in the store, with hidden key names decrypted.
+func (c *Client) List(ctx context.Context) ([]Entry, error) {
+	return c.listEntries(ctx, "")
+}
+
+// ListTagged returns the keys in the store with the tag.
+func (c *Client) ListTagged(ctx context.Context, tag string) ([]Entry, error) {
+	if err := c.requireFeature(ctx, protocol.FeatureMetadata); err != nil {
+		return nil, err
+	}
+
+	return c.listEntries(ctx, tag)
+}
+
+// Description is what's known about a key, besides its value.
+type Description struct {
+	Entry
+
+	// Version counts the values the key has had, starting from 1.
+	Version int
+
+	Description string
+	Tags        []string
+
+	// CreatedAt is when the key was first set, and UpdatedAt when it was
+	// last set.
+	CreatedAt time.Time
+	UpdatedAt time.Time
+}
+
+// Describe returns what's known about the key, besides its value.
+func (c *Client) Describe(ctx context.Context, key string) (*Description, error) {
+	if err := c.requireFeature(ctx, protocol.FeatureMetadata); err != nil {
+		return nil, err
+	}
+
+	storeKey, err := c.storeKey(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+
+	output, err := c.doIdempotent(ctx, c.namespace, protocol.DescribeCommand, storeKey)
+	if err != nil {
+		return nil, err
+	}
+
+	var d protocol.Description
+	if err := json.Unmarshal(output, &d); err != nil {
+		return nil, fmt.Errorf("parse description: %w", err)
+	}
+
+	return &Description{
+		Entry: Entry{
+			Key:       key,
+			Hidden:    d.Name != "",
+			ExpiresAt: d.ExpiresAt,
+		},
+		Version:     d.Version,
+		Description: d.Description,
+		Tags:        d.Tags,
+		CreatedAt:   d.CreatedAt,
+		UpdatedAt:   d.UpdatedAt,
+	}, nil
+}
+
+// listEntries returns the keys in the store with the tag, or all of them when
+// it's empty.
+func (c *Client) listEntries(ctx context.Context, tag string) ([]Entry, error) {
+	records, err := c.list(ctx, c.namespace, tag)
+	if err != nil {
+		return nil, err
+	}
+
+	entries := make([]Entry, len(records))
+
+	for i, r := range records {
+		if r.Name == "" {
+			entries[i] = Entry{Key: string(r.Key), ExpiresAt: r.ExpiresAt}
+			continue
+		}
+
+		name, err := c.identity.decrypt(r.Name, ssh.KeyNameAssociatedData())
+		if err != nil {
+			return nil, fmt.Errorf("decrypt key name: %w", err)
+		}
+
+		hash, err := c.getKeyHasher()
+		if err != nil {
+			return nil, err
+		}
+
+		if hash(name) != string(r.Key) {
+			return nil, fmt.Errorf("key name '%s' doesn't match its hash", name)
+		}
+
+		entries[i] = Entry{Key: name, Hidden: true, ExpiresAt: r.ExpiresAt}
+	}
+
+	return entries, nil
+}
+
+// Remove removes the key from the store.
+func (c *Client) Remove(ctx context.Context, key string) error {
+	storeKey, err := c.storeKey(ctx, key)
+	if err != nil {
+		return err
+	}
+
+	_, err = c.do(ctx, c.namespace, "remove", storeKey)
+	return err
+}
+
+// Namespaces returns the projects and environments that have had values set
+// in them. Servers without namespaces only have the default namespace.
+func (c *Client) Namespaces(ctx context.Context) ([]protocol.Namespace, error) {
+	capabilities, err := c.Capabilities(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("get server capabilities: %w", err)
+	}
+
+	if !capabilities.Supports(protocol.FeatureNamespaces) {
+		return []protocol.Namespace{protocol.DefaultNamespace}, nil
+	}
+
+	output, err := c.doRequest(
+		ctx,
+		protocol.NewRequest(protocol.NamespacesCommand),
+		c.conn.DoIdempotent,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	var namespaces []protocol.Namespace
+	if err := json.Unmarshal(output, &namespaces); err != nil {
+		return nil, fmt.Errorf("parse namespaces: %w", err)
+	}
+
+	return namespaces, nil
+}
+
+// PublicKeys returns the public keys registered for the username, to set
+// values for them as recipients.
+func (c *Client) PublicKeys(ctx context.Context, username string) ([]gossh.PublicKey, error) {
+	if err := c.requireFeature(ctx, protocol.FeaturePublicKeys); err != nil {
+		return nil, err
+	}
+
+	output, err := c.doRequest(
+		ctx,
+		protocol.NewRequest("publickey", username),
+		c.conn.DoIdempotent,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	return ssh.ParseAuthorizedKeys(output)
+}
+
+// AddPublicKey registers the public key of another identity for the user,
+// proving it's held by signing the ssh session ID with it, for servers that
+// require it.
+func (c *Client) AddPublicKey(ctx context.Context, identity *Identity) error {
+	if err := c.requireFeature(ctx, protocol.FeaturePublicKeys); err != nil {
+		return err
+	}
+
+	capabilities, err := c.Capabilities(ctx)
+	if err != nil {
+		return fmt.Errorf("get server capabilities: %w", err)
+	}
+
+	req := protocol.NewRequest(protocol.AddKeyCommand, strings.TrimSpace(
+		string(gossh.MarshalAuthorizedKey(identity.publicKey)),
+	))
+
+	if capabilities.Supports(protocol.FeatureKeyProof) {
+		signer, err := identity.signer()
+		if err != nil {
+			return err
+		}
+
+		proof, err := ssh.SignKeyProof(signer, c.conn.SessionID())
+		if err != nil {
+			return err
+		}
+
+		req.Flags = map[string]string{protocol.ProofFlag: proof}
+	}
+
+	_, err = c.doRequest(ctx, req, c.conn.Do)
+
+	return err
+}
+
+// Audit returns the commands run on the user's account since the time, and
+// attempts to run them, oldest first. Only events of the action are returned,
+// unless it's empty. The server returns at most its latest 1000 events.
+func (c *Client) Audit(
+	ctx context.Context,
+	since time.Time,
+	action string,
+) ([]protocol.AuditEvent, error) {
+	if err := c.requireFeature(ctx, protocol.FeatureAudit); err != nil {
+		return nil, err
+	}
+
+	req := protocol.NewRequest(protocol.AuditCommand)
+	req.Flags = map[string]string{}
+
+	if !since.IsZero() {
+		req.Flags[protocol.SinceFlag] = since.UTC().Format(time.RFC3339)
+	}
+
+	if action != "" {
+		req.Flags[protocol.ActionFlag] = action
+	}
+
+	output, err := c.doRequest(ctx, req, c.conn.DoIdempotent)
+	if err != nil {
+		return nil, err
+	}
+
+	var events []protocol.AuditEvent
+	if err := json.Unmarshal(output, &events); err != nil {
+		return nil, fmt.Errorf("parse audit events: %w", err)
+	}
+
+	return events, nil
+}
+
+// legacyCapabilities are assumed for servers that predate the capabilities
+// command.
+var legacyCapabilities = &protocol.Capabilities{
+	Version:   "0.0.0",
+	Protocols: []int{protocol.Version},
+	Features: []string{
+		protocol.FeatureHiddenKeys,
+		protocol.FeaturePublicKeys,
+	},
+}
+
+// Capabilities returns what the server supports. It's only requested from
+// the server once.
+func (c *Client) Capabilities(ctx context.Context) (*protocol.Capabilities, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.capabilities != nil {
+		return c.capabilities, nil
+	}
+
+	res, err := c.conn.DoIdempotent(ctx, protocol.NewRequest(protocol.CapabilitiesCommand))
+	if err != nil {
+		return nil, err
+	}
+
+	if err := res.Err(); err != nil {
+		if !isUnknownCommand(res) {
+			return nil, err
+		}
+
+		c.capabilities = legacyCapabilities
+		return c.capabilities, nil
+	}
+
+	var capabilities protocol.Capabilities
+	if err := json.Unmarshal(res.Output, &capabilities); err != nil {
+		return nil, fmt.Errorf("parse capabilities: %w", err)
+	}
+
+	c.capabilities = &capabilities
+
+	return c.capabilities, nil
+}
+
+// isUnknownCommand reports whether the server failed the request as it
+// doesn't know the command. Servers that predate error codes fail it as an
+// internal error, with cobra's message.
+func isUnknownCommand(res *protocol.Response) bool {
+	switch res.Code {
+	case protocol.CodeUnknownCommand:
+		return true
+	case "", protocol.CodeInternal:
+		return strings.HasPrefix(res.Error, "unknown command")
+	default:
+		return false
+	}
+}
+
+// Close closes the connection to the server.
+func (c *Client) Close() error {
+	return c.conn.Close()
+}
+
+// requireFeature returns an error if the server doesn't support the feature.
+func (c *Client) requireFeature(ctx context.Context, feature string) error {
+	capabilities, err := c.Capabilities(ctx)
+	if err != nil {
+		return fmt.Errorf("get server capabilities: %w", err)
+	}
+
+	if !capabilities.Supports(feature) {
+		return fmt.Errorf(
+			"server %s doesn't support %s; it may need to be upgraded",
+			capabilities.Version,
+			feature,
+		)
+	}
+
+	return nil
+}
+
+// storeKey returns the key a value is stored under on the server, which is
+// the hash of the key name when key names are hidden.
+func (c *Client) storeKey(ctx context.Context, key string) (string, error) {
+	if !c.hideKeys {
+		return key, nil
+	}
+
+	if err := c.requireFeature(ctx, protocol.FeatureHiddenKeys); err != nil {
+		return "", err
+	}
+
+	hash, err := c.getKeyHasher()
+	if err != nil {
+		return "", err
+	}
+
+	return hash(key), nil
+}
+
+// getKeyHasher returns the identity's KeyHasher, only creating it once since
+// it may need the private key.
+func (c *Client) getKeyHasher() (ssh.KeyHasher, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.keyHasher != nil {
+		return c.keyHasher, nil
+	}
+
+	hash, err := c.identity.keyHasher()
+	if err != nil {
+		return nil, err
+	}
+
+	c.keyHasher = hash
+
+	return hash, nil
+}
+
+func (c *Client) readPassphrase(confirm bool) ([]byte, error) {
+	if c.passphrase == nil {
+		return nil, errors.New("value is encrypted with a passphrase, but there's no passphrase")
+	}
+
+	return c.passphrase(confirm)
+}
+
+// list returns the entries in the namespace with the tag, or all of them when
+// it's empty, as the server lists them, with hidden key names still
+// encrypted.
+func (c *Client) list(
+	ctx context.Context,
+	ns protocol.Namespace,
+	tag string,
+) ([]protocol.Entry, error) {
+	req, err := c.newRequest(ctx, ns, "list")
+	if err != nil {
+		return nil, err
+	}
+
+	req.Flags["json"] = "true"
+
+	if tag != "" {
+		req.Flags[protocol.TagFlag] = tag
+	}
+
+	output, err := c.doRequest(ctx, req, c.conn.DoIdempotent)
+	if err != nil {
+		return nil, err
+	}
+
+	var entries []protocol.Entry
+	if err := json.Unmarshal(output, &entries); err != nil {
+		return nil, fmt.Errorf("parse records: %w", err)
+	}
+
+	return entries, nil
+}
+
+// getStored returns the value stored for the key in the namespace at the
+// version, or its current value when version is 0, still encrypted.
+func (c *Client) getStored(
+	ctx context.Context,
+	ns protocol.Namespace,
+	storeKey string,
+	version int,
+) (string, error) {
+	req, err := c.newRequest(ctx, ns, "get", storeKey)
+	if err != nil {
+		return "", err
+	}
+
+	if version != 0 {
+		req.Flags[protocol.VersionFlag] = strconv.Itoa(version)
+	}
+
+	output, err := c.doRequest(ctx, req, c.conn.DoIdempotent)
+	if err != nil {
+		return "", err
+	}
+
+	return string(output), nil
+}
+
+// checkLegacy refuses the value if it's from before values were
+// authenticated with their key, unless legacy values are allowed.
+func (c *Client) checkLegacy(value string) error {
+	if ssh.IsLegacy(value) && !c.allowLegacy {
+		return ErrLegacyValue
+	}
+
+	return nil
+}
+
+// history returns the versions kept of the key in the namespace, oldest
+// first.
+func (c *Client) history(
+	ctx context.Context,
+	ns protocol.Namespace,
+	storeKey string,
+) ([]protocol.Revision, error) {
+	output, err := c.doIdempotent(ctx, ns, protocol.HistoryCommand, storeKey)
+	if err != nil {
+		return nil, err
+	}
+
+	var revisions []protocol.Revision
+	if err := json.Unmarshal(output, &revisions); err != nil {
+		return nil, fmt.Errorf("parse history: %w", err)
+	}
+
+	return revisions, nil
+}
+
+// replace replaces the key in the namespace, as one write.
+func (c *Client) replace(
+	ctx context.Context,
+	ns protocol.Namespace,
+	storeKey string,
+	replacement *protocol.Replacement,
+) error {
+	b, err := json.Marshal(replacement)
+	if err != nil {
+		return fmt.Errorf("marshal replacement: %w", err)
+	}
+
+	_, err = c.do(ctx, ns, protocol.ReplaceCommand, storeKey, string(b))
+	return err
+}
+
+// newRequest returns a request for the command on values in the namespace.
+// Requests for the default namespace don't name it, so they work with servers
+// that predate namespaces.
+func (c *Client) newRequest(
+	ctx context.Context,
+	ns protocol.Namespace,
+	command string,
+	args ...string,
+) (*protocol.Request, error) {
+	req := protocol.NewRequest(command, args...)
+	req.Flags = map[string]string{}
+
+	if ns == protocol.DefaultNamespace {
+		return req, nil
+	}
+
+	if err := c.requireFeature(ctx, protocol.FeatureNamespaces); err != nil {
+		return nil, err
+	}
+
+	req.Flags[protocol.ProjectFlag] = ns.Project
+	req.Flags[protocol.EnvironmentFlag] = ns.Environment
+
+	return req, nil
+}
+
+// do runs the command on values in the namespace, returning its output.
+func (c *Client) do(
+	ctx context.Context,
+	ns protocol.Namespace,
+	command string,
+	args ...string,
+) ([]byte, error) {
+	req, err := c.newRequest(ctx, ns, command, args...)
+	if err != nil {
+		return nil, err
+	}
+
+	return c.doRequest(ctx, req, c.conn.Do)
+}
+
+// doSet runs the set command on values in the namespace, with the options.
+func (c *Client) doSet(
+	ctx context.Context,
+	ns protocol.Namespace,
+	opts SetOptions,
+	args ...string,
+) error {
+	req, err := c.newRequest(ctx, ns, "set", args...)
+	if err != nil {
+		return err
+	}
+
+	if opts.ExpiresAt != nil {
+		if err := c.requireFeature(ctx, protocol.FeatureExpiry); err != nil {
+			return err
+		}
+
+		req.Flags[protocol.ExpiresAtFlag] = opts.ExpiresAt.UTC().Format(time.RFC3339)
+	}
+
+	if opts.Description != "" || opts.Tags != nil {
+		if err := c.requireFeature(ctx, protocol.FeatureMetadata); err != nil {
+			return err
+		}
+	}
+
+	if opts.Description != "" {
+		req.Flags[protocol.DescriptionFlag] = opts.Description
+	}
+
+	if opts.Tags != nil {
+		for _, tag := range opts.Tags {
+			if strings.Contains(tag, ",") {
+				return fmt.Errorf("invalid tag '%s'", tag)
+			}
+		}
+
+		req.Flags[protocol.TagsFlag] = strings.Join(opts.Tags, ",")
+	}
+
+	_, err = c.doRequest(ctx, req, c.conn.Do)
+	return err
+}
+
+// doIdempotent is do for commands that only read, so are retried after
+// connection errors.
+func (c *Client) doIdempotent(
+	ctx context.Context,
+	ns protocol.Namespace,
+	command string,
+	args ...string,
+) ([]byte, error) {
+	req, err := c.newRequest(ctx, ns, command, args...)
+	if err != nil {
+		return nil, err
+	}
+
+	return c.doRequest(ctx, req, c.conn.DoIdempotent)
+}
+
+func (c *Client) doRequest(
+	ctx context.Context,
+	req *protocol.Request,
+	send func(context.Context, *protocol.Request) (*protocol.Response, error),
+) ([]byte, error) {
+	res, err := send(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := res.Err(); err != nil {
+		return nil, err
+	}
+
+	return res.Output, nil
+}
+
+// associatedData binds a value to its key and namespace. Values in the default
+// namespace are only bound to their key, as they were before namespaces.
+func associatedData(ns protocol.Namespace, key string) []byte {
+	if ns == protocol.DefaultNamespace {
+		return ssh.AssociatedData(key)
+	}
+
+	return ssh.NamespaceAssociatedData(ns.Project, ns.Environment, key)
+}
@@ -0,0 +1,1287 @@
+package client_test
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"maps"
+	"net"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/nixpig/syringe.sh/pkg/client"
+	"github.com/nixpig/syringe.sh/pkg/protocol"
+	"github.com/nixpig/syringe.sh/pkg/ssh"
+	"github.com/stretchr/testify/require"
+	gossh "golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+)
+
+func TestClient(t *testing.T) {
+	scenarios := map[string]func(t *testing.T, server *testServer){
+		"test set and get value":             testClientSetGet,
+		"test get missing value":             testClientGetMissing,
+		"test list values":                   testClientList,
+		"test remove value":                  testClientRemove,
+		"test hidden keys":                   testClientHiddenKeys,
+		"test vault values":                  testClientVault,
+		"test set value for recipient":       testClientRecipient,
+		"test rekey values for new key":      testClientRekey,
+		"test rekey values on legacy server": testClientRekeyLegacyServer,
+		"test rekey shared values":           testClientRekeyRecipient,
+		"test hidden keys rejected in vault": testClientHiddenKeysVault,
+		"test namespaces":                    testClientNamespaces,
+		"test namespaces on legacy server":   testClientNamespacesLegacyServer,
+		"test history and rollback":          testClientHistory,
+		"test history on legacy server":      testClientHistoryLegacyServer,
+		"test history for another key":       testClientHistoryOtherKey,
+		"test legacy values":                 testClientLegacyValue,
+		"test expiring values":               testClientExpiry,
+		"test expiry on legacy server":       testClientExpiryLegacyServer,
+		"test describe and tag values":       testClientMetadata,
+		"test metadata on legacy server":     testClientMetadataLegacyServer,
+		"test audit":                         testClientAudit,
+		"test audit on legacy server":        testClientAuditLegacyServer,
+		"test agent decryption":              testClientAgent,
+		"test capabilities error":            testClientCapabilitiesErr,
+		"test ecdsa identity":                testClientECDSA,
+	}
+
+	for scenario, fn := range scenarios {
+		t.Run(scenario, func(t *testing.T) {
+			t.Setenv("SSH_AUTH_SOCK", "")
+
+			fn(t, newTestServer(t))
+		})
+	}
+}
+
+func testClientSetGet(t *testing.T, server *testServer) {
+	c := server.client(t, newTestIdentity(t))
+
+	require.NoError(t, c.Set(t.Context(), "username", []byte("nixpig")))
+
+	// only ciphertext is sent to the server
+	require.NotEqual(t, []string{"nixpig"}, server.storedValues())
+
+	value, err := c.Get(t.Context(), "username")
+	require.NoError(t, err)
+	require.Equal(t, []byte("nixpig"), value)
+}
+
+func testClientGetMissing(t *testing.T, server *testServer) {
+	c := server.client(t, newTestIdentity(t))
+
+	value, err := c.Get(t.Context(), "username")
+	require.ErrorIs(t, err, client.ErrNotFound)
+	require.Nil(t, value)
+}
+
+func testClientList(t *testing.T, server *testServer) {
+	c := server.client(t, newTestIdentity(t))
+
+	require.NoError(t, c.Set(t.Context(), "username", []byte("nixpig")))
+	require.NoError(t, c.Set(t.Context(), "password", []byte("p4ssw0rd")))
+
+	entries, err := c.List(t.Context())
+	require.NoError(t, err)
+	require.ElementsMatch(t, []client.Entry{
+		{Key: "username"},
+		{Key: "password"},
+	}, entries)
+}
+
+func testClientRemove(t *testing.T, server *testServer) {
+	c := server.client(t, newTestIdentity(t))
+
+	require.NoError(t, c.Set(t.Context(), "username", []byte("nixpig")))
+	require.NoError(t, c.Remove(t.Context(), "username"))
+
+	_, err := c.Get(t.Context(), "username")
+	require.ErrorIs(t, err, client.ErrNotFound)
+}
+
+func testClientHiddenKeys(t *testing.T, server *testServer) {
+	c := server.client(t, newTestIdentity(t), client.WithHiddenKeys())
+
+	require.NoError(t, c.Set(t.Context(), "username", []byte("nixpig")))
+
+	// the key name is hashed
+	keys := server.keys()
+	require.Len(t, keys, 1)
+	require.NotEqual(t, "username", keys[0])
+
+	entries, err := c.List(t.Context())
+	require.NoError(t, err)
+	require.Equal(t, []client.Entry{{Key: "username", Hidden: true}}, entries)
+
+	value, err := c.Get(t.Context(), "username")
+	require.NoError(t, err)
+	require.Equal(t, []byte("nixpig"), value)
+
+	require.NoError(t, c.Remove(t.Context(), "username"))
+	require.Empty(t, server.keys())
+}
+
+func testClientVault(t *testing.T, server *testServer) {
+	passphrase := client.WithPassphrase(func(confirm bool) ([]byte, error) {
+		return []byte("correct horse battery staple"), nil
+	})
+
+	c := server.client(t, newTestIdentity(t), client.WithVault(), passphrase)
+
+	require.NoError(t, c.Set(t.Context(), "username", []byte("nixpig")))
+
+	// vault values can be read with any key that has the passphrase
+	other := server.client(t, newTestIdentity(t), passphrase)
+
+	value, err := other.Get(t.Context(), "username")
+	require.NoError(t, err)
+	require.Equal(t, []byte("nixpig"), value)
+
+	_, err = server.client(t, newTestIdentity(t)).Get(t.Context(), "username")
+	require.Error(t, err)
+}
+
+func testClientRecipient(t *testing.T, server *testServer) {
+	recipient := newTestIdentity(t)
+
+	c := server.client(t, newTestIdentity(t))
+
+	require.NoError(t, c.Set(
+		t.Context(),
+		"username",
+		[]byte("nixpig"),
+		recipient.PublicKey(),
+	))
+
+	value, err := server.client(t, recipient).Get(t.Context(), "username")
+	require.NoError(t, err)
+	require.Equal(t, []byte("nixpig"), value)
+
+	_, err = server.client(t, newTestIdentity(t)).Get(t.Context(), "username")
+	require.Error(t, err)
+}
+
+func testClientRekeyRecipient(t *testing.T, server *testServer) {
+	oldID := newTestIdentity(t)
+	newID := newTestIdentity(t)
+	recipient := newTestIdentity(t)
+
+	c := server.client(t, oldID)
+
+	require.NoError(t, c.Set(t.Context(), "username", []byte("nixpig"), recipient.PublicKey()))
+
+	// the value can't stay shared without the recipient's public key
+	_, _, err := c.Rekey(t.Context(), oldID, newID, nil)
+	require.ErrorIs(t, err, ssh.ErrUnknownRecipient)
+
+	rekeyed, total, err := c.Rekey(t.Context(), oldID, newID, nil, recipient.PublicKey())
+	require.NoError(t, err)
+	require.Equal(t, 1, rekeyed)
+	require.Equal(t, 1, total)
+
+	for _, id := range []*client.Identity{newID, recipient} {
+		value, err := server.client(t, id).Get(t.Context(), "username")
+		require.NoError(t, err)
+		require.Equal(t, []byte("nixpig"), value)
+	}
+
+	_, err = c.Get(t.Context(), "username")
+	require.ErrorIs(t, err, ssh.ErrNotRecipient)
+}
+
+func testClientRekey(t *testing.T, server *testServer) {
+	oldID := newTestIdentity(t)
+	newID := newTestIdentity(t)
+
+	c := server.client(t, oldID)
+	hidden := server.client(t, oldID, client.WithHiddenKeys())
+
+	prod := server.client(t, oldID, client.WithNamespace("syringe", "prod"))
+
+	require.NoError(t, c.Set(t.Context(), "username", []byte("nixpig-old")))
+	require.NoError(t, c.Set(t.Context(), "username", []byte("nixpig")))
+	require.NoError(t, prod.Set(t.Context(), "username", []byte("nixpig-prod")))
+
+	expiresAt := time.Now().Add(time.Hour).Truncate(time.Second)
+	require.NoError(t, hidden.SetWithOptions(
+		t.Context(),
+		"password",
+		[]byte("p4ssw0rd"),
+		client.SetOptions{
+			ExpiresAt:   &expiresAt,
+			Description: "Password for the API",
+			Tags:        []string{"api"},
+		},
+	))
+
+	rekeyed, total, err := c.Rekey(t.Context(), oldID, newID, nil)
+	require.NoError(t, err)
+	require.Equal(t, 3, rekeyed)
+	require.Equal(t, 3, total)
+
+	require.Equal(t, []string{newID.PublicKey().Type()}, server.publicKeyTypes())
+
+	value, err := server.client(t, newID).Get(t.Context(), "username")
+	require.NoError(t, err)
+	require.Equal(t, []byte("nixpig"), value)
+
+	// previous versions are rekeyed too
+	value, err = server.client(t, newID).GetVersion(t.Context(), "username", 1)
+	require.NoError(t, err)
+	require.Equal(t, []byte("nixpig-old"), value)
+
+	newHidden := server.client(t, newID, client.WithHiddenKeys())
+
+	value, err = newHidden.Get(t.Context(), "password")
+	require.NoError(t, err)
+	require.Equal(t, []byte("p4ssw0rd"), value)
+
+	// rekeyed values keep their expiry, description and tags
+	description, err := newHidden.Describe(t.Context(), "password")
+	require.NoError(t, err)
+	require.Equal(t, "Password for the API", description.Description)
+	require.Equal(t, []string{"api"}, description.Tags)
+
+	entries, err := newHidden.List(t.Context())
+	require.NoError(t, err)
+	require.Len(t, entries, 2)
+	for _, e := range entries {
+		if e.Key == "password" {
+			require.NotNil(t, e.ExpiresAt)
+			require.True(t, expiresAt.Equal(*e.ExpiresAt))
+		} else {
+			require.Nil(t, e.ExpiresAt)
+		}
+	}
+
+	value, err = server.client(
+		t,
+		newID,
+		client.WithNamespace("syringe", "prod"),
+	).Get(t.Context(), "username")
+	require.NoError(t, err)
+	require.Equal(t, []byte("nixpig-prod"), value)
+
+	_, err = c.Get(t.Context(), "username")
+	require.Error(t, err)
+
+	// values are replaced in place, so rekeying doesn't add versions
+	revisions, err := newHidden.History(t.Context(), "password")
+	require.NoError(t, err)
+	require.Len(t, revisions, 1)
+	require.Equal(t, 1, description.Version)
+}
+
+func testClientRekeyLegacyServer(t *testing.T, server *testServer) {
+	server.legacy = true
+
+	oldID := newTestIdentity(t)
+	newID := newTestIdentity(t)
+
+	c := server.client(t, oldID)
+	hidden := server.client(t, oldID, client.WithHiddenKeys())
+
+	require.NoError(t, c.Set(t.Context(), "username", []byte("nixpig")))
+	require.NoError(t, hidden.Set(t.Context(), "password", []byte("p4ssw0rd")))
+
+	rekeyed, total, err := c.Rekey(t.Context(), oldID, newID, nil)
+	require.NoError(t, err)
+	require.Equal(t, 2, rekeyed)
+	require.Equal(t, 2, total)
+
+	value, err := server.client(t, newID).Get(t.Context(), "username")
+	require.NoError(t, err)
+	require.Equal(t, []byte("nixpig"), value)
+
+	value, err = server.client(t, newID, client.WithHiddenKeys()).Get(t.Context(), "password")
+	require.NoError(t, err)
+	require.Equal(t, []byte("p4ssw0rd"), value)
+
+	require.Len(t, server.keys(), 2)
+}
+
+func testClientHiddenKeysVault(t *testing.T, server *testServer) {
+	conn := server.dial(t)
+	t.Cleanup(func() { conn.Close() })
+
+	c, err := client.New(conn, newTestIdentity(t), client.WithHiddenKeys(), client.WithVault())
+	require.Error(t, err)
+	require.Nil(t, c)
+}
+
+func testClientNamespaces(t *testing.T, server *testServer) {
+	id := newTestIdentity(t)
+
+	dev := server.client(t, id, client.WithNamespace("syringe", "dev"))
+	prod := server.client(t, id, client.WithNamespace("syringe", "prod"))
+
+	require.NoError(t, dev.Set(t.Context(), "DATABASE_URL", []byte("sqlite://dev.db")))
+	require.NoError(t, prod.Set(t.Context(), "DATABASE_URL", []byte("sqlite://prod.db")))
+
+	value, err := dev.Get(t.Context(), "DATABASE_URL")
+	require.NoError(t, err)
+	require.Equal(t, []byte("sqlite://dev.db"), value)
+
+	value, err = prod.Get(t.Context(), "DATABASE_URL")
+	require.NoError(t, err)
+	require.Equal(t, []byte("sqlite://prod.db"), value)
+
+	// the default namespace is separate
+	require.Empty(t, server.keys())
+
+	_, err = server.client(t, id).Get(t.Context(), "DATABASE_URL")
+	require.ErrorIs(t, err, client.ErrNotFound)
+
+	namespaces, err := dev.Namespaces(t.Context())
+	require.NoError(t, err)
+	require.ElementsMatch(t, []protocol.Namespace{
+		{Project: "syringe", Environment: "dev"},
+		{Project: "syringe", Environment: "prod"},
+	}, namespaces)
+
+	// values moved to another environment can't be decrypted
+	server.copy(
+		protocol.Namespace{Project: "syringe", Environment: "prod"},
+		protocol.Namespace{Project: "syringe", Environment: "dev"},
+		"DATABASE_URL",
+	)
+
+	_, err = dev.Get(t.Context(), "DATABASE_URL")
+	require.Error(t, err)
+}
+
+func testClientNamespacesLegacyServer(t *testing.T, server *testServer) {
+	server.legacy = true
+
+	id := newTestIdentity(t)
+
+	c := server.client(t, id, client.WithNamespace("syringe", "dev"))
+
+	err := c.Set(t.Context(), "DATABASE_URL", []byte("sqlite://dev.db"))
+	require.ErrorContains(t, err, "doesn't support namespaces")
+
+	namespaces, err := c.Namespaces(t.Context())
+	require.NoError(t, err)
+	require.Equal(t, []protocol.Namespace{protocol.DefaultNamespace}, namespaces)
+
+	// the default namespace works without naming it
+	c = server.client(t, id)
+
+	require.NoError(t, c.Set(t.Context(), "DATABASE_URL", []byte("sqlite://dev.db")))
+}
+
+func testClientHistory(t *testing.T, server *testServer) {
+	c := server.client(t, newTestIdentity(t), client.WithHiddenKeys())
+
+	require.NoError(t, c.Set(t.Context(), "password", []byte("p4ssw0rd")))
+	require.NoError(t, c.Set(t.Context(), "password", []byte("hunter2")))
+
+	revisions, err := c.History(t.Context(), "password")
+	require.NoError(t, err)
+	require.Len(t, revisions, 2)
+	require.Equal(t, 1, revisions[0].Version)
+	require.Equal(t, 2, revisions[1].Version)
+
+	value, err := c.GetVersion(t.Context(), "password", 1)
+	require.NoError(t, err)
+	require.Equal(t, []byte("p4ssw0rd"), value)
+
+	_, err = c.GetVersion(t.Context(), "password", 3)
+	require.ErrorIs(t, err, client.ErrNotFound)
+
+	require.NoError(t, c.Rollback(t.Context(), "password", 1))
+
+	value, err = c.Get(t.Context(), "password")
+	require.NoError(t, err)
+	require.Equal(t, []byte("p4ssw0rd"), value)
+
+	// the rollback is a new version
+	revisions, err = c.History(t.Context(), "password")
+	require.NoError(t, err)
+	require.Len(t, revisions, 3)
+
+	require.ErrorIs(t, c.Rollback(t.Context(), "password", 4), client.ErrNotFound)
+}
+
+func testClientHistoryOtherKey(t *testing.T, server *testServer) {
+	oldID := newTestIdentity(t)
+	newID := newTestIdentity(t)
+
+	c := server.client(t, newID)
+
+	require.NoError(t, server.client(t, oldID).Set(t.Context(), "password", []byte("p4ssw0rd")))
+	require.NoError(t, c.Set(t.Context(), "password", []byte("hunter2")))
+
+	_, err := c.GetVersion(t.Context(), "password", 1)
+	require.ErrorIs(t, err, ssh.ErrNotRecipient)
+	require.ErrorContains(t, err, "version 1 predates a rekey")
+
+	// the version can't be decrypted, so isn't rolled back to
+	require.ErrorIs(t, c.Rollback(t.Context(), "password", 1), ssh.ErrNotRecipient)
+
+	revisions, err := c.History(t.Context(), "password")
+	require.NoError(t, err)
+	require.Len(t, revisions, 2)
+
+	require.NoError(t, server.client(t, oldID).Rollback(t.Context(), "password", 1))
+}
+
+func testClientLegacyValue(t *testing.T, server *testServer) {
+	id := newTestIdentity(t)
+	c := server.client(t, id)
+
+	require.NoError(t, c.Set(t.Context(), "password", []byte("p4ssw0rd")))
+
+	// the server swaps in a value from before values were authenticated
+	legacy := make([]byte, 256)
+	rand.Read(legacy)
+
+	server.mu.Lock()
+	value := base64.StdEncoding.EncodeToString(legacy)
+	server.values[protocol.DefaultNamespace]["password"] = value
+	server.history[protocol.DefaultNamespace]["password"] = append(
+		server.history[protocol.DefaultNamespace]["password"],
+		value,
+	)
+	server.mu.Unlock()
+
+	_, err := c.Get(t.Context(), "password")
+	require.ErrorIs(t, err, client.ErrLegacyValue)
+
+	_, err = c.GetVersion(t.Context(), "password", 2)
+	require.ErrorIs(t, err, client.ErrLegacyValue)
+
+	err = c.Rollback(t.Context(), "password", 2)
+	require.ErrorIs(t, err, client.ErrLegacyValue)
+
+	_, _, err = c.Rekey(t.Context(), id, newTestIdentity(t), nil)
+	require.ErrorIs(t, err, client.ErrLegacyValue)
+
+	previous, err := c.GetVersion(t.Context(), "password", 1)
+	require.NoError(t, err)
+	require.Equal(t, []byte("p4ssw0rd"), previous)
+
+	// legacy values are only decrypted when they're allowed
+	_, err = server.client(t, id, client.WithLegacyValues()).Get(t.Context(), "password")
+	require.Error(t, err)
+	require.NotErrorIs(t, err, client.ErrLegacyValue)
+}
+
+func testClientHistoryLegacyServer(t *testing.T, server *testServer) {
+	server.legacy = true
+
+	c := server.client(t, newTestIdentity(t))
+
+	require.NoError(t, c.Set(t.Context(), "username", []byte("nixpig")))
+
+	_, err := c.History(t.Context(), "username")
+	require.ErrorContains(t, err, "doesn't support history")
+
+	_, err = c.GetVersion(t.Context(), "username", 1)
+	require.ErrorContains(t, err, "doesn't support history")
+
+	err = c.Rollback(t.Context(), "username", 1)
+	require.ErrorContains(t, err, "doesn't support history")
+}
+
+func testClientExpiry(t *testing.T, server *testServer) {
+	c := server.client(t, newTestIdentity(t))
+
+	expiresAt := time.Now().Add(time.Hour).Truncate(time.Second)
+
+	require.NoError(t, c.SetExpiring(t.Context(), "token", []byte("t0k3n"), expiresAt))
+
+	value, err := c.Get(t.Context(), "token")
+	require.NoError(t, err)
+	require.Equal(t, []byte("t0k3n"), value)
+
+	entries, err := c.List(t.Context())
+	require.NoError(t, err)
+	require.Len(t, entries, 1)
+	require.True(t, expiresAt.Equal(*entries[0].ExpiresAt))
+
+	require.NoError(t, c.SetExpiring(
+		t.Context(),
+		"token",
+		[]byte("t0k3n"),
+		time.Now().Add(-time.Minute),
+	))
+
+	_, err = c.Get(t.Context(), "token")
+	require.ErrorIs(t, err, client.ErrNotFound)
+
+	// setting the key again without an expiry clears it
+	require.NoError(t, c.Set(t.Context(), "token", []byte("t0k3n")))
+
+	entries, err = c.List(t.Context())
+	require.NoError(t, err)
+	require.Nil(t, entries[0].ExpiresAt)
+}
+
+func testClientExpiryLegacyServer(t *testing.T, server *testServer) {
+	server.legacy = true
+
+	c := server.client(t, newTestIdentity(t))
+
+	err := c.SetExpiring(t.Context(), "token", []byte("t0k3n"), time.Now().Add(time.Hour))
+	require.ErrorContains(t, err, "doesn't support expiry")
+
+	require.Empty(t, server.keys())
+}
+
+func testClientMetadata(t *testing.T, server *testServer) {
+	c := server.client(t, newTestIdentity(t), client.WithHiddenKeys())
+
+	require.NoError(t, c.SetWithOptions(
+		t.Context(),
+		"password",
+		[]byte("p4ssw0rd"),
+		client.SetOptions{
+			Description: "Password for the API",
+			Tags:        []string{"api", "prod"},
+		},
+	))
+	require.NoError(t, c.Set(t.Context(), "username", []byte("nixpig")))
+
+	description, err := c.Describe(t.Context(), "password")
+	require.NoError(t, err)
+	require.Equal(t, "password", description.Key)
+	require.True(t, description.Hidden)
+	require.Equal(t, 1, description.Version)
+	require.Equal(t, "Password for the API", description.Description)
+	require.Equal(t, []string{"api", "prod"}, description.Tags)
+
+	// setting the key again keeps its description and tags
+	require.NoError(t, c.Set(t.Context(), "password", []byte("hunter2")))
+
+	description, err = c.Describe(t.Context(), "password")
+	require.NoError(t, err)
+	require.Equal(t, 2, description.Version)
+	require.Equal(t, "Password for the API", description.Description)
+	require.Equal(t, []string{"api", "prod"}, description.Tags)
+
+	entries, err := c.ListTagged(t.Context(), "prod")
+	require.NoError(t, err)
+	require.Equal(t, []client.Entry{{Key: "password", Hidden: true}}, entries)
+
+	entries, err = c.ListTagged(t.Context(), "staging")
+	require.NoError(t, err)
+	require.Empty(t, entries)
+
+	err = c.SetWithOptions(
+		t.Context(),
+		"password",
+		[]byte("hunter2"),
+		client.SetOptions{Tags: []string{"a,b"}},
+	)
+	require.ErrorContains(t, err, "invalid tag")
+
+	_, err = c.Describe(t.Context(), "missing")
+	require.ErrorIs(t, err, client.ErrNotFound)
+}
+
+func testClientMetadataLegacyServer(t *testing.T, server *testServer) {
+	server.legacy = true
+
+	c := server.client(t, newTestIdentity(t))
+
+	err := c.SetWithOptions(
+		t.Context(),
+		"username",
+		[]byte("nixpig"),
+		client.SetOptions{Description: "Username for the API"},
+	)
+	require.ErrorContains(t, err, "doesn't support metadata")
+
+	_, err = c.Describe(t.Context(), "username")
+	require.ErrorContains(t, err, "doesn't support metadata")
+
+	_, err = c.ListTagged(t.Context(), "prod")
+	require.ErrorContains(t, err, "doesn't support metadata")
+}
+
+func testClientAudit(t *testing.T, server *testServer) {
+	c := server.client(t, newTestIdentity(t))
+
+	require.NoError(t, c.Set(t.Context(), "username", []byte("nixpig")))
+
+	_, err := c.Get(t.Context(), "password")
+	require.ErrorIs(t, err, client.ErrNotFound)
+
+	events, err := c.Audit(t.Context(), time.Time{}, "")
+	require.NoError(t, err)
+	require.Len(t, events, 2)
+	require.Equal(t, "set", events[0].Action)
+	require.Equal(t, "success", events[0].Status)
+	require.Equal(t, "get", events[1].Action)
+	require.Equal(t, string(protocol.CodeNotFound), events[1].Status)
+
+	events, err = c.Audit(t.Context(), time.Time{}, "get")
+	require.NoError(t, err)
+	require.Len(t, events, 1)
+	require.Equal(t, "get", events[0].Action)
+
+	events, err = c.Audit(t.Context(), time.Now().Add(time.Hour), "")
+	require.NoError(t, err)
+	require.Empty(t, events)
+}
+
+func testClientAuditLegacyServer(t *testing.T, server *testServer) {
+	server.legacy = true
+
+	c := server.client(t, newTestIdentity(t))
+
+	_, err := c.Audit(t.Context(), time.Time{}, "")
+	require.ErrorContains(t, err, "doesn't support audit")
+}
+
+// testServer is an ssh server that stores values in memory, as a syringe
+// server does, without checking who's asking. It audits every command but
+// capabilities and audit. A legacy server predates capabilities, namespaces,
+// history, expiry, metadata and audit.
+type testServer struct {
+	addr   *net.TCPAddr
+	legacy bool
+	// capabilitiesErr fails the capabilities command, when set
+	capabilitiesErr error
+
+	mu         sync.Mutex
+	values     map[protocol.Namespace]map[string]string
+	names      map[protocol.Namespace]map[string]string
+	history    map[protocol.Namespace]map[string][]string
+	expiries   map[protocol.Namespace]map[string]time.Time
+	metadata   map[protocol.Namespace]map[string]protocol.Description
+	publicKeys []string
+	audit      []protocol.AuditEvent
+}
+
+func testClientAgent(t *testing.T, server *testServer) {
+	var prompted bool
+
+	id := newTestAgentIdentity(t, func(int) ([]byte, error) {
+		prompted = true
+		return []byte("correct horse battery staple"), nil
+	})
+
+	dev := server.client(t, id, client.WithNamespace("syringe", "dev"))
+	prod := server.client(t, id, client.WithNamespace("syringe", "prod"))
+
+	require.NoError(t, dev.Set(t.Context(), "DATABASE_URL", []byte("sqlite://dev.db")))
+	require.NoError(t, prod.Set(t.Context(), "DATABASE_URL", []byte("sqlite://prod.db")))
+
+	// the agent decrypts the value without the private key
+	value, err := prod.Get(t.Context(), "DATABASE_URL")
+	require.NoError(t, err)
+	require.Equal(t, []byte("sqlite://prod.db"), value)
+	require.False(t, prompted)
+
+	// a value the agent can't open isn't retried with the private key
+	server.copy(
+		protocol.Namespace{Project: "syringe", Environment: "prod"},
+		protocol.Namespace{Project: "syringe", Environment: "dev"},
+		"DATABASE_URL",
+	)
+
+	_, err = dev.Get(t.Context(), "DATABASE_URL")
+	require.Error(t, err)
+	require.NotErrorIs(t, err, ssh.ErrNotRecipient)
+	require.False(t, prompted)
+}
+
+func testClientCapabilitiesErr(t *testing.T, server *testServer) {
+	server.capabilitiesErr = protocol.Errorf(protocol.CodeInternal, "database is locked")
+
+	c := server.client(t, newTestIdentity(t))
+
+	// the server isn't mistaken for one that predates capabilities
+	_, err := c.Capabilities(t.Context())
+	require.ErrorIs(t, err, client.ErrInternal)
+
+	_, err = c.Namespaces(t.Context())
+	require.ErrorIs(t, err, client.ErrInternal)
+}
+
+func testClientECDSA(t *testing.T, server *testServer) {
+	ecdsaKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+
+	ecdsaID := writeTestIdentity(t, ecdsaKey)
+
+	// hidden key names can't be derived from ecdsa signatures
+	_, err = client.New(server.dial(t), ecdsaID, client.WithHiddenKeys())
+	require.ErrorIs(t, err, ssh.ErrNonDeterministicSignatures)
+
+	// values can still be encrypted for the key
+	c := server.client(t, ecdsaID)
+
+	require.NoError(t, c.Set(t.Context(), "username", []byte("nixpig")))
+
+	value, err := c.Get(t.Context(), "username")
+	require.NoError(t, err)
+	require.Equal(t, []byte("nixpig"), value)
+
+	// hidden keys can't be rekeyed to the key, so nothing is
+	id := newTestIdentity(t)
+	hidden := server.client(t, id, client.WithHiddenKeys())
+
+	require.NoError(t, hidden.Set(t.Context(), "password", []byte("p4ssw0rd")))
+
+	_, _, err = hidden.Rekey(t.Context(), id, ecdsaID, nil)
+	require.ErrorIs(t, err, ssh.ErrNonDeterministicSignatures)
+	require.NotContains(t, server.publicKeyTypes(), gossh.KeyAlgoECDSA256)
+}
+
+func newTestServer(t *testing.T) *testServer {
+	_, hostKey, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+
+	hostSigner, err := gossh.NewSignerFromKey(hostKey)
+	require.NoError(t, err)
+
+	config := &gossh.ServerConfig{NoClientAuth: true}
+	config.AddHostKey(hostSigner)
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { listener.Close() })
+
+	s := &testServer{
+		addr:     listener.Addr().(*net.TCPAddr),
+		values:   map[protocol.Namespace]map[string]string{},
+		names:    map[protocol.Namespace]map[string]string{},
+		history:  map[protocol.Namespace]map[string][]string{},
+		expiries: map[protocol.Namespace]map[string]time.Time{},
+		metadata: map[protocol.Namespace]map[string]protocol.Description{},
+	}
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+
+			go s.serve(conn, config)
+		}
+	}()
+
+	return s
+}
+
+func (s *testServer) dial(t *testing.T) *ssh.SSHClient {
+	knownHosts := filepath.Join(t.TempDir(), "known_hosts")
+
+	conn, err := ssh.NewSSHClient(
+		t.Context(),
+		s.addr.IP.String(),
+		s.addr.Port,
+		"alice",
+		gossh.Password(""),
+		ssh.HostKeyCallback(knownHosts, ssh.HostKeyCheckingAcceptNew, "", nil),
+		ssh.DialOptions{},
+	)
+	require.NoError(t, err)
+
+	return conn
+}
+
+func (s *testServer) client(
+	t *testing.T,
+	identity *client.Identity,
+	opts ...client.Option,
+) *client.Client {
+	c, err := client.New(s.dial(t), identity, opts...)
+	require.NoError(t, err)
+	t.Cleanup(func() { c.Close() })
+
+	return c
+}
+
+func (s *testServer) keys() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return slices.Collect(maps.Keys(s.values[protocol.DefaultNamespace]))
+}
+
+func (s *testServer) storedValues() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return slices.Collect(maps.Values(s.values[protocol.DefaultNamespace]))
+}
+
+// copy copies the stored value of the key between namespaces.
+func (s *testServer) copy(from, to protocol.Namespace, key string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.values[to][key] = s.values[from][key]
+}
+
+func (s *testServer) publicKeyTypes() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var types []string
+	for _, k := range s.publicKeys {
+		publicKey, _, _, _, err := gossh.ParseAuthorizedKey([]byte(k))
+		if err == nil {
+			types = append(types, publicKey.Type())
+		}
+	}
+
+	return types
+}
+
+func (s *testServer) serve(conn net.Conn, config *gossh.ServerConfig) {
+	sc, chans, reqs, err := gossh.NewServerConn(conn, config)
+	if err != nil {
+		return
+	}
+
+	go gossh.DiscardRequests(reqs)
+
+	for newChannel := range chans {
+		ch, requests, err := newChannel.Accept()
+		if err != nil {
+			return
+		}
+
+		go func() {
+			for req := range requests {
+				req.Reply(req.Type == "subsystem", nil)
+
+				if req.Type != "subsystem" {
+					continue
+				}
+
+				go func() {
+					for {
+						var req protocol.Request
+						if err := protocol.ReadFrame(ch, &req); err != nil {
+							break
+						}
+
+						res := s.handle(&req, sc.SessionID())
+						s.record(&req, res)
+						res.ID = req.ID
+						res.Version = protocol.Version
+
+						protocol.WriteFrame(ch, res)
+					}
+
+					ch.Close()
+				}()
+			}
+		}()
+	}
+}
+
+func (s *testServer) record(req *protocol.Request, res *protocol.Response) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.legacy ||
+		req.Command == protocol.CapabilitiesCommand ||
+		req.Command == protocol.AuditCommand {
+		return
+	}
+
+	status := "success"
+	if res.Code != "" {
+		status = string(res.Code)
+	}
+
+	s.audit = append(s.audit, protocol.AuditEvent{
+		Timestamp: time.Now(),
+		Action:    req.Command,
+		Status:    status,
+	})
+}
+
+func (s *testServer) handle(req *protocol.Request, sessionID []byte) *protocol.Response {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	args := make([]string, len(req.Args))
+	for i, arg := range req.Args {
+		args[i] = string(arg)
+	}
+
+	ns := protocol.DefaultNamespace
+
+	if project, ok := req.Flags[protocol.ProjectFlag]; ok {
+		if s.legacy {
+			return &protocol.Response{Error: "unknown flag", Code: protocol.CodeInvalidArgument}
+		}
+
+		ns = protocol.Namespace{
+			Project:     project,
+			Environment: req.Flags[protocol.EnvironmentFlag],
+		}
+	}
+
+	values := s.values[ns]
+	names := s.names[ns]
+	history := s.history[ns]
+	expiries := s.expiries[ns]
+	metadata := s.metadata[ns]
+
+	switch req.Command {
+	case "set":
+		if values == nil {
+			values = map[string]string{}
+			names = map[string]string{}
+			history = map[string][]string{}
+			expiries = map[string]time.Time{}
+			metadata = map[string]protocol.Description{}
+			s.values[ns] = values
+			s.names[ns] = names
+			s.history[ns] = history
+			s.expiries[ns] = expiries
+			s.metadata[ns] = metadata
+		}
+
+		m := metadata[args[0]]
+		m.Key = []byte(args[0])
+		m.Version++
+		if description := req.Flags[protocol.DescriptionFlag]; description != "" {
+			m.Description = description
+		}
+		if tags, ok := req.Flags[protocol.TagsFlag]; ok {
+			m.Tags = strings.Split(tags, ",")
+		}
+		metadata[args[0]] = m
+
+		delete(expiries, args[0])
+		if expiresAt, ok := req.Flags[protocol.ExpiresAtFlag]; ok {
+			expiries[args[0]], _ = time.Parse(time.RFC3339, expiresAt)
+		}
+
+		values[args[0]] = args[1]
+		history[args[0]] = append(history[args[0]], args[1])
+		if len(args) > 2 {
+			names[args[0]] = args[2]
+		}
+
+		return &protocol.Response{}
+
+	case "get":
+		value, ok := values[args[0]]
+		if expiresAt, expires := expiries[args[0]]; expires && expiresAt.Before(time.Now()) {
+			ok = false
+		}
+		if version, err := strconv.Atoi(req.Flags[protocol.VersionFlag]); err == nil {
+			ok = version <= len(history[args[0]])
+			if ok {
+				value = history[args[0]][version-1]
+			}
+		}
+		if !ok {
+			return &protocol.Response{Error: "not found", Code: protocol.CodeNotFound}
+		}
+
+		return &protocol.Response{Output: []byte(value)}
+
+	case "list":
+		entries := []protocol.Entry{}
+		for key := range values {
+			if tag := req.Flags[protocol.TagFlag]; tag != "" &&
+				!slices.Contains(metadata[key].Tags, tag) {
+				continue
+			}
+
+			entry := protocol.Entry{
+				Key:         []byte(key),
+				Name:        names[key],
+				Description: metadata[key].Description,
+				Tags:        metadata[key].Tags,
+			}
+			if expiresAt, ok := expiries[key]; ok {
+				entry.ExpiresAt = &expiresAt
+			}
+
+			entries = append(entries, entry)
+		}
+
+		output, _ := json.Marshal(entries)
+
+		return &protocol.Response{Output: output}
+
+	case "remove":
+		delete(values, args[0])
+		delete(names, args[0])
+		delete(history, args[0])
+		delete(expiries, args[0])
+		delete(metadata, args[0])
+
+		return &protocol.Response{}
+
+	case protocol.DescribeCommand:
+		m, ok := metadata[args[0]]
+		if !ok {
+			return &protocol.Response{Error: "not found", Code: protocol.CodeNotFound}
+		}
+
+		m.Name = names[args[0]]
+		output, _ := json.Marshal(&m)
+
+		return &protocol.Response{Output: output}
+
+	case protocol.HistoryCommand:
+		revisions := []protocol.Revision{}
+		for i := range history[args[0]] {
+			revisions = append(revisions, protocol.Revision{Version: i + 1})
+		}
+
+		output, _ := json.Marshal(revisions)
+
+		return &protocol.Response{Output: output}
+
+	case protocol.RollbackCommand:
+		version, _ := strconv.Atoi(args[1])
+		if version < 1 || version > len(history[args[0]]) {
+			return &protocol.Response{Error: "version not found", Code: protocol.CodeNotFound}
+		}
+
+		values[args[0]] = history[args[0]][version-1]
+		history[args[0]] = append(history[args[0]], values[args[0]])
+
+		return &protocol.Response{}
+
+	case protocol.AuditCommand:
+		if s.legacy {
+			break
+		}
+
+		since, _ := time.Parse(time.RFC3339, req.Flags[protocol.SinceFlag])
+
+		events := []protocol.AuditEvent{}
+		for _, e := range s.audit {
+			action := req.Flags[protocol.ActionFlag]
+			if e.Timestamp.Before(since) || (action != "" && e.Action != action) {
+				continue
+			}
+
+			events = append(events, e)
+		}
+
+		output, _ := json.Marshal(events)
+
+		return &protocol.Response{Output: output}
+
+	case protocol.ReplaceCommand:
+		if s.legacy {
+			break
+		}
+
+		var replacement protocol.Replacement
+		if err := json.Unmarshal([]byte(args[1]), &replacement); err != nil {
+			return &protocol.Response{Error: err.Error(), Code: protocol.CodeInvalidArgument}
+		}
+
+		if _, ok := values[args[0]]; !ok {
+			return &protocol.Response{Error: "key not found", Code: protocol.CodeNotFound}
+		}
+
+		versions := history[args[0]]
+		if _, ok := replacement.Values[len(versions)]; !ok {
+			return &protocol.Response{Error: "stale replacement", Code: protocol.CodeInvalidArgument}
+		}
+
+		for version, value := range replacement.Values {
+			if version >= 1 && version <= len(versions) {
+				versions[version-1] = value
+			}
+		}
+
+		m := metadata[args[0]]
+		m.Key = []byte(replacement.Key)
+
+		delete(values, args[0])
+		delete(names, args[0])
+		delete(history, args[0])
+		delete(metadata, args[0])
+
+		values[replacement.Key] = versions[len(versions)-1]
+		history[replacement.Key] = versions
+		metadata[replacement.Key] = m
+		if replacement.Name != "" {
+			names[replacement.Key] = replacement.Name
+		}
+
+		if expiresAt, ok := expiries[args[0]]; ok {
+			delete(expiries, args[0])
+			expiries[replacement.Key] = expiresAt
+		}
+
+		return &protocol.Response{}
+
+	case protocol.AddKeyCommand:
+		publicKey, _, _, _, err := gossh.ParseAuthorizedKey([]byte(args[0]))
+		if err != nil {
+			return &protocol.Response{Error: err.Error(), Code: protocol.CodeInvalidArgument}
+		}
+
+		if !s.legacy {
+			err := ssh.VerifyKeyProof(publicKey, sessionID, req.Flags[protocol.ProofFlag])
+			if err != nil {
+				return &protocol.Response{Error: err.Error(), Code: protocol.CodeInvalidArgument}
+			}
+		}
+
+		s.publicKeys = append(s.publicKeys, args[0])
+
+		return &protocol.Response{}
+
+	case protocol.CapabilitiesCommand:
+		if s.legacy {
+			break
+		}
+
+		if s.capabilitiesErr != nil {
+			return &protocol.Response{
+				Error: s.capabilitiesErr.Error(),
+				Code:  protocol.ErrorCode(s.capabilitiesErr),
+			}
+		}
+
+		output, _ := json.Marshal(&protocol.Capabilities{
+			Version:   "1.0.0",
+			Protocols: []int{protocol.Version},
+			Features: []string{
+				protocol.FeatureHiddenKeys,
+				protocol.FeaturePublicKeys,
+				protocol.FeatureNamespaces,
+				protocol.FeatureHistory,
+				protocol.FeatureExpiry,
+				protocol.FeatureMetadata,
+				protocol.FeatureAudit,
+				protocol.FeatureReplace,
+				protocol.FeatureKeyProof,
+			},
+		})
+
+		return &protocol.Response{Output: output}
+
+	case protocol.NamespacesCommand:
+		output, _ := json.Marshal(slices.Collect(maps.Keys(s.values)))
+
+		return &protocol.Response{Output: output}
+	}
+
+	// servers that predate error codes fail unknown commands with cobra's
+	// message
+	if s.legacy {
+		return &protocol.Response{
+			Error: fmt.Sprintf("unknown command %q for \"syringe\"", req.Command),
+		}
+	}
+
+	return &protocol.Response{Error: "unknown command", Code: protocol.CodeUnknownCommand}
+}
+
+// newTestIdentity writes a new ed25519 key to disk and returns its identity.
+func newTestIdentity(t *testing.T) *client.Identity {
+	_, privateKey, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+
+	return writeTestIdentity(t, privateKey)
+}
+
+// writeTestIdentity writes the private key to disk and returns its identity.
+func writeTestIdentity(t *testing.T, privateKey crypto.PrivateKey) *client.Identity {
+	block, err := gossh.MarshalPrivateKey(privateKey, "")
+	require.NoError(t, err)
+
+	signer, err := gossh.NewSignerFromKey(privateKey)
+	require.NoError(t, err)
+
+	path := filepath.Join(t.TempDir(), "id")
+	require.NoError(t, os.WriteFile(path, pem.EncodeToMemory(block), 0600))
+	require.NoError(t, os.WriteFile(
+		path+".pub",
+		gossh.MarshalAuthorizedKey(signer.PublicKey()),
+		0644,
+	))
+
+	identity, err := client.NewIdentity(path, nil, nil)
+	require.NoError(t, err)
+
+	return identity
+}
+
+// newTestAgentIdentity returns an identity whose key is held by an ssh agent
+// and encrypted on disk, its passphrase read with readPassword.
+func newTestAgentIdentity(t *testing.T, readPassword ssh.PasswordReader) *client.Identity {
+	_, privateKey, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+
+	block, err := gossh.MarshalPrivateKeyWithPassphrase(
+		privateKey,
+		"",
+		[]byte("correct horse battery staple"),
+	)
+	require.NoError(t, err)
+
+	signer, err := gossh.NewSignerFromKey(privateKey)
+	require.NoError(t, err)
+
+	path := filepath.Join(t.TempDir(), "id_ed25519")
+	require.NoError(t, os.WriteFile(path, pem.EncodeToMemory(block), 0600))
+	require.NoError(t, os.WriteFile(
+		path+".pub",
+		gossh.MarshalAuthorizedKey(signer.PublicKey()),
+		0644,
+	))
+
+	keyring := agent.NewKeyring()
+	require.NoError(t, keyring.Add(agent.AddedKey{PrivateKey: privateKey}))
+
+	// unix socket paths are too short for the test's temp dir
+	dir, err := os.MkdirTemp("", "agent")
+	require.NoError(t, err)
+	t.Cleanup(func() { os.RemoveAll(dir) })
+
+	sock := filepath.Join(dir, "agent.sock")
+
+	listener, err := net.Listen("unix", sock)
+	require.NoError(t, err)
+	t.Cleanup(func() { listener.Close() })
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+
+			go func() {
+				defer conn.Close()
+				agent.ServeAgent(keyring, conn)
+			}()
+		}
+	}()
+
+	t.Setenv("SSH_AUTH_SOCK", sock)
+
+	identity, err := client.NewIdentity(path, nil, readPassword)
+	require.NoError(t, err)
+
+	return identity
+}
@@ -0,0 +1,158 @@
+package client
+
+import (
+	"crypto"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+
+	"github.com/nixpig/syringe.sh/pkg/ssh"
+	gossh "golang.org/x/crypto/ssh"
+)
+
+// Identity is the user's SSH key. The ssh agent is preferred when it holds the
+// key, so the private key is only read, and its passphrase prompted for, when
+// it's needed.
+type Identity struct {
+	path         string
+	out          io.Writer
+	readPassword ssh.PasswordReader
+	publicKey    gossh.PublicKey
+	agentSigner  gossh.Signer
+
+	mu         sync.Mutex
+	privateKey crypto.PrivateKey
+}
+
+// NewIdentity returns the identity for the private key at path, whose public
+// key is alongside it with a .pub extension. The passphrase of an encrypted
+// private key is prompted for on out and read with readPassword, either of
+// which may be nil when the key isn't encrypted or is held by the agent.
+func NewIdentity(
+	path string,
+	out io.Writer,
+	readPassword ssh.PasswordReader,
+) (*Identity, error) {
+	publicKey, err := ssh.GetPublicKey(path + ".pub")
+	if err != nil {
+		return nil, fmt.Errorf("get public key: %w", err)
+	}
+
+	if out == nil {
+		out = io.Discard
+	}
+
+	i := &Identity{
+		path:         path,
+		out:          out,
+		readPassword: readPassword,
+		publicKey:    publicKey,
+	}
+
+	if signer, err := ssh.AgentSigner(publicKey); err == nil {
+		i.agentSigner = signer
+	}
+
+	return i, nil
+}
+
+// PublicKey returns the identity's public key.
+func (i *Identity) PublicKey() gossh.PublicKey {
+	return i.publicKey
+}
+
+// getPrivateKey reads the private key, at most once.
+func (i *Identity) getPrivateKey() (crypto.PrivateKey, error) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	if i.privateKey != nil {
+		return i.privateKey, nil
+	}
+
+	readPassword := i.readPassword
+	if readPassword == nil {
+		readPassword = func(int) ([]byte, error) {
+			return nil, errors.New("no way to read the passphrase")
+		}
+	}
+
+	privateKey, err := ssh.GetPrivateKey(i.path, i.out, readPassword)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get private key from identity: %w", err)
+	}
+
+	i.privateKey = privateKey
+
+	return privateKey, nil
+}
+
+// signer returns the agent's signer for the key, otherwise a signer for the
+// private key.
+func (i *Identity) signer() (gossh.Signer, error) {
+	if i.agentSigner != nil {
+		return i.agentSigner, nil
+	}
+
+	privateKey, err := i.getPrivateKey()
+	if err != nil {
+		return nil, err
+	}
+
+	signer, err := gossh.NewSignerFromKey(privateKey)
+	if err != nil {
+		return nil, fmt.Errorf("create signer: %w", err)
+	}
+
+	return signer, nil
+}
+
+// encryptor returns a Cryptor that encrypts for the public keys and, when the
+// agent holds the identity, also for the agent so values can be decrypted
+// without reading the private key.
+func (i *Identity) encryptor(
+	publicKeys []gossh.PublicKey,
+	associatedData []byte,
+) ssh.Cryptor {
+	if i.agentSigner != nil {
+		return ssh.NewAgentEncryptor(i.agentSigner, publicKeys, associatedData)
+	}
+
+	return ssh.NewEncryptor(publicKeys, associatedData)
+}
+
+// decrypt decrypts the value, trying the agent first and falling back to the
+// private key only for values that weren't wrapped for the agent.
+func (i *Identity) decrypt(value string, associatedData []byte) (string, error) {
+	if i.agentSigner != nil && !ssh.IsLegacy(value) {
+		decrypt := ssh.NewAgentDecryptor(i.agentSigner, associatedData)
+
+		decryptedValue, err := decrypt(value)
+		if !errors.Is(err, ssh.ErrNotRecipient) {
+			return decryptedValue, err
+		}
+	}
+
+	privateKey, err := i.getPrivateKey()
+	if err != nil {
+		return "", err
+	}
+
+	return ssh.NewDecryptor(privateKey, associatedData)(value)
+}
+
+// keyHasher returns the KeyHasher used to hide key names from the server.
+func (i *Identity) keyHasher() (ssh.KeyHasher, error) {
+	signer, err := i.signer()
+	if err != nil {
+		return nil, err
+	}
+
+	hasher, err := ssh.NewKeyHasher(signer)
+	if err != nil {
+		return nil, fmt.Errorf("create key hasher: %w", err)
+	}
+
+	return hasher, nil
+}
@@ -0,0 +1,347 @@
+package client
+
+import (
+	"context"
+	"crypto"
+	"errors"
+	"fmt"
+	"maps"
+	"slices"
+
+	"github.com/nixpig/syringe.sh/pkg/protocol"
+	"github.com/nixpig/syringe.sh/pkg/ssh"
+	gossh "golang.org/x/crypto/ssh"
+)
+
+// RekeyProgress records the keys that have been rekeyed, so an interrupted
+// rekey can be resumed.
+type RekeyProgress interface {
+	IsDone(key string) bool
+	MarkDone(key string) error
+}
+
+// memoryProgress is the RekeyProgress when none is given, so a rekey starts
+// over each time.
+type memoryProgress map[string]bool
+
+func (p memoryProgress) IsDone(key string) bool {
+	return p[key]
+}
+
+func (p memoryProgress) MarkDone(key string) error {
+	p[key] = true
+	return nil
+}
+
+// Rekey registers the public key of the new identity, then re-encrypts each
+// value that the old identity can decrypt for the new one, in every
+// namespace. Values shared with other recipients stay shared with them, so
+// their public keys must be given. Progress may be nil. It returns the number
+// of records rekeyed, out of the total.
+func (c *Client) Rekey(
+	ctx context.Context,
+	from, to *Identity,
+	progress RekeyProgress,
+	recipients ...gossh.PublicKey,
+) (rekeyed, total int, err error) {
+	if progress == nil {
+		progress = memoryProgress{}
+	}
+
+	privateKey, err := from.getPrivateKey()
+	if err != nil {
+		return 0, 0, err
+	}
+
+	namespaces, err := c.Namespaces(ctx)
+	if err != nil {
+		return 0, 0, fmt.Errorf("list namespaces: %w", err)
+	}
+
+	// hidden keys are hashed again for the new key, which needs its
+	// signatures to be deterministic, so they're checked for before anything
+	// is rekeyed
+	if err := ssh.CheckDeterministicSignatures(to.publicKey); err != nil {
+		for _, ns := range namespaces {
+			records, listErr := c.list(ctx, ns, "")
+			if listErr != nil {
+				return 0, 0, fmt.Errorf("list records: %w", listErr)
+			}
+
+			if slices.ContainsFunc(records, func(record protocol.Entry) bool {
+				return record.Name != ""
+			}) {
+				return 0, 0, fmt.Errorf("can't rekey hidden keys: %w", err)
+			}
+		}
+	}
+
+	if err := c.AddPublicKey(ctx, to); err != nil {
+		return 0, 0, fmt.Errorf("register new public key: %w", err)
+	}
+
+	capabilities, err := c.Capabilities(ctx)
+	if err != nil {
+		return 0, 0, fmt.Errorf("get server capabilities: %w", err)
+	}
+
+	r := &rekeyer{
+		client:     c,
+		from:       from,
+		to:         to,
+		privateKey: privateKey,
+		recipients: recipients,
+		progress:   progress,
+		replace:    capabilities.Supports(protocol.FeatureReplace),
+	}
+
+	for _, ns := range namespaces {
+		if err := r.rekeyNamespace(ctx, ns); err != nil {
+			return r.rekeyed, r.total, err
+		}
+	}
+
+	return r.rekeyed, r.total, nil
+}
+
+// rekeyer rekeys the records in each namespace in turn.
+type rekeyer struct {
+	client     *Client
+	from, to   *Identity
+	privateKey crypto.PrivateKey
+	recipients []gossh.PublicKey
+	progress   RekeyProgress
+
+	// hidden keys are hashed with a key derived from the identity, so
+	// they're stored under a new hash for the new key
+	newHash ssh.KeyHasher
+
+	// replace is whether the server replaces keys in one write. Older
+	// servers have rekeyed values set again, and hidden keys set under their
+	// new hash before the old one is removed.
+	replace bool
+
+	rekeyed, total int
+}
+
+func (r *rekeyer) rekeyNamespace(ctx context.Context, ns protocol.Namespace) error {
+	c := r.client
+
+	records, err := c.list(ctx, ns, "")
+	if err != nil {
+		return fmt.Errorf("list records: %w", err)
+	}
+
+	r.total += len(records)
+
+	for _, record := range records {
+		key := string(record.Key)
+
+		// progress of the default namespace is recorded by key alone, as it
+		// was before namespaces
+		progressKey := key
+		if ns != protocol.DefaultNamespace {
+			progressKey = ns.Project + "/" + ns.Environment + "/" + key
+		}
+
+		if r.progress.IsDone(progressKey) {
+			continue
+		}
+
+		values, err := r.stored(ctx, ns, key)
+		if err != nil {
+			return fmt.Errorf("get '%s': %w", key, err)
+		}
+
+		// previous versions need rekeying if the current one doesn't when
+		// they're still encrypted for the old key
+		current := slices.Max(slices.Collect(maps.Keys(values)))
+		if !r.needsRekey(values[current]) &&
+			!slices.ContainsFunc(slices.Collect(maps.Values(values)), func(v string) bool {
+				return ssh.IsEncryptedFor(v, r.from.publicKey)
+			}) {
+			if err := r.progress.MarkDone(progressKey); err != nil {
+				return err
+			}
+
+			continue
+		}
+
+		name := key
+		if record.Name != "" {
+			name, err = r.from.decrypt(record.Name, ssh.KeyNameAssociatedData())
+			if err != nil {
+				return fmt.Errorf("decrypt key name: %w", err)
+			}
+		}
+
+		rekey := ssh.NewRekeyer(
+			r.privateKey,
+			r.to.publicKey,
+			r.to.agentSigner,
+			r.recipients,
+			associatedData(ns, name),
+		)
+
+		changed := false
+
+		for version, value := range values {
+			if !r.needsRekey(value) {
+				continue
+			}
+
+			// rekeying would authenticate the value with its key
+			if err := c.checkLegacy(value); err != nil {
+				return fmt.Errorf("rekey '%s' version %d: %w", name, version, err)
+			}
+
+			rekeyedValue, err := rekey(value)
+
+			// versions from before an earlier rekey can't be rekeyed, and
+			// are left as they are
+			if errors.Is(err, ssh.ErrNotRecipient) && version != current {
+				continue
+			}
+			if err != nil {
+				return fmt.Errorf("rekey '%s': %w", name, err)
+			}
+
+			values[version] = rekeyedValue
+			changed = true
+		}
+
+		if !changed {
+			if err := r.progress.MarkDone(progressKey); err != nil {
+				return err
+			}
+
+			continue
+		}
+
+		newKey, rekeyedName := key, ""
+		if record.Name != "" {
+			if r.newHash == nil {
+				r.newHash, err = r.to.keyHasher()
+				if err != nil {
+					return err
+				}
+			}
+
+			rekeyName := ssh.NewRekeyer(
+				r.privateKey,
+				r.to.publicKey,
+				r.to.agentSigner,
+				nil,
+				ssh.KeyNameAssociatedData(),
+			)
+
+			rekeyedName, err = rekeyName(record.Name)
+			if err != nil {
+				return fmt.Errorf("rekey key name '%s': %w", name, err)
+			}
+
+			newKey = r.newHash(name)
+		}
+
+		if value, ok := values[0]; ok {
+			if err := r.set(ctx, ns, record, key, newKey, value, rekeyedName); err != nil {
+				return fmt.Errorf("set '%s' in store: %w", name, err)
+			}
+		} else if err := c.replace(ctx, ns, key, &protocol.Replacement{
+			Key:    newKey,
+			Name:   rekeyedName,
+			Values: values,
+		}); err != nil {
+			return fmt.Errorf("replace '%s' in store: %w", name, err)
+		}
+
+		if err := r.progress.MarkDone(progressKey); err != nil {
+			return err
+		}
+
+		r.rekeyed++
+	}
+
+	return nil
+}
+
+// stored returns the stored values of the key, by version. They're every
+// version kept when the server replaces keys, so each is rekeyed, and
+// replacing them fails if the key is set again before they're written back.
+// Otherwise, the current value is returned as version 0.
+func (r *rekeyer) stored(
+	ctx context.Context,
+	ns protocol.Namespace,
+	key string,
+) (map[int]string, error) {
+	c := r.client
+
+	var revisions []protocol.Revision
+	if r.replace {
+		var err error
+		if revisions, err = c.history(ctx, ns, key); err != nil {
+			return nil, err
+		}
+	}
+
+	if len(revisions) == 0 {
+		value, err := c.getStored(ctx, ns, key, 0)
+		if err != nil {
+			return nil, err
+		}
+
+		return map[int]string{0: value}, nil
+	}
+
+	values := make(map[int]string, len(revisions))
+	for _, revision := range revisions {
+		value, err := c.getStored(ctx, ns, key, revision.Version)
+		if err != nil {
+			return nil, err
+		}
+
+		values[revision.Version] = value
+	}
+
+	return values, nil
+}
+
+// needsRekey reports whether the value may need rekeying. It may have been
+// rekeyed before progress was recorded, and vault values are encrypted with a
+// passphrase, not the key.
+func (r *rekeyer) needsRekey(value string) bool {
+	if ssh.IsEncryptedFor(value, r.from.publicKey) {
+		return true
+	}
+
+	return !ssh.IsEncryptedFor(value, r.to.publicKey) && !ssh.IsPassphraseEncrypted(value)
+}
+
+// set sets the rekeyed value, for servers that don't replace keys. Hidden
+// keys are set under their new hash, keeping their expiry, description and
+// tags, then removed from under the old one.
+func (r *rekeyer) set(
+	ctx context.Context,
+	ns protocol.Namespace,
+	record protocol.Entry,
+	key, newKey, value, name string,
+) error {
+	c := r.client
+
+	opts := SetOptions{
+		ExpiresAt:   record.ExpiresAt,
+		Description: record.Description,
+		Tags:        record.Tags,
+	}
+
+	if name == "" {
+		return c.doSet(ctx, ns, opts, key, value)
+	}
+
+	if err := c.doSet(ctx, ns, opts, newKey, value, name); err != nil {
+		return err
+	}
+
+	_, err := c.do(ctx, ns, "remove", key)
+	return err
+}
@@ -0,0 +1,54 @@
+package protocol
+
+import "slices"
+
+// CapabilitiesCommand is the command the server answers with its
+// Capabilities, as JSON. It doesn't require the client to be registered.
+const CapabilitiesCommand = "capabilities"
+
+// Features a server can advertise.
+const (
+	// FeatureSubsystem is the syringe subsystem, which carries many requests
+	// over one channel.
+	FeatureSubsystem = "subsystem"
+	// FeatureHiddenKeys is storing values under hashed keys with their
+	// encrypted names.
+	FeatureHiddenKeys = "hidden-keys"
+	// FeaturePublicKeys is looking up users' public keys and adding keys.
+	FeaturePublicKeys = "public-keys"
+	// FeatureNamespaces is storing values in projects and environments, set
+	// with the ProjectFlag and EnvironmentFlag of requests.
+	FeatureNamespaces = "namespaces"
+	// FeatureHistory is keeping previous versions of values, getting them
+	// with the VersionFlag, listing them with the HistoryCommand and rolling
+	// back to them with the RollbackCommand.
+	FeatureHistory = "history"
+	// FeatureExpiry is setting values that expire, with the ExpiresAtFlag.
+	FeatureExpiry = "expiry"
+	// FeatureMetadata is describing values with the DescriptionFlag and
+	// TagsFlag of the set command, listing them by the TagFlag and getting
+	// them with the DescribeCommand.
+	FeatureMetadata = "metadata"
+	// FeatureAudit is listing the commands run on the user's account with the
+	// AuditCommand.
+	FeatureAudit = "audit"
+	// FeatureReplace is re-encrypting keys in place with the
+	// ReplaceCommand.
+	FeatureReplace = "replace"
+	// FeatureKeyProof is requiring keys added with the AddKeyCommand to be
+	// proven with the ProofFlag.
+	FeatureKeyProof = "key-proof"
+)
+
+// Capabilities is what the server supports, so clients can adapt to older or
+// newer servers.
+type Capabilities struct {
+	Version   string   `json:"version"`
+	Protocols []int    `json:"protocols"`
+	Features  []string `json:"features"`
+}
+
+// Supports reports whether the server advertised the feature.
+func (c *Capabilities) Supports(feature string) bool {
+	return slices.Contains(c.Features, feature)
+}
@@ -0,0 +1,83 @@
+package protocol
+
+import (
+	"errors"
+	"fmt"
+)
+
+// Code identifies the kind of error a request failed with.
+type Code string
+
+const (
+	CodeInternal         Code = "internal"
+	CodeInvalidArgument  Code = "invalid_argument"
+	CodeNotAuthenticated Code = "not_authenticated"
+	CodeNotFound         Code = "not_found"
+	CodeAlreadyExists    Code = "already_exists"
+	CodeUnsupported      Code = "unsupported"
+	CodeUnknownCommand   Code = "unknown_command"
+)
+
+// exitStatuses are the exit statuses of sessions and the client that fail
+// with each code, so scripts can tell errors apart.
+var exitStatuses = map[Code]int{
+	CodeInternal:         1,
+	CodeInvalidArgument:  2,
+	CodeNotAuthenticated: 3,
+	CodeNotFound:         4,
+	CodeAlreadyExists:    5,
+	CodeUnsupported:      6,
+	CodeUnknownCommand:   6,
+}
+
+// ExitStatus returns the exit status for the code.
+func ExitStatus(code Code) int {
+	if status, ok := exitStatuses[code]; ok {
+		return status
+	}
+
+	return exitStatuses[CodeInternal]
+}
+
+// Error is an error with a code. An Error without a message matches any
+// Error with the same code with errors.Is, so can be used as a sentinel.
+type Error struct {
+	Code    Code
+	Message string
+}
+
+// Errorf returns an Error with the code and formatted message.
+func Errorf(code Code, format string, a ...any) *Error {
+	return &Error{
+		Code:    code,
+		Message: fmt.Sprintf(format, a...),
+	}
+}
+
+func (e *Error) Error() string {
+	if e.Message == "" {
+		return string(e.Code)
+	}
+
+	return e.Message
+}
+
+func (e *Error) Is(target error) bool {
+	t, ok := target.(*Error)
+	if !ok {
+		return false
+	}
+
+	return t.Code == e.Code && (t.Message == "" || t.Message == e.Message)
+}
+
+// ErrorCode returns the code of the first Error in err's tree, or
+// CodeInternal if there isn't one.
+func ErrorCode(err error) Code {
+	var e *Error
+	if errors.As(err, &e) {
+		return e.Code
+	}
+
+	return CodeInternal
+}
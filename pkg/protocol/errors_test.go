@@ -0,0 +1,32 @@
+package protocol_test
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/nixpig/syringe.sh/pkg/protocol"
+	"github.com/stretchr/testify/require"
+)
+
+func TestErrors(t *testing.T) {
+	notFound := &protocol.Error{Code: protocol.CodeNotFound}
+
+	res := &protocol.Response{Error: "key not found", Code: protocol.CodeNotFound}
+	err := fmt.Errorf("get 'foo': %w", res.Err())
+
+	require.ErrorIs(t, err, notFound)
+	require.NotErrorIs(t, err, &protocol.Error{Code: protocol.CodeNotAuthenticated})
+	require.Equal(t, "get 'foo': key not found", err.Error())
+	require.Equal(t, protocol.CodeNotFound, protocol.ErrorCode(err))
+	require.Equal(t, 4, protocol.ExitStatus(protocol.ErrorCode(err)))
+
+	// servers that predate error codes fail with internal errors
+	res = &protocol.Response{Error: "database error"}
+	require.ErrorIs(t, res.Err(), &protocol.Error{Code: protocol.CodeInternal})
+
+	require.NoError(t, (&protocol.Response{Output: []byte("bar")}).Err())
+
+	require.Equal(t, protocol.CodeInternal, protocol.ErrorCode(errors.New("boom")))
+	require.Equal(t, 1, protocol.ExitStatus(protocol.ErrorCode(errors.New("boom"))))
+}
@@ -0,0 +1,277 @@
+// Package protocol is the request/response protocol spoken between the
+// syringe client and server over the stdin and stdout of an ssh session.
+//
+// Each message is a frame of a 4 byte big-endian length followed by that many
+// bytes of JSON. Arguments and output are bytes, encoded as base64 in JSON, so
+// arbitrary values round-trip unchanged.
+package protocol
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+)
+
+// Version is the version of the protocol spoken by this package.
+const Version = 1
+
+// Subsystem is the ssh subsystem that starts a protocol session. A session
+// can carry any number of requests, each answered by a response with the
+// same ID, in the order they were received.
+const Subsystem = "syringe"
+
+// Command is the ssh command that starts a protocol session, for servers
+// without the subsystem.
+const Command = "syringe-protocol"
+
+// MaxFrameSize is the maximum size of a frame, excluding its length prefix.
+const MaxFrameSize = 4 << 20
+
+var ErrFrameTooLarge = errors.New("frame too large")
+
+// ErrInvalidFrame is the error for a frame whose JSON can't be marshalled or
+// unmarshalled.
+var ErrInvalidFrame = errors.New("invalid frame")
+
+// Request asks the server to run a command.
+type Request struct {
+	ID      uint64            `json:"id,omitempty"`
+	Version int               `json:"version"`
+	Command string            `json:"command"`
+	Flags   map[string]string `json:"flags,omitempty"`
+	Args    [][]byte          `json:"args,omitempty"`
+}
+
+// CancelCommand cancels the request with the same ID, stopping it if it's
+// running, or skipping it if it hasn't started. It has no response of its
+// own, and the rest of the session's requests are unaffected.
+const CancelCommand = "cancel"
+
+// NewRequest returns a request for the command with the args.
+func NewRequest(command string, args ...string) *Request {
+	r := &Request{
+		Version: Version,
+		Command: command,
+	}
+
+	for _, arg := range args {
+		r.Args = append(r.Args, []byte(arg))
+	}
+
+	return r
+}
+
+// Response is the result of a request. Error and Code are set if the command
+// failed.
+type Response struct {
+	ID      uint64 `json:"id,omitempty"`
+	Version int    `json:"version"`
+	Output  []byte `json:"output,omitempty"`
+	Error   string `json:"error,omitempty"`
+	Code    Code   `json:"code,omitempty"`
+}
+
+// Err returns the error the request failed with, or nil if it succeeded.
+// Servers that predate error codes fail with CodeInternal.
+func (r *Response) Err() error {
+	if r.Error == "" {
+		return nil
+	}
+
+	code := r.Code
+	if code == "" {
+		code = CodeInternal
+	}
+
+	return &Error{Code: code, Message: r.Error}
+}
+
+// Entry is a key in the store, as listed in the output of the list command
+// with the "json" flag. Name is the encrypted key name when the key is hidden,
+// and ExpiresAt is when the value expires, if it does.
+type Entry struct {
+	Key         []byte     `json:"key"`
+	Name        string     `json:"name,omitempty"`
+	ExpiresAt   *time.Time `json:"expires_at,omitempty"`
+	Description string     `json:"description,omitempty"`
+	Tags        []string   `json:"tags,omitempty"`
+}
+
+// ExpiresAtFlag of the set command is when the value expires, in RFC 3339
+// format. Expired values can't be got, and are removed by the server.
+const ExpiresAtFlag = "expires-at"
+
+// Flags of the set command describing the value. Tags are separated by
+// commas. The key keeps its description and tags when they aren't given.
+const (
+	DescriptionFlag = "description"
+	TagsFlag        = "tags"
+)
+
+// TagFlag of the list command only lists the keys with the tag.
+const TagFlag = "tag"
+
+// DescribeCommand is the command the server answers with a key's
+// Description, as JSON.
+const DescribeCommand = "describe"
+
+// Description is what's known about a key, besides its value. Name is the
+// encrypted key name when the key is hidden.
+type Description struct {
+	Key         []byte     `json:"key"`
+	Name        string     `json:"name,omitempty"`
+	Version     int        `json:"version"`
+	Description string     `json:"description,omitempty"`
+	Tags        []string   `json:"tags,omitempty"`
+	CreatedAt   time.Time  `json:"created_at"`
+	UpdatedAt   time.Time  `json:"updated_at"`
+	ExpiresAt   *time.Time `json:"expires_at,omitempty"`
+}
+
+// VersionFlag of the get command asks for a previous version of the value.
+const VersionFlag = "version"
+
+// HistoryCommand is the command the server answers with the versions kept of
+// a key, oldest first, as a JSON array of Revision.
+const HistoryCommand = "history"
+
+// RollbackCommand sets a key back to the value it had at a version.
+const RollbackCommand = "rollback"
+
+// Revision is a version of a key's value, and when it was set.
+type Revision struct {
+	Version   int       `json:"version"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// ReplaceCommand replaces the values of a key's versions, re-encrypted, in
+// place, moving it with its history, tags and timestamps to a new key in the
+// same write. Its args are the key and a Replacement, as JSON.
+const ReplaceCommand = "replace"
+
+// Replacement is a key's values by version, which must include its current
+// version, and the key and encrypted name to move it to. Key is the same key
+// unless it's hidden.
+type Replacement struct {
+	Key    string         `json:"key"`
+	Name   string         `json:"name,omitempty"`
+	Values map[int]string `json:"values"`
+}
+
+// AddKeyCommand registers another public key for the user. Its arg is the
+// key, in authorized_keys format.
+const AddKeyCommand = "addkey"
+
+// ProofFlag of the add key command proves the client holds the key, with the
+// key's signature of the ssh session ID.
+const ProofFlag = "proof"
+
+// AuditCommand is the command the server answers with the commands run on the
+// user's account, and attempts to, oldest first, as a JSON array of
+// AuditEvent.
+const AuditCommand = "audit"
+
+// Flags of the audit command. SinceFlag is the earliest time of events, in
+// RFC 3339 format, and ActionFlag only returns events of the command.
+const (
+	SinceFlag  = "since"
+	ActionFlag = "action"
+)
+
+// AuditEvent is a command run on the user's account, or an attempt to run one.
+// Status is "success", or the Code of the error the command failed with, and
+// PublicKey is the SHA256 fingerprint of the key the session was for, and
+// KeyID the key ID of its certificate, if it was one.
+type AuditEvent struct {
+	Timestamp time.Time `json:"timestamp"`
+	Action    string    `json:"action"`
+	Status    string    `json:"status"`
+	Address   string    `json:"address"`
+	Client    string    `json:"client"`
+	Username  string    `json:"username"`
+	PublicKey string    `json:"public_key"`
+	KeyID     string    `json:"key_id,omitempty"`
+}
+
+// Flags of requests for values, naming the project and environment they're
+// in. Requests without them are for the default namespace.
+const (
+	ProjectFlag     = "project"
+	EnvironmentFlag = "env"
+)
+
+// DefaultNamespace is the project and environment of requests without the
+// namespace flags.
+var DefaultNamespace = Namespace{Project: "default", Environment: "default"}
+
+// NamespacesCommand is the command the server answers with the user's
+// namespaces, as a JSON array of Namespace.
+const NamespacesCommand = "namespaces"
+
+// Namespace is a project and one of its environments.
+type Namespace struct {
+	Project     string `json:"project"`
+	Environment string `json:"environment"`
+}
+
+// WriteFrame writes v as a length-prefixed JSON frame.
+func WriteFrame(w io.Writer, v any) error {
+	frame, err := MarshalFrame(v)
+	if err != nil {
+		return err
+	}
+
+	if _, err := w.Write(frame); err != nil {
+		return fmt.Errorf("write frame: %w", err)
+	}
+
+	return nil
+}
+
+// MarshalFrame returns v as a length-prefixed JSON frame, or ErrFrameTooLarge
+// if it's larger than MaxFrameSize.
+func MarshalFrame(v any) ([]byte, error) {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return nil, fmt.Errorf("marshal frame: %w: %w", ErrInvalidFrame, err)
+	}
+
+	if len(b) > MaxFrameSize {
+		return nil, ErrFrameTooLarge
+	}
+
+	frame := binary.BigEndian.AppendUint32(make([]byte, 0, 4+len(b)), uint32(len(b)))
+
+	return append(frame, b...), nil
+}
+
+// ReadFrame reads a length-prefixed JSON frame into v. It returns io.EOF if
+// there are no more frames.
+func ReadFrame(r io.Reader, v any) error {
+	var size uint32
+	if err := binary.Read(r, binary.BigEndian, &size); err != nil {
+		if errors.Is(err, io.EOF) {
+			return io.EOF
+		}
+
+		return fmt.Errorf("read frame size: %w", err)
+	}
+
+	if size > MaxFrameSize {
+		return ErrFrameTooLarge
+	}
+
+	b := make([]byte, size)
+	if _, err := io.ReadFull(r, b); err != nil {
+		return fmt.Errorf("read frame: %w", err)
+	}
+
+	if err := json.Unmarshal(b, v); err != nil {
+		return fmt.Errorf("unmarshal frame: %w: %w", ErrInvalidFrame, err)
+	}
+
+	return nil
+}
@@ -0,0 +1,101 @@
+package protocol_test
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"testing"
+
+	"github.com/nixpig/syringe.sh/pkg/protocol"
+	"github.com/stretchr/testify/require"
+)
+
+func TestProtocol(t *testing.T) {
+	scenarios := map[string]func(t *testing.T){
+		"round trip request (binary args)": testRoundTripRequestBinaryArgs,
+		"round trip response":              testRoundTripResponse,
+		"read frames (multiple frames)":    testReadFramesMultiple,
+		"read frame (no frames)":           testReadFrameNoFrames,
+		"read frame (truncated frame)":     testReadFrameTruncated,
+		"read frame (frame too large)":     testReadFrameTooLarge,
+	}
+
+	for scenario, fn := range scenarios {
+		t.Run(scenario, func(t *testing.T) {
+			fn(t)
+		})
+	}
+}
+
+func testRoundTripRequestBinaryArgs(t *testing.T) {
+	req := protocol.NewRequest(
+		"set",
+		"key with spaces",
+		"'quoted' \"value\"; $(rm -rf /)\n\x00\xff",
+	)
+	req.Flags = map[string]string{"ttl": "1h"}
+
+	var b bytes.Buffer
+	require.NoError(t, protocol.WriteFrame(&b, req))
+
+	var got protocol.Request
+	require.NoError(t, protocol.ReadFrame(&b, &got))
+
+	require.Equal(t, *req, got)
+	require.Equal(t, protocol.Version, got.Version)
+	require.Equal(t, "'quoted' \"value\"; $(rm -rf /)\n\x00\xff", string(got.Args[1]))
+}
+
+func testRoundTripResponse(t *testing.T) {
+	res := &protocol.Response{
+		Version: protocol.Version,
+		Output:  []byte{0x00, 0x01, 0xfe, 0xff},
+		Error:   "not found",
+	}
+
+	var b bytes.Buffer
+	require.NoError(t, protocol.WriteFrame(&b, res))
+
+	var got protocol.Response
+	require.NoError(t, protocol.ReadFrame(&b, &got))
+
+	require.Equal(t, *res, got)
+}
+
+func testReadFramesMultiple(t *testing.T) {
+	var b bytes.Buffer
+	require.NoError(t, protocol.WriteFrame(&b, protocol.NewRequest("get", "foo")))
+	require.NoError(t, protocol.WriteFrame(&b, protocol.NewRequest("list")))
+
+	var first, second protocol.Request
+	require.NoError(t, protocol.ReadFrame(&b, &first))
+	require.NoError(t, protocol.ReadFrame(&b, &second))
+
+	require.Equal(t, "get", first.Command)
+	require.Equal(t, "list", second.Command)
+
+	require.ErrorIs(t, protocol.ReadFrame(&b, &first), io.EOF)
+}
+
+func testReadFrameNoFrames(t *testing.T) {
+	var req protocol.Request
+	require.ErrorIs(t, protocol.ReadFrame(bytes.NewReader(nil), &req), io.EOF)
+}
+
+func testReadFrameTruncated(t *testing.T) {
+	var b bytes.Buffer
+	require.NoError(t, protocol.WriteFrame(&b, protocol.NewRequest("get", "foo")))
+
+	var req protocol.Request
+	err := protocol.ReadFrame(bytes.NewReader(b.Bytes()[:b.Len()-1]), &req)
+	require.Error(t, err)
+	require.NotErrorIs(t, err, io.EOF)
+}
+
+func testReadFrameTooLarge(t *testing.T) {
+	frame := binary.BigEndian.AppendUint32(nil, protocol.MaxFrameSize+1)
+
+	var req protocol.Request
+	err := protocol.ReadFrame(bytes.NewReader(frame), &req)
+	require.ErrorIs(t, err, protocol.ErrFrameTooLarge)
+}
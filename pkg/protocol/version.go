@@ -0,0 +1,150 @@
+package protocol
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// clientName identifies syringe clients in the ssh identification string.
+const clientName = "SSH-2.0-Syringe"
+
+// ClientIdentifier returns the ssh identification string of a client with
+// the semantic version, e.g. SSH-2.0-Syringe_1.2.3.
+func ClientIdentifier(version string) string {
+	return clientName + "_" + version
+}
+
+// ParseClientIdentifier returns the semantic version in a client's ssh
+// identification string. Clients that predate versioned identifiers are
+// version 0.0.0.
+func ParseClientIdentifier(id string) (string, error) {
+	if id == clientName {
+		return "0.0.0", nil
+	}
+
+	version, ok := strings.CutPrefix(id, clientName+"_")
+	if !ok {
+		return "", fmt.Errorf("not a syringe client: %s", id)
+	}
+
+	if _, err := parseSemver(version); err != nil {
+		return "", err
+	}
+
+	return version, nil
+}
+
+// ValidateVersion returns an error if the version isn't a semantic version.
+func ValidateVersion(version string) error {
+	_, err := parseSemver(version)
+	return err
+}
+
+// CompareVersions compares two semantic versions, returning -1, 0 or 1 if a
+// is less than, equal to or greater than b.
+func CompareVersions(a, b string) (int, error) {
+	va, err := parseSemver(a)
+	if err != nil {
+		return 0, err
+	}
+
+	vb, err := parseSemver(b)
+	if err != nil {
+		return 0, err
+	}
+
+	for i := range va.core {
+		if c := compareInts(va.core[i], vb.core[i]); c != 0 {
+			return c, nil
+		}
+	}
+
+	// a pre-release is lower than the release it precedes
+	switch {
+	case va.prerelease == nil && vb.prerelease == nil:
+		return 0, nil
+	case va.prerelease == nil:
+		return 1, nil
+	case vb.prerelease == nil:
+		return -1, nil
+	}
+
+	for i := 0; i < len(va.prerelease) && i < len(vb.prerelease); i++ {
+		if c := comparePrerelease(va.prerelease[i], vb.prerelease[i]); c != 0 {
+			return c, nil
+		}
+	}
+
+	return compareInts(len(va.prerelease), len(vb.prerelease)), nil
+}
+
+type semver struct {
+	core       [3]int
+	prerelease []string
+}
+
+func parseSemver(s string) (*semver, error) {
+	invalid := fmt.Errorf("invalid semantic version: %s", s)
+
+	// build metadata doesn't affect precedence
+	s, _, _ = strings.Cut(s, "+")
+
+	core, prerelease, hasPrerelease := strings.Cut(s, "-")
+
+	parts := strings.Split(core, ".")
+	if len(parts) != 3 {
+		return nil, invalid
+	}
+
+	var v semver
+
+	for i, part := range parts {
+		n, err := strconv.Atoi(part)
+		if err != nil || n < 0 {
+			return nil, invalid
+		}
+
+		v.core[i] = n
+	}
+
+	if hasPrerelease {
+		v.prerelease = strings.Split(prerelease, ".")
+		for _, identifier := range v.prerelease {
+			if identifier == "" {
+				return nil, invalid
+			}
+		}
+	}
+
+	return &v, nil
+}
+
+// comparePrerelease compares pre-release identifiers, numerically if both
+// are numbers.
+func comparePrerelease(a, b string) int {
+	na, errA := strconv.Atoi(a)
+	nb, errB := strconv.Atoi(b)
+
+	switch {
+	case errA == nil && errB == nil:
+		return compareInts(na, nb)
+	case errA == nil:
+		return -1
+	case errB == nil:
+		return 1
+	default:
+		return strings.Compare(a, b)
+	}
+}
+
+func compareInts(a, b int) int {
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	default:
+		return 0
+	}
+}
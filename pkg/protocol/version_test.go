@@ -0,0 +1,52 @@
+package protocol_test
+
+import (
+	"testing"
+
+	"github.com/nixpig/syringe.sh/pkg/protocol"
+	"github.com/stretchr/testify/require"
+)
+
+func TestClientIdentifier(t *testing.T) {
+	version, err := protocol.ParseClientIdentifier(protocol.ClientIdentifier("1.2.3"))
+	require.NoError(t, err)
+	require.Equal(t, "1.2.3", version)
+
+	version, err = protocol.ParseClientIdentifier("SSH-2.0-Syringe")
+	require.NoError(t, err)
+	require.Equal(t, "0.0.0", version)
+
+	_, err = protocol.ParseClientIdentifier("SSH-2.0-OpenSSH_9.6")
+	require.Error(t, err)
+
+	_, err = protocol.ParseClientIdentifier("SSH-2.0-Syringe_latest")
+	require.Error(t, err)
+}
+
+func TestCompareVersions(t *testing.T) {
+	scenarios := map[string]struct {
+		a, b   string
+		expect int
+	}{
+		"equal":                        {"1.2.3", "1.2.3", 0},
+		"major":                        {"2.0.0", "1.9.9", 1},
+		"minor":                        {"1.2.0", "1.10.0", -1},
+		"patch":                        {"1.2.4", "1.2.3", 1},
+		"pre-release before release":   {"0.1.0-alpha.1", "0.1.0", -1},
+		"numeric pre-release":          {"0.1.0-alpha.2", "0.1.0-alpha.10", -1},
+		"alphanumeric pre-release":     {"0.1.0-beta", "0.1.0-alpha", 1},
+		"shorter pre-release is lower": {"0.1.0-alpha", "0.1.0-alpha.1", -1},
+		"build metadata is ignored":    {"1.0.0+abc", "1.0.0+def", 0},
+	}
+
+	for scenario, s := range scenarios {
+		t.Run(scenario, func(t *testing.T) {
+			c, err := protocol.CompareVersions(s.a, s.b)
+			require.NoError(t, err)
+			require.Equal(t, s.expect, c)
+		})
+	}
+
+	_, err := protocol.CompareVersions("1.2", "1.2.3")
+	require.Error(t, err)
+}
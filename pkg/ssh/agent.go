@@ -0,0 +1,200 @@
+package ssh
+
+import (
+	"crypto/hkdf"
+	"crypto/rand"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"os"
+
+	gossh "golang.org/x/crypto/ssh"
+)
+
+const agentInfo = "syringe.sh/agent"
+
+const agentSaltSize = 32
+
+// NewAgentEncryptor returns a Cryptor that encrypts values so they can be
+// decrypted by the private key of any of the given public keys and, without
+// access to the private key, by an ssh agent holding the signer's key.
+func NewAgentEncryptor(
+	signer gossh.Signer,
+	publicKeys []gossh.PublicKey,
+	associatedData []byte,
+) Cryptor {
+	recipients := []recipient{&agentRecipient{signer}}
+	for _, publicKey := range publicKeys {
+		recipients = append(recipients, &publicKeyRecipient{publicKey})
+	}
+
+	return newEncryptor(recipients, associatedData)
+}
+
+// NewAgentDecryptor returns a Cryptor that decrypts values encrypted by
+// NewAgentEncryptor using a signer, typically held by an ssh agent.
+func NewAgentDecryptor(signer gossh.Signer, associatedData []byte) Cryptor {
+	return newDecryptor(&agentIdentity{signer}, associatedData)
+}
+
+// ErrNonDeterministicSignatures is the error deriving keys from the
+// signatures of a key whose signatures differ each time, i.e. an ecdsa key, as
+// agent decryption and hidden key names do.
+var ErrNonDeterministicSignatures = errors.New("signatures aren't deterministic")
+
+// CheckDeterministicSignatures returns ErrNonDeterministicSignatures unless
+// the key produces the same signature each time, i.e. it's an ed25519 or rsa
+// key, so keys can be derived from its signatures.
+func CheckDeterministicSignatures(publicKey gossh.PublicKey) error {
+	switch publicKey.Type() {
+	case gossh.KeyAlgoED25519, gossh.KeyAlgoRSA:
+		return nil
+	default:
+		return fmt.Errorf(
+			"%w for %s keys; agent decryption and hidden key names require an ed25519 or rsa key",
+			ErrNonDeterministicSignatures,
+			publicKey.Type(),
+		)
+	}
+}
+
+// AgentSigner returns the signer for the public key from the ssh agent
+// listening on SSH_AUTH_SOCK. Only keys that produce deterministic signatures,
+// i.e. ed25519 and rsa, are supported.
+func AgentSigner(publicKey gossh.PublicKey) (gossh.Signer, error) {
+	if err := CheckDeterministicSignatures(publicKey); err != nil {
+		return nil, err
+	}
+
+	sshAgentClient, err := NewSSHAgentClient(os.Getenv("SSH_AUTH_SOCK"))
+	if err != nil {
+		return nil, err
+	}
+
+	agentSigners, err := sshAgentClient.Signers()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get signers from ssh agent: %w", err)
+	}
+
+	signers, err := NewSignersFunc(publicKey, agentSigners)()
+	if err != nil {
+		return nil, err
+	}
+
+	return signers[0], nil
+}
+
+// agentRecipient wraps the data key with a key derived from a signature by
+// the signer.
+type agentRecipient struct {
+	signer gossh.Signer
+}
+
+func (r *agentRecipient) wrap(dataKey []byte) (*stanza, error) {
+	salt := make([]byte, agentSaltSize)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, fmt.Errorf("generate salt: %w", err)
+	}
+
+	kek, err := agentKEK(r.signer, salt)
+	if err != nil {
+		return nil, err
+	}
+
+	sealedKey, err := seal(kek, dataKey, nil)
+	if err != nil {
+		return nil, fmt.Errorf("seal data key: %w", err)
+	}
+
+	return &stanza{
+		algorithm:   algorithmAgent,
+		fingerprint: fingerprint(r.signer.PublicKey()),
+		wrappedKey:  append(salt, sealedKey...),
+	}, nil
+}
+
+// agentIdentity unwraps data keys wrapped by agentRecipient.
+type agentIdentity struct {
+	signer gossh.Signer
+}
+
+func (i *agentIdentity) fingerprint() ([sha256.Size]byte, error) {
+	return fingerprint(i.signer.PublicKey()), nil
+}
+
+func (i *agentIdentity) unwrap(s *stanza) ([]byte, error) {
+	if s.algorithm != algorithmAgent {
+		return nil, errUnsupportedStanza
+	}
+
+	return unwrapAgent(i.signer, s.wrappedKey)
+}
+
+func unwrapAgent(signer gossh.Signer, wrappedKey []byte) ([]byte, error) {
+	if len(wrappedKey) < agentSaltSize {
+		return nil, errors.New("invalid wrapped key size")
+	}
+
+	kek, err := agentKEK(signer, wrappedKey[:agentSaltSize])
+	if err != nil {
+		return nil, err
+	}
+
+	dataKey, err := open(kek, wrappedKey[agentSaltSize:], nil)
+	if err != nil {
+		return nil, fmt.Errorf("open data key: %w", err)
+	}
+
+	return dataKey, nil
+}
+
+// agentKEK derives a key encryption key from the signature over a challenge
+// made from the salt.
+func agentKEK(signer gossh.Signer, salt []byte) ([]byte, error) {
+	return deriveKey(signer, agentInfo, salt)
+}
+
+// deriveKey derives a key from the signer's signature over a challenge made
+// from the info and salt. The signature must be deterministic, so the same key
+// is derived each time for the same signer, info and salt.
+func deriveKey(signer gossh.Signer, info string, salt []byte) ([]byte, error) {
+	challenge := append([]byte(info), salt...)
+
+	var signature *gossh.Signature
+	var err error
+
+	switch signer.PublicKey().Type() {
+	case gossh.KeyAlgoED25519:
+		signature, err = signer.Sign(rand.Reader, challenge)
+
+	case gossh.KeyAlgoRSA:
+		algorithmSigner, ok := signer.(gossh.AlgorithmSigner)
+		if !ok {
+			return nil, errors.New("rsa signer doesn't support sha256 signatures")
+		}
+
+		// PKCS #1 v1.5 signatures are deterministic
+		signature, err = algorithmSigner.SignWithAlgorithm(
+			rand.Reader,
+			challenge,
+			gossh.KeyAlgoRSASHA256,
+		)
+
+	default:
+		return nil, CheckDeterministicSignatures(signer.PublicKey())
+	}
+	if err != nil {
+		return nil, fmt.Errorf("sign challenge: %w", err)
+	}
+
+	if err := signer.PublicKey().Verify(challenge, signature); err != nil {
+		return nil, fmt.Errorf("verify challenge signature: %w", err)
+	}
+
+	key, err := hkdf.Key(sha256.New, signature.Blob, salt, info, dataKeySize)
+	if err != nil {
+		return nil, fmt.Errorf("derive key: %w", err)
+	}
+
+	return key, nil
+}
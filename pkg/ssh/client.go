@@ -2,101 +2,592 @@ package ssh
 
 import (
 	"bytes"
+	"cmp"
+	"context"
+	"errors"
 	"fmt"
 	"io"
 	"net"
-	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
 
-	"github.com/skeema/knownhosts"
+	"github.com/nixpig/syringe.sh/internal/version"
+	"github.com/nixpig/syringe.sh/pkg/protocol"
 	gossh "golang.org/x/crypto/ssh"
 	"golang.org/x/crypto/ssh/agent"
 )
 
-const Client = "SSH-2.0-Syringe"
+// Client is the ssh identification string of the client, which carries its
+// version so the server can reject clients it no longer supports.
+var Client = protocol.ClientIdentifier(version.Version)
+
+// ErrAuthenticationFailed is returned when the server rejects the client's
+// keys.
+var ErrAuthenticationFailed = errors.New("server rejected authentication")
+
+// ConnectionError is a failure to connect to the server, or losing the
+// connection to it, as opposed to the server rejecting the client or a
+// request.
+type ConnectionError struct {
+	Addr string
+	Err  error
+}
+
+func (e *ConnectionError) Error() string {
+	return fmt.Sprintf("connection to %s failed: %s", e.Addr, e.Err)
+}
+
+func (e *ConnectionError) Unwrap() error {
+	return e.Err
+}
+
+// IsConnectionError reports whether the error is a connection problem, which
+// may be temporary, rather than the server rejecting the client or a request.
+func IsConnectionError(err error) bool {
+	var connErr *ConnectionError
+	return errors.As(err, &connErr)
+}
+
+// serverMessage is why the server ended a session without responding, e.g.
+// rejecting an outdated client.
+type serverMessage string
+
+func (m serverMessage) Error() string {
+	return string(m)
+}
+
+// DialOptions are how the client connects to the server and keeps the
+// connection alive. Zero values disable each option.
+type DialOptions struct {
+	// Timeout limits how long connecting to each host, including the ssh
+	// handshake, can take.
+	Timeout time.Duration
+	// KeepaliveInterval is how often the server is checked to still be
+	// there, closing the connection when it doesn't respond within the
+	// interval.
+	KeepaliveInterval time.Duration
+	// Retries is how many times connecting, and idempotent requests, are
+	// retried after a connection error.
+	Retries int
+	// RetryBackoff is how long to wait before the first retry, doubling for
+	// each retry after it.
+	RetryBackoff time.Duration
+}
+
+// DefaultDialOptions are the options used by the CLI unless configured.
+var DefaultDialOptions = DialOptions{
+	Timeout:           10 * time.Second,
+	KeepaliveInterval: 15 * time.Second,
+	Retries:           3,
+	RetryBackoff:      500 * time.Millisecond,
+}
+
+// maxRetryBackoff limits the wait between retries.
+const maxRetryBackoff = 10 * time.Second
+
+// backoff returns how long to wait before the retry.
+func (o DialOptions) backoff(retry int) time.Duration {
+	return min(o.RetryBackoff<<retry, maxRetryBackoff)
+}
 
 type SSHClient struct {
+	// connect dials the server, through any proxy jumps
+	connect func(ctx context.Context) (*gossh.Client, []*gossh.Client, error)
+	opts    DialOptions
+	addr    string
+
+	mu     sync.Mutex
 	client *gossh.Client
+	// lost is set once the connection is known to have been lost, so it's
+	// replaced before the next request is sent
+	lost bool
+	// conn is opened by the first request and carries the requests after it
+	conn *Conn
+	// noSubsystem is set when the server doesn't have the syringe subsystem
+	noSubsystem bool
+
+	// jumps are the connections to the proxy jumps the client is connected
+	// through, in order
+	jumps []*gossh.Client
 }
 
 func (s *SSHClient) Close() error {
-	if err := s.client.Close(); err != nil {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// let the server respond to any requests still waiting for a response
+	if s.conn != nil {
+		s.conn.Close()
+		s.conn = nil
+	}
+
+	return s.disconnect()
+}
+
+// SessionID returns the ID of the ssh session with the server, which the
+// server knows it by too.
+func (s *SSHClient) SessionID() []byte {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.client.SessionID()
+}
+
+// disconnect closes the connection to the server and any proxy jumps. The
+// lock must be held.
+func (s *SSHClient) disconnect() error {
+	err := s.client.Close()
+
+	if s.conn != nil {
+		s.conn.Close()
+		s.conn = nil
+	}
+
+	for _, j := range slices.Backward(s.jumps) {
+		j.Close()
+	}
+
+	if errors.Is(err, net.ErrClosed) {
+		// the connection was already lost
+		return nil
+	}
+
+	return err
+}
+
+// Do sends the request to the server and returns its response. Requests share
+// a single session on the syringe subsystem, falling back to a session per
+// request for servers without it.
+//
+// Cancelling the context cancels only the request, leaving any other requests
+// on the same session waiting for their responses.
+func (s *SSHClient) Do(ctx context.Context, req *protocol.Request) (*protocol.Response, error) {
+	res, _, err := s.do(ctx, req)
+	return res, err
+}
+
+// DoIdempotent sends a request that's safe to repeat, reconnecting and
+// retrying it with backoff after connection errors.
+func (s *SSHClient) DoIdempotent(ctx context.Context, req *protocol.Request) (*protocol.Response, error) {
+	for retry := 0; ; retry++ {
+		res, client, err := s.do(ctx, req)
+		if err == nil || !IsConnectionError(err) || retry >= s.opts.Retries {
+			return res, err
+		}
+
+		if err := sleep(ctx, s.opts.backoff(retry)); err != nil {
+			return nil, err
+		}
+
+		if err := s.reconnect(ctx, client); err != nil && !IsConnectionError(err) {
+			return nil, err
+		}
+	}
+}
+
+// do sends the request, returning the connection it was sent on. A
+// connection known to have been lost is replaced first, as the request can't
+// have been sent on it.
+func (s *SSHClient) do(
+	ctx context.Context,
+	req *protocol.Request,
+) (*protocol.Response, *gossh.Client, error) {
+	s.mu.Lock()
+	client, lost := s.client, s.lost
+	s.mu.Unlock()
+
+	if lost {
+		if err := s.reconnect(ctx, client); err != nil {
+			return nil, client, err
+		}
+	}
+
+	s.mu.Lock()
+	client = s.client
+	// a session ended by the server is opened again
+	if s.conn != nil && s.conn.ended() {
+		s.conn.Close()
+		s.conn = nil
+	}
+	if s.conn == nil && !s.noSubsystem {
+		conn, err := openConn(client)
+		if err != nil {
+			s.noSubsystem = true
+		} else {
+			s.conn = conn
+		}
+	}
+	conn := s.conn
+	s.mu.Unlock()
+
+	var res *protocol.Response
+	var err error
+
+	if conn == nil {
+		res, err = doExec(ctx, client, req)
+	} else {
+		res, err = conn.Do(ctx, req)
+	}
+
+	if err != nil && isTransportError(ctx, err) {
+		s.markLost(client)
+		err = &ConnectionError{Addr: s.addr, Err: err}
+	}
+
+	return res, client, err
+}
+
+// isTransportError reports whether the request failed because of the
+// connection, rather than being rejected by the server, cancelled, or unable
+// to be framed.
+func isTransportError(ctx context.Context, err error) bool {
+	var m serverMessage
+
+	return !errors.As(err, &m) &&
+		!errors.Is(err, protocol.ErrFrameTooLarge) &&
+		!errors.Is(err, protocol.ErrInvalidFrame) &&
+		ctx.Err() == nil
+}
+
+// markLost records that the connection has been lost, unless it's already
+// been replaced.
+func (s *SSHClient) markLost(client *gossh.Client) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.client == client {
+		s.lost = true
+	}
+}
+
+// setClient replaces the connection, watching for it to be lost. The lock
+// must be held.
+func (s *SSHClient) setClient(client *gossh.Client, jumps []*gossh.Client) {
+	s.client = client
+	s.jumps = jumps
+	s.lost = false
+	s.noSubsystem = false
+
+	go func() {
+		client.Wait()
+		s.markLost(client)
+	}()
+}
+
+// reconnect replaces the failed connection, unless it's already been
+// replaced by another request.
+func (s *SSHClient) reconnect(ctx context.Context, failed *gossh.Client) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.client != failed {
+		return nil
+	}
+
+	client, jumps, err := s.connect(ctx)
+	if err != nil {
 		return err
 	}
 
+	s.disconnect()
+	s.setClient(client, jumps)
+
 	return nil
 }
 
-func (s *SSHClient) Run(cmd string, out io.Writer) error {
-	session, err := s.client.NewSession()
+// doExec sends the request in a new protocol session started by an exec
+// request.
+func doExec(
+	ctx context.Context,
+	client *gossh.Client,
+	req *protocol.Request,
+) (*protocol.Response, error) {
+	session, err := client.NewSession()
 	if err != nil {
-		return fmt.Errorf("new session: %w", err)
+		return nil, fmt.Errorf("new session: %w", err)
 	}
 
 	defer session.Close()
 
-	e := bytes.Buffer{}
+	stop := context.AfterFunc(ctx, func() {
+		session.Signal(gossh.SIGINT)
+		session.Close()
+	})
+	defer stop()
 
-	session.Stdout = out
+	e := bytes.Buffer{}
 	session.Stderr = io.Writer(&e)
 
-	if err := session.Run(cmd); err != nil {
-		return fmt.Errorf("%s", e.String())
+	stdin, err := session.StdinPipe()
+	if err != nil {
+		return nil, fmt.Errorf("stdin pipe: %w", err)
 	}
 
-	return nil
+	stdout, err := session.StdoutPipe()
+	if err != nil {
+		return nil, fmt.Errorf("stdout pipe: %w", err)
+	}
+
+	if err := session.Start(protocol.Command); err != nil {
+		return nil, fmt.Errorf("start session: %w", err)
+	}
+
+	if err := protocol.WriteFrame(stdin, req); err != nil {
+		return nil, err
+	}
+
+	stdin.Close()
+
+	var res protocol.Response
+	readErr := protocol.ReadFrame(stdout, &res)
+
+	// stderr is only complete once the session has ended
+	waitErr := session.Wait()
+
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	if readErr != nil {
+		// the server writes to stderr when it fails before responding
+		if e.Len() > 0 {
+			return nil, serverMessage(e.String())
+		}
+
+		return nil, fmt.Errorf("read response: %w", readErr)
+	}
+
+	if waitErr != nil && e.Len() > 0 {
+		return nil, serverMessage(e.String())
+	}
+
+	return &res, nil
+}
+
+// ProxyJump is a host to connect to the server through, as with ssh's
+// ProxyJump. The user and host key callback default to the server's.
+type ProxyJump struct {
+	Host            string
+	Port            int
+	User            string
+	HostKeyCallback gossh.HostKeyCallback
 }
 
+// NewSSHClient connects to the server, through each of the proxy jumps in
+// turn when given, retrying after connection errors. The context only
+// applies to connecting.
 func NewSSHClient(
+	ctx context.Context,
 	host string,
 	port int,
 	username string,
 	authMethod gossh.AuthMethod,
-	knownHosts string,
+	hostKeyCallback gossh.HostKeyCallback,
+	opts DialOptions,
+	proxyJumps ...ProxyJump,
 ) (*SSHClient, error) {
-	sshConfig := &gossh.ClientConfig{
-		User:          username,
-		ClientVersion: Client,
-		Auth:          []gossh.AuthMethod{authMethod},
+	s := &SSHClient{
+		opts: opts,
+		addr: net.JoinHostPort(host, strconv.Itoa(port)),
+	}
+
+	s.connect = func(ctx context.Context) (*gossh.Client, []*gossh.Client, error) {
+		var jumps []*gossh.Client
+
+		closeJumps := func() {
+			for _, j := range slices.Backward(jumps) {
+				j.Close()
+			}
+		}
+
+		for _, proxyJump := range proxyJumps {
+			callback := proxyJump.HostKeyCallback
+			if callback == nil {
+				callback = hostKeyCallback
+			}
+
+			jump, err := dial(ctx, jumps, proxyJump.Host, proxyJump.Port, opts, &gossh.ClientConfig{
+				User:            cmp.Or(proxyJump.User, username),
+				Auth:            []gossh.AuthMethod{authMethod},
+				HostKeyCallback: callback,
+			})
+			if err != nil {
+				closeJumps()
+				return nil, nil, fmt.Errorf("proxy jump '%s': %w", proxyJump.Host, err)
+			}
+
+			jumps = append(jumps, jump)
+		}
+
+		client, err := dial(ctx, jumps, host, port, opts, &gossh.ClientConfig{
+			User:          username,
+			ClientVersion: Client,
+			Auth:          []gossh.AuthMethod{authMethod},
+
+			HostKeyCallback: hostKeyCallback,
+		})
+		if err != nil {
+			closeJumps()
+			return nil, nil, err
+		}
+
+		return client, jumps, nil
+	}
 
-		HostKeyCallback: gossh.HostKeyCallback(
-			func(hostname string, remote net.Addr, key gossh.PublicKey) error {
-				kh, err := knownhosts.New(knownHosts)
-				if err != nil {
-					return fmt.Errorf("failed to open knownhosts file: %w", err)
-				}
+	for retry := 0; ; retry++ {
+		client, jumps, err := s.connect(ctx)
+		if err == nil {
+			s.setClient(client, jumps)
 
-				err = kh(fmt.Sprintf("%s:%d", host, port), remote, key)
+			return s, nil
+		}
 
-				if knownhosts.IsHostKeyChanged(err) {
-					return fmt.Errorf("remote host identification has changed which may indicate a MITM attack: %w", err)
-				}
+		if !IsConnectionError(err) || retry >= opts.Retries {
+			return nil, err
+		}
 
-				if knownhosts.IsHostUnknown(err) {
-					khHandle, err := os.OpenFile(knownHosts, os.O_APPEND|os.O_WRONLY, 0600)
-					if err != nil {
-						return fmt.Errorf("failed to open known hosts file for writing: %w", err)
-					}
+		if err := sleep(ctx, opts.backoff(retry)); err != nil {
+			return nil, err
+		}
+	}
+}
 
-					defer khHandle.Close()
+// sleep waits for the duration, unless the context is done first.
+func sleep(ctx context.Context, d time.Duration) error {
+	t := time.NewTimer(d)
+	defer t.Stop()
 
-					if err := knownhosts.WriteKnownHost(khHandle, hostname, remote, key); err != nil {
-						return fmt.Errorf("failed to write to known hosts: %w", err)
-					}
-				}
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-t.C:
+		return nil
+	}
+}
 
-				return nil
-			},
-		),
+// dial connects to the host, through the last of the jumps when there are
+// any.
+func dial(
+	parent context.Context,
+	jumps []*gossh.Client,
+	host string,
+	port int,
+	opts DialOptions,
+	config *gossh.ClientConfig,
+) (*gossh.Client, error) {
+	addr := net.JoinHostPort(host, strconv.Itoa(port))
+
+	ctx := parent
+	if opts.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, opts.Timeout)
+		defer cancel()
 	}
 
-	conn, err := gossh.Dial("tcp", fmt.Sprintf("%s:%d", host, port), sshConfig)
+	var netConn net.Conn
+	var err error
+
+	if len(jumps) == 0 {
+		netConn, err = (&net.Dialer{}).DialContext(ctx, "tcp", addr)
+	} else {
+		netConn, err = jumps[len(jumps)-1].DialContext(ctx, "tcp", addr)
+	}
 	if err != nil {
-		return nil, fmt.Errorf("dial ssh: %w", err)
+		if err := parent.Err(); err != nil {
+			return nil, err
+		}
+
+		return nil, &ConnectionError{Addr: addr, Err: err}
 	}
 
-	return &SSHClient{
-		conn,
-	}, nil
+	// the handshake can't be cancelled, so the connection is closed to end
+	// it when it takes too long or the context is cancelled
+	stop := context.AfterFunc(ctx, func() { netConn.Close() })
+
+	c, chans, reqs, err := gossh.NewClientConn(netConn, addr, config)
+
+	if !stop() {
+		if err == nil {
+			c.Close()
+		}
+
+		if err := parent.Err(); err != nil {
+			return nil, err
+		}
+
+		return nil, &ConnectionError{Addr: addr, Err: fmt.Errorf("ssh handshake: %w", ctx.Err())}
+	}
+
+	if err != nil {
+		netConn.Close()
+		return nil, handshakeError(addr, err)
+	}
+
+	client := gossh.NewClient(c, chans, reqs)
+
+	if opts.KeepaliveInterval > 0 {
+		go keepalive(client, opts.KeepaliveInterval)
+	}
+
+	return client, nil
+}
+
+// handshakeError tells apart the server rejecting the client from failing to
+// connect to it.
+func handshakeError(addr string, err error) error {
+	switch {
+	case errors.Is(err, ErrHostKeyRejected):
+		return fmt.Errorf("dial ssh: %w", err)
+	case strings.Contains(err.Error(), "unable to authenticate"):
+		return fmt.Errorf("%w: %w", ErrAuthenticationFailed, err)
+	default:
+		return &ConnectionError{Addr: addr, Err: err}
+	}
+}
+
+// keepalive checks the server is still there every interval, closing the
+// connection when it doesn't respond, until the connection is closed.
+func keepalive(client *gossh.Client, interval time.Duration) {
+	closed := make(chan struct{})
+
+	go func() {
+		client.Wait()
+		close(closed)
+	}()
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-closed:
+			return
+		case <-ticker.C:
+		}
+
+		replied := make(chan error, 1)
+
+		go func() {
+			_, _, err := client.SendRequest("keepalive@openssh.com", true, nil)
+			replied <- err
+		}()
+
+		select {
+		case <-closed:
+			return
+		case err := <-replied:
+			if err != nil {
+				client.Close()
+				return
+			}
+		case <-time.After(interval):
+			client.Close()
+			return
+		}
+	}
 }
 
 func NewSSHAgentClient(sshAuthSock string) (agent.ExtendedAgent, error) {
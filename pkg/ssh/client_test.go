@@ -0,0 +1,215 @@
+package ssh_test
+
+import (
+	"net"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/nixpig/syringe.sh/pkg/protocol"
+	"github.com/nixpig/syringe.sh/pkg/ssh"
+	"github.com/stretchr/testify/require"
+	gossh "golang.org/x/crypto/ssh"
+)
+
+var testDialOptions = ssh.DialOptions{
+	Timeout:      time.Second,
+	Retries:      2,
+	RetryBackoff: time.Millisecond,
+}
+
+func TestSSHClientRetry(t *testing.T) {
+	scenarios := map[string]func(t *testing.T){
+		"retry idempotent request after connection lost": testRetryIdempotent,
+		"don't retry request after connection lost":      testNoRetry,
+		"reconnect for request after connection lost":    testReconnectLost,
+		"don't retry request too large to send":          testNoRetryFrameTooLarge,
+		"give up after retries":                          testRetriesExhausted,
+		"time out handshake":                             testHandshakeTimeout,
+		"connection refused":                             testConnectionRefused,
+		"authentication rejected":                        testAuthenticationRejected,
+	}
+
+	for scenario, fn := range scenarios {
+		t.Run(scenario, fn)
+	}
+}
+
+// startDroppingServer starts a server that drops each of its first connections
+// up to drops when they send a request, and echoes requests on the
+// connections after.
+func startDroppingServer(t *testing.T, drops int32) (*net.TCPAddr, *atomic.Int32) {
+	var conns atomic.Int32
+
+	addr := startTestServer(t, func(conn net.Conn, config *gossh.ServerConfig) {
+		n := conns.Add(1)
+
+		serveTestConn(conn, config, func(ch gossh.Channel) {
+			for {
+				var req protocol.Request
+				if err := protocol.ReadFrame(ch, &req); err != nil {
+					return
+				}
+
+				if n <= drops {
+					conn.Close()
+					return
+				}
+
+				protocol.WriteFrame(ch, &protocol.Response{
+					ID:      req.ID,
+					Version: protocol.Version,
+					Output:  req.Args[0],
+				})
+			}
+		})
+	})
+
+	return addr, &conns
+}
+
+func dialTestServer(t *testing.T, addr *net.TCPAddr, opts ssh.DialOptions) (*ssh.SSHClient, error) {
+	return ssh.NewSSHClient(
+		t.Context(),
+		addr.IP.String(),
+		addr.Port,
+		"alice",
+		gossh.Password(""),
+		testHostKeyCallback(t),
+		opts,
+	)
+}
+
+func testRetryIdempotent(t *testing.T) {
+	addr, conns := startDroppingServer(t, 1)
+
+	client, err := dialTestServer(t, addr, testDialOptions)
+	require.NoError(t, err)
+	defer client.Close()
+
+	res, err := client.DoIdempotent(t.Context(), protocol.NewRequest("get", "secret"))
+	require.NoError(t, err)
+	require.Equal(t, "secret", string(res.Output))
+	require.Equal(t, int32(2), conns.Load())
+}
+
+func testNoRetry(t *testing.T) {
+	addr, conns := startDroppingServer(t, 1)
+
+	client, err := dialTestServer(t, addr, testDialOptions)
+	require.NoError(t, err)
+	defer client.Close()
+
+	_, err = client.Do(t.Context(), protocol.NewRequest("set", "secret", "value"))
+	require.True(t, ssh.IsConnectionError(err))
+	require.Equal(t, int32(1), conns.Load())
+}
+
+func testReconnectLost(t *testing.T) {
+	addr, conns := startDroppingServer(t, 1)
+
+	client, err := dialTestServer(t, addr, testDialOptions)
+	require.NoError(t, err)
+	defer client.Close()
+
+	_, err = client.Do(t.Context(), protocol.NewRequest("set", "secret", "value"))
+	require.True(t, ssh.IsConnectionError(err))
+
+	// the next request isn't sent on the lost connection
+	res, err := client.Do(t.Context(), protocol.NewRequest("set", "secret", "value"))
+	require.NoError(t, err)
+	require.Equal(t, "secret", string(res.Output))
+	require.Equal(t, int32(2), conns.Load())
+}
+
+func testNoRetryFrameTooLarge(t *testing.T) {
+	addr, conns := startDroppingServer(t, 0)
+
+	client, err := dialTestServer(t, addr, testDialOptions)
+	require.NoError(t, err)
+	defer client.Close()
+
+	_, err = client.DoIdempotent(
+		t.Context(),
+		protocol.NewRequest("get", strings.Repeat("x", protocol.MaxFrameSize)),
+	)
+	require.ErrorIs(t, err, protocol.ErrFrameTooLarge)
+	require.False(t, ssh.IsConnectionError(err))
+	require.Equal(t, int32(1), conns.Load())
+}
+
+func testRetriesExhausted(t *testing.T) {
+	addr, conns := startDroppingServer(t, 3)
+
+	client, err := dialTestServer(t, addr, testDialOptions)
+	require.NoError(t, err)
+	defer client.Close()
+
+	_, err = client.DoIdempotent(t.Context(), protocol.NewRequest("get", "secret"))
+	require.True(t, ssh.IsConnectionError(err))
+	require.ErrorContains(t, err, "connection to "+addr.String()+" failed")
+	require.Equal(t, int32(3), conns.Load())
+}
+
+func testHandshakeTimeout(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { listener.Close() })
+
+	var conns atomic.Int32
+
+	// accept connections but never respond
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+
+			conns.Add(1)
+			t.Cleanup(func() { conn.Close() })
+		}
+	}()
+
+	opts := testDialOptions
+	opts.Timeout = 50 * time.Millisecond
+
+	_, err = dialTestServer(t, listener.Addr().(*net.TCPAddr), opts)
+	require.True(t, ssh.IsConnectionError(err))
+	require.ErrorContains(t, err, "ssh handshake")
+	require.Equal(t, int32(3), conns.Load())
+}
+
+func testConnectionRefused(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	addr := listener.Addr().(*net.TCPAddr)
+	listener.Close()
+
+	_, err = dialTestServer(t, addr, testDialOptions)
+	require.True(t, ssh.IsConnectionError(err))
+}
+
+func testAuthenticationRejected(t *testing.T) {
+	var conns atomic.Int32
+
+	addr := startTestServer(t, func(conn net.Conn, config *gossh.ServerConfig) {
+		conns.Add(1)
+
+		config = &gossh.ServerConfig{
+			PasswordCallback: func(gossh.ConnMetadata, []byte) (*gossh.Permissions, error) {
+				return nil, gossh.ErrNoAuth
+			},
+		}
+		config.AddHostKey(testHostSigner(t))
+
+		serveTestConn(conn, config, func(ch gossh.Channel) {})
+	})
+
+	_, err := dialTestServer(t, addr, testDialOptions)
+	require.ErrorIs(t, err, ssh.ErrAuthenticationFailed)
+	require.False(t, ssh.IsConnectionError(err))
+	require.Equal(t, int32(1), conns.Load())
+}
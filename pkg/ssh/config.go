@@ -3,8 +3,10 @@ package ssh
 import (
 	"errors"
 	"fmt"
+	"net"
 	"os"
 	"path/filepath"
+	"strconv"
 	"strings"
 
 	"github.com/kevinburke/ssh_config"
@@ -180,3 +182,157 @@ func addHost(cfg *ssh_config.Config, name, identity string) error {
 
 	return nil
 }
+
+// HostConfig is how to connect to a host, as configured in an ssh config
+// file. Settings the file doesn't have are left empty.
+type HostConfig struct {
+	HostName      string
+	Port          int
+	User          string
+	IdentityFiles []string
+	ProxyJumps    []ProxyJump
+}
+
+// LoadHostConfig resolves the host alias through the ssh config file at path,
+// which may not exist.
+func LoadHostConfig(path, alias string) (*HostConfig, error) {
+	f, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return &HostConfig{HostName: alias}, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to open ssh config file: %w", err)
+	}
+
+	defer f.Close()
+
+	cfg, err := configFromFile(f)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse ssh config file: %w", err)
+	}
+
+	hostConfig, err := resolveHost(cfg, alias)
+	if err != nil {
+		return nil, err
+	}
+
+	proxyJump, err := cfg.Get(alias, "ProxyJump")
+	if err != nil {
+		return nil, err
+	}
+
+	if proxyJump == "" || strings.EqualFold(proxyJump, "none") {
+		return hostConfig, nil
+	}
+
+	for _, jump := range strings.Split(proxyJump, ",") {
+		proxyJump, err := parseProxyJump(cfg, strings.TrimSpace(jump))
+		if err != nil {
+			return nil, fmt.Errorf("invalid proxy jump '%s': %w", jump, err)
+		}
+
+		hostConfig.ProxyJumps = append(hostConfig.ProxyJumps, *proxyJump)
+	}
+
+	return hostConfig, nil
+}
+
+func resolveHost(cfg *ssh_config.Config, alias string) (*HostConfig, error) {
+	hostConfig := &HostConfig{HostName: alias}
+
+	hostName, err := cfg.Get(alias, "HostName")
+	if err != nil {
+		return nil, err
+	}
+
+	if hostName != "" {
+		hostConfig.HostName = strings.ReplaceAll(hostName, "%h", alias)
+	}
+
+	port, err := cfg.Get(alias, "Port")
+	if err != nil {
+		return nil, err
+	}
+
+	if port != "" {
+		if hostConfig.Port, err = strconv.Atoi(port); err != nil {
+			return nil, fmt.Errorf("invalid port '%s' for host '%s'", port, alias)
+		}
+	}
+
+	if hostConfig.User, err = cfg.Get(alias, "User"); err != nil {
+		return nil, err
+	}
+
+	identityFiles, err := cfg.GetAll(alias, "IdentityFile")
+	if err != nil {
+		return nil, err
+	}
+
+	for _, identityFile := range identityFiles {
+		hostConfig.IdentityFiles = append(
+			hostConfig.IdentityFiles,
+			expandHome(identityFile),
+		)
+	}
+
+	return hostConfig, nil
+}
+
+// parseProxyJump parses a jump host given as [user@]host[:port], where host
+// may itself be an alias in the ssh config.
+func parseProxyJump(cfg *ssh_config.Config, jump string) (*ProxyJump, error) {
+	var user string
+	if i := strings.LastIndex(jump, "@"); i != -1 {
+		user, jump = jump[:i], jump[i+1:]
+	}
+
+	alias, port := jump, ""
+	if h, p, err := net.SplitHostPort(jump); err == nil {
+		alias, port = h, p
+	}
+
+	if alias == "" {
+		return nil, errors.New("no host")
+	}
+
+	hostConfig, err := resolveHost(cfg, alias)
+	if err != nil {
+		return nil, err
+	}
+
+	proxyJump := &ProxyJump{
+		Host: hostConfig.HostName,
+		Port: hostConfig.Port,
+		User: hostConfig.User,
+	}
+
+	if port != "" {
+		if proxyJump.Port, err = strconv.Atoi(port); err != nil {
+			return nil, fmt.Errorf("invalid port '%s'", port)
+		}
+	}
+
+	if proxyJump.Port == 0 {
+		proxyJump.Port = 22
+	}
+
+	if user != "" {
+		proxyJump.User = user
+	}
+
+	return proxyJump, nil
+}
+
+func expandHome(path string) string {
+	if !strings.HasPrefix(path, "~/") {
+		return path
+	}
+
+	home, err := os.UserHomeDir()
+	if err != nil {
+		home = os.Getenv("HOME")
+	}
+
+	return filepath.Join(home, path[2:])
+}
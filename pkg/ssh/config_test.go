@@ -0,0 +1,98 @@
+package ssh_test
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/nixpig/syringe.sh/pkg/ssh"
+	"github.com/stretchr/testify/require"
+)
+
+const testSSHConfig = `
+Host syringe
+  HostName ssh.example.org
+  Port 2323
+  User alice
+  IdentityFile ~/.ssh/id_syringe
+  IdentityFile /keys/id_ed25519
+  ProxyJump bob@bastion:2222,jump.example.org
+
+Host bastion
+  HostName bastion.example.org
+  User carol
+
+Host direct
+  HostName %h.example.org
+  ProxyJump none
+
+Host *
+  User dave
+`
+
+func TestLoadHostConfig(t *testing.T) {
+	scenarios := map[string]func(t *testing.T, path string){
+		"alias with proxy jumps": testLoadHostConfigAlias,
+		"alias without proxy":    testLoadHostConfigNoProxy,
+		"host not in config":     testLoadHostConfigUnknownHost,
+		"missing config file":    testLoadHostConfigMissingFile,
+	}
+
+	for scenario, fn := range scenarios {
+		t.Run(scenario, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "config")
+			require.NoError(t, os.WriteFile(path, []byte(testSSHConfig), 0600))
+
+			fn(t, path)
+		})
+	}
+}
+
+func testLoadHostConfigAlias(t *testing.T, path string) {
+	home, err := os.UserHomeDir()
+	require.NoError(t, err)
+
+	hostConfig, err := ssh.LoadHostConfig(path, "syringe")
+	require.NoError(t, err)
+
+	require.Equal(t, &ssh.HostConfig{
+		HostName: "ssh.example.org",
+		Port:     2323,
+		User:     "alice",
+		IdentityFiles: []string{
+			filepath.Join(home, ".ssh", "id_syringe"),
+			"/keys/id_ed25519",
+		},
+		ProxyJumps: []ssh.ProxyJump{
+			{Host: "bastion.example.org", Port: 2222, User: "bob"},
+			{Host: "jump.example.org", Port: 22, User: "dave"},
+		},
+	}, hostConfig)
+}
+
+func testLoadHostConfigNoProxy(t *testing.T, path string) {
+	hostConfig, err := ssh.LoadHostConfig(path, "direct")
+	require.NoError(t, err)
+
+	require.Equal(t, &ssh.HostConfig{
+		HostName: "direct.example.org",
+		User:     "dave",
+	}, hostConfig)
+}
+
+func testLoadHostConfigUnknownHost(t *testing.T, path string) {
+	hostConfig, err := ssh.LoadHostConfig(path, "ssh.syringe.sh")
+	require.NoError(t, err)
+
+	require.Equal(t, &ssh.HostConfig{
+		HostName: "ssh.syringe.sh",
+		User:     "dave",
+	}, hostConfig)
+}
+
+func testLoadHostConfigMissingFile(t *testing.T, path string) {
+	hostConfig, err := ssh.LoadHostConfig(path+".missing", "syringe")
+	require.NoError(t, err)
+
+	require.Equal(t, &ssh.HostConfig{HostName: "syringe"}, hostConfig)
+}
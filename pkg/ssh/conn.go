@@ -0,0 +1,269 @@
+package ssh
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/nixpig/syringe.sh/pkg/protocol"
+	gossh "golang.org/x/crypto/ssh"
+)
+
+var ErrConnClosed = errors.New("connection closed")
+
+// closeTimeout limits how long closing a session waits for the server to
+// respond to the requests still waiting for a response.
+const closeTimeout = 5 * time.Second
+
+// Conn is a protocol session over the syringe subsystem. It keeps a single
+// channel open and multiplexes requests over it, matching each response to
+// its request by ID, so it's safe for concurrent use.
+type Conn struct {
+	client  *gossh.Client
+	session *gossh.Session
+	stdin   io.WriteCloser
+
+	writeMu sync.Mutex
+
+	mu      sync.Mutex
+	nextID  uint64
+	pending map[uint64]chan *protocol.Response
+	err     error
+
+	// done is closed once the session has ended
+	done chan struct{}
+
+	// stderr is what the server wrote to stderr, complete once stderrDone is
+	// closed
+	stderr     []byte
+	stderrDone chan struct{}
+}
+
+// openConn opens a protocol session on the syringe subsystem.
+func openConn(client *gossh.Client) (*Conn, error) {
+	session, err := client.NewSession()
+	if err != nil {
+		return nil, fmt.Errorf("new session: %w", err)
+	}
+
+	stdin, err := session.StdinPipe()
+	if err != nil {
+		session.Close()
+		return nil, fmt.Errorf("stdin pipe: %w", err)
+	}
+
+	stdout, err := session.StdoutPipe()
+	if err != nil {
+		session.Close()
+		return nil, fmt.Errorf("stdout pipe: %w", err)
+	}
+
+	stderr, err := session.StderrPipe()
+	if err != nil {
+		session.Close()
+		return nil, fmt.Errorf("stderr pipe: %w", err)
+	}
+
+	if err := session.RequestSubsystem(protocol.Subsystem); err != nil {
+		session.Close()
+		return nil, fmt.Errorf("request subsystem: %w", err)
+	}
+
+	c := &Conn{
+		client:     client,
+		session:    session,
+		stdin:      stdin,
+		pending:    map[uint64]chan *protocol.Response{},
+		done:       make(chan struct{}),
+		stderrDone: make(chan struct{}),
+	}
+
+	go func() {
+		defer close(c.stderrDone)
+		c.stderr, _ = io.ReadAll(stderr)
+	}()
+
+	go c.read(stdout)
+
+	return c, nil
+}
+
+// Do sends the request and waits for its response. Cancelling the context
+// sends the server a cancel frame with the request's ID, leaving the session
+// and its other requests as they are.
+func (c *Conn) Do(ctx context.Context, req *protocol.Request) (*protocol.Response, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	ch := make(chan *protocol.Response, 1)
+
+	c.mu.Lock()
+	if c.err != nil {
+		c.mu.Unlock()
+		return nil, c.err
+	}
+
+	c.nextID++
+	id := c.nextID
+	c.pending[id] = ch
+	c.mu.Unlock()
+
+	r := *req
+	r.ID = id
+
+	// a request that can't be framed, e.g. as it's too large, is never
+	// written, so the session is unaffected
+	frame, err := protocol.MarshalFrame(&r)
+	if err != nil {
+		c.mu.Lock()
+		delete(c.pending, id)
+		c.mu.Unlock()
+
+		return nil, err
+	}
+
+	c.writeMu.Lock()
+	_, err = c.stdin.Write(frame)
+	c.writeMu.Unlock()
+
+	if err != nil {
+		// the server may have ended the session, e.g. rejecting the client,
+		// in which case the reason is more useful than the write error
+		select {
+		case <-c.done:
+		case <-ctx.Done():
+			c.mu.Lock()
+			delete(c.pending, id)
+			c.mu.Unlock()
+
+			return nil, ctx.Err()
+		}
+
+		c.mu.Lock()
+		defer c.mu.Unlock()
+
+		delete(c.pending, id)
+
+		return nil, c.err
+	}
+
+	select {
+	case res, ok := <-ch:
+		if !ok {
+			c.mu.Lock()
+			defer c.mu.Unlock()
+
+			return nil, c.err
+		}
+
+		return res, nil
+
+	case <-ctx.Done():
+		c.mu.Lock()
+		delete(c.pending, id)
+		c.mu.Unlock()
+
+		c.cancel(id)
+
+		return nil, ctx.Err()
+	}
+}
+
+// cancel asks the server to stop the request with the ID. Servers that
+// predate cancel frames respond with an error for the ID, which is dropped as
+// the request is no longer waiting for a response.
+func (c *Conn) cancel(id uint64) {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+
+	// a session that can't be written to has ended, failing its requests
+	_ = protocol.WriteFrame(c.stdin, &protocol.Request{
+		ID:      id,
+		Version: protocol.Version,
+		Command: protocol.CancelCommand,
+	})
+}
+
+// read delivers responses to the requests waiting for them, until the
+// session ends.
+func (c *Conn) read(r io.Reader) {
+	defer close(c.done)
+
+	for {
+		var res protocol.Response
+		if err := protocol.ReadFrame(r, &res); err != nil {
+			if errors.Is(err, io.EOF) {
+				err = ErrConnClosed
+			}
+
+			// the server writes to stderr when it fails before responding
+			<-c.stderrDone
+			if len(c.stderr) > 0 {
+				err = serverMessage(c.stderr)
+			}
+
+			c.fail(err)
+			return
+		}
+
+		c.mu.Lock()
+		ch, ok := c.pending[res.ID]
+		delete(c.pending, res.ID)
+		c.mu.Unlock()
+
+		if ok {
+			ch <- &res
+		}
+	}
+}
+
+// ended reports whether the session has ended.
+func (c *Conn) ended() bool {
+	select {
+	case <-c.done:
+		return true
+	default:
+		return false
+	}
+}
+
+// fail fails all pending and future requests with the error.
+func (c *Conn) fail(err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.err == nil {
+		c.err = err
+	}
+
+	for id, ch := range c.pending {
+		close(ch)
+		delete(c.pending, id)
+	}
+}
+
+// Close ends the session once the server has responded to any requests
+// still waiting for a response. If the server hasn't ended the session within
+// closeTimeout, the connection is closed instead.
+func (c *Conn) Close() error {
+	c.stdin.Close()
+
+	select {
+	case <-c.done:
+	case <-time.After(closeTimeout):
+		c.client.Close()
+		<-c.done
+
+		return fmt.Errorf("session not closed by server within %s", closeTimeout)
+	}
+
+	if err := c.session.Close(); err != nil && !errors.Is(err, io.EOF) {
+		return err
+	}
+
+	return nil
+}
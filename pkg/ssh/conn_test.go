@@ -0,0 +1,452 @@
+package ssh_test
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/nixpig/syringe.sh/pkg/protocol"
+	"github.com/nixpig/syringe.sh/pkg/ssh"
+	"github.com/stretchr/testify/require"
+	gossh "golang.org/x/crypto/ssh"
+)
+
+func TestConn(t *testing.T) {
+	var sessions atomic.Int32
+
+	client := newTestClient(t, func(ch gossh.Channel) {
+		sessions.Add(1)
+
+		// echo the first arg of each request back as its output
+		for {
+			var req protocol.Request
+			if err := protocol.ReadFrame(ch, &req); err != nil {
+				return
+			}
+
+			protocol.WriteFrame(ch, &protocol.Response{
+				ID:      req.ID,
+				Version: protocol.Version,
+				Output:  req.Args[0],
+			})
+		}
+	})
+
+	outputs := make([]string, 50)
+	errs := make([]error, 50)
+
+	var wg sync.WaitGroup
+
+	for i := range outputs {
+		wg.Add(1)
+
+		go func() {
+			defer wg.Done()
+
+			res, err := client.Do(t.Context(), protocol.NewRequest("get", fmt.Sprintf("secret %d", i)))
+			if err != nil {
+				errs[i] = err
+				return
+			}
+
+			outputs[i] = string(res.Output)
+		}()
+	}
+
+	wg.Wait()
+
+	for i := range outputs {
+		require.NoError(t, errs[i])
+		require.Equal(t, fmt.Sprintf("secret %d", i), outputs[i])
+	}
+
+	require.NoError(t, client.Close())
+	require.Equal(t, int32(1), sessions.Load())
+}
+
+func TestConnCancel(t *testing.T) {
+	cancelled := make(chan uint64, 1)
+
+	var sessions atomic.Int32
+
+	client := newTestClient(t, func(ch gossh.Channel) {
+		sessions.Add(1)
+
+		for {
+			var req protocol.Request
+			if err := protocol.ReadFrame(ch, &req); err != nil {
+				return
+			}
+
+			if req.Command == protocol.CancelCommand {
+				cancelled <- req.ID
+				continue
+			}
+
+			// never respond to the slow request
+			if string(req.Args[0]) == "slow" {
+				continue
+			}
+
+			protocol.WriteFrame(ch, &protocol.Response{
+				ID:      req.ID,
+				Version: protocol.Version,
+				Output:  req.Args[0],
+			})
+		}
+	})
+
+	ctx, cancel := context.WithTimeout(t.Context(), 50*time.Millisecond)
+	defer cancel()
+
+	_, err := client.Do(ctx, protocol.NewRequest("get", "slow"))
+	require.ErrorIs(t, err, context.DeadlineExceeded)
+	require.False(t, ssh.IsConnectionError(err))
+
+	select {
+	case id := <-cancelled:
+		require.Equal(t, uint64(1), id)
+	case <-time.After(time.Second):
+		t.Fatal("request wasn't cancelled")
+	}
+
+	// later requests use the same session
+	res, err := client.Do(t.Context(), protocol.NewRequest("get", "secret"))
+	require.NoError(t, err)
+	require.Equal(t, "secret", string(res.Output))
+	require.Equal(t, int32(1), sessions.Load())
+
+	require.NoError(t, client.Close())
+}
+
+func TestConnCancelInFlight(t *testing.T) {
+	received := make(chan struct{})
+	release := make(chan struct{})
+
+	client := newTestClient(t, func(ch gossh.Channel) {
+		var held *protocol.Request
+
+		for {
+			var req protocol.Request
+			if err := protocol.ReadFrame(ch, &req); err != nil {
+				return
+			}
+
+			switch {
+			case req.Command == protocol.CancelCommand:
+				// respond to the held request once the other is cancelled
+				<-release
+
+				protocol.WriteFrame(ch, &protocol.Response{
+					ID:      held.ID,
+					Version: protocol.Version,
+					Output:  held.Args[0],
+				})
+
+			case string(req.Args[0]) == "held":
+				held = &req
+				close(received)
+			}
+		}
+	})
+
+	heldRes := make(chan *protocol.Response, 1)
+	heldErr := make(chan error, 1)
+
+	go func() {
+		res, err := client.Do(t.Context(), protocol.NewRequest("get", "held"))
+		heldRes <- res
+		heldErr <- err
+	}()
+
+	<-received
+
+	ctx, cancel := context.WithTimeout(t.Context(), 50*time.Millisecond)
+	defer cancel()
+
+	_, err := client.Do(ctx, protocol.NewRequest("get", "cancelled"))
+	require.ErrorIs(t, err, context.DeadlineExceeded)
+
+	close(release)
+
+	// the other request on the session is unaffected
+	require.NoError(t, <-heldErr)
+	require.Equal(t, "held", string((<-heldRes).Output))
+
+	require.NoError(t, client.Close())
+}
+
+func TestConnCloseTimeout(t *testing.T) {
+	client := newTestClient(t, func(ch gossh.Channel) {
+		// never respond, or end the session
+		io.Copy(io.Discard, ch)
+		select {}
+	})
+
+	// open the session
+	ctx, cancel := context.WithTimeout(t.Context(), 50*time.Millisecond)
+	defer cancel()
+
+	_, err := client.Do(ctx, protocol.NewRequest("get", "secret"))
+	require.ErrorIs(t, err, context.DeadlineExceeded)
+
+	closed := make(chan error, 1)
+
+	go func() { closed <- client.Close() }()
+
+	select {
+	case <-closed:
+	case <-time.After(10 * time.Second):
+		t.Fatal("client wasn't closed")
+	}
+}
+
+func TestConnFrameTooLarge(t *testing.T) {
+	client := newTestClient(t, func(ch gossh.Channel) {
+		for {
+			var req protocol.Request
+			if err := protocol.ReadFrame(ch, &req); err != nil {
+				return
+			}
+
+			protocol.WriteFrame(ch, &protocol.Response{
+				ID:      req.ID,
+				Version: protocol.Version,
+				Output:  req.Args[0],
+			})
+		}
+	})
+
+	ctx, cancel := context.WithTimeout(t.Context(), 5*time.Second)
+	defer cancel()
+
+	// the request isn't written, so it fails without waiting on the session
+	_, err := client.Do(ctx, protocol.NewRequest("set", "key", strings.Repeat("x", protocol.MaxFrameSize)))
+	require.ErrorIs(t, err, protocol.ErrFrameTooLarge)
+	require.NoError(t, ctx.Err())
+
+	// and the session is still used for later requests
+	res, err := client.Do(t.Context(), protocol.NewRequest("get", "secret"))
+	require.NoError(t, err)
+	require.Equal(t, "secret", string(res.Output))
+
+	require.NoError(t, client.Close())
+}
+
+func TestConnProxyJump(t *testing.T) {
+	addr := startTestServer(t, func(conn net.Conn, config *gossh.ServerConfig) {
+		serveTestConn(conn, config, func(ch gossh.Channel) {
+			var req protocol.Request
+			if err := protocol.ReadFrame(ch, &req); err != nil {
+				return
+			}
+
+			protocol.WriteFrame(ch, &protocol.Response{
+				ID:      req.ID,
+				Version: protocol.Version,
+				Output:  req.Args[0],
+			})
+		})
+	})
+
+	var firstJumps, secondJumps atomic.Int32
+
+	firstJump := startTestServer(t, func(conn net.Conn, config *gossh.ServerConfig) {
+		serveJumpConn(conn, config, &firstJumps)
+	})
+
+	secondJump := startTestServer(t, func(conn net.Conn, config *gossh.ServerConfig) {
+		serveJumpConn(conn, config, &secondJumps)
+	})
+
+	client, err := ssh.NewSSHClient(
+		t.Context(),
+		addr.IP.String(),
+		addr.Port,
+		"alice",
+		gossh.Password(""),
+		testHostKeyCallback(t),
+		ssh.DialOptions{},
+		ssh.ProxyJump{Host: firstJump.IP.String(), Port: firstJump.Port},
+		ssh.ProxyJump{Host: secondJump.IP.String(), Port: secondJump.Port, User: "bob"},
+	)
+	require.NoError(t, err)
+
+	res, err := client.Do(t.Context(), protocol.NewRequest("get", "secret"))
+	require.NoError(t, err)
+	require.Equal(t, "secret", string(res.Output))
+
+	require.NoError(t, client.Close())
+
+	// the first jump forwards to the second, which forwards to the server
+	require.Equal(t, int32(1), firstJumps.Load())
+	require.Equal(t, int32(1), secondJumps.Load())
+}
+
+// newTestClient returns a client connected to an ssh server that passes the
+// channel of each syringe subsystem session to handle.
+func newTestClient(t *testing.T, handle func(ch gossh.Channel)) *ssh.SSHClient {
+	addr := startTestServer(t, func(conn net.Conn, config *gossh.ServerConfig) {
+		serveTestConn(conn, config, handle)
+	})
+
+	client, err := ssh.NewSSHClient(
+		t.Context(),
+		addr.IP.String(),
+		addr.Port,
+		"alice",
+		gossh.Password(""),
+		testHostKeyCallback(t),
+		ssh.DialOptions{},
+	)
+	require.NoError(t, err)
+
+	return client
+}
+
+// startTestServer starts an ssh server that passes each connection to serve.
+func startTestServer(
+	t *testing.T,
+	serve func(conn net.Conn, config *gossh.ServerConfig),
+) *net.TCPAddr {
+	config := &gossh.ServerConfig{NoClientAuth: true}
+	config.AddHostKey(testHostSigner(t))
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { listener.Close() })
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+
+			go serve(conn, config)
+		}
+	}()
+
+	return listener.Addr().(*net.TCPAddr)
+}
+
+func testHostSigner(t *testing.T) gossh.Signer {
+	_, hostKey, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+
+	hostSigner, err := gossh.NewSignerFromKey(hostKey)
+	require.NoError(t, err)
+
+	return hostSigner
+}
+
+func testHostKeyCallback(t *testing.T) gossh.HostKeyCallback {
+	knownHosts := filepath.Join(t.TempDir(), "known_hosts")
+	require.NoError(t, os.WriteFile(knownHosts, nil, 0600))
+
+	return ssh.HostKeyCallback(knownHosts, ssh.HostKeyCheckingAcceptNew, "", nil)
+}
+
+func serveTestConn(
+	conn net.Conn,
+	config *gossh.ServerConfig,
+	handle func(ch gossh.Channel),
+) {
+	_, chans, reqs, err := gossh.NewServerConn(conn, config)
+	if err != nil {
+		return
+	}
+
+	go gossh.DiscardRequests(reqs)
+
+	for newChannel := range chans {
+		ch, requests, err := newChannel.Accept()
+		if err != nil {
+			return
+		}
+
+		go func() {
+			for req := range requests {
+				subsystem := struct{ Name string }{}
+				ok := req.Type == "subsystem" &&
+					gossh.Unmarshal(req.Payload, &subsystem) == nil &&
+					subsystem.Name == protocol.Subsystem
+
+				req.Reply(ok, nil)
+
+				if ok {
+					go func() {
+						handle(ch)
+
+						ch.SendRequest("exit-status", false, gossh.Marshal(struct{ Status uint32 }{0}))
+						ch.Close()
+					}()
+				}
+			}
+		}()
+	}
+}
+
+// serveJumpConn forwards direct-tcpip channels, as a jump host does.
+func serveJumpConn(conn net.Conn, config *gossh.ServerConfig, jumps *atomic.Int32) {
+	_, chans, reqs, err := gossh.NewServerConn(conn, config)
+	if err != nil {
+		return
+	}
+
+	go gossh.DiscardRequests(reqs)
+
+	for newChannel := range chans {
+		if newChannel.ChannelType() != "direct-tcpip" {
+			newChannel.Reject(gossh.UnknownChannelType, "unknown channel type")
+			continue
+		}
+
+		target := struct {
+			Host       string
+			Port       uint32
+			OriginHost string
+			OriginPort uint32
+		}{}
+		if err := gossh.Unmarshal(newChannel.ExtraData(), &target); err != nil {
+			newChannel.Reject(gossh.ConnectionFailed, err.Error())
+			continue
+		}
+
+		targetConn, err := net.Dial("tcp", net.JoinHostPort(target.Host, fmt.Sprint(target.Port)))
+		if err != nil {
+			newChannel.Reject(gossh.ConnectionFailed, err.Error())
+			continue
+		}
+
+		ch, requests, err := newChannel.Accept()
+		if err != nil {
+			targetConn.Close()
+			continue
+		}
+
+		jumps.Add(1)
+
+		go gossh.DiscardRequests(requests)
+
+		go func() {
+			io.Copy(ch, targetConn)
+			ch.CloseWrite()
+		}()
+
+		go func() {
+			io.Copy(targetConn, ch)
+			targetConn.Close()
+		}()
+	}
+}
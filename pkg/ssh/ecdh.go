@@ -0,0 +1,82 @@
+package ssh
+
+import (
+	"crypto/ecdsa"
+	"crypto/rand"
+	"errors"
+	"fmt"
+)
+
+const ecdhInfo = "syringe.sh/ecdh"
+
+// ecdhSealedKeySize is the size of the sealed data key that follows the
+// ephemeral public key in a data key wrapped by wrapECDH.
+const ecdhSealedKeySize = 12 + dataKeySize + 16
+
+// wrapECDH wraps the data key to an ecdsa public key, by sealing it with a
+// key derived from an ephemeral ECDH exchange on the key's curve.
+func wrapECDH(publicKey *ecdsa.PublicKey, dataKey []byte) ([]byte, error) {
+	recipient, err := publicKey.ECDH()
+	if err != nil {
+		return nil, fmt.Errorf("convert public key: %w", err)
+	}
+
+	ephemeral, err := recipient.Curve().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, fmt.Errorf("generate ephemeral key: %w", err)
+	}
+
+	shared, err := ephemeral.ECDH(recipient)
+	if err != nil {
+		return nil, fmt.Errorf("ecdh exchange: %w", err)
+	}
+
+	kek, err := exchangeKEK(ecdhInfo, shared, ephemeral.PublicKey(), recipient)
+	if err != nil {
+		return nil, err
+	}
+
+	sealedKey, err := seal(kek, dataKey, nil)
+	if err != nil {
+		return nil, fmt.Errorf("seal data key: %w", err)
+	}
+
+	return append(ephemeral.PublicKey().Bytes(), sealedKey...), nil
+}
+
+// unwrapECDH recovers a data key wrapped by wrapECDH using the corresponding
+// ecdsa private key.
+func unwrapECDH(privateKey *ecdsa.PrivateKey, wrappedKey []byte) ([]byte, error) {
+	identity, err := privateKey.ECDH()
+	if err != nil {
+		return nil, fmt.Errorf("convert private key: %w", err)
+	}
+
+	if len(wrappedKey) <= ecdhSealedKeySize {
+		return nil, errors.New("invalid wrapped key size")
+	}
+
+	ephemeralSize := len(wrappedKey) - ecdhSealedKeySize
+
+	ephemeral, err := identity.Curve().NewPublicKey(wrappedKey[:ephemeralSize])
+	if err != nil {
+		return nil, fmt.Errorf("parse ephemeral key: %w", err)
+	}
+
+	shared, err := identity.ECDH(ephemeral)
+	if err != nil {
+		return nil, fmt.Errorf("ecdh exchange: %w", err)
+	}
+
+	kek, err := exchangeKEK(ecdhInfo, shared, ephemeral, identity.PublicKey())
+	if err != nil {
+		return nil, err
+	}
+
+	dataKey, err := open(kek, wrappedKey[ephemeralSize:], nil)
+	if err != nil {
+		return nil, fmt.Errorf("open data key: %w", err)
+	}
+
+	return dataKey, nil
+}
@@ -0,0 +1,272 @@
+package ssh
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+
+	gossh "golang.org/x/crypto/ssh"
+)
+
+// envelopeMagic prefixes every enveloped value, distinguishing it from values
+// stored before the envelope was introduced.
+const envelopeMagic = "SYR"
+
+// envelopeVersion is the version of envelopes written and read. Versions 1
+// and 2 were never released, so aren't read.
+const envelopeVersion = 3
+
+// maxRecipients is the maximum number of recipients in an envelope.
+const maxRecipients = 255
+
+var errNotEnvelope = errors.New("not an envelope")
+
+// algorithm identifies the scheme used to wrap the data key in an envelope.
+type algorithm byte
+
+const (
+	// algorithmRSAOAEP wraps the data key with RSA-OAEP-SHA256.
+	algorithmRSAOAEP algorithm = iota + 1
+	// algorithmX25519 wraps the data key with a key derived from an X25519
+	// exchange with the recipient's ed25519 key.
+	algorithmX25519
+	// algorithmAgent wraps the data key with a key derived from the
+	// recipient's deterministic signature over a challenge, so it can be
+	// unwrapped by an ssh agent holding the key.
+	algorithmAgent
+	// algorithmScrypt wraps the data key with a key derived from a
+	// passphrase with scrypt.
+	algorithmScrypt
+	// algorithmECDH wraps the data key with a key derived from an ephemeral
+	// ECDH exchange with the recipient's ecdsa key.
+	algorithmECDH
+)
+
+func (a algorithm) String() string {
+	switch a {
+	case algorithmRSAOAEP:
+		return "rsa-oaep-sha256"
+	case algorithmX25519:
+		return "x25519"
+	case algorithmAgent:
+		return "agent"
+	case algorithmScrypt:
+		return "scrypt"
+	case algorithmECDH:
+		return "ecdh"
+	default:
+		return fmt.Sprintf("unknown(%d)", byte(a))
+	}
+}
+
+// stanza is the data key wrapped to a single recipient.
+type stanza struct {
+	algorithm   algorithm
+	fingerprint [sha256.Size]byte
+	wrappedKey  []byte
+}
+
+func (s *stanza) marshal(b *bytes.Buffer) {
+	b.WriteByte(byte(s.algorithm))
+	b.Write(s.fingerprint[:])
+	binary.Write(b, binary.BigEndian, uint16(len(s.wrappedKey)))
+	b.Write(s.wrappedKey)
+}
+
+func unmarshalStanza(r *bytes.Reader) (*stanza, error) {
+	var s stanza
+
+	alg, err := r.ReadByte()
+	if err != nil {
+		return nil, fmt.Errorf("read algorithm: %w", err)
+	}
+
+	s.algorithm = algorithm(alg)
+
+	if _, err := io.ReadFull(r, s.fingerprint[:]); err != nil {
+		return nil, fmt.Errorf("read fingerprint: %w", err)
+	}
+
+	var wrappedKeySize uint16
+	if err := binary.Read(r, binary.BigEndian, &wrappedKeySize); err != nil {
+		return nil, fmt.Errorf("read wrapped key size: %w", err)
+	}
+
+	s.wrappedKey = make([]byte, wrappedKeySize)
+	if _, err := io.ReadFull(r, s.wrappedKey); err != nil {
+		return nil, fmt.Errorf("read wrapped key: %w", err)
+	}
+
+	return &s, nil
+}
+
+// envelope is the self-describing format of an encrypted value.
+//
+//	magic "SYR" | version (1) | recipient count (1) | stanzas | payload
+//
+// Each stanza is the data key wrapped to one recipient.
+//
+//	algorithm (1) | fingerprint (32) | wrapped key length (2) | wrapped key
+//
+// The payload is the value sealed with the data key, with the header and
+// associated data authenticated as additional data.
+type envelope struct {
+	version    byte
+	recipients []stanza
+	payload    []byte
+
+	// rawHeader is the header as read, so the payload is authenticated
+	// against the header exactly as it was sealed with.
+	rawHeader []byte
+}
+
+func (e *envelope) marshal() []byte {
+	return append(e.header(), e.payload...)
+}
+
+// header returns the marshalled envelope up to the payload.
+func (e *envelope) header() []byte {
+	if e.rawHeader != nil {
+		return e.rawHeader
+	}
+
+	var b bytes.Buffer
+
+	b.WriteString(envelopeMagic)
+	b.WriteByte(e.version)
+	b.WriteByte(byte(len(e.recipients)))
+
+	for _, s := range e.recipients {
+		s.marshal(&b)
+	}
+
+	return b.Bytes()
+}
+
+func unmarshalEnvelope(data []byte) (*envelope, error) {
+	if !bytes.HasPrefix(data, []byte(envelopeMagic)) {
+		return nil, errNotEnvelope
+	}
+
+	r := bytes.NewReader(data[len(envelopeMagic):])
+
+	var e envelope
+
+	version, err := r.ReadByte()
+	if err != nil {
+		return nil, fmt.Errorf("read version: %w", err)
+	}
+
+	if version != envelopeVersion {
+		return nil, fmt.Errorf("unsupported envelope version: %d", version)
+	}
+
+	e.version = version
+
+	recipientCount, err := r.ReadByte()
+	if err != nil {
+		return nil, fmt.Errorf("read recipient count: %w", err)
+	}
+
+	for range recipientCount {
+		s, err := unmarshalStanza(r)
+		if err != nil {
+			return nil, err
+		}
+
+		e.recipients = append(e.recipients, *s)
+	}
+
+	e.rawHeader = data[:len(data)-r.Len()]
+
+	e.payload = make([]byte, r.Len())
+	r.Read(e.payload)
+
+	return &e, nil
+}
+
+// additionalData returns the data authenticated alongside the payload.
+func (e *envelope) additionalData(associatedData []byte) []byte {
+	return append(e.header(), associatedData...)
+}
+
+// IsLegacy reports whether the encrypted value predates the envelope, so
+// isn't authenticated with the key it's stored under.
+func IsLegacy(s string) bool {
+	data, err := base64.StdEncoding.DecodeString(s)
+	if err != nil {
+		return false
+	}
+
+	return !bytes.HasPrefix(data, []byte(envelopeMagic))
+}
+
+// IsEncryptedFor reports whether the encrypted value has a stanza for the
+// public key, without decrypting it.
+func IsEncryptedFor(s string, publicKey gossh.PublicKey) bool {
+	data, err := base64.StdEncoding.DecodeString(s)
+	if err != nil {
+		return false
+	}
+
+	e, err := unmarshalEnvelope(data)
+	if err != nil {
+		return false
+	}
+
+	fp := fingerprint(publicKey)
+
+	for _, st := range e.recipients {
+		if st.fingerprint == fp {
+			return true
+		}
+	}
+
+	return false
+}
+
+// AssociatedData returns the data that binds an encrypted value to the key
+// it's stored under. Decrypting a value with associated data for a different
+// key fails, so values swapped between keys are rejected.
+func AssociatedData(key string) []byte {
+	return associatedData("syringe.sh", key)
+}
+
+// NamespaceAssociatedData is AssociatedData for a key in a project and
+// environment, so values swapped between environments are rejected too.
+func NamespaceAssociatedData(project, environment, key string) []byte {
+	return associatedData("syringe.sh", project, environment, key)
+}
+
+// KeyNameAssociatedData returns the data that binds an encrypted key name to
+// its purpose, so names and values can't be swapped for one another.
+func KeyNameAssociatedData() []byte {
+	return associatedData("syringe.sh/name")
+}
+
+// associatedData length-prefixes each part, so different parts never produce
+// the same associated data.
+func associatedData(parts ...string) []byte {
+	var b bytes.Buffer
+
+	for _, part := range parts {
+		binary.Write(&b, binary.BigEndian, uint32(len(part)))
+		b.WriteString(part)
+	}
+
+	return b.Bytes()
+}
+
+// fingerprint returns the SHA256 digest of the public key in SSH wire format,
+// as used by ssh-keygen -l.
+func fingerprint(publicKey gossh.PublicKey) [sha256.Size]byte {
+	return sha256.Sum256(publicKey.Marshal())
+}
+
+func formatFingerprint(fp [sha256.Size]byte) string {
+	return "SHA256:" + base64.RawStdEncoding.EncodeToString(fp[:])
+}
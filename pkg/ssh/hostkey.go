@@ -0,0 +1,146 @@
+package ssh
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+
+	"github.com/skeema/knownhosts"
+	gossh "golang.org/x/crypto/ssh"
+	xknownhosts "golang.org/x/crypto/ssh/knownhosts"
+)
+
+// HostKeyChecking is how host keys that aren't in known_hosts are treated.
+type HostKeyChecking string
+
+const (
+	// HostKeyCheckingStrict rejects unknown host keys.
+	HostKeyCheckingStrict HostKeyChecking = "strict"
+	// HostKeyCheckingAsk shows the fingerprint of unknown host keys and asks
+	// whether to trust them.
+	HostKeyCheckingAsk HostKeyChecking = "ask"
+	// HostKeyCheckingAcceptNew trusts unknown host keys on first use.
+	HostKeyCheckingAcceptNew HostKeyChecking = "accept-new"
+)
+
+var ErrHostKeyRejected = errors.New("host key verification failed")
+
+// ParseHostKeyChecking parses a host key checking mode.
+func ParseHostKeyChecking(s string) (HostKeyChecking, error) {
+	switch mode := HostKeyChecking(s); mode {
+	case HostKeyCheckingStrict, HostKeyCheckingAsk, HostKeyCheckingAcceptNew:
+		return mode, nil
+	default:
+		return "", fmt.Errorf(
+			"invalid host key checking mode '%s', expected one of %s, %s or %s",
+			s,
+			HostKeyCheckingStrict,
+			HostKeyCheckingAsk,
+			HostKeyCheckingAcceptNew,
+		)
+	}
+}
+
+// HostKeyConfirm asks whether to trust the unknown host key.
+type HostKeyConfirm func(hostname string, key gossh.PublicKey) (bool, error)
+
+// HostKeyCallback returns a callback that verifies host keys against
+// known_hosts, adding unknown host keys when the mode allows it. When
+// fingerprint is set, the host key must have that SHA256 fingerprint instead,
+// and known_hosts isn't used.
+func HostKeyCallback(
+	knownHosts string,
+	mode HostKeyChecking,
+	fingerprint string,
+	confirm HostKeyConfirm,
+) gossh.HostKeyCallback {
+	return func(hostname string, remote net.Addr, key gossh.PublicKey) error {
+		if fingerprint != "" {
+			if f := gossh.FingerprintSHA256(key); f != pinnedFingerprint(fingerprint) {
+				return fmt.Errorf(
+					"%w: host key fingerprint %s doesn't match pinned fingerprint %s",
+					ErrHostKeyRejected,
+					f,
+					fingerprint,
+				)
+			}
+
+			return nil
+		}
+
+		err := checkKnownHost(knownHosts, hostname, remote, key)
+
+		if knownhosts.IsHostKeyChanged(err) {
+			return fmt.Errorf("remote host identification has changed which may indicate a MITM attack: %w", err)
+		}
+
+		if !knownhosts.IsHostUnknown(err) {
+			return err
+		}
+
+		switch mode {
+		case HostKeyCheckingAcceptNew:
+		case HostKeyCheckingAsk:
+			if confirm == nil {
+				return fmt.Errorf("%w: no way to confirm unknown host key for %s", ErrHostKeyRejected, hostname)
+			}
+
+			ok, err := confirm(hostname, key)
+			if err != nil {
+				return fmt.Errorf("%w: %w", ErrHostKeyRejected, err)
+			}
+
+			if !ok {
+				return ErrHostKeyRejected
+			}
+		default:
+			return fmt.Errorf(
+				"%w: no %s host key is known for %s (fingerprint %s)",
+				ErrHostKeyRejected,
+				key.Type(),
+				hostname,
+				gossh.FingerprintSHA256(key),
+			)
+		}
+
+		khHandle, err := os.OpenFile(knownHosts, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+		if err != nil {
+			return fmt.Errorf("failed to open known hosts file for writing: %w", err)
+		}
+
+		defer khHandle.Close()
+
+		if err := knownhosts.WriteKnownHost(khHandle, hostname, remote, key); err != nil {
+			return fmt.Errorf("failed to write to known hosts: %w", err)
+		}
+
+		return nil
+	}
+}
+
+// checkKnownHost checks the host key against known_hosts, treating a missing
+// known_hosts as having no known hosts.
+func checkKnownHost(
+	knownHosts string,
+	hostname string,
+	remote net.Addr,
+	key gossh.PublicKey,
+) error {
+	kh, err := knownhosts.New(knownHosts)
+	if errors.Is(err, os.ErrNotExist) {
+		return &xknownhosts.KeyError{}
+	}
+	if err != nil {
+		return fmt.Errorf("failed to open knownhosts file: %w", err)
+	}
+
+	return kh(hostname, remote, key)
+}
+
+// pinnedFingerprint normalises the fingerprint, which may be given without
+// its hash prefix.
+func pinnedFingerprint(fingerprint string) string {
+	return "SHA256:" + strings.TrimPrefix(fingerprint, "SHA256:")
+}
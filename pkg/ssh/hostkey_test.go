@@ -0,0 +1,192 @@
+package ssh_test
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/nixpig/syringe.sh/pkg/ssh"
+	"github.com/stretchr/testify/require"
+	gossh "golang.org/x/crypto/ssh"
+)
+
+const testHostname = "127.0.0.1:2323"
+
+var testRemote = &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 2323}
+
+func TestHostKeyCallback(t *testing.T) {
+	scenarios := map[string]func(
+		t *testing.T,
+		knownHosts string,
+		hostKey gossh.PublicKey,
+	){
+		"strict (unknown host)":               testHostKeyStrictUnknown,
+		"strict (known host)":                 testHostKeyStrictKnown,
+		"strict (changed host key)":           testHostKeyStrictChanged,
+		"accept new (unknown host)":           testHostKeyAcceptNewUnknown,
+		"accept new (missing known hosts)":    testHostKeyAcceptNewMissingKnownHosts,
+		"accept new (changed host key)":       testHostKeyAcceptNewChanged,
+		"ask (confirmed)":                     testHostKeyAskConfirmed,
+		"ask (declined)":                      testHostKeyAskDeclined,
+		"ask (known host)":                    testHostKeyAskKnown,
+		"pinned fingerprint (matching)":       testHostKeyPinnedMatching,
+		"pinned fingerprint (not matching)":   testHostKeyPinnedNotMatching,
+		"pinned fingerprint (without prefix)": testHostKeyPinnedWithoutPrefix,
+	}
+
+	for scenario, fn := range scenarios {
+		t.Run(scenario, func(t *testing.T) {
+			knownHosts := filepath.Join(t.TempDir(), "known_hosts")
+			require.NoError(t, os.WriteFile(knownHosts, nil, 0600))
+
+			fn(t, knownHosts, generateHostKey(t))
+		})
+	}
+}
+
+func TestParseHostKeyChecking(t *testing.T) {
+	for _, s := range []string{"strict", "ask", "accept-new"} {
+		mode, err := ssh.ParseHostKeyChecking(s)
+		require.NoError(t, err)
+		require.Equal(t, ssh.HostKeyChecking(s), mode)
+	}
+
+	_, err := ssh.ParseHostKeyChecking("no")
+	require.Error(t, err)
+}
+
+func trustHostKey(t *testing.T, knownHosts string, hostKey gossh.PublicKey) {
+	cb := ssh.HostKeyCallback(knownHosts, ssh.HostKeyCheckingAcceptNew, "", nil)
+	require.NoError(t, cb(testHostname, testRemote, hostKey))
+}
+
+func generateHostKey(t *testing.T) gossh.PublicKey {
+	signer, err := gossh.NewSignerFromKey(generateEd25519Key(t))
+	require.NoError(t, err)
+
+	return signer.PublicKey()
+}
+
+func confirmed(answer bool, asked *bool) ssh.HostKeyConfirm {
+	return func(hostname string, key gossh.PublicKey) (bool, error) {
+		*asked = true
+		return answer, nil
+	}
+}
+
+func testHostKeyStrictUnknown(t *testing.T, knownHosts string, hostKey gossh.PublicKey) {
+	cb := ssh.HostKeyCallback(knownHosts, ssh.HostKeyCheckingStrict, "", nil)
+
+	err := cb(testHostname, testRemote, hostKey)
+	require.ErrorIs(t, err, ssh.ErrHostKeyRejected)
+	require.ErrorContains(t, err, gossh.FingerprintSHA256(hostKey))
+
+	contents, err := os.ReadFile(knownHosts)
+	require.NoError(t, err)
+	require.Empty(t, contents)
+}
+
+func testHostKeyStrictKnown(t *testing.T, knownHosts string, hostKey gossh.PublicKey) {
+	trustHostKey(t, knownHosts, hostKey)
+
+	cb := ssh.HostKeyCallback(knownHosts, ssh.HostKeyCheckingStrict, "", nil)
+	require.NoError(t, cb(testHostname, testRemote, hostKey))
+}
+
+func testHostKeyStrictChanged(t *testing.T, knownHosts string, hostKey gossh.PublicKey) {
+	trustHostKey(t, knownHosts, hostKey)
+
+	cb := ssh.HostKeyCallback(knownHosts, ssh.HostKeyCheckingStrict, "", nil)
+	require.ErrorContains(t, cb(testHostname, testRemote, generateHostKey(t)), "remote host identification has changed")
+}
+
+func testHostKeyAcceptNewUnknown(t *testing.T, knownHosts string, hostKey gossh.PublicKey) {
+	cb := ssh.HostKeyCallback(knownHosts, ssh.HostKeyCheckingAcceptNew, "", nil)
+	require.NoError(t, cb(testHostname, testRemote, hostKey))
+
+	strict := ssh.HostKeyCallback(knownHosts, ssh.HostKeyCheckingStrict, "", nil)
+	require.NoError(t, strict(testHostname, testRemote, hostKey))
+}
+
+func testHostKeyAcceptNewMissingKnownHosts(t *testing.T, knownHosts string, hostKey gossh.PublicKey) {
+	require.NoError(t, os.Remove(knownHosts))
+
+	cb := ssh.HostKeyCallback(knownHosts, ssh.HostKeyCheckingAcceptNew, "", nil)
+	require.NoError(t, cb(testHostname, testRemote, hostKey))
+
+	strict := ssh.HostKeyCallback(knownHosts, ssh.HostKeyCheckingStrict, "", nil)
+	require.NoError(t, strict(testHostname, testRemote, hostKey))
+}
+
+func testHostKeyAcceptNewChanged(t *testing.T, knownHosts string, hostKey gossh.PublicKey) {
+	trustHostKey(t, knownHosts, hostKey)
+
+	cb := ssh.HostKeyCallback(knownHosts, ssh.HostKeyCheckingAcceptNew, "", nil)
+	require.ErrorContains(t, cb(testHostname, testRemote, generateHostKey(t)), "remote host identification has changed")
+}
+
+func testHostKeyAskConfirmed(t *testing.T, knownHosts string, hostKey gossh.PublicKey) {
+	var asked bool
+
+	cb := ssh.HostKeyCallback(knownHosts, ssh.HostKeyCheckingAsk, "", confirmed(true, &asked))
+	require.NoError(t, cb(testHostname, testRemote, hostKey))
+	require.True(t, asked)
+
+	strict := ssh.HostKeyCallback(knownHosts, ssh.HostKeyCheckingStrict, "", nil)
+	require.NoError(t, strict(testHostname, testRemote, hostKey))
+}
+
+func testHostKeyAskDeclined(t *testing.T, knownHosts string, hostKey gossh.PublicKey) {
+	var asked bool
+
+	cb := ssh.HostKeyCallback(knownHosts, ssh.HostKeyCheckingAsk, "", confirmed(false, &asked))
+	require.ErrorIs(t, cb(testHostname, testRemote, hostKey), ssh.ErrHostKeyRejected)
+	require.True(t, asked)
+
+	strict := ssh.HostKeyCallback(knownHosts, ssh.HostKeyCheckingStrict, "", nil)
+	require.ErrorIs(t, strict(testHostname, testRemote, hostKey), ssh.ErrHostKeyRejected)
+}
+
+func testHostKeyAskKnown(t *testing.T, knownHosts string, hostKey gossh.PublicKey) {
+	trustHostKey(t, knownHosts, hostKey)
+
+	var asked bool
+
+	cb := ssh.HostKeyCallback(knownHosts, ssh.HostKeyCheckingAsk, "", confirmed(false, &asked))
+	require.NoError(t, cb(testHostname, testRemote, hostKey))
+	require.False(t, asked)
+}
+
+func testHostKeyPinnedMatching(t *testing.T, knownHosts string, hostKey gossh.PublicKey) {
+	cb := ssh.HostKeyCallback(
+		knownHosts,
+		ssh.HostKeyCheckingStrict,
+		gossh.FingerprintSHA256(hostKey),
+		nil,
+	)
+	require.NoError(t, cb(testHostname, testRemote, hostKey))
+}
+
+func testHostKeyPinnedNotMatching(t *testing.T, knownHosts string, hostKey gossh.PublicKey) {
+	// the pin takes precedence over known hosts
+	trustHostKey(t, knownHosts, hostKey)
+
+	cb := ssh.HostKeyCallback(
+		knownHosts,
+		ssh.HostKeyCheckingAcceptNew,
+		gossh.FingerprintSHA256(generateHostKey(t)),
+		nil,
+	)
+	require.ErrorIs(t, cb(testHostname, testRemote, hostKey), ssh.ErrHostKeyRejected)
+}
+
+func testHostKeyPinnedWithoutPrefix(t *testing.T, knownHosts string, hostKey gossh.PublicKey) {
+	cb := ssh.HostKeyCallback(
+		knownHosts,
+		ssh.HostKeyCheckingStrict,
+		gossh.FingerprintSHA256(hostKey)[len("SHA256:"):],
+		nil,
+	)
+	require.NoError(t, cb(testHostname, testRemote, hostKey))
+}
@@ -0,0 +1,32 @@
+package ssh
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+
+	gossh "golang.org/x/crypto/ssh"
+)
+
+const keyHashInfo = "syringe.sh/key-hash"
+
+// KeyHasher hashes a key name, so it can be used to look up a value without
+// revealing the name.
+type KeyHasher func(string) string
+
+// NewKeyHasher returns a KeyHasher that computes an HMAC-SHA256 of key names
+// with a key derived from the signer. The same hash is produced for a name
+// each time, but can't be computed or reversed without the signer's key.
+func NewKeyHasher(signer gossh.Signer) (KeyHasher, error) {
+	hmacKey, err := deriveKey(signer, keyHashInfo, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	return func(name string) string {
+		mac := hmac.New(sha256.New, hmacKey)
+		mac.Write([]byte(name))
+
+		return hex.EncodeToString(mac.Sum(nil))
+	}, nil
+}
@@ -0,0 +1,58 @@
+package ssh
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+
+	gossh "golang.org/x/crypto/ssh"
+)
+
+const keyProofInfo = "syringe.sh/key-proof"
+
+// ErrKeyNotProven is the error for a key added without proof that the client
+// holds it.
+var ErrKeyNotProven = errors.New("key isn't proven to be held by the client")
+
+// SignKeyProof signs the ssh session ID with the key being added to the user,
+// proving the client holds it. The session ID is agreed by the client and
+// server and unique to the connection, so the proof can't be replayed.
+func SignKeyProof(signer gossh.Signer, sessionID []byte) (string, error) {
+	signature, err := signer.Sign(rand.Reader, keyProof(sessionID))
+	if err != nil {
+		return "", fmt.Errorf("sign key proof: %w", err)
+	}
+
+	return base64.StdEncoding.EncodeToString(gossh.Marshal(signature)), nil
+}
+
+// VerifyKeyProof verifies the proof from SignKeyProof that the client on the
+// session holds the public key.
+func VerifyKeyProof(publicKey gossh.PublicKey, sessionID []byte, proof string) error {
+	if proof == "" {
+		return ErrKeyNotProven
+	}
+
+	b, err := base64.StdEncoding.DecodeString(proof)
+	if err != nil {
+		return fmt.Errorf("%w: decode signature: %w", ErrKeyNotProven, err)
+	}
+
+	var signature gossh.Signature
+	if err := gossh.Unmarshal(b, &signature); err != nil {
+		return fmt.Errorf("%w: parse signature: %w", ErrKeyNotProven, err)
+	}
+
+	if err := publicKey.Verify(keyProof(sessionID), &signature); err != nil {
+		return fmt.Errorf("%w: %w", ErrKeyNotProven, err)
+	}
+
+	return nil
+}
+
+// keyProof is what's signed to prove a key is held, kept apart from anything
+// else signed with the key over the session, e.g. to authenticate.
+func keyProof(sessionID []byte) []byte {
+	return append([]byte(keyProofInfo+"\x00"), sessionID...)
+}
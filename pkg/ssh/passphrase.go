@@ -0,0 +1,151 @@
+package ssh
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+
+	"golang.org/x/crypto/scrypt"
+)
+
+const passphraseLabel = "syringe.sh/passphrase"
+
+const passphraseSaltSize = 16
+
+// passphraseLogN is the scrypt work factor for wrapping data keys, as used by
+// age, taking around a second on a modern machine.
+const passphraseLogN = 18
+
+// maxPassphraseLogN limits the work factor accepted when unwrapping, so a
+// value can't make decryption arbitrarily expensive.
+const maxPassphraseLogN = 22
+
+// passphraseFingerprint identifies passphrase stanzas, which have no public
+// key.
+var passphraseFingerprint = sha256.Sum256([]byte(passphraseLabel))
+
+// NewPassphraseEncryptor returns a Cryptor that encrypts values so they can be
+// decrypted with the passphrase, without an ssh key.
+func NewPassphraseEncryptor(passphrase []byte, associatedData []byte) Cryptor {
+	return newEncryptor(
+		[]recipient{&passphraseRecipient{passphrase}},
+		associatedData,
+	)
+}
+
+// NewPassphraseDecryptor returns a Cryptor that decrypts values encrypted by
+// NewPassphraseEncryptor.
+func NewPassphraseDecryptor(passphrase []byte, associatedData []byte) Cryptor {
+	return newDecryptor(&passphraseIdentity{passphrase}, associatedData)
+}
+
+// IsPassphraseEncrypted reports whether the encrypted value can be decrypted
+// with a passphrase, without decrypting it.
+func IsPassphraseEncrypted(s string) bool {
+	data, err := base64.StdEncoding.DecodeString(s)
+	if err != nil {
+		return false
+	}
+
+	e, err := unmarshalEnvelope(data)
+	if err != nil {
+		return false
+	}
+
+	for _, st := range e.recipients {
+		if st.algorithm == algorithmScrypt {
+			return true
+		}
+	}
+
+	return false
+}
+
+// passphraseRecipient wraps the data key with a key derived from a passphrase
+// with scrypt.
+//
+//	work factor (1) | salt (16) | sealed data key
+type passphraseRecipient struct {
+	passphrase []byte
+}
+
+func (r *passphraseRecipient) wrap(dataKey []byte) (*stanza, error) {
+	salt := make([]byte, passphraseSaltSize)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, fmt.Errorf("generate salt: %w", err)
+	}
+
+	kek, err := passphraseKEK(r.passphrase, salt, passphraseLogN)
+	if err != nil {
+		return nil, err
+	}
+
+	sealedKey, err := seal(kek, dataKey, nil)
+	if err != nil {
+		return nil, fmt.Errorf("seal data key: %w", err)
+	}
+
+	wrappedKey := append([]byte{passphraseLogN}, salt...)
+
+	return &stanza{
+		algorithm:   algorithmScrypt,
+		fingerprint: passphraseFingerprint,
+		wrappedKey:  append(wrappedKey, sealedKey...),
+	}, nil
+}
+
+// passphraseIdentity unwraps data keys wrapped by passphraseRecipient.
+type passphraseIdentity struct {
+	passphrase []byte
+}
+
+func (i *passphraseIdentity) fingerprint() ([sha256.Size]byte, error) {
+	return passphraseFingerprint, nil
+}
+
+func (i *passphraseIdentity) unwrap(s *stanza) ([]byte, error) {
+	if s.algorithm != algorithmScrypt {
+		return nil, errUnsupportedStanza
+	}
+
+	if len(s.wrappedKey) < 1+passphraseSaltSize {
+		return nil, errors.New("invalid wrapped key size")
+	}
+
+	logN := s.wrappedKey[0]
+	if logN > maxPassphraseLogN {
+		return nil, fmt.Errorf("scrypt work factor too high: %d", logN)
+	}
+
+	salt := s.wrappedKey[1 : 1+passphraseSaltSize]
+
+	kek, err := passphraseKEK(i.passphrase, salt, logN)
+	if err != nil {
+		return nil, err
+	}
+
+	dataKey, err := open(kek, s.wrappedKey[1+passphraseSaltSize:], nil)
+	if err != nil {
+		return nil, errors.New("incorrect passphrase")
+	}
+
+	return dataKey, nil
+}
+
+func passphraseKEK(passphrase, salt []byte, logN byte) ([]byte, error) {
+	kek, err := scrypt.Key(
+		passphrase,
+		append([]byte(passphraseLabel), salt...),
+		1<<logN,
+		8,
+		1,
+		dataKeySize,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("derive key encryption key: %w", err)
+	}
+
+	return kek, nil
+}
@@ -0,0 +1,119 @@
+package ssh
+
+import (
+	"crypto"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+
+	gossh "golang.org/x/crypto/ssh"
+)
+
+// errUnsupportedStanza is returned by an identity that can't unwrap a stanza
+// using the given algorithm.
+var errUnsupportedStanza = errors.New("unsupported stanza")
+
+// ErrNotRecipient is returned decrypting a value that isn't encrypted for the
+// key, e.g. as it was encrypted before the key was rekeyed.
+var ErrNotRecipient = errors.New("value is not encrypted for key")
+
+// recipient wraps a data key into a stanza of an envelope.
+type recipient interface {
+	wrap(dataKey []byte) (*stanza, error)
+}
+
+// identity unwraps a data key from a stanza of an envelope.
+type identity interface {
+	fingerprint() ([sha256.Size]byte, error)
+	unwrap(s *stanza) ([]byte, error)
+}
+
+// unwrap returns the data key of the envelope using the first stanza for the
+// identity that it can unwrap.
+func (e *envelope) unwrap(id identity) ([]byte, error) {
+	fp, err := id.fingerprint()
+	if err != nil {
+		return nil, err
+	}
+
+	unwrapErr := fmt.Errorf("%w %s", ErrNotRecipient, formatFingerprint(fp))
+
+	for _, st := range e.recipients {
+		if st.fingerprint != fp {
+			continue
+		}
+
+		dataKey, err := id.unwrap(&st)
+		if err == nil {
+			return dataKey, nil
+		}
+
+		if !errors.Is(err, errUnsupportedStanza) {
+			unwrapErr = fmt.Errorf("unwrap data key: %w", err)
+		}
+	}
+
+	return nil, unwrapErr
+}
+
+// publicKeyRecipient wraps the data key to an ssh public key.
+type publicKeyRecipient struct {
+	publicKey gossh.PublicKey
+}
+
+func (r *publicKeyRecipient) wrap(dataKey []byte) (*stanza, error) {
+	fp := fingerprint(r.publicKey)
+
+	cryptoKey, err := cryptoPublicKey(r.publicKey)
+	if err != nil {
+		return nil, err
+	}
+
+	alg, wrappedKey, err := wrapDataKey(cryptoKey, dataKey)
+	if err != nil {
+		return nil, fmt.Errorf("wrap for %s: %w", formatFingerprint(fp), err)
+	}
+
+	return &stanza{
+		algorithm:   alg,
+		fingerprint: fp,
+		wrappedKey:  wrappedKey,
+	}, nil
+}
+
+// privateKeyIdentity unwraps the data key using an ssh private key.
+type privateKeyIdentity struct {
+	privateKey crypto.PrivateKey
+}
+
+func (i *privateKeyIdentity) fingerprint() ([sha256.Size]byte, error) {
+	signer, err := i.signer()
+	if err != nil {
+		return [sha256.Size]byte{}, err
+	}
+
+	return fingerprint(signer.PublicKey()), nil
+}
+
+func (i *privateKeyIdentity) unwrap(s *stanza) ([]byte, error) {
+	// the private key can produce the same signature as an agent holding it
+	if s.algorithm == algorithmAgent {
+		signer, err := i.signer()
+		if err != nil {
+			return nil, err
+		}
+
+		return unwrapAgent(signer, s.wrappedKey)
+	}
+
+	return unwrapDataKey(i.privateKey, s.algorithm, s.wrappedKey)
+}
+
+func (i *privateKeyIdentity) signer() (gossh.Signer, error) {
+	signer, err := gossh.NewSignerFromKey(i.privateKey)
+	if err != nil {
+		return nil, fmt.Errorf("unsupported private key type: %T", i.privateKey)
+	}
+
+	return signer, nil
+}
@@ -0,0 +1,100 @@
+package ssh
+
+import (
+	"crypto"
+	"crypto/ed25519"
+	"encoding/base64"
+	"errors"
+	"fmt"
+
+	"slices"
+
+	gossh "golang.org/x/crypto/ssh"
+)
+
+// ErrUnknownRecipient is the error rekeying a value that's also encrypted for
+// a key that isn't one of the recipients given.
+var ErrUnknownRecipient = errors.New("value is also encrypted for key")
+
+// NewRekeyer returns a Cryptor that re-encrypts values encrypted for the
+// private key so they're encrypted for the new public key instead. Values are
+// sealed with a new data key, so the old key can't decrypt them even with an
+// earlier ciphertext. Any other recipients of a value are kept, so must be
+// among the recipients given. If signer isn't nil, values are also wrapped
+// for the agent holding the new key.
+func NewRekeyer(
+	privateKey crypto.PrivateKey,
+	publicKey gossh.PublicKey,
+	signer gossh.Signer,
+	others []gossh.PublicKey,
+	associatedData []byte,
+) Cryptor {
+	if k, ok := privateKey.(*ed25519.PrivateKey); ok {
+		privateKey = *k
+	}
+
+	recipients := []recipient{&publicKeyRecipient{publicKey}}
+	if signer != nil {
+		recipients = append(recipients, &agentRecipient{signer})
+	}
+
+	id := &privateKeyIdentity{privateKey}
+
+	return func(s string) (string, error) {
+		data, err := base64.StdEncoding.DecodeString(s)
+		if err != nil {
+			return "", fmt.Errorf("decode cypher text: %w", err)
+		}
+
+		e, err := unmarshalEnvelope(data)
+		if errors.Is(err, errNotEnvelope) {
+			value, err := decryptLegacy(privateKey, data)
+			if err != nil {
+				return "", err
+			}
+
+			return newEncryptor(recipients, associatedData)(value)
+		}
+		if err != nil {
+			return "", fmt.Errorf("parse envelope: %w", err)
+		}
+
+		dataKey, err := e.unwrap(id)
+		if err != nil {
+			return "", err
+		}
+
+		value, err := open(dataKey, e.payload, e.additionalData(associatedData))
+		if err != nil {
+			return "", fmt.Errorf(
+				"decrypt cypher text (value may not belong to this key): %w",
+				err,
+			)
+		}
+
+		fp, err := id.fingerprint()
+		if err != nil {
+			return "", err
+		}
+
+		// the other recipients' stanzas wrap the old data key, so they're
+		// wrapped again with their public keys
+		rekeyed := slices.Clone(recipients)
+		for _, st := range e.recipients {
+			if st.fingerprint == fp {
+				continue
+			}
+
+			i := slices.IndexFunc(others, func(k gossh.PublicKey) bool {
+				return fingerprint(k) == st.fingerprint
+			})
+			if i < 0 {
+				return "", fmt.Errorf("%w %s", ErrUnknownRecipient, formatFingerprint(st.fingerprint))
+			}
+
+			rekeyed = append(rekeyed, &publicKeyRecipient{others[i]})
+		}
+
+		return newEncryptor(rekeyed, associatedData)(string(value))
+	}
+}
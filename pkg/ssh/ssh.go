@@ -1,6 +1,12 @@
 package ssh
 
 import (
+	"bytes"
+	"crypto"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdsa"
+	"crypto/ed25519"
 	"crypto/rand"
 	"crypto/rsa"
 	"crypto/sha256"
@@ -16,63 +22,233 @@ import (
 	"golang.org/x/term"
 )
 
+// dataKeySize is the size in bytes of the random AES-256 key used to encrypt
+// each value. Only the data key is encrypted with the identity key, so the
+// size of a value isn't limited by the size of the identity key.
+const dataKeySize = 32
+
 type PasswordReader func(int) ([]byte, error)
 
 type Cryptor func(string) (string, error)
 
-func NewEncryptor(publicKey gossh.PublicKey) Cryptor {
-	return func(s string) (string, error) {
-		authorisedKey, _, _, _, err := gossh.ParseAuthorizedKey([]byte(
-			gossh.MarshalAuthorizedKey(publicKey),
-		))
-		if err != nil {
-			return "", fmt.Errorf("parse authorised key: %w", err)
-		}
+// NewEncryptor returns a Cryptor that encrypts values so they can be
+// decrypted by the private key of any of the given public keys.
+func NewEncryptor(publicKeys []gossh.PublicKey, associatedData []byte) Cryptor {
+	recipients := make([]recipient, len(publicKeys))
+	for i, publicKey := range publicKeys {
+		recipients[i] = &publicKeyRecipient{publicKey}
+	}
 
-		cryptoKey, ok := authorisedKey.(gossh.CryptoPublicKey)
-		if !ok {
-			return "", fmt.Errorf("failed to cast authorised key to crypto key")
+	return newEncryptor(recipients, associatedData)
+}
+
+// NewDecryptor returns a Cryptor that decrypts values using the private key.
+func NewDecryptor(privateKey crypto.PrivateKey, associatedData []byte) Cryptor {
+	if k, ok := privateKey.(*ed25519.PrivateKey); ok {
+		privateKey = *k
+	}
+
+	return newDecryptor(&privateKeyIdentity{privateKey}, associatedData)
+}
+
+func newEncryptor(recipients []recipient, associatedData []byte) Cryptor {
+	return func(s string) (string, error) {
+		if len(recipients) == 0 {
+			return "", errors.New("no recipients")
 		}
 
-		rsaPublicKey, ok := cryptoKey.CryptoPublicKey().(*rsa.PublicKey)
-		if !ok {
-			return "", fmt.Errorf("failed to cast crypto key to rsa public key")
+		dataKey := make([]byte, dataKeySize)
+		if _, err := rand.Read(dataKey); err != nil {
+			return "", fmt.Errorf("generate data key: %w", err)
 		}
 
-		encryptedValue, err := rsa.EncryptOAEP(
-			sha256.New(),
-			rand.Reader,
-			rsaPublicKey,
+		return sealEnvelope(
+			&envelope{version: envelopeVersion},
+			dataKey,
+			recipients,
 			[]byte(s),
-			nil,
+			associatedData,
 		)
+	}
+}
+
+// sealEnvelope wraps the data key for each recipient, in addition to any
+// stanzas already in the envelope, and seals the value as the payload.
+func sealEnvelope(
+	e *envelope,
+	dataKey []byte,
+	recipients []recipient,
+	value []byte,
+	associatedData []byte,
+) (string, error) {
+	for _, r := range recipients {
+		st, err := r.wrap(dataKey)
 		if err != nil {
-			return "", fmt.Errorf("encrypt provided value: %w", err)
+			return "", fmt.Errorf("wrap data key: %w", err)
 		}
 
-		return base64.StdEncoding.EncodeToString(encryptedValue), nil
+		if slices.ContainsFunc(e.recipients, func(existing stanza) bool {
+			return existing.algorithm == st.algorithm &&
+				existing.fingerprint == st.fingerprint
+		}) {
+			continue
+		}
+
+		e.recipients = append(e.recipients, *st)
+	}
+
+	if len(e.recipients) > maxRecipients {
+		return "", fmt.Errorf("too many recipients (max %d)", maxRecipients)
+	}
+
+	var err error
+
+	e.payload, err = seal(dataKey, value, e.additionalData(associatedData))
+	if err != nil {
+		return "", fmt.Errorf("encrypt provided value: %w", err)
 	}
+
+	return base64.StdEncoding.EncodeToString(e.marshal()), nil
 }
 
-func NewDecryptor(privateKey *rsa.PrivateKey) Cryptor {
+func newDecryptor(id identity, associatedData []byte) Cryptor {
 	return func(s string) (string, error) {
 		data, err := base64.StdEncoding.DecodeString(s)
 		if err != nil {
 			return "", fmt.Errorf("decode cypher text: %w", err)
 		}
 
-		decryptedValue, err := rsa.DecryptOAEP(
+		e, err := unmarshalEnvelope(data)
+		if errors.Is(err, errNotEnvelope) {
+			k, ok := id.(*privateKeyIdentity)
+			if !ok {
+				return "", errors.New("value predates envelope encryption and requires the private key to decrypt")
+			}
+
+			return decryptLegacy(k.privateKey, data)
+		}
+		if err != nil {
+			return "", fmt.Errorf("parse envelope: %w", err)
+		}
+
+		dataKey, err := e.unwrap(id)
+		if err != nil {
+			return "", err
+		}
+
+		decryptedValue, err := open(
+			dataKey,
+			e.payload,
+			e.additionalData(associatedData),
+		)
+		if err != nil {
+			return "", fmt.Errorf(
+				"decrypt cypher text (value may not belong to this key): %w",
+				err,
+			)
+		}
+
+		return string(decryptedValue), nil
+	}
+}
+
+// cryptoPublicKey returns the underlying crypto public key of an ssh public
+// key, e.g. for keys listed by an agent that don't expose it directly.
+func cryptoPublicKey(publicKey gossh.PublicKey) (crypto.PublicKey, error) {
+	authorisedKey, _, _, _, err := gossh.ParseAuthorizedKey([]byte(
+		gossh.MarshalAuthorizedKey(publicKey),
+	))
+	if err != nil {
+		return nil, fmt.Errorf("parse authorised key: %w", err)
+	}
+
+	cryptoKey, ok := authorisedKey.(gossh.CryptoPublicKey)
+	if !ok {
+		return nil, fmt.Errorf("failed to cast authorised key to crypto key")
+	}
+
+	return cryptoKey.CryptoPublicKey(), nil
+}
+
+// decryptLegacy decrypts values stored before the envelope was introduced,
+// which were encrypted directly with the rsa key.
+func decryptLegacy(privateKey crypto.PrivateKey, data []byte) (string, error) {
+	k, ok := privateKey.(*rsa.PrivateKey)
+	if !ok {
+		return "", errors.New("value predates envelope encryption and requires an rsa key to decrypt")
+	}
+
+	decryptedValue, err := rsa.DecryptOAEP(sha256.New(), rand.Reader, k, data, nil)
+	if err != nil {
+		return "", fmt.Errorf("decrypt cypher text: %w", err)
+	}
+
+	return string(decryptedValue), nil
+}
+
+// wrapDataKey encrypts the data key to the public key, returning the
+// algorithm used.
+func wrapDataKey(publicKey crypto.PublicKey, dataKey []byte) (algorithm, []byte, error) {
+	switch k := publicKey.(type) {
+	case *rsa.PublicKey:
+		wrappedKey, err := rsa.EncryptOAEP(
 			sha256.New(),
 			rand.Reader,
-			privateKey,
-			data,
+			k,
+			dataKey,
 			nil,
 		)
-		if err != nil {
-			return "", fmt.Errorf("decrypt cypher text: %w", err)
+
+		return algorithmRSAOAEP, wrappedKey, err
+
+	case ed25519.PublicKey:
+		wrappedKey, err := wrapX25519(k, dataKey)
+
+		return algorithmX25519, wrappedKey, err
+
+	case *ecdsa.PublicKey:
+		wrappedKey, err := wrapECDH(k, dataKey)
+
+		return algorithmECDH, wrappedKey, err
+
+	default:
+		return 0, nil, fmt.Errorf("unsupported public key type: %T", publicKey)
+	}
+}
+
+// unwrapDataKey decrypts a data key wrapped with the given algorithm.
+func unwrapDataKey(
+	privateKey crypto.PrivateKey,
+	alg algorithm,
+	wrappedKey []byte,
+) ([]byte, error) {
+	switch alg {
+	case algorithmRSAOAEP:
+		k, ok := privateKey.(*rsa.PrivateKey)
+		if !ok {
+			return nil, fmt.Errorf("%s requires an rsa key", alg)
 		}
 
-		return string(decryptedValue), nil
+		return rsa.DecryptOAEP(sha256.New(), rand.Reader, k, wrappedKey, nil)
+
+	case algorithmX25519:
+		k, ok := privateKey.(ed25519.PrivateKey)
+		if !ok {
+			return nil, fmt.Errorf("%s requires an ed25519 key", alg)
+		}
+
+		return unwrapX25519(k, wrappedKey)
+
+	case algorithmECDH:
+		k, ok := privateKey.(*ecdsa.PrivateKey)
+		if !ok {
+			return nil, fmt.Errorf("%s requires an ecdsa key", alg)
+		}
+
+		return unwrapECDH(k, wrappedKey)
+
+	default:
+		return nil, fmt.Errorf("unsupported algorithm: %s", alg)
 	}
 }
 
@@ -90,7 +266,25 @@ func GetPublicKey(path string) (gossh.PublicKey, error) {
 	return publicKey, nil
 }
 
-func GetPrivateKey(path string, out io.Writer, pr PasswordReader) (*rsa.PrivateKey, error) {
+// ParseAuthorizedKeys parses one or more public keys in authorized_keys
+// format.
+func ParseAuthorizedKeys(b []byte) ([]gossh.PublicKey, error) {
+	var publicKeys []gossh.PublicKey
+
+	for len(bytes.TrimSpace(b)) > 0 {
+		publicKey, _, _, rest, err := gossh.ParseAuthorizedKey(b)
+		if err != nil {
+			return nil, err
+		}
+
+		publicKeys = append(publicKeys, publicKey)
+		b = rest
+	}
+
+	return publicKeys, nil
+}
+
+func GetPrivateKey(path string, out io.Writer, pr PasswordReader) (crypto.PrivateKey, error) {
 	var err error
 
 	fc, err := os.ReadFile(path)
@@ -121,12 +315,18 @@ func GetPrivateKey(path string, out io.Writer, pr PasswordReader) (*rsa.PrivateK
 		}
 	}
 
-	rsaPrivateKey, ok := key.(*rsa.PrivateKey)
-	if !ok {
-		return nil, errors.New("failed to cast to rsa private key")
+	switch k := key.(type) {
+	case *rsa.PrivateKey:
+		return k, nil
+	case ed25519.PrivateKey:
+		return k, nil
+	case *ed25519.PrivateKey:
+		return *k, nil
+	case *ecdsa.PrivateKey:
+		return k, nil
+	default:
+		return nil, fmt.Errorf("unsupported private key type: %T", key)
 	}
-
-	return rsaPrivateKey, nil
 }
 
 func GetSigner(path string, out io.Writer, pr PasswordReader) (gossh.Signer, error) {
@@ -180,7 +380,7 @@ func NewSignersFunc(publicKey gossh.PublicKey, agentSigners []gossh.Signer) func
 }
 
 func AuthMethod(identity string, out io.Writer) (gossh.AuthMethod, error) {
-	var authMethod gossh.AuthMethod
+	var signers func() ([]gossh.Signer, error)
 
 	publicKey, err := GetPublicKey(fmt.Sprintf("%s.pub", identity))
 	if err != nil {
@@ -197,7 +397,9 @@ func AuthMethod(identity string, out io.Writer) (gossh.AuthMethod, error) {
 			return nil, err
 		}
 
-		authMethod = gossh.PublicKeys(signer)
+		signers = func() ([]gossh.Signer, error) {
+			return []gossh.Signer{signer}, nil
+		}
 
 	} else {
 		agentKeys, err := sshAgentClient.List()
@@ -224,11 +426,122 @@ func AuthMethod(identity string, out io.Writer) (gossh.AuthMethod, error) {
 			return nil, fmt.Errorf("failed to get signers from ssh client: %w", err)
 		}
 
-		authMethod = gossh.PublicKeysCallback(
-			// use only signer for the specified identity key
-			NewSignersFunc(publicKey, sshAgentClientSigners),
-		)
+		// use only signer for the specified identity key
+		signers = NewSignersFunc(publicKey, sshAgentClientSigners)
+	}
+
+	cert, err := GetCertificate(identity)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get certificate: %w", err)
+	}
+
+	if cert != nil {
+		if string(cert.Key.Marshal()) != string(publicKey.Marshal()) {
+			return nil, fmt.Errorf("certificate %s-cert.pub is for a different key", identity)
+		}
+
+		signers = NewCertSignersFunc(cert, signers)
+	}
+
+	return gossh.PublicKeysCallback(signers), nil
+}
+
+// GetCertificate reads the ssh certificate kept alongside the identity, as
+// identity-cert.pub, returning nil when there isn't one.
+func GetCertificate(identity string) (*gossh.Certificate, error) {
+	publicKey, err := GetPublicKey(identity + "-cert.pub")
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	cert, ok := publicKey.(*gossh.Certificate)
+	if !ok {
+		return nil, fmt.Errorf("%s-cert.pub is not a certificate", identity)
+	}
+
+	return cert, nil
+}
+
+// NewCertSignersFunc returns the signers with the certificate offered first,
+// falling back to the key itself for servers that don't trust the
+// certificate's authority.
+func NewCertSignersFunc(
+	cert *gossh.Certificate,
+	signers func() ([]gossh.Signer, error),
+) func() ([]gossh.Signer, error) {
+	return func() ([]gossh.Signer, error) {
+		keySigners, err := signers()
+		if err != nil {
+			return nil, err
+		}
+
+		var certSigners []gossh.Signer
+
+		for _, signer := range keySigners {
+			certSigner, err := gossh.NewCertSigner(cert, signer)
+			if err != nil {
+				continue
+			}
+
+			certSigners = append(certSigners, certSigner)
+		}
+
+		return append(certSigners, keySigners...), nil
+	}
+}
+
+// seal encrypts plaintext with AES-256-GCM using the given data key,
+// authenticating the additional data. The random nonce is prepended to the
+// returned cypher text.
+func seal(dataKey, plaintext, additionalData []byte) ([]byte, error) {
+	gcm, err := newGCM(dataKey)
+	if err != nil {
+		return nil, err
+	}
+
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, fmt.Errorf("generate nonce: %w", err)
+	}
+
+	return gcm.Seal(nonce, nonce, plaintext, additionalData), nil
+}
+
+// open decrypts cypher text produced by seal using the given data key and
+// additional data.
+func open(dataKey, sealed, additionalData []byte) ([]byte, error) {
+	gcm, err := newGCM(dataKey)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(sealed) < gcm.NonceSize() {
+		return nil, errors.New("sealed value too short")
+	}
+
+	nonce, cypherText := sealed[:gcm.NonceSize()], sealed[gcm.NonceSize():]
+
+	plaintext, err := gcm.Open(nil, nonce, cypherText, additionalData)
+	if err != nil {
+		return nil, fmt.Errorf("open sealed value: %w", err)
+	}
+
+	return plaintext, nil
+}
+
+func newGCM(dataKey []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(dataKey)
+	if err != nil {
+		return nil, fmt.Errorf("create cipher: %w", err)
+	}
+
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, fmt.Errorf("create gcm: %w", err)
 	}
 
-	return authMethod, nil
+	return gcm, nil
 }
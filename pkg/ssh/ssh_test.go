@@ -0,0 +1,653 @@
+package ssh_test
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/nixpig/syringe.sh/pkg/ssh"
+	"github.com/stretchr/testify/require"
+	gossh "golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+)
+
+func TestCryptor(t *testing.T) {
+	scenarios := map[string]func(
+		t *testing.T,
+		privateKey crypto.PrivateKey,
+		publicKey gossh.PublicKey,
+	){
+		"encrypt and decrypt value (short value)":      testCryptorShortValue,
+		"encrypt and decrypt value (large value)":      testCryptorLargeValue,
+		"decrypt value (tampered cypher text)":         testCryptorTamperedCypherText,
+		"decrypt value (cypher text for another key)":  testCryptorWrongKey,
+		"encrypt value (cypher text is not plaintext)": testCryptorNotPlaintext,
+		"encrypt value (envelope header)":              testCryptorEnvelopeHeader,
+		"decrypt value (different associated data)":    testCryptorDifferentAssociatedData,
+		"decrypt value (unsupported envelope version)": testCryptorUnsupportedVersion,
+		"decrypt value (multiple recipients)":          testCryptorMultipleRecipients,
+		"encrypt value (no recipients)":                testCryptorNoRecipients,
+		"decrypt value (agent)":                        testCryptorAgent,
+		"decrypt value (agent without agent stanza)":   testCryptorAgentNoStanza,
+		"rekey value (keeps other recipients)":         testCryptorRekey,
+	}
+
+	for keyType, generateKey := range map[string]func(t *testing.T) crypto.PrivateKey{
+		"rsa":     generateRSAKey,
+		"ed25519": generateEd25519Key,
+		"ecdsa":   generateECDSAKey,
+	} {
+		privateKey := generateKey(t)
+
+		signer, err := gossh.NewSignerFromKey(privateKey)
+		require.NoError(t, err)
+
+		for scenario, fn := range scenarios {
+			t.Run(keyType+" "+scenario, func(t *testing.T) {
+				fn(t, privateKey, signer.PublicKey())
+			})
+		}
+	}
+}
+
+func TestCryptorECDSACurves(t *testing.T) {
+	for _, curve := range []elliptic.Curve{
+		elliptic.P256(),
+		elliptic.P384(),
+		elliptic.P521(),
+	} {
+		t.Run(curve.Params().Name, func(t *testing.T) {
+			privateKey, err := ecdsa.GenerateKey(curve, rand.Reader)
+			require.NoError(t, err)
+
+			signer, err := gossh.NewSignerFromKey(privateKey)
+			require.NoError(t, err)
+
+			encrypted, err := ssh.NewEncryptor(
+				[]gossh.PublicKey{signer.PublicKey()},
+				ssh.AssociatedData("foo"),
+			)("s3cr3t")
+			require.NoError(t, err)
+
+			decrypted, err := ssh.NewDecryptor(
+				privateKey,
+				ssh.AssociatedData("foo"),
+			)(encrypted)
+			require.NoError(t, err)
+			require.Equal(t, "s3cr3t", decrypted)
+		})
+	}
+}
+
+func TestCryptorLegacyRSACypherText(t *testing.T) {
+	privateKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+
+	legacy, err := rsa.EncryptOAEP(
+		sha256.New(),
+		rand.Reader,
+		&privateKey.PublicKey,
+		[]byte("s3cr3t"),
+		nil,
+	)
+	require.NoError(t, err)
+
+	require.True(t, ssh.IsLegacy(base64.StdEncoding.EncodeToString(legacy)))
+
+	decrypted, err := ssh.NewDecryptor(privateKey, ssh.AssociatedData("foo"))(
+		base64.StdEncoding.EncodeToString(legacy),
+	)
+	require.NoError(t, err)
+	require.Equal(t, "s3cr3t", decrypted)
+
+	signer, err := gossh.NewSignerFromKey(privateKey)
+	require.NoError(t, err)
+
+	encrypted, err := ssh.NewEncryptor(
+		[]gossh.PublicKey{signer.PublicKey()},
+		ssh.AssociatedData("foo"),
+	)("s3cr3t")
+	require.NoError(t, err)
+	require.False(t, ssh.IsLegacy(encrypted))
+}
+
+func TestKeyHasher(t *testing.T) {
+	for keyType, generateKey := range map[string]func(t *testing.T) crypto.PrivateKey{
+		"rsa":     generateRSAKey,
+		"ed25519": generateEd25519Key,
+	} {
+		t.Run(keyType, func(t *testing.T) {
+			privateKey := generateKey(t)
+
+			signer, err := gossh.NewSignerFromKey(privateKey)
+			require.NoError(t, err)
+
+			hash, err := ssh.NewKeyHasher(signer)
+			require.NoError(t, err)
+
+			require.Equal(t, hash("foo"), hash("foo"))
+			require.NotEqual(t, hash("foo"), hash("bar"))
+			require.NotContains(t, hash("foo"), "foo")
+
+			// the agent derives the same hashes as the private key
+			agentHash, err := ssh.NewKeyHasher(agentSigner(t, privateKey))
+			require.NoError(t, err)
+			require.Equal(t, hash("foo"), agentHash("foo"))
+
+			otherSigner, err := gossh.NewSignerFromKey(generateKey(t))
+			require.NoError(t, err)
+
+			otherHash, err := ssh.NewKeyHasher(otherSigner)
+			require.NoError(t, err)
+			require.NotEqual(t, hash("foo"), otherHash("foo"))
+		})
+	}
+
+	t.Run("ecdsa", func(t *testing.T) {
+		signer, err := gossh.NewSignerFromKey(generateECDSAKey(t))
+		require.NoError(t, err)
+
+		hash, err := ssh.NewKeyHasher(signer)
+		require.ErrorIs(t, err, ssh.ErrNonDeterministicSignatures)
+		require.Nil(t, hash)
+	})
+}
+
+func TestKeyProof(t *testing.T) {
+	for keyType, generateKey := range map[string]func(t *testing.T) crypto.PrivateKey{
+		"rsa":     generateRSAKey,
+		"ed25519": generateEd25519Key,
+		"ecdsa":   generateECDSAKey,
+	} {
+		t.Run(keyType, func(t *testing.T) {
+			signer, err := gossh.NewSignerFromKey(generateKey(t))
+			require.NoError(t, err)
+
+			sessionID := []byte("session")
+
+			proof, err := ssh.SignKeyProof(signer, sessionID)
+			require.NoError(t, err)
+			require.NoError(t, ssh.VerifyKeyProof(signer.PublicKey(), sessionID, proof))
+
+			// the proof can't be replayed on another session
+			err = ssh.VerifyKeyProof(signer.PublicKey(), []byte("other"), proof)
+			require.ErrorIs(t, err, ssh.ErrKeyNotProven)
+
+			// or used for another key
+			otherSigner, err := gossh.NewSignerFromKey(generateKey(t))
+			require.NoError(t, err)
+
+			err = ssh.VerifyKeyProof(otherSigner.PublicKey(), sessionID, proof)
+			require.ErrorIs(t, err, ssh.ErrKeyNotProven)
+
+			err = ssh.VerifyKeyProof(signer.PublicKey(), sessionID, "")
+			require.ErrorIs(t, err, ssh.ErrKeyNotProven)
+		})
+	}
+}
+
+func TestPassphraseCryptor(t *testing.T) {
+	passphrase := []byte("correct horse battery staple")
+
+	encrypted, err := ssh.NewPassphraseEncryptor(
+		passphrase,
+		ssh.AssociatedData("foo"),
+	)("s3cr3t")
+	require.NoError(t, err)
+	require.True(t, ssh.IsPassphraseEncrypted(encrypted))
+
+	decrypted, err := ssh.NewPassphraseDecryptor(
+		passphrase,
+		ssh.AssociatedData("foo"),
+	)(encrypted)
+	require.NoError(t, err)
+	require.Equal(t, "s3cr3t", decrypted)
+
+	decrypted, err = ssh.NewPassphraseDecryptor(
+		[]byte("incorrect"),
+		ssh.AssociatedData("foo"),
+	)(encrypted)
+	require.ErrorContains(t, err, "incorrect passphrase")
+	require.Empty(t, decrypted)
+
+	decrypted, err = ssh.NewPassphraseDecryptor(
+		passphrase,
+		ssh.AssociatedData("bar"),
+	)(encrypted)
+	require.Error(t, err)
+	require.Empty(t, decrypted)
+
+	// values encrypted for ssh keys can't be decrypted with a passphrase
+	privateKey := generateEd25519Key(t)
+	signer, err := gossh.NewSignerFromKey(privateKey)
+	require.NoError(t, err)
+
+	encrypted, err = ssh.NewEncryptor(
+		[]gossh.PublicKey{signer.PublicKey()},
+		ssh.AssociatedData("foo"),
+	)("s3cr3t")
+	require.NoError(t, err)
+	require.False(t, ssh.IsPassphraseEncrypted(encrypted))
+
+	decrypted, err = ssh.NewPassphraseDecryptor(
+		passphrase,
+		ssh.AssociatedData("foo"),
+	)(encrypted)
+	require.Error(t, err)
+	require.Empty(t, decrypted)
+}
+
+func TestNamespaceAssociatedData(t *testing.T) {
+	privateKey := generateEd25519Key(t)
+	signer, err := gossh.NewSignerFromKey(privateKey)
+	require.NoError(t, err)
+
+	encrypted, err := ssh.NewEncryptor(
+		[]gossh.PublicKey{signer.PublicKey()},
+		ssh.NamespaceAssociatedData("syringe", "prod", "foo"),
+	)("s3cr3t")
+	require.NoError(t, err)
+
+	decrypted, err := ssh.NewDecryptor(
+		privateKey,
+		ssh.NamespaceAssociatedData("syringe", "prod", "foo"),
+	)(encrypted)
+	require.NoError(t, err)
+	require.Equal(t, "s3cr3t", decrypted)
+
+	// values can't be moved to another environment or out of namespaces
+	for _, associatedData := range [][]byte{
+		ssh.NamespaceAssociatedData("syringe", "dev", "foo"),
+		ssh.NamespaceAssociatedData("syringe", "prodfoo", ""),
+		ssh.AssociatedData("foo"),
+	} {
+		decrypted, err := ssh.NewDecryptor(privateKey, associatedData)(encrypted)
+		require.Error(t, err)
+		require.Empty(t, decrypted)
+	}
+}
+
+func generateRSAKey(t *testing.T) crypto.PrivateKey {
+	privateKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+
+	return privateKey
+}
+
+func generateEd25519Key(t *testing.T) crypto.PrivateKey {
+	_, privateKey, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+
+	return privateKey
+}
+
+func generateECDSAKey(t *testing.T) crypto.PrivateKey {
+	privateKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+
+	return privateKey
+}
+
+func testCryptorShortValue(
+	t *testing.T,
+	privateKey crypto.PrivateKey,
+	publicKey gossh.PublicKey,
+) {
+	encrypted, err := ssh.NewEncryptor([]gossh.PublicKey{publicKey}, ssh.AssociatedData("foo"))("s3cr3t")
+	require.NoError(t, err)
+
+	decrypted, err := ssh.NewDecryptor(privateKey, ssh.AssociatedData("foo"))(encrypted)
+	require.NoError(t, err)
+	require.Equal(t, "s3cr3t", decrypted)
+}
+
+func testCryptorLargeValue(
+	t *testing.T,
+	privateKey crypto.PrivateKey,
+	publicKey gossh.PublicKey,
+) {
+	value := strings.Repeat("0123456789abcdef", 1024)
+
+	encrypted, err := ssh.NewEncryptor([]gossh.PublicKey{publicKey}, ssh.AssociatedData("foo"))(value)
+	require.NoError(t, err)
+
+	decrypted, err := ssh.NewDecryptor(privateKey, ssh.AssociatedData("foo"))(encrypted)
+	require.NoError(t, err)
+	require.Equal(t, value, decrypted)
+}
+
+func testCryptorTamperedCypherText(
+	t *testing.T,
+	privateKey crypto.PrivateKey,
+	publicKey gossh.PublicKey,
+) {
+	encrypted, err := ssh.NewEncryptor([]gossh.PublicKey{publicKey}, ssh.AssociatedData("foo"))("s3cr3t")
+	require.NoError(t, err)
+
+	data, err := base64.StdEncoding.DecodeString(encrypted)
+	require.NoError(t, err)
+
+	data[len(data)-1] ^= 0xff
+
+	decrypted, err := ssh.NewDecryptor(privateKey, ssh.AssociatedData("foo"))(
+		base64.StdEncoding.EncodeToString(data),
+	)
+	require.Error(t, err)
+	require.Empty(t, decrypted)
+}
+
+func testCryptorWrongKey(
+	t *testing.T,
+	privateKey crypto.PrivateKey,
+	publicKey gossh.PublicKey,
+) {
+	otherPrivateKey := generateRSAKey(t)
+	if _, ok := privateKey.(ed25519.PrivateKey); ok {
+		otherPrivateKey = generateEd25519Key(t)
+	}
+
+	encrypted, err := ssh.NewEncryptor([]gossh.PublicKey{publicKey}, ssh.AssociatedData("foo"))("s3cr3t")
+	require.NoError(t, err)
+
+	decrypted, err := ssh.NewDecryptor(otherPrivateKey, ssh.AssociatedData("foo"))(encrypted)
+	require.Error(t, err)
+	require.Empty(t, decrypted)
+}
+
+func testCryptorNotPlaintext(
+	t *testing.T,
+	privateKey crypto.PrivateKey,
+	publicKey gossh.PublicKey,
+) {
+	encrypted, err := ssh.NewEncryptor([]gossh.PublicKey{publicKey}, ssh.AssociatedData("foo"))("s3cr3t")
+	require.NoError(t, err)
+
+	data, err := base64.StdEncoding.DecodeString(encrypted)
+	require.NoError(t, err)
+	require.NotContains(t, string(data), "s3cr3t")
+}
+
+func testCryptorEnvelopeHeader(
+	t *testing.T,
+	privateKey crypto.PrivateKey,
+	publicKey gossh.PublicKey,
+) {
+	encrypted, err := ssh.NewEncryptor([]gossh.PublicKey{publicKey}, ssh.AssociatedData("foo"))("s3cr3t")
+	require.NoError(t, err)
+
+	data, err := base64.StdEncoding.DecodeString(encrypted)
+	require.NoError(t, err)
+
+	fingerprint := sha256.Sum256(publicKey.Marshal())
+
+	require.Equal(t, "SYR", string(data[:3]))
+	require.Equal(t, byte(3), data[3])
+	require.Equal(t, byte(1), data[4])
+	require.Equal(t, fingerprint[:], data[6:6+sha256.Size])
+}
+
+func testCryptorDifferentAssociatedData(
+	t *testing.T,
+	privateKey crypto.PrivateKey,
+	publicKey gossh.PublicKey,
+) {
+	encrypted, err := ssh.NewEncryptor([]gossh.PublicKey{publicKey}, ssh.AssociatedData("foo"))("s3cr3t")
+	require.NoError(t, err)
+
+	decrypted, err := ssh.NewDecryptor(privateKey, ssh.AssociatedData("bar"))(encrypted)
+	require.Error(t, err)
+	require.Empty(t, decrypted)
+}
+
+func testCryptorUnsupportedVersion(
+	t *testing.T,
+	privateKey crypto.PrivateKey,
+	publicKey gossh.PublicKey,
+) {
+	encrypted, err := ssh.NewEncryptor([]gossh.PublicKey{publicKey}, ssh.AssociatedData("foo"))("s3cr3t")
+	require.NoError(t, err)
+
+	data, err := base64.StdEncoding.DecodeString(encrypted)
+	require.NoError(t, err)
+
+	// versions 1 and 2 were never released, and didn't authenticate the
+	// header or associated data
+	for _, version := range []byte{1, 2, 0xff} {
+		data[3] = version
+
+		decrypted, err := ssh.NewDecryptor(privateKey, ssh.AssociatedData("foo"))(
+			base64.StdEncoding.EncodeToString(data),
+		)
+		require.ErrorContains(t, err, "unsupported envelope version")
+		require.Empty(t, decrypted)
+	}
+}
+
+func testCryptorMultipleRecipients(
+	t *testing.T,
+	privateKey crypto.PrivateKey,
+	publicKey gossh.PublicKey,
+) {
+	rsaPrivateKey := generateRSAKey(t)
+	rsaSigner, err := gossh.NewSignerFromKey(rsaPrivateKey)
+	require.NoError(t, err)
+
+	ed25519PrivateKey := generateEd25519Key(t)
+	ed25519Signer, err := gossh.NewSignerFromKey(ed25519PrivateKey)
+	require.NoError(t, err)
+
+	encrypted, err := ssh.NewEncryptor(
+		[]gossh.PublicKey{
+			publicKey,
+			rsaSigner.PublicKey(),
+			ed25519Signer.PublicKey(),
+		},
+		ssh.AssociatedData("foo"),
+	)("s3cr3t")
+	require.NoError(t, err)
+
+	for _, key := range []crypto.PrivateKey{
+		privateKey,
+		rsaPrivateKey,
+		ed25519PrivateKey,
+	} {
+		decrypted, err := ssh.NewDecryptor(key, ssh.AssociatedData("foo"))(encrypted)
+		require.NoError(t, err)
+		require.Equal(t, "s3cr3t", decrypted)
+	}
+}
+
+func testCryptorNoRecipients(
+	t *testing.T,
+	privateKey crypto.PrivateKey,
+	publicKey gossh.PublicKey,
+) {
+	encrypted, err := ssh.NewEncryptor(nil, ssh.AssociatedData("foo"))("s3cr3t")
+	require.Error(t, err)
+	require.Empty(t, encrypted)
+}
+
+func agentSigner(t *testing.T, privateKey crypto.PrivateKey) gossh.Signer {
+	keyring := agent.NewKeyring()
+	require.NoError(t, keyring.Add(agent.AddedKey{PrivateKey: privateKey}))
+
+	signers, err := keyring.Signers()
+	require.NoError(t, err)
+	require.Len(t, signers, 1)
+
+	return signers[0]
+}
+
+// skipNonDeterministicSigner skips tests that derive keys from signatures,
+// which ecdsa keys can't do.
+func skipNonDeterministicSigner(t *testing.T, privateKey crypto.PrivateKey) {
+	if _, ok := privateKey.(*ecdsa.PrivateKey); ok {
+		t.Skip("ecdsa signatures aren't deterministic")
+	}
+}
+
+func testCryptorAgent(
+	t *testing.T,
+	privateKey crypto.PrivateKey,
+	publicKey gossh.PublicKey,
+) {
+	skipNonDeterministicSigner(t, privateKey)
+
+	signer := agentSigner(t, privateKey)
+
+	encrypted, err := ssh.NewAgentEncryptor(
+		signer,
+		[]gossh.PublicKey{publicKey},
+		ssh.AssociatedData("foo"),
+	)("s3cr3t")
+	require.NoError(t, err)
+
+	decrypted, err := ssh.NewAgentDecryptor(signer, ssh.AssociatedData("foo"))(encrypted)
+	require.NoError(t, err)
+	require.Equal(t, "s3cr3t", decrypted)
+
+	decrypted, err = ssh.NewDecryptor(privateKey, ssh.AssociatedData("foo"))(encrypted)
+	require.NoError(t, err)
+	require.Equal(t, "s3cr3t", decrypted)
+
+	decrypted, err = ssh.NewAgentDecryptor(signer, ssh.AssociatedData("bar"))(encrypted)
+	require.Error(t, err)
+	require.Empty(t, decrypted)
+}
+
+func testCryptorAgentNoStanza(
+	t *testing.T,
+	privateKey crypto.PrivateKey,
+	publicKey gossh.PublicKey,
+) {
+	skipNonDeterministicSigner(t, privateKey)
+
+	signer := agentSigner(t, privateKey)
+
+	encrypted, err := ssh.NewEncryptor(
+		[]gossh.PublicKey{publicKey},
+		ssh.AssociatedData("foo"),
+	)("s3cr3t")
+	require.NoError(t, err)
+
+	decrypted, err := ssh.NewAgentDecryptor(signer, ssh.AssociatedData("foo"))(encrypted)
+	require.Error(t, err)
+	require.Empty(t, decrypted)
+}
+
+func testCryptorRekey(
+	t *testing.T,
+	privateKey crypto.PrivateKey,
+	publicKey gossh.PublicKey,
+) {
+	otherPrivateKey := generateRSAKey(t)
+	otherSigner, err := gossh.NewSignerFromKey(otherPrivateKey)
+	require.NoError(t, err)
+
+	newPrivateKey := generateEd25519Key(t)
+	newSigner, err := gossh.NewSignerFromKey(newPrivateKey)
+	require.NoError(t, err)
+
+	encrypted, err := ssh.NewEncryptor(
+		[]gossh.PublicKey{publicKey, otherSigner.PublicKey()},
+		ssh.AssociatedData("foo"),
+	)("s3cr3t")
+	require.NoError(t, err)
+
+	// the other recipient's public key is needed to keep them
+	_, err = ssh.NewRekeyer(
+		privateKey,
+		newSigner.PublicKey(),
+		nil,
+		nil,
+		ssh.AssociatedData("foo"),
+	)(encrypted)
+	require.ErrorIs(t, err, ssh.ErrUnknownRecipient)
+
+	rekeyed, err := ssh.NewRekeyer(
+		privateKey,
+		newSigner.PublicKey(),
+		nil,
+		[]gossh.PublicKey{otherSigner.PublicKey()},
+		ssh.AssociatedData("foo"),
+	)(encrypted)
+	require.NoError(t, err)
+
+	require.True(t, ssh.IsEncryptedFor(rekeyed, newSigner.PublicKey()))
+	require.True(t, ssh.IsEncryptedFor(rekeyed, otherSigner.PublicKey()))
+	require.False(t, ssh.IsEncryptedFor(rekeyed, publicKey))
+
+	for _, key := range []crypto.PrivateKey{newPrivateKey, otherPrivateKey} {
+		decrypted, err := ssh.NewDecryptor(key, ssh.AssociatedData("foo"))(rekeyed)
+		require.NoError(t, err)
+		require.Equal(t, "s3cr3t", decrypted)
+	}
+
+	decrypted, err := ssh.NewDecryptor(privateKey, ssh.AssociatedData("foo"))(rekeyed)
+	require.Error(t, err)
+	require.Empty(t, decrypted)
+}
+
+func TestCertificate(t *testing.T) {
+	dir := t.TempDir()
+	identity := filepath.Join(dir, "id_ed25519")
+
+	cert, err := ssh.GetCertificate(identity)
+	require.NoError(t, err)
+	require.Nil(t, cert, "no certificate")
+
+	signer, err := gossh.NewSignerFromKey(generateEd25519Key(t))
+	require.NoError(t, err)
+
+	caSigner, err := gossh.NewSignerFromKey(generateEd25519Key(t))
+	require.NoError(t, err)
+
+	userCert := &gossh.Certificate{
+		Key:             signer.PublicKey(),
+		KeyId:           "alice@example.org",
+		CertType:        gossh.UserCert,
+		ValidPrincipals: []string{"alice"},
+		ValidBefore:     gossh.CertTimeInfinity,
+	}
+	require.NoError(t, userCert.SignCert(rand.Reader, caSigner))
+
+	require.NoError(t, os.WriteFile(
+		identity+"-cert.pub",
+		gossh.MarshalAuthorizedKey(userCert),
+		0600,
+	))
+
+	cert, err = ssh.GetCertificate(identity)
+	require.NoError(t, err)
+	require.Equal(t, "alice@example.org", cert.KeyId)
+	require.Equal(t, []string{"alice"}, cert.ValidPrincipals)
+
+	signers, err := ssh.NewCertSignersFunc(cert, func() ([]gossh.Signer, error) {
+		return []gossh.Signer{signer}, nil
+	})()
+	require.NoError(t, err)
+	require.Len(t, signers, 2)
+
+	// the certificate is offered first, then the key for servers that don't
+	// trust its authority
+	require.Equal(t, cert.Marshal(), signers[0].PublicKey().Marshal())
+	require.Equal(t, signer.PublicKey().Marshal(), signers[1].PublicKey().Marshal())
+
+	require.NoError(t, os.WriteFile(
+		identity+"-cert.pub",
+		gossh.MarshalAuthorizedKey(signer.PublicKey()),
+		0600,
+	))
+
+	_, err = ssh.GetCertificate(identity)
+	require.ErrorContains(t, err, "not a certificate")
+}
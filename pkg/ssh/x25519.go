@@ -0,0 +1,165 @@
+package ssh
+
+import (
+	"crypto/ecdh"
+	"crypto/ed25519"
+	"crypto/hkdf"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/sha512"
+	"errors"
+	"fmt"
+	"math/big"
+	"slices"
+)
+
+const x25519Info = "syringe.sh/x25519"
+
+// x25519WrappedKeySize is the size of a data key wrapped by wrapX25519, i.e.
+// the ephemeral public key followed by the sealed data key.
+const x25519WrappedKeySize = 32 + 12 + dataKeySize + 16
+
+// curve25519P is the field prime 2^255 - 19 shared by edwards25519 and
+// curve25519.
+var curve25519P = new(big.Int).Sub(
+	new(big.Int).Lsh(big.NewInt(1), 255),
+	big.NewInt(19),
+)
+
+// wrapX25519 wraps the data key to an ed25519 public key. Similar to age
+// ssh-ed25519 recipients, the ed25519 key is converted to its X25519
+// equivalent and the data key sealed with a key derived from an ephemeral
+// X25519 exchange.
+func wrapX25519(publicKey ed25519.PublicKey, dataKey []byte) ([]byte, error) {
+	recipient, err := x25519PublicKey(publicKey)
+	if err != nil {
+		return nil, err
+	}
+
+	ephemeral, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, fmt.Errorf("generate ephemeral key: %w", err)
+	}
+
+	shared, err := ephemeral.ECDH(recipient)
+	if err != nil {
+		return nil, fmt.Errorf("x25519 exchange: %w", err)
+	}
+
+	kek, err := exchangeKEK(x25519Info, shared, ephemeral.PublicKey(), recipient)
+	if err != nil {
+		return nil, err
+	}
+
+	sealedKey, err := seal(kek, dataKey, nil)
+	if err != nil {
+		return nil, fmt.Errorf("seal data key: %w", err)
+	}
+
+	return append(ephemeral.PublicKey().Bytes(), sealedKey...), nil
+}
+
+// unwrapX25519 recovers a data key wrapped by wrapX25519 using the
+// corresponding ed25519 private key.
+func unwrapX25519(privateKey ed25519.PrivateKey, wrappedKey []byte) ([]byte, error) {
+	if len(wrappedKey) != x25519WrappedKeySize {
+		return nil, errors.New("invalid wrapped key size")
+	}
+
+	identity, err := x25519PrivateKey(privateKey)
+	if err != nil {
+		return nil, err
+	}
+
+	ephemeral, err := ecdh.X25519().NewPublicKey(wrappedKey[:32])
+	if err != nil {
+		return nil, fmt.Errorf("parse ephemeral key: %w", err)
+	}
+
+	shared, err := identity.ECDH(ephemeral)
+	if err != nil {
+		return nil, fmt.Errorf("x25519 exchange: %w", err)
+	}
+
+	kek, err := exchangeKEK(x25519Info, shared, ephemeral, identity.PublicKey())
+	if err != nil {
+		return nil, err
+	}
+
+	dataKey, err := open(kek, wrappedKey[32:], nil)
+	if err != nil {
+		return nil, fmt.Errorf("open data key: %w", err)
+	}
+
+	return dataKey, nil
+}
+
+// exchangeKEK derives a key encryption key from the shared secret of an
+// exchange between an ephemeral key and the recipient's key.
+func exchangeKEK(
+	info string,
+	shared []byte,
+	ephemeral *ecdh.PublicKey,
+	recipient *ecdh.PublicKey,
+) ([]byte, error) {
+	salt := append(ephemeral.Bytes(), recipient.Bytes()...)
+
+	kek, err := hkdf.Key(sha256.New, shared, salt, info, dataKeySize)
+	if err != nil {
+		return nil, fmt.Errorf("derive key encryption key: %w", err)
+	}
+
+	return kek, nil
+}
+
+// x25519PrivateKey converts an ed25519 private key to the X25519 private key
+// for the same secret, as described in RFC 8032 section 5.1.5.
+func x25519PrivateKey(privateKey ed25519.PrivateKey) (*ecdh.PrivateKey, error) {
+	h := sha512.Sum512(privateKey.Seed())
+
+	key, err := ecdh.X25519().NewPrivateKey(h[:32])
+	if err != nil {
+		return nil, fmt.Errorf("convert private key: %w", err)
+	}
+
+	return key, nil
+}
+
+// x25519PublicKey converts an ed25519 public key to the X25519 public key on
+// the birationally equivalent Montgomery curve, u = (1 + y) / (1 - y).
+func x25519PublicKey(publicKey ed25519.PublicKey) (*ecdh.PublicKey, error) {
+	if len(publicKey) != ed25519.PublicKeySize {
+		return nil, errors.New("invalid ed25519 public key size")
+	}
+
+	// the encoded point is the little-endian y coordinate, with the sign of
+	// x in the most significant bit
+	encoded := slices.Clone(publicKey)
+	encoded[31] &= 0x7f
+	slices.Reverse(encoded)
+
+	y := new(big.Int).SetBytes(encoded)
+	if y.Cmp(curve25519P) >= 0 {
+		return nil, errors.New("invalid ed25519 public key")
+	}
+
+	denominator := new(big.Int).Sub(big.NewInt(1), y)
+	denominator.Mod(denominator, curve25519P)
+	if denominator.ModInverse(denominator, curve25519P) == nil {
+		return nil, errors.New("invalid ed25519 public key")
+	}
+
+	u := new(big.Int).Add(big.NewInt(1), y)
+	u.Mul(u, denominator)
+	u.Mod(u, curve25519P)
+
+	b := u.FillBytes(make([]byte, 32))
+	slices.Reverse(b)
+
+	key, err := ecdh.X25519().NewPublicKey(b)
+	if err != nil {
+		return nil, fmt.Errorf("convert public key: %w", err)
+	}
+
+	return key, nil
+}